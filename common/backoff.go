@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff spaces out retries of a failing operation, doubling the wait after
+// each attempt up to a ceiling. Jitter keeps nodes that failed together from
+// retrying in lockstep.
+type Backoff struct {
+	// Base is the wait before the first retry.
+	Base time.Duration
+	// Max caps the wait between attempts.
+	Max time.Duration
+	// Factor multiplies the wait after each attempt.
+	Factor float64
+	// Jitter is the fraction of each wait that is randomised, from 0 to 1.
+	Jitter float64
+}
+
+// DefaultBackoff returns the backoff used for dialing peers.
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Base:   250 * time.Millisecond,
+		Max:    10 * time.Second,
+		Factor: 2,
+		Jitter: 0.5,
+	}
+}
+
+// Delay returns how long to wait after the given failed attempt, counted
+// from zero.
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Factor < 1 {
+		b.Factor = 1
+	}
+	d := float64(b.Base)
+	for i := 0; i < attempt && (b.Max <= 0 || d < float64(b.Max)); i++ {
+		d *= b.Factor
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if j := min(max(b.Jitter, 0), 1); j > 0 {
+		d -= d * j * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Retry calls fn until it succeeds, attempts calls have failed or ctx is
+// done, waiting Delay between calls. It returns the last error.
+func (b Backoff) Retry(ctx context.Context, attempts int, fn func(context.Context) error) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(b.Delay(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		if err = fn(ctx); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
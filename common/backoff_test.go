@@ -0,0 +1,47 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/common"
+)
+
+func TestBackoffDelayGrowsWithJitter(t *testing.T) {
+	b := common.Backoff{Base: 100 * time.Millisecond, Max: time.Second, Factor: 2, Jitter: 0.5}
+
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			d := b.Delay(attempt)
+			require.LessOrEqual(t, d, want, "Delay should not exceed the exponential wait.")
+			require.GreaterOrEqual(t, d, want/2, "Jitter should take off at most half the wait.")
+		}
+	}
+}
+
+func TestBackoffRetry(t *testing.T) {
+	b := common.Backoff{Base: time.Millisecond, Factor: 2}
+	failure := errors.New("unreachable")
+
+	calls := 0
+	err := b.Retry(context.Background(), 5, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return failure
+		}
+		return nil
+	})
+	require.NoError(t, err, "Retry should stop at the first success.")
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = b.Retry(context.Background(), 4, func(context.Context) error {
+		calls++
+		return failure
+	})
+	require.ErrorIs(t, err, failure, "Retry should return the last error.")
+	require.Equal(t, 4, calls, "Retry should give up after the given attempts.")
+}
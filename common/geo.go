@@ -1 +1,127 @@
 package common
+
+import (
+	"fmt"
+	"github.com/google/hilbert"
+	"math"
+	"sort"
+)
+
+const (
+	// GeoOrder is the number of bits per axis of the grid geo cells number.
+	// At the default 100m precision it spans the whole globe.
+	GeoOrder = 20
+	// GeoCellBits is the number of significant bits of a GeoCell.
+	GeoCellBits = 2 * GeoOrder
+
+	geoSide = 1 << GeoOrder
+)
+
+// geoCurve numbers the grid squares along a Hilbert curve.
+var geoCurve = func() *hilbert.Hilbert {
+	h, err := hilbert.NewHilbert(geoSide)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}()
+
+// GeoCell is the position of a grid square on a Hilbert curve through the
+// grid. Squares close on the curve are close on the ground, and the cells
+// sharing their top 2k bits form an aligned square of side 2^(GeoOrder-k).
+type GeoCell uint64
+
+// CellRange is an inclusive range of cells.
+type CellRange struct {
+	From, To GeoCell
+}
+
+// Contains reports whether c lies in the range.
+func (r CellRange) Contains(c GeoCell) bool {
+	return r.From <= c && c <= r.To
+}
+
+// Cell returns the Hilbert cell of the grid square s lies in. The grid is
+// centred on the origin, so both indices must lie within half its side.
+func (s SafeLatitudeLongitude) Cell() (GeoCell, error) {
+	if len(s) != 2 {
+		return 0, fmt.Errorf("location must hold a latitude and a longitude index, got %d values", len(s))
+	}
+	x, y := s[1]+geoSide/2, s[0]+geoSide/2
+	t, err := geoCurve.MapInverse(x, y)
+	if err != nil {
+		return 0, fmt.Errorf("location %v is outside the geo grid: %v", s, err)
+	}
+	return GeoCell(t), nil
+}
+
+// Distance returns the straight line distance between s and o in grid
+// squares.
+func (s SafeLatitudeLongitude) Distance(o SafeLatitudeLongitude) float64 {
+	if len(s) != 2 || len(o) != 2 {
+		return math.Inf(1)
+	}
+	return math.Hypot(float64(s[0]-o[0]), float64(s[1]-o[1]))
+}
+
+// Location returns the grid square of c.
+func (c GeoCell) Location() (SafeLatitudeLongitude, error) {
+	x, y, err := geoCurve.Map(int(c))
+	if err != nil {
+		return nil, fmt.Errorf("cell %d is outside the geo grid: %v", c, err)
+	}
+	return SafeLatitudeLongitude{y - geoSide/2, x - geoSide/2}, nil
+}
+
+// Within returns the ranges of cells covering the square of grid squares
+// at most radius away from c along either axis, in curve order.
+func (c GeoCell) Within(radius int) ([]CellRange, error) {
+	if radius < 0 {
+		return nil, fmt.Errorf("radius must not be negative")
+	}
+	x, y, err := geoCurve.Map(int(c))
+	if err != nil {
+		return nil, fmt.Errorf("cell %d is outside the geo grid: %v", c, err)
+	}
+	box := geoBox{
+		minX: max(x-radius, 0), maxX: min(x+radius, geoSide-1),
+		minY: max(y-radius, 0), maxY: min(y+radius, geoSide-1),
+	}
+	var out []CellRange
+	box.cover(0, geoSide, &out)
+
+	sort.Slice(out, func(i, j int) bool { return out[i].From < out[j].From })
+	merged := out[:0]
+	for _, r := range out {
+		if n := len(merged); n > 0 && merged[n-1].To+1 == r.From {
+			merged[n-1].To = r.To
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// geoBox is an inclusive rectangle of grid squares.
+type geoBox struct {
+	minX, maxX, minY, maxY int
+}
+
+// cover appends the cells of the aligned square of the given side starting
+// at cell start that fall in b, splitting the square into its four
+// quadrants while it straddles the edge of b.
+func (b geoBox) cover(start, side int, out *[]CellRange) {
+	x, y, _ := geoCurve.Map(start)
+	x, y = x&^(side-1), y&^(side-1)
+	if x > b.maxX || x+side-1 < b.minX || y > b.maxY || y+side-1 < b.minY {
+		return
+	}
+	size := side * side
+	if side == 1 || (x >= b.minX && x+side-1 <= b.maxX && y >= b.minY && y+side-1 <= b.maxY) {
+		*out = append(*out, CellRange{From: GeoCell(start), To: GeoCell(start + size - 1)})
+		return
+	}
+	for q := 0; q < 4; q++ {
+		b.cover(start+q*size/4, side/2, out)
+	}
+}
@@ -0,0 +1,54 @@
+package common_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/common"
+)
+
+func TestGeoCellRoundTrip(t *testing.T) {
+	var loc common.SafeLatitudeLongitude
+	require.NoError(t, loc.Set(37.7749, -122.4194, 100))
+
+	cell, err := loc.Cell()
+	require.NoError(t, err, "A location on the globe should map to a cell.")
+	back, err := cell.Location()
+	require.NoError(t, err)
+	require.Equal(t, loc, back)
+
+	_, err = common.SafeLatitudeLongitude{1 << common.GeoOrder, 0}.Cell()
+	require.Error(t, err, "Locations off the grid should be rejected.")
+}
+
+func TestGeoCellWithinCoversSquare(t *testing.T) {
+	center := common.SafeLatitudeLongitude{1234, -5678}
+	cell, err := center.Cell()
+	require.NoError(t, err)
+
+	const radius = 5
+	ranges, err := cell.Within(radius)
+	require.NoError(t, err)
+	require.Less(t, len(ranges), (2*radius+1)*(2*radius+1), "Adjacent cells should be merged into ranges.")
+
+	covered := 0
+	for i, r := range ranges {
+		if i > 0 {
+			require.Greater(t, r.From, ranges[i-1].To+1, "Ranges should be sorted and disjoint.")
+		}
+		for c := r.From; c <= r.To; c++ {
+			loc, err := c.Location()
+			require.NoError(t, err)
+			require.LessOrEqual(t, abs(loc[0]-center[0]), radius)
+			require.LessOrEqual(t, abs(loc[1]-center[1]), radius)
+			covered++
+		}
+	}
+	require.Equal(t, (2*radius+1)*(2*radius+1), covered, "Every square within the radius should be covered.")
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
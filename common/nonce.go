@@ -1,9 +1,8 @@
 package common
 
 import (
-	"bytes"
+	"crypto/rand"
 	"encoding/binary"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/zeebo/blake3"
 	"sync"
 	"time"
@@ -22,73 +21,83 @@ type NonceMapEntry struct {
 	Timestamp int64
 }
 
-// Maps an address to its nonce information
+const nonceLifetime = 3600 // Define a suitable nonce lifetime
+
+// defaultNonceStore backs the package level helpers and is guarded by
+// defaultNonceStoreMu.
 var (
-	nonces      = make(map[string]NonceMapEntry)
-	noncesMutex sync.RWMutex
+	defaultNonceStoreMu sync.RWMutex
+	defaultNonceStore   NonceStore = NewMemoryNonceStore(DefaultNonceStoreConfig())
 )
 
-func (n Nonce) Reset() {
-	n.value = 0
-	n.hash = nil
+// DefaultNonceStore returns the store used by the package level helpers.
+func DefaultNonceStore() NonceStore {
+	defaultNonceStoreMu.RLock()
+	defer defaultNonceStoreMu.RUnlock()
+	return defaultNonceStore
 }
 
-// GenerateOrUpdateNonce creates or updates a nonce for the given address.
-func GenerateOrUpdateNonce(address string) *Nonce {
-	noncesMutex.Lock()
-	defer noncesMutex.Unlock()
-
-	// Check if a nonce already exists for the address
-	if entry, exists := nonces[address]; exists {
-		// If nonce exists, simply return it (or update it based on your requirements)
-		return &Nonce{
-			Address:   address,
-			value:     entry.Value,
-			hash:      entry.Hash,
-			Timestamp: entry.Timestamp,
-		}
-	}
-
-	// Generate a new nonce for the address
-	value := uint32(1) // Example value generation, consider using a more secure method
-	hash := generateNonceHash(value)
-	timestamp := time.Now().Unix()
-
-	nonces[address] = NonceMapEntry{Value: value, Hash: hash, Timestamp: timestamp}
-
-	spew.Dump(nonces)
-
+// NewNonce rebuilds a nonce received from a peer, recomputing its hash.
+func NewNonce(address string, value uint32, timestamp int64) *Nonce {
 	return &Nonce{
 		Address:   address,
 		value:     value,
-		hash:      hash,
+		hash:      generateNonceHash(value),
 		Timestamp: timestamp,
 	}
 }
 
-// ValidateNonce checks if a nonce associated with the address is valid.
-func ValidateNonce(address string, nonce Nonce) bool {
-	noncesMutex.RLock()
-	defer noncesMutex.RUnlock()
+// Value returns the random nonce value.
+func (n *Nonce) Value() uint32 {
+	return n.value
+}
+
+// Hash returns the Blake3 hash of the nonce value.
+func (n *Nonce) Hash() []byte {
+	return n.hash
+}
 
-	if entry, exists := nonces[address]; exists {
-		return nonce.value == entry.Value && bytes.Equal(nonce.hash, entry.Hash) && time.Now().Unix()-entry.Timestamp <= nonceLifetime
+// Reset clears the nonce value and hash.
+func (n *Nonce) Reset() {
+	n.value = 0
+	n.hash = nil
+}
+
+// GenerateOrUpdateNonce returns the outstanding nonce for the given address
+// from the default store, issuing a new one if none is live.
+func GenerateOrUpdateNonce(address string) *Nonce {
+	store := DefaultNonceStore()
+	if n := store.Outstanding(address); n != nil {
+		return n
+	}
+
+	n, err := store.Generate(address)
+	if err != nil {
+		return nil
 	}
-	return false
+	return n
 }
 
-const nonceLifetime = 3600 // Define a suitable nonce lifetime
+// ValidateNonce checks if a nonce associated with the address is valid.
+func ValidateNonce(address string, nonce Nonce) bool {
+	return DefaultNonceStore().Validate(address, nonce)
+}
 
-func pruneExpiredNonces() {
-	noncesMutex.Lock()
-	defer noncesMutex.Unlock()
+// SetDefaultNonceStore replaces the store used by GenerateOrUpdateNonce and ValidateNonce.
+func SetDefaultNonceStore(store NonceStore) {
+	defaultNonceStoreMu.Lock()
+	defer defaultNonceStoreMu.Unlock()
+	defaultNonceStore = store
+}
 
-	currentTimestamp := time.Now().Unix()
-	for address, entry := range nonces {
-		if currentTimestamp-entry.Timestamp > nonceLifetime {
-			delete(nonces, address)
-		}
+// generateSecureNonce draws a nonce value from the CSPRNG.
+func generateSecureNonce() (uint32, error) {
+	var nonce uint32
+	err := binary.Read(rand.Reader, binary.BigEndian, &nonce)
+	if err != nil {
+		return 0, err
 	}
+	return nonce, nil
 }
 
 // generateNonceHash generates a hash for a given nonce value using Blake3.
@@ -101,3 +110,8 @@ func generateNonceHash(value uint32) []byte {
 	h := blake3.Sum256(buf)
 	return h[:]
 }
+
+// nonceExpired reports whether a timestamp is older than the lifetime.
+func nonceExpired(timestamp int64, lifetime time.Duration, now time.Time) bool {
+	return now.Unix()-timestamp > int64(lifetime/time.Second)
+}
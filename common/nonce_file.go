@@ -0,0 +1,117 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// nonceSnapshot is the on-disk representation of a nonce store.
+type nonceSnapshot struct {
+	Issued  map[string][]NonceMapEntry `json:"issued"`
+	Windows map[string]*replayWindow   `json:"windows"`
+}
+
+// FileNonceStore is a MemoryNonceStore that persists its state to a file
+// after every change, so issued nonces and replay windows survive restarts.
+type FileNonceStore struct {
+	*MemoryNonceStore
+	path   string
+	saveMu sync.Mutex
+}
+
+// NewFileNonceStore opens the store at path, loading any existing state.
+func NewFileNonceStore(path string, cfg NonceStoreConfig) (*FileNonceStore, error) {
+	fs := &FileNonceStore{
+		MemoryNonceStore: NewMemoryNonceStore(cfg),
+		path:             path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read nonce store: %v", err)
+	}
+
+	var snap nonceSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode nonce store: %v", err)
+	}
+	if snap.Issued != nil {
+		fs.issued = snap.Issued
+	}
+	if snap.Windows != nil {
+		fs.windows = snap.Windows
+	}
+	return fs, nil
+}
+
+func (fs *FileNonceStore) Generate(address string) (*Nonce, error) {
+	n, err := fs.MemoryNonceStore.Generate(address)
+	if err != nil {
+		return nil, err
+	}
+	return n, fs.save()
+}
+
+func (fs *FileNonceStore) Consume(address string, nonce Nonce) error {
+	if err := fs.MemoryNonceStore.Consume(address, nonce); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+func (fs *FileNonceStore) Observe(address string, nonce Nonce) error {
+	if err := fs.MemoryNonceStore.Observe(address, nonce); err != nil {
+		return err
+	}
+	return fs.save()
+}
+
+func (fs *FileNonceStore) Prune(now time.Time) {
+	fs.MemoryNonceStore.Prune(now)
+	_ = fs.save()
+}
+
+func (fs *FileNonceStore) Close() error {
+	return fs.save()
+}
+
+// save writes the current state to a temporary file and renames it over the
+// store, so a crash never leaves a half written file behind.
+func (fs *FileNonceStore) save() error {
+	fs.saveMu.Lock()
+	defer fs.saveMu.Unlock()
+
+	fs.mu.RLock()
+	data, err := json.Marshal(nonceSnapshot{Issued: fs.issued, Windows: fs.windows})
+	fs.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode nonce store: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write nonce store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write nonce store: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync nonce store: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write nonce store: %v", err)
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNonceUnknown  = errors.New("nonce was not issued for this address")
+	ErrNonceExpired  = errors.New("nonce has expired")
+	ErrNonceReplayed = errors.New("nonce has already been seen")
+	ErrNonceTooOld   = errors.New("nonce is older than the replay window")
+	ErrNonceFuture   = errors.New("nonce timestamp is ahead of the allowed skew")
+)
+
+// NonceStore issues nonces to addresses and remembers the nonces it has seen
+// from them so that replays can be rejected.
+type NonceStore interface {
+	// Generate issues a fresh CSPRNG nonce for the address.
+	Generate(address string) (*Nonce, error)
+
+	// Outstanding returns the most recently issued live nonce for the address, or nil.
+	Outstanding(address string) *Nonce
+
+	// Validate reports whether the nonce was issued to the address and is still live.
+	Validate(address string, nonce Nonce) bool
+
+	// Consume validates an issued nonce and retires it so it can only be used once.
+	Consume(address string, nonce Nonce) error
+
+	// Observe records a nonce received from the address, rejecting it if it
+	// was already seen or falls behind the address's replay window.
+	Observe(address string, nonce Nonce) error
+
+	// Prune drops expired issued nonces and replay state outside the window.
+	Prune(now time.Time)
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// NonceStoreConfig controls nonce lifetimes and replay windows.
+type NonceStoreConfig struct {
+	// Lifetime is how long an issued nonce stays valid.
+	Lifetime time.Duration
+	// ReplayWindow is how far back seen nonces are remembered per address.
+	ReplayWindow time.Duration
+	// MaxWindowSize caps the number of seen nonces kept per address.
+	MaxWindowSize int
+	// MaxOutstanding caps the live nonces issued to one address; issuing
+	// another retires the oldest.
+	MaxOutstanding int
+	// MaxSkew is how far in the future an observed nonce may be stamped.
+	MaxSkew time.Duration
+	// Now overrides the clock, mainly for tests.
+	Now func() time.Time
+}
+
+// DefaultNonceStoreConfig returns the configuration used by the package level helpers.
+func DefaultNonceStoreConfig() NonceStoreConfig {
+	return NonceStoreConfig{
+		Lifetime:       nonceLifetime * time.Second,
+		ReplayWindow:   nonceLifetime * time.Second,
+		MaxWindowSize:  4096,
+		MaxOutstanding: 16,
+		MaxSkew:        30 * time.Second,
+		Now:            time.Now,
+	}
+}
+
+// replayWindow is the sliding window of nonces seen from one address. Seen
+// is keyed by the address a nonce was issued for and its value, so equal
+// values issued for different addresses do not collide.
+type replayWindow struct {
+	Seen  map[string]int64
+	Floor int64
+}
+
+// seenKey is the replay window key of nonce.
+func seenKey(nonce Nonce) string {
+	return nonce.Address + "#" + strconv.FormatUint(uint64(nonce.value), 10)
+}
+
+// MemoryNonceStore is a NonceStore kept entirely in memory.
+type MemoryNonceStore struct {
+	mu      sync.RWMutex
+	cfg     NonceStoreConfig
+	issued  map[string][]NonceMapEntry
+	windows map[string]*replayWindow
+}
+
+// NewMemoryNonceStore creates an empty in-memory nonce store.
+func NewMemoryNonceStore(cfg NonceStoreConfig) *MemoryNonceStore {
+	def := DefaultNonceStoreConfig()
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = def.Lifetime
+	}
+	if cfg.ReplayWindow <= 0 {
+		cfg.ReplayWindow = def.ReplayWindow
+	}
+	if cfg.MaxWindowSize <= 0 {
+		cfg.MaxWindowSize = def.MaxWindowSize
+	}
+	if cfg.MaxOutstanding <= 0 {
+		cfg.MaxOutstanding = def.MaxOutstanding
+	}
+	if cfg.MaxSkew <= 0 {
+		cfg.MaxSkew = def.MaxSkew
+	}
+	if cfg.Now == nil {
+		cfg.Now = def.Now
+	}
+	return &MemoryNonceStore{
+		cfg:     cfg,
+		issued:  make(map[string][]NonceMapEntry),
+		windows: make(map[string]*replayWindow),
+	}
+}
+
+func (s *MemoryNonceStore) Generate(address string) (*Nonce, error) {
+	value, err := generateSecureNonce()
+	if err != nil {
+		return nil, err
+	}
+	n := NewNonce(address, value, s.cfg.Now().Unix())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := append(s.issued[address], NonceMapEntry{Value: n.value, Hash: n.hash, Timestamp: n.Timestamp})
+	if excess := len(entries) - s.cfg.MaxOutstanding; excess > 0 {
+		entries = append(entries[:0:0], entries[excess:]...)
+	}
+	s.issued[address] = entries
+	return n, nil
+}
+
+func (s *MemoryNonceStore) Outstanding(address string) *Nonce {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := s.issued[address]
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !nonceExpired(e.Timestamp, s.cfg.Lifetime, s.cfg.Now()) {
+			return &Nonce{Address: address, value: e.Value, hash: e.Hash, Timestamp: e.Timestamp}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryNonceStore) Validate(address string, nonce Nonce) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, err := s.find(address, nonce)
+	return err == nil
+}
+
+func (s *MemoryNonceStore) Consume(address string, nonce Nonce) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.find(address, nonce)
+	if err != nil {
+		return err
+	}
+	entries := s.issued[address]
+	s.issued[address] = append(entries[:i:i], entries[i+1:]...)
+	if len(s.issued[address]) == 0 {
+		delete(s.issued, address)
+	}
+	return nil
+}
+
+// find locates an issued nonce; callers must hold the lock.
+func (s *MemoryNonceStore) find(address string, nonce Nonce) (int, error) {
+	for i, e := range s.issued[address] {
+		if e.Value != nonce.value || !bytes.Equal(e.Hash, nonce.hash) || e.Timestamp != nonce.Timestamp {
+			continue
+		}
+		if nonceExpired(e.Timestamp, s.cfg.Lifetime, s.cfg.Now()) {
+			return -1, ErrNonceExpired
+		}
+		return i, nil
+	}
+	return -1, ErrNonceUnknown
+}
+
+func (s *MemoryNonceStore) Observe(address string, nonce Nonce) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.cfg.Now()
+	if now.Unix()-nonce.Timestamp > int64(s.cfg.ReplayWindow/time.Second) {
+		return ErrNonceTooOld
+	}
+	if nonce.Timestamp-now.Unix() > int64(s.cfg.MaxSkew/time.Second) {
+		return ErrNonceFuture
+	}
+
+	w, ok := s.windows[address]
+	if !ok {
+		w = &replayWindow{Seen: make(map[string]int64)}
+		s.windows[address] = w
+	}
+	if nonce.Timestamp < w.Floor {
+		return ErrNonceTooOld
+	}
+	key := seenKey(nonce)
+	if _, seen := w.Seen[key]; seen {
+		return ErrNonceReplayed
+	}
+
+	w.Seen[key] = nonce.Timestamp
+	if len(w.Seen) > s.cfg.MaxWindowSize {
+		w.evictOldest()
+	}
+	return nil
+}
+
+// evictOldest drops the oldest seen nonce and raises the window floor past it,
+// so anything at least as old is rejected rather than silently accepted.
+func (w *replayWindow) evictOldest() {
+	var (
+		oldestKey string
+		oldestTS  int64
+		first     = true
+	)
+	for k, ts := range w.Seen {
+		if first || ts < oldestTS {
+			oldestKey, oldestTS, first = k, ts, false
+		}
+	}
+	delete(w.Seen, oldestKey)
+	if oldestTS+1 > w.Floor {
+		w.Floor = oldestTS + 1
+	}
+}
+
+func (s *MemoryNonceStore) Prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, entries := range s.issued {
+		live := entries[:0]
+		for _, e := range entries {
+			if !nonceExpired(e.Timestamp, s.cfg.Lifetime, now) {
+				live = append(live, e)
+			}
+		}
+		if len(live) == 0 {
+			delete(s.issued, address)
+		} else {
+			s.issued[address] = live
+		}
+	}
+
+	cutoff := now.Unix() - int64(s.cfg.ReplayWindow/time.Second)
+	for address, w := range s.windows {
+		for v, ts := range w.Seen {
+			if ts < cutoff {
+				delete(w.Seen, v)
+			}
+		}
+		if len(w.Seen) == 0 {
+			delete(s.windows, address)
+		}
+	}
+}
+
+func (s *MemoryNonceStore) Close() error {
+	return nil
+}
+
+// StartNoncePruner prunes the store every interval until ctx is cancelled.
+func StartNoncePruner(ctx context.Context, store NonceStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				store.Prune(now)
+			}
+		}
+	}()
+}
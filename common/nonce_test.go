@@ -0,0 +1,105 @@
+package common_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+	"trustmesh/common"
+)
+
+func TestNonceStoreConsumeOnce(t *testing.T) {
+	store := common.NewMemoryNonceStore(common.DefaultNonceStoreConfig())
+
+	n, err := store.Generate("peer-a")
+	require.NoError(t, err, "Generating a nonce should not fail.")
+	require.True(t, store.Validate("peer-a", *n), "Issued nonce should validate.")
+	require.False(t, store.Validate("peer-b", *n), "Nonce should not validate for another address.")
+
+	require.NoError(t, store.Consume("peer-a", *n), "First consume should succeed.")
+	require.ErrorIs(t, store.Consume("peer-a", *n), common.ErrNonceUnknown, "Second consume should fail.")
+}
+
+func TestNonceStoreExpiry(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cfg := common.DefaultNonceStoreConfig()
+	cfg.Lifetime = time.Minute
+	cfg.Now = func() time.Time { return now }
+	store := common.NewMemoryNonceStore(cfg)
+
+	n, err := store.Generate("peer-a")
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+	require.ErrorIs(t, store.Consume("peer-a", *n), common.ErrNonceExpired, "Expired nonce should be rejected.")
+
+	store.Prune(now)
+	require.Nil(t, store.Outstanding("peer-a"), "Pruned nonce should no longer be outstanding.")
+}
+
+func TestNonceStoreReplayWindow(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cfg := common.DefaultNonceStoreConfig()
+	cfg.ReplayWindow = time.Minute
+	cfg.MaxWindowSize = 2
+	cfg.Now = func() time.Time { return now }
+	store := common.NewMemoryNonceStore(cfg)
+
+	first := common.NewNonce("peer-a", 1, now.Unix()-30)
+	require.NoError(t, store.Observe("peer-a", *first))
+	require.ErrorIs(t, store.Observe("peer-a", *first), common.ErrNonceReplayed, "Replayed nonce should be rejected.")
+	require.NoError(t, store.Observe("peer-b", *first), "Windows are tracked per address.")
+
+	stale := common.NewNonce("peer-a", 2, now.Unix()-120)
+	require.ErrorIs(t, store.Observe("peer-a", *stale), common.ErrNonceTooOld, "Nonce outside the window should be rejected.")
+
+	// Overflowing the window evicts the oldest entry and raises the floor past it.
+	require.NoError(t, store.Observe("peer-a", *common.NewNonce("peer-a", 3, now.Unix()-10)))
+	require.NoError(t, store.Observe("peer-a", *common.NewNonce("peer-a", 4, now.Unix())))
+	require.ErrorIs(t, store.Observe("peer-a", *first), common.ErrNonceTooOld, "Evicted nonce must not be accepted again.")
+}
+
+func TestNonceStoreBounds(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	cfg := common.DefaultNonceStoreConfig()
+	cfg.MaxOutstanding = 2
+	cfg.MaxSkew = 30 * time.Second
+	cfg.Now = func() time.Time { return now }
+	store := common.NewMemoryNonceStore(cfg)
+
+	var issued []*common.Nonce
+	for i := 0; i < 3; i++ {
+		n, err := store.Generate("peer-a")
+		require.NoError(t, err)
+		issued = append(issued, n)
+	}
+	require.False(t, store.Validate("peer-a", *issued[0]), "Issuing past the cap should retire the oldest nonce.")
+	require.True(t, store.Validate("peer-a", *issued[1]))
+	require.True(t, store.Validate("peer-a", *issued[2]))
+
+	future := common.NewNonce("peer-a", 7, now.Add(time.Hour).Unix())
+	require.ErrorIs(t, store.Observe("peer-a", *future), common.ErrNonceFuture, "Nonce stamped beyond the skew should be rejected.")
+	require.NoError(t, store.Observe("peer-a", *common.NewNonce("peer-a", 7, now.Add(10*time.Second).Unix())))
+
+	// The same value issued for another address is a different nonce.
+	require.NoError(t, store.Observe("peer-a", *common.NewNonce("peer-b", 7, now.Unix())))
+	require.ErrorIs(t, store.Observe("peer-a", *common.NewNonce("peer-b", 7, now.Unix())), common.ErrNonceReplayed)
+}
+
+func TestFileNonceStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nonces.json")
+	cfg := common.DefaultNonceStoreConfig()
+
+	store, err := common.NewFileNonceStore(path, cfg)
+	require.NoError(t, err)
+	n, err := store.Generate("peer-a")
+	require.NoError(t, err)
+	seen := common.NewNonce("peer-b", 42, time.Now().Unix())
+	require.NoError(t, store.Observe("peer-b", *seen))
+	require.NoError(t, store.Close())
+
+	reopened, err := common.NewFileNonceStore(path, cfg)
+	require.NoError(t, err)
+	require.True(t, reopened.Validate("peer-a", *n), "Issued nonce should survive a restart.")
+	require.ErrorIs(t, reopened.Observe("peer-b", *seen), common.ErrNonceReplayed, "Replay window should survive a restart.")
+}
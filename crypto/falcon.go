@@ -0,0 +1,106 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/algorand/falcon"
+	"github.com/zeebo/blake3"
+)
+
+const FALCON_VERSION = "det1024"
+
+const signingSeedDomain = "trustmesh/falcon/seed/v1"
+
+var ErrInvalidPublicKey = errors.New("invalid falcon public key length")
+
+// Falcon is the post-quantum signature scheme used for node identities.
+type Falcon struct{}
+
+// GenerateKeys generates a Falcon key pair seeded from the CSPRNG.
+func (f Falcon) GenerateKeys() (falcon.PublicKey, falcon.PrivateKey, error) {
+	seed := make([]byte, 48)
+	if _, err := rand.Read(seed); err != nil {
+		return falcon.PublicKey{}, falcon.PrivateKey{}, fmt.Errorf("failed to read falcon seed: %v", err)
+	}
+	return falcon.GenerateKey(seed)
+}
+
+// Usage returns the cryptographic capabilities of the Falcon implementation.
+func (f Falcon) Usage() []AlgUsage {
+	return []AlgUsage{SIGNATURE}
+}
+
+// Name returns the name of the cryptographic implementation.
+func (f Falcon) Name() string {
+	return "falcon"
+}
+
+// Version returns the Falcon parameter set in use.
+func (f Falcon) Version() string {
+	return FALCON_VERSION
+}
+
+// GetFalconAlgorithm returns an instance of the Falcon algorithm.
+func GetFalconAlgorithm() Falcon {
+	return Falcon{}
+}
+
+// SigningKey is a Falcon key pair used to sign on behalf of a node.
+type SigningKey struct {
+	Public  falcon.PublicKey
+	private falcon.PrivateKey
+}
+
+// NewSigningKey generates a fresh Falcon signing key.
+func NewSigningKey() (*SigningKey, error) {
+	pub, priv, err := GetFalconAlgorithm().GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Public: pub, private: priv}, nil
+}
+
+// NewSigningKeyFromSeed derives a Falcon signing key from seed. The same
+// seed always yields the same key.
+func NewSigningKeyFromSeed(seed []byte) (*SigningKey, error) {
+	var s [48]byte
+	blake3.DeriveKey(signingSeedDomain, seed, s[:])
+	pub, priv, err := falcon.GenerateKey(s[:])
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Public: pub, private: priv}, nil
+}
+
+// Derive returns the signing key k derives for label. Without k's private
+// key, the derived key cannot be linked to k.
+func (k *SigningKey) Derive(label []byte) (*SigningKey, error) {
+	seed := make([]byte, 0, len(k.private)+len(label))
+	seed = append(append(seed, k.private[:]...), label...)
+	return NewSigningKeyFromSeed(seed)
+}
+
+// PublicKeyBytes returns the encoded public key.
+func (k *SigningKey) PublicKeyBytes() []byte {
+	return k.Public[:]
+}
+
+// Sign returns a compressed Falcon signature over msg.
+func (k *SigningKey) Sign(msg []byte) ([]byte, error) {
+	sig, err := k.private.SignCompressed(msg)
+	if err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// VerifySignature checks a compressed Falcon signature over msg.
+func VerifySignature(publicKey, msg, sig []byte) error {
+	if len(publicKey) != falcon.PublicKeySize {
+		return ErrInvalidPublicKey
+	}
+	var pk falcon.PublicKey
+	copy(pk[:], publicKey)
+	return pk.Verify(sig, msg)
+}
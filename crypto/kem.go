@@ -0,0 +1,130 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/group/edwards25519"
+)
+
+const (
+	kemDomain     = "trustmesh/kem/v1"
+	kemSeedDomain = "trustmesh/kem/seed/v1"
+)
+
+var (
+	ErrInvalidKEMKey     = errors.New("invalid KEM public key")
+	ErrInvalidCiphertext = errors.New("invalid KEM ciphertext")
+	ErrDecryptFailed     = errors.New("ciphertext failed authentication")
+)
+
+var kemSuite = edwards25519.NewBlakeSHA256Ed25519()
+
+// KEMKey is a key pair for the key encapsulation mechanism of the
+// KyberCrystal algorithm. Nodes publish the public half so that others can
+// establish secrets only they can recover.
+type KEMKey struct {
+	public  kyber.Point
+	private kyber.Scalar
+}
+
+// NewKEMKey generates a fresh KEM key pair.
+func NewKEMKey() (*KEMKey, error) {
+	pub, priv, err := GetKyberAlgorithm().GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &KEMKey{public: pub, private: priv}, nil
+}
+
+// NewKEMKeyFromSeed derives a KEM key pair from seed. The same seed always
+// yields the same key.
+func NewKEMKeyFromSeed(seed []byte) *KEMKey {
+	var s [64]byte
+	blake3.DeriveKey(kemSeedDomain, seed, s[:])
+	priv := kemSuite.Scalar().SetBytes(s[:])
+	return &KEMKey{public: kemSuite.Point().Mul(priv, nil), private: priv}
+}
+
+// PublicKeyBytes returns the encoded public key.
+func (k *KEMKey) PublicKeyBytes() []byte {
+	b, _ := k.public.MarshalBinary()
+	return b
+}
+
+// Encapsulate returns a fresh 32-byte secret for the holder of publicKey and
+// the ciphertext from which only they can recover it.
+func Encapsulate(publicKey []byte) (secret, ciphertext []byte, err error) {
+	pub := kemSuite.Point()
+	if err := pub.UnmarshalBinary(publicKey); err != nil {
+		return nil, nil, ErrInvalidKEMKey
+	}
+	r := kemSuite.Scalar().Pick(kemSuite.RandomStream())
+	ciphertext, err = kemSuite.Point().Mul(r, nil).MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return kemSecret(kemSuite.Point().Mul(r, pub), ciphertext, publicKey), ciphertext, nil
+}
+
+// Decapsulate recovers the secret a ciphertext from Encapsulate carries.
+func (k *KEMKey) Decapsulate(ciphertext []byte) ([]byte, error) {
+	eph := kemSuite.Point()
+	if err := eph.UnmarshalBinary(ciphertext); err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return kemSecret(kemSuite.Point().Mul(k.private, eph), ciphertext, k.PublicKeyBytes()), nil
+}
+
+// kemSecret derives the shared secret from the Diffie-Hellman point, bound
+// to the ciphertext and the recipient's key.
+func kemSecret(shared kyber.Point, ciphertext, publicKey []byte) []byte {
+	point, _ := shared.MarshalBinary()
+	material := make([]byte, 0, len(point)+len(ciphertext)+len(publicKey))
+	material = append(append(append(material, point...), ciphertext...), publicKey...)
+	secret := make([]byte, 32)
+	blake3.DeriveKey(kemDomain, material, secret)
+	return secret
+}
+
+// Seal encrypts and authenticates plaintext under a 32-byte key with
+// AES-256-GCM. The random nonce is prepended to the result.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a ciphertext made by Seal under the same key.
+func Open(key, sealed []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecryptFailed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
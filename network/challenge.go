@@ -0,0 +1,264 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/zeebo/blake3"
+	"io"
+	"time"
+	"trustmesh/common"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+// ChallengeProtocol proves a peer is live and holds the key behind its NodeID.
+// It runs inside the connection handshake and on demand over streams of the
+// session. Answers are bound to the transcript of the session they were
+// asked in, so they cannot be relayed into any other.
+var ChallengeProtocol = types.Protocol{
+	Name:   "/trustmesh/challenge/1.0.0",
+	ID:     []byte("challenge"),
+	Opcode: 0x02,
+}
+
+const (
+	challengeDomain  = "trustmesh/challenge/v2"
+	transcriptDomain = "trustmesh/transcript/v1"
+)
+
+// DefaultChallengeSkew is the allowed clock difference on response timestamps.
+const DefaultChallengeSkew = 30 * time.Second
+
+var (
+	ErrChallengeHash      = errors.New("challenge nonce hash does not match its value")
+	ErrChallengeNodeID    = errors.New("node id does not match the public key")
+	ErrChallengeSession   = errors.New("challenge is bound to another session")
+	ErrChallengeTimestamp = errors.New("response timestamp is outside the allowed skew")
+)
+
+func init() {
+	if err := RegisterProtocol(ChallengeProtocol); err != nil {
+		panic(err)
+	}
+}
+
+// ChallengeRequest carries a freshly issued nonce to the challenged peer. It
+// names the challenger and the transcript of the session it is asked in, so a
+// peer relaying it into another session cannot get it answered there.
+type ChallengeRequest struct {
+	Address    string       `json:"address"`
+	Nonce      uint32       `json:"nonce"`
+	Hash       []byte       `json:"hash"`
+	Timestamp  int64        `json:"timestamp"`
+	Challenger types.NodeID `json:"challenger"`
+	Transcript []byte       `json:"transcript"`
+}
+
+// ChallengeResponse is the peer's signature over the nonce, its NodeID and a timestamp.
+type ChallengeResponse struct {
+	Request   ChallengeRequest `json:"request"`
+	NodeID    types.NodeID     `json:"node_id"`
+	PublicKey []byte           `json:"public_key"`
+	Timestamp int64            `json:"timestamp"`
+	Signature []byte           `json:"signature"`
+}
+
+// ChallengeService issues, answers and verifies nonce challenges.
+type ChallengeService struct {
+	store common.NonceStore
+	key   *crypto.SigningKey
+	id    types.NodeID
+	skew  time.Duration
+	now   func() time.Time
+}
+
+// NewChallengeService creates a service issuing nonces from store and
+// answering challenges with key.
+func NewChallengeService(store common.NonceStore, key *crypto.SigningKey) *ChallengeService {
+	return &ChallengeService{
+		store: store,
+		key:   key,
+		id:    types.NewNodeID(key.PublicKeyBytes()),
+		skew:  DefaultChallengeSkew,
+		now:   time.Now,
+	}
+}
+
+// SessionTranscript hashes the messages that opened a session, in the order
+// they were sent, into the transcript its challenges are bound to.
+func SessionTranscript(msgs ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(transcriptDomain)
+	for _, msg := range msgs {
+		writeBytes(&buf, msg)
+	}
+	sum := blake3.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+// Issue creates a challenge for the peer reachable at address in the session
+// with the given transcript.
+func (c *ChallengeService) Issue(address string, transcript []byte) (*ChallengeRequest, error) {
+	n, err := c.store.Generate(address)
+	if err != nil {
+		return nil, err
+	}
+	return &ChallengeRequest{
+		Address:    n.Address,
+		Nonce:      n.Value(),
+		Hash:       n.Hash(),
+		Timestamp:  n.Timestamp,
+		Challenger: c.id,
+		Transcript: transcript,
+	}, nil
+}
+
+// Answer signs a challenge received from a peer in the session with the given
+// transcript. Challenges asked in any other session are refused.
+func (c *ChallengeService) Answer(req *ChallengeRequest, transcript []byte) (*ChallengeResponse, error) {
+	return c.answer(req, transcript, c.now())
+}
+
+// answer is Answer stamping the response at now.
+func (c *ChallengeService) answer(req *ChallengeRequest, transcript []byte, now time.Time) (*ChallengeResponse, error) {
+	if !bytes.Equal(req.Transcript, transcript) {
+		return nil, ErrChallengeSession
+	}
+	n := common.NewNonce(req.Address, req.Nonce, req.Timestamp)
+	if !bytes.Equal(n.Hash(), req.Hash) {
+		return nil, ErrChallengeHash
+	}
+
+	resp := &ChallengeResponse{
+		Request:   *req,
+		NodeID:    c.id,
+		PublicKey: c.key.PublicKeyBytes(),
+		Timestamp: now.Unix(),
+	}
+	sig, err := c.key.Sign(resp.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	resp.Signature = sig
+	return resp, nil
+}
+
+// Verify checks a response to a challenge the service issued in the session
+// with the given transcript and consumes the nonce it answers, so the same
+// response can never be accepted twice.
+func (c *ChallengeService) Verify(resp *ChallengeResponse, transcript []byte) error {
+	return c.verify(resp, transcript, c.now())
+}
+
+// verify is Verify checking the response timestamp against now.
+func (c *ChallengeService) verify(resp *ChallengeResponse, transcript []byte, now time.Time) error {
+	if resp.Request.Challenger != c.id || !bytes.Equal(resp.Request.Transcript, transcript) {
+		return ErrChallengeSession
+	}
+	if types.NewNodeID(resp.PublicKey) != resp.NodeID {
+		return ErrChallengeNodeID
+	}
+	age := now.Sub(time.Unix(resp.Timestamp, 0))
+	if age > c.skew || age < -c.skew {
+		return ErrChallengeTimestamp
+	}
+	if err := crypto.VerifySignature(resp.PublicKey, resp.signingBytes(), resp.Signature); err != nil {
+		return err
+	}
+
+	n := common.NewNonce(resp.Request.Address, resp.Request.Nonce, resp.Request.Timestamp)
+	if !bytes.Equal(n.Hash(), resp.Request.Hash) {
+		return ErrChallengeHash
+	}
+	return c.store.Consume(resp.Request.Address, *n)
+}
+
+// Challenge runs the issuing side of the protocol over rw, the session with
+// the given transcript, and returns the verified response.
+func (c *ChallengeService) Challenge(ctx context.Context, rw io.ReadWriter, address string, transcript []byte) (*ChallengeResponse, error) {
+	return c.challenge(ctx, rw, address, transcript, c.now)
+}
+
+// challenge is Challenge checking the response timestamp against now.
+func (c *ChallengeService) challenge(ctx context.Context, rw io.ReadWriter, address string, transcript []byte, now func() time.Time) (*ChallengeResponse, error) {
+	defer applyDeadline(ctx, rw)()
+
+	req, err := c.Issue(address, transcript)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteMessage(rw, req); err != nil {
+		return nil, err
+	}
+
+	var resp ChallengeResponse
+	if err := ReadMessage(rw, &resp); err != nil {
+		return nil, err
+	}
+	if err := c.verify(&resp, transcript, now()); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ServeChallenge runs the answering side of the protocol over rw, the session
+// with the given transcript.
+func (c *ChallengeService) ServeChallenge(ctx context.Context, rw io.ReadWriter, transcript []byte) error {
+	return c.serve(ctx, rw, transcript, c.now)
+}
+
+// serve is ServeChallenge stamping the response at now.
+func (c *ChallengeService) serve(ctx context.Context, rw io.ReadWriter, transcript []byte, now func() time.Time) error {
+	defer applyDeadline(ctx, rw)()
+
+	var req ChallengeRequest
+	if err := ReadMessage(rw, &req); err != nil {
+		return err
+	}
+	resp, err := c.answer(&req, transcript, now())
+	if err != nil {
+		return err
+	}
+	return WriteMessage(rw, resp)
+}
+
+// signingBytes is the domain separated encoding covered by the signature.
+func (r *ChallengeResponse) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(challengeDomain)
+	writeBytes(&buf, []byte(r.Request.Address))
+	binary.Write(&buf, binary.BigEndian, r.Request.Nonce)
+	writeBytes(&buf, r.Request.Hash)
+	binary.Write(&buf, binary.BigEndian, r.Request.Timestamp)
+	buf.Write(r.Request.Challenger[:])
+	writeBytes(&buf, r.Request.Transcript)
+	buf.Write(r.NodeID[:])
+	binary.Write(&buf, binary.BigEndian, r.Timestamp)
+	return buf.Bytes()
+}
+
+// writeBytes writes a length-prefixed byte slice.
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+// deadliner is implemented by connections that support deadlines.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// applyDeadline copies the context deadline onto rw when possible and
+// returns a function that clears it again.
+func applyDeadline(ctx context.Context, rw interface{}) func() {
+	d, ok := rw.(deadliner)
+	if !ok {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		d.SetDeadline(deadline)
+	}
+	return func() { d.SetDeadline(time.Time{}) }
+}
@@ -0,0 +1,123 @@
+package network_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+	"trustmesh/common"
+	"trustmesh/crypto"
+	"trustmesh/network"
+	"trustmesh/types"
+)
+
+func newChallengeService(t *testing.T) (*network.ChallengeService, *crypto.SigningKey) {
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err, "Generating a signing key should not fail.")
+	return network.NewChallengeService(common.NewMemoryNonceStore(common.DefaultNonceStoreConfig()), key), key
+}
+
+func TestChallengeRoundTrip(t *testing.T) {
+	issuer, _ := newChallengeService(t)
+	peer, peerKey := newChallengeService(t)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	transcript := network.SessionTranscript([]byte("dialer hello"), []byte("listener hello"))
+	go func() { errCh <- peer.ServeChallenge(ctx, b, transcript) }()
+
+	resp, err := issuer.Challenge(ctx, a, "10.0.0.2:7000", transcript)
+	require.NoError(t, err, "Challenge should verify.")
+	require.NoError(t, <-errCh)
+	require.Equal(t, types.NewNodeID(peerKey.PublicKeyBytes()), resp.NodeID)
+
+	// The nonce was consumed, so replaying the same response must fail.
+	require.ErrorIs(t, issuer.Verify(resp, transcript), common.ErrNonceUnknown, "Replayed response should be rejected.")
+}
+
+func TestChallengeRejectsForgedResponse(t *testing.T) {
+	issuer, _ := newChallengeService(t)
+	peer, _ := newChallengeService(t)
+
+	transcript := network.SessionTranscript([]byte("dialer hello"), []byte("listener hello"))
+	req, err := issuer.Issue("10.0.0.2:7000", transcript)
+	require.NoError(t, err)
+	resp, err := peer.Answer(req, transcript)
+	require.NoError(t, err)
+
+	resp.Timestamp++
+	require.Error(t, issuer.Verify(resp, transcript), "Tampered response should not verify.")
+
+	resp.Timestamp--
+	require.NoError(t, issuer.Verify(resp, transcript), "Nonce must not be burnt by a forged response.")
+}
+
+func TestChallengeRejectsRelayedAnswer(t *testing.T) {
+	victim, _ := newChallengeService(t)
+	relay, _ := newChallengeService(t)
+	honest, _ := newChallengeService(t)
+
+	// The victim believes it is talking to the honest node, but its session
+	// is with the relay, which has a session of its own with the honest node.
+	victimSession := network.SessionTranscript([]byte("victim hello"), []byte("relay hello claiming honest"))
+	relaySession := network.SessionTranscript([]byte("relay hello"), []byte("honest hello"))
+
+	req, err := victim.Issue("10.0.0.2:7000", victimSession)
+	require.NoError(t, err)
+	_, err = honest.Answer(req, relaySession)
+	require.ErrorIs(t, err, network.ErrChallengeSession, "A challenge from another session should not be answered.")
+
+	// Rebinding the challenge to the relay's session gets it answered, but
+	// not accepted by the victim.
+	rebound := *req
+	rebound.Transcript = relaySession
+	resp, err := honest.Answer(&rebound, relaySession)
+	require.NoError(t, err)
+	require.ErrorIs(t, victim.Verify(resp, victimSession), network.ErrChallengeSession,
+		"An answer given in another session should be rejected.")
+	resp.Request.Transcript = victimSession
+	require.Error(t, victim.Verify(resp, victimSession), "Rewriting the transcript should break the signature.")
+
+	// Answers to the relay's own challenges do not pass as the victim's.
+	own, err := relay.Issue("10.0.0.3:7000", victimSession)
+	require.NoError(t, err)
+	resp, err = honest.Answer(own, victimSession)
+	require.NoError(t, err)
+	require.ErrorIs(t, victim.Verify(resp, victimSession), network.ErrChallengeSession,
+		"An answer to another challenger should be rejected.")
+	resp.Request.Challenger = req.Challenger
+	require.Error(t, victim.Verify(resp, victimSession), "Rewriting the challenger should break the signature.")
+
+	resp, err = honest.Answer(req, victimSession)
+	require.NoError(t, err)
+	require.NoError(t, victim.Verify(resp, victimSession), "The victim's nonce should survive the rejected answers.")
+}
+
+func TestNetworkChallengesPeersOnDemand(t *testing.T) {
+	node := newNetwork(t, network.Config{})
+	peer := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := node.Challenge(ctx, peer.Self())
+	require.NoError(t, err, "A connected peer should answer challenges over the protocol.")
+	require.Equal(t, peer.Self().ID, resp.NodeID)
+
+	resp, err = peer.Challenge(ctx, node.Self())
+	require.NoError(t, err, "Challenges should run in both directions of a session.")
+	require.Equal(t, node.Self().ID, resp.NodeID)
+
+	s, err := node.NewStream(ctx, peer.Self(), network.ChallengeProtocol.Name)
+	require.NoError(t, err)
+	defer s.Close()
+	issuer, _ := newChallengeService(t)
+	_, err = issuer.Challenge(ctx, s, "10.0.0.2:7000", network.SessionTranscript([]byte("another session")))
+	require.Error(t, err, "Challenges bound to another session should go unanswered.")
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+const (
+	// clockSamples is how many peer offsets the clock keeps.
+	clockSamples = 15
+	// MaxClockOffset is the largest offset from the local clock a peer's
+	// sample may have. Peers further off are assumed to be wrong or lying
+	// and are not sampled.
+	MaxClockOffset = 10 * time.Minute
+)
+
+// Clock estimates network time from the clocks of connected peers. Each
+// authenticated peer contributes one offset sample, its latest, and the clock
+// runs at the median of the recent peers' samples, so a minority of peers
+// with wrong clocks cannot move it.
+type Clock struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	samples map[types.NodeID]time.Duration
+	order   []types.NodeID
+	offset  time.Duration
+}
+
+// NewClock creates a clock reading local time from now until samples arrive.
+func NewClock(now func() time.Time) *Clock {
+	if now == nil {
+		now = time.Now
+	}
+	return &Clock{now: now, samples: make(map[types.NodeID]time.Duration)}
+}
+
+// clockOffset is how far remote, a peer's time read between the local times
+// sent and received, is ahead of the local clock. The peer is assumed to have
+// read its clock halfway through the round trip.
+func clockOffset(sent, remote, received time.Time) time.Duration {
+	return remote.Sub(sent.Add(received.Sub(sent) / 2))
+}
+
+// Observe records the time remote of peer id, read between the local times
+// sent and received, replacing the peer's earlier sample. It reports false
+// and ignores the sample if it is more than MaxClockOffset off.
+func (c *Clock) Observe(id types.NodeID, sent, remote, received time.Time) bool {
+	offset := clockOffset(sent, remote, received)
+	if offset > MaxClockOffset || offset < -MaxClockOffset {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.samples[id]; ok {
+		for i, other := range c.order {
+			if other == id {
+				c.order = append(c.order[:i], c.order[i+1:]...)
+				break
+			}
+		}
+	}
+	c.samples[id] = offset
+	c.order = append(c.order, id)
+	if len(c.order) > clockSamples {
+		delete(c.samples, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	sorted := make([]time.Duration, 0, len(c.samples))
+	for _, s := range c.samples {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c.offset = sorted[len(sorted)/2]
+	return true
+}
+
+// Offset returns how far network time is ahead of the local clock.
+func (c *Clock) Offset() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// Now returns the network time in UTC.
+func (c *Clock) Now() time.Time {
+	return c.now().Add(c.Offset()).UTC()
+}
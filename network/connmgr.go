@@ -0,0 +1,276 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultHighWater is the number of connections above which the
+	// connection manager trims them.
+	DefaultHighWater = 192
+	// DefaultLowWater is the number of connections trimming leaves.
+	DefaultLowWater = 128
+	// DefaultGracePeriod is how long new connections are spared from
+	// trimming.
+	DefaultGracePeriod = 20 * time.Second
+	// DefaultTrimInterval is how often the connection count is checked
+	// against the high watermark besides when peers connect.
+	DefaultTrimInterval = time.Minute
+	// DefaultMaxInboundPerIP caps the inbound connections from one address.
+	DefaultMaxInboundPerIP = 8
+	// DefaultMaxInboundPerSubnet caps the inbound connections from one IPv4
+	// /24 or IPv6 /48.
+	DefaultMaxInboundPerSubnet = 32
+)
+
+// ConnManagerConfig configures the connection manager.
+type ConnManagerConfig struct {
+	// HighWater is the number of connections above which the lowest valued
+	// are closed, down to LowWater. A negative HighWater disables
+	// trimming.
+	HighWater, LowWater int
+	// GracePeriod spares new connections from trimming.
+	GracePeriod time.Duration
+	// TrimInterval is how often the connection count is checked besides
+	// when peers connect.
+	TrimInterval time.Duration
+	// MaxInboundPerIP and MaxInboundPerSubnet cap the inbound connections,
+	// handshaking or established, from one address and from one IPv4 /24
+	// or IPv6 /48. Negative values disable the caps.
+	MaxInboundPerIP, MaxInboundPerSubnet int
+}
+
+// ConnManager keeps the number of connections within bounds. Once there are
+// more than the high watermark, it closes the connections of least value
+// until the low watermark is reached, sparing protected peers and
+// connections still in their grace period. A peer's value is the sum of
+// its tags plus, when the network's scorer rates peers, its score.
+type ConnManager struct {
+	highWater, lowWater int
+	grace               time.Duration
+	maxPerIP, maxPerNet int
+
+	mu        sync.Mutex
+	tags      map[types.NodeID]map[string]int
+	protected map[types.NodeID]map[string]bool
+	perIP     map[string]int
+	perNet    map[string]int
+
+	trimMu sync.Mutex
+}
+
+func newConnManager(cfg ConnManagerConfig) *ConnManager {
+	if cfg.HighWater == 0 {
+		cfg.HighWater = DefaultHighWater
+	}
+	if cfg.LowWater <= 0 {
+		cfg.LowWater = DefaultLowWater
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = DefaultGracePeriod
+	}
+	if cfg.MaxInboundPerIP == 0 {
+		cfg.MaxInboundPerIP = DefaultMaxInboundPerIP
+	}
+	if cfg.MaxInboundPerSubnet == 0 {
+		cfg.MaxInboundPerSubnet = DefaultMaxInboundPerSubnet
+	}
+	return &ConnManager{
+		highWater: cfg.HighWater,
+		lowWater:  min(cfg.LowWater, max(cfg.HighWater, 0)),
+		grace:     cfg.GracePeriod,
+		maxPerIP:  cfg.MaxInboundPerIP,
+		maxPerNet: cfg.MaxInboundPerSubnet,
+		tags:      make(map[types.NodeID]map[string]int),
+		protected: make(map[types.NodeID]map[string]bool),
+		perIP:     make(map[string]int),
+		perNet:    make(map[string]int),
+	}
+}
+
+// TagPeer sets the value tag gives id. Trimming closes the connections of
+// lowest total value first.
+func (cm *ConnManager) TagPeer(id types.NodeID, tag string, value int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	tags := cm.tags[id]
+	if tags == nil {
+		tags = make(map[string]int)
+		cm.tags[id] = tags
+	}
+	tags[tag] = value
+}
+
+// UntagPeer removes tag from id.
+func (cm *ConnManager) UntagPeer(id types.NodeID, tag string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	delete(cm.tags[id], tag)
+	if len(cm.tags[id]) == 0 {
+		delete(cm.tags, id)
+	}
+}
+
+// Protect keeps the connection to id from being trimmed until every tag it
+// is protected under is removed.
+func (cm *ConnManager) Protect(id types.NodeID, tag string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	tags := cm.protected[id]
+	if tags == nil {
+		tags = make(map[string]bool)
+		cm.protected[id] = tags
+	}
+	tags[tag] = true
+}
+
+// Unprotect removes the protection tag gave id and reports whether id is
+// still protected under other tags.
+func (cm *ConnManager) Unprotect(id types.NodeID, tag string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	delete(cm.protected[id], tag)
+	if len(cm.protected[id]) == 0 {
+		delete(cm.protected, id)
+		return false
+	}
+	return true
+}
+
+// IsProtected reports whether id is protected under tag, or under any tag
+// if tag is empty.
+func (cm *ConnManager) IsProtected(id types.NodeID, tag string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if tag == "" {
+		return len(cm.protected[id]) > 0
+	}
+	return cm.protected[id][tag]
+}
+
+// trim closes the connections of least value while there are more than the
+// low watermark, once there are more than the high watermark, and returns
+// the peers it closed.
+func (cm *ConnManager) trim(peers *peerstore, score func(types.NodeID) float64, now time.Time) []*peer {
+	if cm.highWater < 0 {
+		return nil
+	}
+	cm.trimMu.Lock()
+	defer cm.trimMu.Unlock()
+
+	all := peers.all()
+	if len(all) <= cm.highWater {
+		return nil
+	}
+	type candidate struct {
+		p     *peer
+		value float64
+	}
+	var candidates []candidate
+	cm.mu.Lock()
+	for _, p := range all {
+		if len(cm.protected[p.node.ID]) > 0 || now.Sub(p.connectedAt) < cm.grace {
+			continue
+		}
+		var value float64
+		for _, v := range cm.tags[p.node.ID] {
+			value += float64(v)
+		}
+		candidates = append(candidates, candidate{p: p, value: value})
+	}
+	cm.mu.Unlock()
+	if score != nil {
+		for i := range candidates {
+			candidates[i].value += score(candidates[i].p.node.ID)
+		}
+	}
+
+	// Among equals, the newest connections go first.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].value != candidates[j].value {
+			return candidates[i].value < candidates[j].value
+		}
+		return candidates[i].p.connectedAt.After(candidates[j].p.connectedAt)
+	})
+	excess := len(all) - cm.lowWater
+	var closed []*peer
+	for _, c := range candidates[:min(excess, len(candidates))] {
+		peers.remove(c.p)
+		closed = append(closed, c.p)
+	}
+	return closed
+}
+
+// admit reserves an inbound slot for conn, or reports false if its address
+// or subnet is at its cap. The slot is freed when the returned connection
+// closes.
+func (cm *ConnManager) admit(conn net.Conn) (net.Conn, bool) {
+	ip, subnet := addrKeys(conn.RemoteAddr())
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.maxPerIP > 0 && cm.perIP[ip] >= cm.maxPerIP {
+		return nil, false
+	}
+	if subnet != "" && cm.maxPerNet > 0 && cm.perNet[subnet] >= cm.maxPerNet {
+		return nil, false
+	}
+	cm.perIP[ip]++
+	if subnet != "" {
+		cm.perNet[subnet]++
+	}
+	return &inboundConn{Conn: conn, release: func() { cm.release(ip, subnet) }}, true
+}
+
+func (cm *ConnManager) release(ip, subnet string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.perIP[ip]--; cm.perIP[ip] <= 0 {
+		delete(cm.perIP, ip)
+	}
+	if subnet == "" {
+		return
+	}
+	if cm.perNet[subnet]--; cm.perNet[subnet] <= 0 {
+		delete(cm.perNet, subnet)
+	}
+}
+
+// addrKeys returns the host of addr and, for IP addresses, the subnet it
+// is counted under.
+func addrKeys(addr net.Addr) (ip, subnet string) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		return host, ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String(), v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.String(), parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// inboundConn frees its inbound slot when closed.
+type inboundConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *inboundConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,62 @@
+package network_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/network"
+)
+
+func TestConnManagerTrimsLowestValue(t *testing.T) {
+	node := newNetwork(t, network.Config{ConnManager: network.ConnManagerConfig{
+		HighWater:    2,
+		LowWater:     2,
+		GracePeriod:  500 * time.Millisecond,
+		TrimInterval: 20 * time.Millisecond,
+	}})
+	a, b := newNetwork(t, network.Config{}), newNetwork(t, network.Config{})
+	protected, valued := newNetwork(t, network.Config{}), newNetwork(t, network.Config{})
+	cm := node.ConnManager()
+	cm.Protect(protected.Self().ID, "test")
+	cm.TagPeer(valued.Self().ID, "test", 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, peer := range []network.P2PNetwork{a, b, protected, valued} {
+		_, err := node.Connect(ctx, peer.Self().URL())
+		require.NoError(t, err)
+	}
+	require.Len(t, node.Nodes(), 4, "New connections should be spared during their grace period.")
+
+	require.Eventually(t, func() bool { return len(node.Nodes()) == 2 }, 3*time.Second, 10*time.Millisecond,
+		"Connections above the high watermark should be trimmed to the low watermark.")
+	require.Contains(t, node.Nodes(), protected.Self().ID.String(), "Protected peers should not be trimmed.")
+	require.Contains(t, node.Nodes(), valued.Self().ID.String(), "The lowest valued peers should be trimmed first.")
+
+	require.False(t, cm.Unprotect(protected.Self().ID, "test"))
+	require.False(t, cm.IsProtected(protected.Self().ID, ""))
+}
+
+func TestConnManagerLimitsInboundPerIP(t *testing.T) {
+	node := newNetwork(t, network.Config{ConnManager: network.ConnManagerConfig{MaxInboundPerIP: 2}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var peers []network.P2PNetwork
+	for i := 0; i < 3; i++ {
+		peers = append(peers, newNetwork(t, network.Config{}))
+	}
+	for _, peer := range peers[:2] {
+		_, err := peer.Connect(ctx, node.Self().URL())
+		require.NoError(t, err)
+	}
+	_, err := peers[2].Connect(ctx, node.Self().URL())
+	require.Error(t, err, "Inbound connections beyond the per-address cap should be refused.")
+
+	require.NoError(t, peers[0].Close())
+	require.Eventually(t, func() bool {
+		_, err := peers[2].Connect(ctx, node.Self().URL())
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond, "Closed connections should free their slot.")
+}
@@ -0,0 +1,163 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// DHTProtocol carries qDHT RPCs, one request and response per stream.
+var DHTProtocol = types.Protocol{
+	Name:   "/trustmesh/qdht/1.0.0",
+	ID:     []byte("qdht"),
+	Opcode: 0x03,
+}
+
+// BlockProtocol transfers content blocks straight from the providers serving
+// them, one block per stream. It runs apart from DHTProtocol so that blocks
+// are held to their own size limits rather than those of RPCs.
+var BlockProtocol = types.Protocol{
+	Name:   "/trustmesh/block/1.0.0",
+	ID:     []byte("block"),
+	Opcode: 0x05,
+}
+
+const (
+	// MaxBlockSize bounds the blocks BlockProtocol transfers.
+	MaxBlockSize = 1 << 20
+	// maxBlockRequest bounds the frame naming the requested block.
+	maxBlockRequest = 256
+	// maxBlockResponse bounds the frame carrying a block, which JSON
+	// encodes in base64.
+	maxBlockResponse = (MaxBlockSize+2)/3*4 + 256
+)
+
+var (
+	ErrSenderMismatch = errors.New("message sender is not the stream's peer")
+	ErrBlockTooLarge  = errors.New("block exceeds maximum size")
+	ErrBlockNotServed = errors.New("provider did not serve the block")
+)
+
+func init() {
+	for _, p := range []types.Protocol{DHTProtocol, BlockProtocol} {
+		if err := RegisterProtocol(p); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ServeDHT returns a handler answering qDHT RPCs with h. Requests must come
+// from the node the stream was authenticated as.
+func ServeDHT(h qdht.Handler) StreamHandler {
+	return func(ctx context.Context, rw io.ReadWriteCloser) error {
+		var msg qdht.Message
+		if err := ReadMessage(rw, &msg); err != nil {
+			return err
+		}
+		if p := PeerFromContext(ctx); p != nil && (msg.Sender == nil || msg.Sender.ID != p.ID) {
+			WriteMessage(rw, &qdht.Message{Type: msg.Type, Error: ErrSenderMismatch.Error()})
+			return ErrSenderMismatch
+		}
+		resp, err := h.HandleMessage(ctx, &msg)
+		if err != nil {
+			resp = &qdht.Message{Type: msg.Type, Error: err.Error()}
+		}
+		return WriteMessage(rw, resp)
+	}
+}
+
+// DHTMessenger delivers qDHT RPCs over DHTProtocol streams of a network.
+type DHTMessenger struct {
+	Network P2PNetwork
+}
+
+var (
+	_ qdht.Messenger      = DHTMessenger{}
+	_ qdht.BlockTransport = DHTMessenger{}
+)
+
+var _ qdht.Protector = (*ConnManager)(nil)
+
+func (m DHTMessenger) Send(ctx context.Context, to *types.Node, msg *qdht.Message) (*qdht.Message, error) {
+	s, err := m.Network.NewStream(ctx, to, DHTProtocol.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	defer applyDeadline(ctx, s)()
+
+	if err := WriteMessage(s, msg); err != nil {
+		return nil, err
+	}
+	var resp qdht.Message
+	if err := ReadMessage(s, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// BlockSource serves content blocks. qdht.DHT implements it.
+type BlockSource interface {
+	Block(c qdht.CID) ([]byte, error)
+}
+
+var _ BlockSource = (*qdht.DHT)(nil)
+
+// blockRequest names the block a stream asks for.
+type blockRequest struct {
+	CID string `json:"cid"`
+}
+
+// blockResponse carries the block or why it was not served.
+type blockResponse struct {
+	Block []byte `json:"block,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ServeBlocks returns a handler answering BlockProtocol requests from src.
+func ServeBlocks(src BlockSource) StreamHandler {
+	return func(ctx context.Context, rw io.ReadWriteCloser) error {
+		var req blockRequest
+		if err := readMessageLimit(rw, &req, maxBlockRequest); err != nil {
+			return err
+		}
+		c, err := qdht.ParseCID(req.CID)
+		if err != nil {
+			WriteMessage(rw, &blockResponse{Error: err.Error()})
+			return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+		block, err := src.Block(c)
+		if err == nil && len(block) > MaxBlockSize {
+			err = ErrBlockTooLarge
+		}
+		if err != nil {
+			return WriteMessage(rw, &blockResponse{Error: err.Error()})
+		}
+		return WriteMessage(rw, &blockResponse{Block: block})
+	}
+}
+
+// FetchBlock asks provider for the block c over a BlockProtocol stream.
+func (m DHTMessenger) FetchBlock(ctx context.Context, provider *types.Node, c qdht.CID) ([]byte, error) {
+	s, err := m.Network.NewStream(ctx, provider, BlockProtocol.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	defer applyDeadline(ctx, s)()
+
+	if err := WriteMessage(s, &blockRequest{CID: c.String()}); err != nil {
+		return nil, err
+	}
+	var resp blockResponse
+	if err := readMessageLimit(s, &resp, maxBlockResponse); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotServed, resp.Error)
+	}
+	return resp.Block, nil
+}
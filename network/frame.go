@@ -0,0 +1,74 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+)
+
+// MaxFrameSize bounds a single length-prefixed message.
+const MaxFrameSize = 4 << 20
+
+var (
+	ErrFrameTooLarge    = errors.New("frame exceeds maximum size")
+	ErrMalformedMessage = errors.New("failed to decode message")
+)
+
+// WriteMessage JSON encodes v and writes it with a 4 byte length prefix.
+func WriteMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage reads one length-prefixed frame and decodes it into v. Frames
+// read from inbound streams are charged to their peer's and protocol's rate
+// limits, and to their resource budgets while they are decoded.
+func ReadMessage(r io.Reader, v interface{}) error {
+	return readMessageLimit(r, v, MaxFrameSize)
+}
+
+// readMessageLimit is ReadMessage refusing frames larger than limit.
+func readMessageLimit(r io.Reader, v interface{}, limit uint32) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > limit {
+		return ErrFrameTooLarge
+	}
+	if c, ok := r.(messageCharger); ok {
+		if err := c.chargeMessage(); err != nil {
+			return err
+		}
+	}
+	if m, ok := r.(memoryReserver); ok {
+		release, err := m.reserveMemory(int64(size))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	return nil
+}
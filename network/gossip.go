@@ -0,0 +1,17 @@
+package network
+
+import "trustmesh/types"
+
+// GossipProtocol disseminates messages between peers. Package pubsub serves
+// it, carrying topic-based publish/subscribe.
+var GossipProtocol = types.Protocol{
+	Name:   "/trustmesh/gossip/1.0.0",
+	ID:     []byte("gossip"),
+	Opcode: 0x04,
+}
+
+func init() {
+	if err := RegisterProtocol(GossipProtocol); err != nil {
+		panic(err)
+	}
+}
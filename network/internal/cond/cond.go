@@ -0,0 +1,46 @@
+// Package cond holds the wakeup channels the stream transports block on.
+// A channel of capacity one is signalled whenever a blocked call may be able
+// to make progress, and the call re-checks its state after every wakeup.
+package cond
+
+import "time"
+
+// ErrTimeout is returned when a deadline passes. It satisfies net.Error so
+// callers can tell timeouts apart.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Notify signals ch without blocking. A signal already pending covers this
+// one.
+func Notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until ch is signalled or deadline passes. A zero deadline
+// never passes.
+func Wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	until := time.Until(deadline)
+	if until <= 0 {
+		return ErrTimeout
+	}
+	timer := time.NewTimer(until)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,51 @@
+// Package lossy wraps packet sockets to lose datagrams, so that tests can
+// exercise the transports' recovery from loss reproducibly.
+package lossy
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+)
+
+// PacketConn drops each datagram written to it with a fixed probability,
+// drawn from a seeded source.
+type PacketConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	rng  *rand.Rand
+	loss float64
+}
+
+// New wraps pc to drop written datagrams with probability loss.
+func New(pc net.PacketConn, loss float64, seed int64) *PacketConn {
+	return &PacketConn{PacketConn: pc, rng: rand.New(rand.NewSource(seed)), loss: loss}
+}
+
+// WriteTo reports a dropped datagram as written, as the network would.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	lost := c.rng.Float64() < c.loss
+	c.mu.Unlock()
+	if lost {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Listen returns a function opening UDP sockets that drop written datagrams
+// with probability loss, each seeded in turn from seed.
+func Listen(loss float64, seed int64) func(addr string) (net.PacketConn, error) {
+	var mu sync.Mutex
+	return func(addr string) (net.PacketConn, error) {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seed++
+		return New(pc, loss, seed), nil
+	}
+}
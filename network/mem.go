@@ -0,0 +1,501 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnRefused     = errors.New("connection refused")
+	ErrHostUnreachable = errors.New("host unreachable")
+	ErrAddrInUse       = errors.New("address already in use")
+)
+
+// minRetransmit is the least a lost write is delayed by on a MemNetwork.
+const minRetransmit = 10 * time.Millisecond
+
+// Link describes a simulated path between two hosts.
+type Link struct {
+	// Latency is the one-way delay.
+	Latency time.Duration
+	// Bandwidth caps throughput in bytes per second; zero is unlimited.
+	Bandwidth int64
+	// Loss is the probability a write is lost. Connections are reliable, so
+	// a lost write arrives late, as if retransmitted after a timeout of
+	// three latencies, but at least 10ms.
+	Loss float64
+}
+
+// transmit returns when n bytes written at start arrive, and when the link
+// is next free to send.
+func (l Link) transmit(start time.Time, n int, lost bool) (arrive, free time.Time) {
+	free = start
+	if l.Bandwidth > 0 {
+		free = start.Add(time.Duration(int64(n) * int64(time.Second) / l.Bandwidth))
+	}
+	arrive = free.Add(l.Latency)
+	if lost {
+		arrive = arrive.Add(max(3*l.Latency, minRetransmit))
+	}
+	return arrive, free
+}
+
+// Transmission is what a MemNetwork decided for one write: whether it was
+// lost, and how long the link takes to deliver it, before any wait for
+// earlier writes on the same connection.
+type Transmission struct {
+	From, To string
+	Bytes    int
+	Lost     bool
+	Delay    time.Duration
+}
+
+// MemNetwork is an in-process network of named hosts joined by simulated
+// links, for tests that need many nodes. Loss is drawn from a seeded source
+// so runs repeat.
+type MemNetwork struct {
+	mu        sync.Mutex
+	rng       *rand.Rand
+	trace     func(Transmission)
+	link      Link
+	links     map[[2]string]Link
+	groups    map[string]int
+	listeners map[string]*memListener
+	ports     map[string]int
+	conns     map[*memConn]struct{}
+}
+
+// NewMemNetwork creates a network whose links default to link.
+func NewMemNetwork(link Link, seed int64) *MemNetwork {
+	return &MemNetwork{
+		rng:       rand.New(rand.NewSource(seed)),
+		link:      link,
+		links:     make(map[[2]string]Link),
+		groups:    make(map[string]int),
+		listeners: make(map[string]*memListener),
+		ports:     make(map[string]int),
+		conns:     make(map[*memConn]struct{}),
+	}
+}
+
+// SetLink overrides the link between hosts a and b, both ways.
+func (m *MemNetwork) SetLink(a, b string, l Link) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.links[[2]string{a, b}] = l
+	m.links[[2]string{b, a}] = l
+}
+
+// Partition splits the network so that hosts only reach hosts in their own
+// group. Nodes left out of every group form one more group. Connections
+// across groups break.
+func (m *MemNetwork) Partition(groups ...[]string) {
+	m.mu.Lock()
+	m.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			m.groups[host] = i + 1
+		}
+	}
+	var broken []*memConn
+	for c := range m.conns {
+		if m.groups[c.local.host] != m.groups[c.remote.host] {
+			broken = append(broken, c)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, c := range broken {
+		c.fail(ErrHostUnreachable)
+	}
+}
+
+// Trace calls fn with every write's transmission as the network decides it.
+// Given the same seed and writes, the transmissions repeat exactly, however
+// the scheduler runs the test. fn runs on the writing goroutine and must not
+// write to the network itself.
+func (m *MemNetwork) Trace(fn func(Transmission)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trace = fn
+}
+
+// Heal removes any partition.
+func (m *MemNetwork) Heal() {
+	m.Partition()
+}
+
+// Host returns the transport of the named host. Its protocol is "mem".
+func (m *MemNetwork) Host(name string) *MemTransport {
+	return &MemTransport{net: m, host: name}
+}
+
+// linkLocked returns the link from a to b.
+func (m *MemNetwork) linkLocked(a, b string) Link {
+	if l, ok := m.links[[2]string{a, b}]; ok {
+		return l
+	}
+	return m.link
+}
+
+// portLocked assigns the next free port on host.
+func (m *MemNetwork) portLocked(host string) string {
+	for {
+		m.ports[host]++
+		port := strconv.Itoa(m.ports[host])
+		if _, ok := m.listeners[net.JoinHostPort(host, port)]; !ok {
+			return port
+		}
+	}
+}
+
+// MemTransport is one host's view of a MemNetwork.
+type MemTransport struct {
+	net  *MemNetwork
+	host string
+}
+
+var _ Transport = (*MemTransport)(nil)
+
+// Listen listens on addr. The host part is ignored, as every listener is on
+// the transport's host; port 0 picks a free port.
+func (t *MemTransport) Listen(addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	m := t.net
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if port == "0" || port == "" {
+		port = m.portLocked(t.host)
+	}
+	a := memAddr{host: t.host, port: port}
+	if _, ok := m.listeners[a.String()]; ok {
+		return nil, ErrAddrInUse
+	}
+	l := &memListener{net: m, addr: a, accept: make(chan net.Conn, 64), done: make(chan struct{})}
+	m.listeners[a.String()] = l
+	return l, nil
+}
+
+// Dial connects to the listener at addr after a simulated round trip.
+func (t *MemTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	m := t.net
+	m.mu.Lock()
+	l := m.listeners[addr]
+	reachable := m.groups[t.host] == m.groups[host]
+	rtt := m.linkLocked(t.host, host).Latency * 2
+	local := memAddr{host: t.host, port: m.portLocked(t.host)}
+	m.mu.Unlock()
+
+	if !reachable {
+		return nil, ErrHostUnreachable
+	}
+	timer := time.NewTimer(rtt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if l == nil {
+		return nil, ErrConnRefused
+	}
+
+	client, server := m.pipe(local, l.addr)
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	client.Close()
+	server.Close()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, ErrConnRefused
+}
+
+func (t *MemTransport) Protocols() []string {
+	return []string{"mem"}
+}
+
+type memAddr struct {
+	host, port string
+}
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return net.JoinHostPort(a.host, a.port) }
+
+type memListener struct {
+	net    *MemNetwork
+	addr   memAddr
+	accept chan net.Conn
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.net.mu.Lock()
+		delete(l.net.listeners, l.addr.String())
+		l.net.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipe connects two conns through simulated links.
+func (m *MemNetwork) pipe(a, b memAddr) (*memConn, *memConn) {
+	ab, ba := newMemHalf(), newMemHalf()
+	ca := &memConn{net: m, local: a, remote: b, in: ba, out: ab}
+	cb := &memConn{net: m, local: b, remote: a, in: ab, out: ba}
+	ca.peer, cb.peer = cb, ca
+	m.mu.Lock()
+	m.conns[ca] = struct{}{}
+	m.conns[cb] = struct{}{}
+	m.mu.Unlock()
+	return ca, cb
+}
+
+// chunk is a write in flight.
+type chunk struct {
+	data   []byte
+	arrive time.Time
+}
+
+// memHalf carries one direction of a connection.
+type memHalf struct {
+	mu    sync.Mutex
+	queue []chunk
+	// free is when the link is next free to send.
+	free time.Time
+	// eof is set when the writer closes, and readerGone when the reader
+	// does.
+	eof, readerGone bool
+	err             error
+	signal          chan struct{}
+}
+
+func newMemHalf() *memHalf {
+	return &memHalf{signal: make(chan struct{}, 1)}
+}
+
+func (h *memHalf) notify() {
+	select {
+	case h.signal <- struct{}{}:
+	default:
+	}
+}
+
+// memConn is one end of a connection on a MemNetwork.
+type memConn struct {
+	net           *MemNetwork
+	local, remote memAddr
+	in, out       *memHalf
+	peer          *memConn
+
+	mu                          sync.Mutex
+	closed                      bool
+	readDeadline, writeDeadline time.Time
+}
+
+var _ net.Conn = (*memConn)(nil)
+
+func (c *memConn) Read(p []byte) (int, error) {
+	h := c.in
+	for {
+		c.mu.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+
+		h.mu.Lock()
+		if h.err != nil {
+			err := h.err
+			h.mu.Unlock()
+			return 0, err
+		}
+		var wake time.Duration
+		if len(h.queue) > 0 {
+			head := &h.queue[0]
+			if wake = time.Until(head.arrive); wake <= 0 {
+				n := copy(p, head.data)
+				if head.data = head.data[n:]; len(head.data) == 0 {
+					h.queue = h.queue[1:]
+				}
+				h.mu.Unlock()
+				return n, nil
+			}
+		} else if h.eof {
+			h.mu.Unlock()
+			return 0, io.EOF
+		}
+		h.mu.Unlock()
+
+		if !deadline.IsZero() {
+			until := time.Until(deadline)
+			if until <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			if wake == 0 || until < wake {
+				wake = until
+			}
+		}
+		if wake == 0 {
+			<-h.signal
+			continue
+		}
+		timer := time.NewTimer(wake)
+		select {
+		case <-h.signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Write queues p for delivery after the link's delays. It does not block:
+// bandwidth shows up as latency.
+func (c *memConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	m := c.net
+	m.mu.Lock()
+	link := m.linkLocked(c.local.host, c.remote.host)
+	lost := link.Loss > 0 && m.rng.Float64() < link.Loss
+	trace := m.trace
+	m.mu.Unlock()
+
+	h := c.out
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return 0, h.err
+	}
+	if h.readerGone {
+		return 0, io.ErrClosedPipe
+	}
+	start := time.Now()
+	if start.Before(h.free) {
+		start = h.free
+	}
+	arrive, free := link.transmit(start, len(p), lost)
+	h.free = free
+	if trace != nil {
+		trace(Transmission{From: c.local.host, To: c.remote.host, Bytes: len(p), Lost: lost, Delay: arrive.Sub(start)})
+	}
+	// A stream keeps its order however writes are delayed.
+	if n := len(h.queue); n > 0 && arrive.Before(h.queue[n-1].arrive) {
+		arrive = h.queue[n-1].arrive
+	}
+	h.queue = append(h.queue, chunk{data: append([]byte(nil), p...), arrive: arrive})
+	h.notify()
+	return len(p), nil
+}
+
+// Close closes the connection. The peer reads what was already written and
+// then io.EOF.
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.out.mu.Lock()
+	c.out.eof = true
+	c.out.mu.Unlock()
+	c.out.notify()
+	c.in.mu.Lock()
+	c.in.readerGone = true
+	c.in.queue = nil
+	c.in.mu.Unlock()
+	c.in.notify()
+
+	c.net.mu.Lock()
+	delete(c.net.conns, c)
+	c.net.mu.Unlock()
+	return nil
+}
+
+// fail breaks both ends of the connection with err.
+func (c *memConn) fail(err error) {
+	for _, h := range []*memHalf{c.in, c.out} {
+		h.mu.Lock()
+		if h.err == nil {
+			h.err = err
+		}
+		h.queue = nil
+		h.mu.Unlock()
+		h.notify()
+	}
+	c.net.mu.Lock()
+	delete(c.net.conns, c)
+	delete(c.net.conns, c.peer)
+	c.net.mu.Unlock()
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.in.notify()
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
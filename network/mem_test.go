@@ -0,0 +1,161 @@
+package network_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"testing"
+	"time"
+	"trustmesh/network"
+)
+
+// memPair dials b from a over hub and returns both ends.
+func memPair(t *testing.T, hub *network.MemNetwork) (client, server io.ReadWriteCloser) {
+	t.Helper()
+	l, err := hub.Host("b").Listen(":0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	client, err = hub.Host("a").Dial(context.Background(), l.Addr().String())
+	require.NoError(t, err)
+	server, err = l.Accept()
+	require.NoError(t, err)
+	return client, server
+}
+
+func TestMemTransportLinks(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{Latency: 30 * time.Millisecond, Bandwidth: 1 << 20}, 1)
+	client, server := memPair(t, hub)
+
+	start := time.Now()
+	_, err := client.Write(make([]byte, 100<<10))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	got, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Len(t, got, 100<<10)
+	require.GreaterOrEqual(t, time.Since(start), 120*time.Millisecond,
+		"Delivery should take the latency plus the time to send at the link's bandwidth.")
+
+	_, err = server.Write([]byte("x"))
+	require.ErrorIs(t, err, io.ErrClosedPipe, "Writing to a closed peer should fail.")
+}
+
+func TestMemTransportLossIsReproducible(t *testing.T) {
+	link := network.Link{Latency: time.Millisecond, Loss: 0.5}
+	transmissions := func(seed int64) []network.Transmission {
+		hub := network.NewMemNetwork(link, seed)
+		var out []network.Transmission
+		hub.Trace(func(tx network.Transmission) { out = append(out, tx) })
+		client, server := memPair(t, hub)
+		buf := make([]byte, 1)
+		for i := 0; i < 20; i++ {
+			client.Write([]byte{byte(i)})
+			_, err := io.ReadFull(server, buf)
+			require.NoError(t, err)
+			require.Equal(t, byte(i), buf[0], "Lost writes should still arrive, in order.")
+		}
+		return out
+	}
+	first := transmissions(7)
+	require.Len(t, first, 20)
+	require.Equal(t, first, transmissions(7), "The same seed should lose the same writes.")
+
+	var lost, sent int
+	for _, tx := range first {
+		if tx.Lost {
+			lost++
+			require.Equal(t, link.Latency+10*time.Millisecond, tx.Delay, "Lost writes should arrive after a retransmission.")
+		} else {
+			sent++
+			require.Equal(t, link.Latency, tx.Delay)
+		}
+	}
+	require.Positive(t, lost, "Some writes should be lost and resent.")
+	require.Positive(t, sent, "Some writes should get through at once.")
+}
+
+func TestMemTransportPartition(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	memNode := func(host string) network.P2PNetwork {
+		return newNetwork(t, network.Config{
+			ListenAddr: "mem://:0",
+			Transports: []network.Transport{hub.Host(host)},
+		})
+	}
+	a, b := memNode("a"), memNode("b")
+	require.Equal(t, "mem://b:1", b.Self().URL())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.Ping(ctx, b.Self())
+	require.NoError(t, err)
+
+	hub.Partition([]string{"a"}, []string{"b"})
+	require.Eventually(t, func() bool { return len(a.Nodes()) == 0 }, time.Second, 10*time.Millisecond,
+		"A partition should break connections across it.")
+	_, err = a.Connect(ctx, b.Self().URL())
+	require.ErrorIs(t, err, network.ErrHostUnreachable)
+
+	hub.Heal()
+	_, err = a.Ping(ctx, b.Self())
+	require.NoError(t, err, "Healing should let nodes reconnect.")
+}
+
+// TestMemTransportThousandEchoHosts checks the transport carries a thousand
+// hosts at once. It runs plain echo servers: keying a thousand full nodes
+// takes far longer than a unit test should.
+func TestMemTransportThousandEchoHosts(t *testing.T) {
+	const size = 1000
+	hub := network.NewMemNetwork(network.Link{Latency: time.Millisecond, Loss: 0.01}, 1)
+	addrs := make([]string, size)
+	for i := range addrs {
+		l, err := hub.Host(fmt.Sprintf("n%d", i)).Listen(":0")
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		addrs[i] = l.Addr().String()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*size)
+	for i := range addrs {
+		// Every host talks to its neighbour and to one far across the mesh.
+		for _, j := range []int{(i + 1) % size, (i * 7) % size} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := hub.Host(fmt.Sprintf("n%d", i)).Dial(ctx, addrs[j])
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer c.Close()
+				msg := []byte(addrs[j])
+				c.Write(msg)
+				got := make([]byte, len(msg))
+				if _, err := io.ReadFull(c, got); err != nil || string(got) != addrs[j] {
+					errs <- fmt.Errorf("echo from %s: %q, %v", addrs[j], got, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
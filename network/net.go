@@ -1,40 +1,774 @@
 package network
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"io"
+	"net"
+	"sync"
 	"time"
+	"trustmesh/common"
+	"trustmesh/crypto"
+	"trustmesh/network/smux"
+	"trustmesh/qdht"
+	"trustmesh/trust"
 	"trustmesh/types"
 )
 
+const (
+	// DefaultVersion is the protocol version nodes announce in handshakes.
+	DefaultVersion = "trustmesh/1.0.0"
+	// DefaultListenAddr listens on an ephemeral port on every interface.
+	DefaultListenAddr = ":0"
+	// DefaultHandshakeTimeout bounds connection setup.
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultBootAttempts is how many times Start dials each boot node.
+	DefaultBootAttempts = 5
+)
+
+var (
+	ErrNetworkClosed    = errors.New("network is closed")
+	ErrSelfConnection   = errors.New("connection leads back to the local node")
+	ErrUnexpectedPeer   = errors.New("peer answered with an unexpected node id")
+	ErrInvalidHello     = errors.New("invalid handshake")
+	ErrPeerDisconnected = errors.New("peer disconnected")
+	ErrPeerBanned       = errors.New("peer is banned")
+)
+
+// Scorer tracks how peers behave. The network refuses connections from
+// banned peers, drops them when they become banned and reports the ping
+// round trips, protocol violations and exceeded limits it sees.
+// trust.Engine implements it.
+type Scorer interface {
+	Banned(id types.NodeID) bool
+	Record(id types.NodeID, ev trust.Event)
+	ObserveLatency(id types.NodeID, rtt time.Duration)
+}
+
+var _ Scorer = (*trust.Engine)(nil)
+
+// Config configures a network node.
+type Config struct {
+	// ListenAddr is the address the node accepts connections on. A udp://
+	// or tcp:// scheme picks the transport; plain host:port is TCP.
+	ListenAddr string
+	// Transports carry connections, chosen by address scheme. They default
+	// to TCP and UDP.
+	Transports []Transport
+	// Key proves the node's identity. A fresh key is generated when unset.
+	Key *crypto.SigningKey
+	// KEMKey establishes the keys connections are encrypted with. A fresh
+	// key is generated when unset.
+	KEMKey *crypto.KEMKey
+	// BootNodes are the nodes Start connects to.
+	BootNodes []*types.Node
+	// BootAttempts is how many times Start dials each boot node.
+	BootAttempts int
+	// BootBackoff spaces out the dials to a boot node. The zero value uses
+	// common.DefaultBackoff.
+	BootBackoff common.Backoff
+	// Version is announced in handshakes.
+	Version string
+	// HandshakeTimeout bounds connection setup.
+	HandshakeTimeout time.Duration
+	// Mux tunes the stream multiplexer on peer connections.
+	Mux smux.Config
+	// Scorer, when set, keeps banned peers out and is told of their
+	// misbehaviour.
+	Scorer Scorer
+	// ConnManager bounds the connections the node keeps.
+	ConnManager ConnManagerConfig
+	// Resources rate limits and budgets the streams peers open.
+	Resources ResourceConfig
+	// Now overrides the local clock, mainly for tests.
+	Now func() time.Time
+}
+
+// P2PNetwork is a running TrustMesh node.
 type P2PNetwork interface {
+	types.TrustMesh
+
+	// Self returns the local node as peers see it.
+	Self() *types.Node
+
+	// Start connects to the boot nodes. ctx bounds the dials.
+	Start(ctx context.Context) error
+
+	// Ready is closed once Start has connected to a boot node.
+	Ready() <-chan struct{}
+
+	// FailedBootNodes returns the boot nodes the last Start could not reach.
+	FailedBootNodes() []*types.Node
+
+	// Connect dials addr, a host:port or a tcp:// or udp:// URL, and
+	// returns the node that answered.
+	Connect(ctx context.Context, addr string) (*types.Node, error)
+
+	// Handle registers h for inbound streams of the protocol path. It
+	// panics on a bad or duplicate path.
+	Handle(path string, h func(ctx context.Context, rw io.ReadWriteCloser) error)
+
+	// NewStream opens a stream to node for the first of protocols node
+	// supports.
+	NewStream(ctx context.Context, node *types.Node, protocols ...string) (*Stream, error)
+
+	// Ping measures the round trip to node over PingProtocol.
+	Ping(ctx context.Context, node *types.Node) (time.Duration, error)
+
+	// Challenge asks node over ChallengeProtocol to prove again that it is
+	// live and holds the key behind its node ID, and returns its verified
+	// answer.
+	Challenge(ctx context.Context, node *types.Node) (*ChallengeResponse, error)
+
+	// ConnManager returns the manager deciding which connections to keep.
+	ConnManager() *ConnManager
+
+	// ResourceManager returns the manager limiting what peers' streams use.
+	ResourceManager() *ResourceManager
+
+	// Close stops accepting connections and drops every peer.
+	Close() error
+}
+
+type p2pNetwork struct {
+	self         *types.Node
+	kem          *crypto.KEMKey
+	version      string
+	boot         []*types.Node
+	bootAttempts int
+	bootBackoff  common.Backoff
+	timeout      time.Duration
+	transports   []Transport
+	listener     net.Listener
+	peers        *peerstore
+	clock        *Clock
+	challenges   *ChallengeService
+	router       *Router
+	mux          smux.Config
+	scorer       Scorer
+	conns        *ConnManager
+	resources    *ResourceManager
+	now          func() time.Time
+	started      time.Time
+
+	bootMu     sync.Mutex
+	bootFailed []*types.Node
+	ready      chan struct{}
+	readyOnce  sync.Once
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ P2PNetwork = (*p2pNetwork)(nil)
+
+// NewNetwork starts a node listening on cfg.ListenAddr. Call Start to join
+// the network through the boot nodes.
+func NewNetwork(cfg Config) (P2PNetwork, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	}
+	if cfg.Version == "" {
+		cfg.Version = DefaultVersion
+	}
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.BootAttempts <= 0 {
+		cfg.BootAttempts = DefaultBootAttempts
+	}
+	if cfg.BootBackoff == (common.Backoff{}) {
+		cfg.BootBackoff = common.DefaultBackoff()
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if cfg.ConnManager.TrimInterval <= 0 {
+		cfg.ConnManager.TrimInterval = DefaultTrimInterval
+	}
+	if len(cfg.Transports) == 0 {
+		cfg.Transports = []Transport{TCPTransport{}, UDPTransport{}}
+	}
+	if cfg.Key == nil {
+		key, err := crypto.NewSigningKey()
+		if err != nil {
+			return nil, fmt.Errorf("network config: %v", err)
+		}
+		cfg.Key = key
+	}
+	if cfg.KEMKey == nil {
+		kem, err := crypto.NewKEMKey()
+		if err != nil {
+			return nil, fmt.Errorf("network config: %v", err)
+		}
+		cfg.KEMKey = kem
+	}
+
+	scheme, hostport := splitAddr(cfg.ListenAddr)
+	t, err := transportFor(cfg.Transports, scheme)
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.Listen(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+
+	n := &p2pNetwork{
+		self: &types.Node{
+			ID:        types.NewNodeID(cfg.Key.PublicKeyBytes()),
+			PeerInfo:  &types.Peer{Keys: [][]byte{cfg.Key.PublicKeyBytes(), cfg.KEMKey.PublicKeyBytes()}},
+			Host:      host,
+			Port:      port,
+			Transport: scheme,
+		},
+		kem:          cfg.KEMKey,
+		version:      cfg.Version,
+		boot:         cfg.BootNodes,
+		bootAttempts: cfg.BootAttempts,
+		bootBackoff:  cfg.BootBackoff,
+		timeout:      cfg.HandshakeTimeout,
+		transports:   cfg.Transports,
+		listener:     l,
+		peers:        newPeerstore(),
+		clock:        NewClock(cfg.Now),
+		challenges:   NewChallengeService(common.NewMemoryNonceStore(common.DefaultNonceStoreConfig()), cfg.Key),
+		router:       NewRouter(),
+		mux:          cfg.Mux,
+		scorer:       cfg.Scorer,
+		conns:        newConnManager(cfg.ConnManager),
+		resources:    newResourceManager(cfg.Resources, cfg.Mux.StreamWindow, cfg.Now),
+		now:          cfg.Now,
+		started:      cfg.Now(),
+		ready:        make(chan struct{}),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.router.Handle(PingProtocol.Name, ServePing)
+	n.router.Handle(ChallengeProtocol.Name, n.serveChallenge)
+
+	n.wg.Add(2)
+	go n.acceptLoop()
+	go n.trimLoop(cfg.ConnManager.TrimInterval)
+	return n, nil
+}
+
+func (n *p2pNetwork) Network() types.Network {
+	nw := types.Network{Self: n.self, Version: n.version}
+	switch addr := n.listener.Addr().(type) {
+	case *net.TCPAddr:
+		nw.Addr = *addr
+	case *net.UDPAddr:
+		nw.Addr = net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+	return nw
+}
+
+// Nodes returns the connected peers keyed by their hex node ID.
+func (n *p2pNetwork) Nodes() map[string]*types.Node {
+	return n.peers.nodes()
+}
+
+func (n *p2pNetwork) BootNodes() []*types.Node {
+	return append([]*types.Node(nil), n.boot...)
+}
+
+// UTCTime returns the network time agreed with connected peers.
+func (n *p2pNetwork) UTCTime() time.Time {
+	return n.clock.Now()
+}
+
+// UpTime returns how long the node has been running.
+func (n *p2pNetwork) UpTime() time.Duration {
+	return n.now().Sub(n.started)
+}
+
+func (n *p2pNetwork) Self() *types.Node {
+	return n.self
+}
+
+// Start dials every boot node concurrently, retrying each with exponential
+// backoff, and fails only when none answers. Ready is closed once it
+// succeeds.
+func (n *p2pNetwork) Start(ctx context.Context) error {
+	if n.ctx.Err() != nil {
+		return ErrNetworkClosed
+	}
+	failed, err := qdht.DialBootNodes(ctx, n.boot, n.bootAttempts, n.bootBackoff, func(ctx context.Context, b *types.Node) error {
+		node, err := n.Connect(ctx, b.URL())
+		if err == nil && b.ID != (types.NodeID{}) && node.ID != b.ID {
+			err = ErrUnexpectedPeer
+		}
+		return err
+	})
+	n.bootMu.Lock()
+	n.bootFailed = failed
+	n.bootMu.Unlock()
+	if err != nil {
+		return err
+	}
+	n.readyOnce.Do(func() { close(n.ready) })
+	return nil
 }
 
-type p2pNetwork struct{}
+func (n *p2pNetwork) Ready() <-chan struct{} {
+	return n.ready
+}
+
+func (n *p2pNetwork) FailedBootNodes() []*types.Node {
+	n.bootMu.Lock()
+	defer n.bootMu.Unlock()
+	return append([]*types.Node(nil), n.bootFailed...)
+}
+
+func (n *p2pNetwork) Connect(ctx context.Context, addr string) (*types.Node, error) {
+	if n.ctx.Err() != nil {
+		return nil, ErrNetworkClosed
+	}
+	conn, node, err := n.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	n.attach(conn, node, true)
+	return node, nil
+}
+
+func (n *p2pNetwork) Handle(path string, h func(ctx context.Context, rw io.ReadWriteCloser) error) {
+	n.router.Handle(path, h)
+}
+
+// Stream is an outbound protocol stream to a peer.
+type Stream struct {
+	net.Conn
+	// Protocol is the path the peer chose to serve the stream.
+	Protocol string
+	// Peer is the node at the other end.
+	Peer *types.Node
+
+	transcript []byte
+}
+
+// NewStream opens a stream on the connection to node, connecting first if
+// there is none, and negotiates the protocol.
+func (n *p2pNetwork) NewStream(ctx context.Context, node *types.Node, protocols ...string) (*Stream, error) {
+	if n.ctx.Err() != nil {
+		return nil, ErrNetworkClosed
+	}
+	p := n.peers.get(node.ID)
+	if p == nil {
+		remote, err := n.Connect(ctx, node.URL())
+		if err != nil {
+			return nil, err
+		}
+		if remote.ID != node.ID {
+			return nil, ErrUnexpectedPeer
+		}
+		if p = n.peers.get(node.ID); p == nil {
+			return nil, ErrPeerDisconnected
+		}
+	}
+	st, err := p.session.Open()
+	if err != nil {
+		return nil, err
+	}
+	path, err := Select(ctx, st, protocols...)
+	if err != nil {
+		st.Reset()
+		return nil, err
+	}
+	return &Stream{Conn: st, Protocol: path, Peer: p.node, transcript: p.transcript}, nil
+}
 
-func (p p2pNetwork) Network() types.Network {
-	//TODO implement me
-	panic("implement me")
+func (n *p2pNetwork) ConnManager() *ConnManager {
+	return n.conns
 }
 
-func (p p2pNetwork) Nodes() map[string]*types.Node {
-	//TODO implement me
-	panic("implement me")
+func (n *p2pNetwork) ResourceManager() *ResourceManager {
+	return n.resources
 }
 
-func (p p2pNetwork) BootNodes() []*types.Node {
-	//TODO implement me
-	panic("implement me")
+func (n *p2pNetwork) Ping(ctx context.Context, node *types.Node) (time.Duration, error) {
+	s, err := n.NewStream(ctx, node, PingProtocol.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	rtt, err := Ping(ctx, s)
+	if err == nil && n.scorer != nil {
+		n.scorer.ObserveLatency(node.ID, rtt)
+	}
+	return rtt, err
 }
 
-func (p p2pNetwork) UTCTime() time.Time {
-	//TODO implement me
-	panic("implement me")
+func (n *p2pNetwork) Challenge(ctx context.Context, node *types.Node) (*ChallengeResponse, error) {
+	s, err := n.NewStream(ctx, node, ChallengeProtocol.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	resp, err := n.challenges.challenge(ctx, s, s.Peer.URL(), s.transcript, n.clock.Now)
+	if err != nil {
+		return nil, err
+	}
+	if resp.NodeID != s.Peer.ID {
+		return nil, ErrUnexpectedPeer
+	}
+	return resp, nil
 }
 
-func (p p2pNetwork) UpTime() time.Duration {
-	//TODO implement me
-	panic("implement me")
+// serveChallenge answers challenges asked over streams of a session. The
+// answers are bound to the session's transcript and stamped in network
+// time, which both ends of a session share.
+func (n *p2pNetwork) serveChallenge(ctx context.Context, rw io.ReadWriteCloser) error {
+	transcript, _ := ctx.Value(transcriptKey{}).([]byte)
+	return n.challenges.serve(ctx, rw, transcript, n.clock.Now)
+}
+
+// dial connects to addr over the transport its scheme names and runs the
+// handshake.
+func (n *p2pNetwork) dial(ctx context.Context, addr string) (*secureConn, *types.Node, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+
+	scheme, hostport := splitAddr(addr)
+	t, err := transportFor(n.transports, scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := t.Dial(ctx, hostport)
+	if err != nil {
+		return nil, nil, err
+	}
+	secured, node, err := n.handshake(ctx, conn, true)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return secured, node, nil
+}
+
+func (n *p2pNetwork) Close() error {
+	if n.ctx.Err() != nil {
+		return nil
+	}
+	n.cancel()
+	err := n.listener.Close()
+	for _, p := range n.peers.all() {
+		p.session.Close()
+	}
+	n.wg.Wait()
+	return err
+}
+
+func (n *p2pNetwork) acceptLoop() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		// Inbound connections are capped per address and subnet before
+		// they cost a handshake.
+		admitted, ok := n.conns.admit(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		conn = admitted
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.timeout)
+			secured, node, err := n.handshake(ctx, conn, false)
+			cancel()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			n.attach(secured, node, false)
+		}()
+	}
+}
+
+// attach records a handshaken connection, multiplexes streams over it and
+// serves the ones the peer opens until it closes. The dialing side runs the
+// client end of the session.
+func (n *p2pNetwork) attach(conn *secureConn, node *types.Node, outbound bool) {
+	p := &peer{node: node, conn: conn, transcript: conn.transcript, outbound: outbound, connectedAt: n.now()}
+	if outbound {
+		p.session = smux.Client(conn, n.mux)
+	} else {
+		p.session = smux.Server(conn, n.mux)
+	}
+	if dropped := n.peers.add(p, n.self.ID); dropped != nil {
+		dropped.session.Close()
+	}
+	if n.ctx.Err() != nil {
+		p.session.Close()
+	}
+	n.trimConns()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer n.peers.remove(p)
+		defer p.session.Close()
+
+		ctx := context.WithValue(context.WithValue(n.ctx, peerKey{}, node), transcriptKey{}, p.transcript)
+		for {
+			st, err := p.session.Accept()
+			if err != nil {
+				return
+			}
+			if n.banned(node.ID) {
+				st.Reset()
+				return
+			}
+			scope, err := n.resources.openStream(node.ID)
+			if err != nil {
+				st.Reset()
+				if overLimit(err) {
+					n.penalize(p, trust.LimitExceeded)
+				}
+				continue
+			}
+			n.wg.Add(1)
+			go func() {
+				defer n.wg.Done()
+				err := n.router.serve(ctx, &managedStream{Stream: st, scope: scope}, scope.setProtocol)
+				scope.done()
+				switch {
+				case violation(err):
+					n.penalize(p, trust.ProtocolViolation)
+				case overLimit(err):
+					n.penalize(p, trust.LimitExceeded)
+				}
+			}()
+		}
+	}()
 }
 
-func NewNetwork() types.TrustMesh {
-	return &p2pNetwork{}
+// penalize reports ev against p's node and drops the connection if the
+// node is now banned.
+func (n *p2pNetwork) penalize(p *peer, ev trust.Event) {
+	if n.scorer == nil {
+		return
+	}
+	n.scorer.Record(p.node.ID, ev)
+	if n.scorer.Banned(p.node.ID) {
+		p.session.Close()
+	}
+}
+
+func (n *p2pNetwork) trimLoop(interval time.Duration) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.trimConns()
+		}
+	}
+}
+
+// trimConns closes the connections the connection manager trims, valuing
+// peers by their score too when the scorer rates them.
+func (n *p2pNetwork) trimConns() {
+	var score func(types.NodeID) float64
+	if s, ok := n.scorer.(interface{ Score(types.NodeID) float64 }); ok {
+		score = s.Score
+	}
+	for _, p := range n.conns.trim(n.peers, score, n.now()) {
+		p.session.Close()
+	}
+}
+
+// banned reports whether the scorer bans id.
+func (n *p2pNetwork) banned(id types.NodeID) bool {
+	return n.scorer != nil && n.scorer.Banned(id)
+}
+
+// violation reports whether a stream ended because the peer broke the
+// protocol rather than by failing or going away.
+func violation(err error) bool {
+	return errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrSenderMismatch)
+}
+
+type (
+	peerKey       struct{}
+	transcriptKey struct{}
+)
+
+// PeerFromContext returns the authenticated node at the other end of the
+// stream a handler serves.
+func PeerFromContext(ctx context.Context) *types.Node {
+	node, _ := ctx.Value(peerKey{}).(*types.Node)
+	return node
+}
+
+// hello opens every connection, introducing the node and its clock.
+type hello struct {
+	Node    *types.Node `json:"node"`
+	Version string      `json:"version"`
+	Time    int64       `json:"time"`
+}
+
+// handshake exchanges hellos over conn, and each side then encapsulates a
+// secret to the KEM key in the other's hello and challenges it to prove it
+// holds the key behind its node ID. Challenges are bound to the challenger
+// and to the transcript of both hellos and both ciphertexts, so a peer cannot
+// pass them by relaying them into a session of its own with the node it
+// claims to be, nor swap the keys the session is encrypted with. The
+// dialing side samples the peer's clock from the hello round trip once the
+// peer is authenticated.
+//
+// The returned connection seals everything written after the handshake
+// under keys derived from the transcript and both secrets, one per
+// direction, so an attacker on the path can neither read the session nor
+// inject into it.
+func (n *p2pNetwork) handshake(ctx context.Context, conn net.Conn, dialer bool) (*secureConn, *types.Node, error) {
+	defer applyDeadline(ctx, conn)()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	// Challenge responses are stamped and checked in the listener's time.
+	// The dialer learns it from the hello round trip but only samples it
+	// into the network clock after the challenges, so peers failing them
+	// cannot move the clock.
+	local := hello{Node: n.self, Version: n.version}
+	var remote hello
+	var localRaw, remoteRaw json.RawMessage
+	peerNow := n.now
+	var sent, received time.Time
+	var err error
+	if dialer {
+		sent = n.now()
+		local.Time = sent.UnixNano()
+		if localRaw, err = json.Marshal(&local); err != nil {
+			return nil, nil, err
+		}
+		if err := WriteMessage(conn, localRaw); err != nil {
+			return nil, nil, err
+		}
+		if err := ReadMessage(conn, &remoteRaw); err != nil {
+			return nil, nil, err
+		}
+		received = n.now()
+	} else {
+		if err := ReadMessage(conn, &remoteRaw); err != nil {
+			return nil, nil, err
+		}
+		local.Time = n.now().UnixNano()
+		if localRaw, err = json.Marshal(&local); err != nil {
+			return nil, nil, err
+		}
+		if err := WriteMessage(conn, localRaw); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := json.Unmarshal(remoteRaw, &remote); err != nil {
+		return nil, nil, ErrInvalidHello
+	}
+
+	node := remote.Node
+	if node == nil || node.PeerInfo.SigningKey() == nil || node.PeerInfo.KEMKey() == nil {
+		return nil, nil, ErrInvalidHello
+	}
+	if node.ID == n.self.ID {
+		return nil, nil, ErrSelfConnection
+	}
+	if n.banned(node.ID) {
+		return nil, nil, ErrPeerBanned
+	}
+	if types.NewNodeID(node.PeerInfo.SigningKey()) != node.ID {
+		return nil, nil, ErrChallengeNodeID
+	}
+
+	// Each side encapsulates a secret to the other, the dialer first.
+	secret, ciphertext, err := crypto.Encapsulate(node.PeerInfo.KEMKey())
+	if err != nil {
+		return nil, nil, ErrInvalidHello
+	}
+	var remoteCiphertext []byte
+	if dialer {
+		if err := WriteMessage(conn, ciphertext); err != nil {
+			return nil, nil, err
+		}
+		if err := ReadMessage(conn, &remoteCiphertext); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := ReadMessage(conn, &remoteCiphertext); err != nil {
+			return nil, nil, err
+		}
+		if err := WriteMessage(conn, ciphertext); err != nil {
+			return nil, nil, err
+		}
+	}
+	remoteSecret, err := n.kem.Decapsulate(remoteCiphertext)
+	if err != nil {
+		return nil, nil, ErrInvalidHello
+	}
+
+	var transcript, sealKey, openKey []byte
+	if dialer {
+		transcript = SessionTranscript(localRaw, remoteRaw, ciphertext, remoteCiphertext)
+		sealKey, openKey = sessionKeys(transcript, secret, remoteSecret)
+		offset := clockOffset(sent, time.Unix(0, remote.Time), received)
+		peerNow = func() time.Time { return n.now().Add(offset) }
+	} else {
+		transcript = SessionTranscript(remoteRaw, localRaw, remoteCiphertext, ciphertext)
+		openKey, sealKey = sessionKeys(transcript, remoteSecret, secret)
+	}
+
+	address := conn.RemoteAddr().String()
+	verify := func() error {
+		resp, err := n.challenges.challenge(ctx, conn, address, transcript, peerNow)
+		if err != nil {
+			return err
+		}
+		if resp.NodeID != node.ID {
+			return ErrUnexpectedPeer
+		}
+		return nil
+	}
+	if dialer {
+		if err := verify(); err != nil {
+			return nil, nil, err
+		}
+		if err := n.challenges.serve(ctx, conn, transcript, peerNow); err != nil {
+			return nil, nil, err
+		}
+		n.clock.Observe(node.ID, sent, time.Unix(0, remote.Time), received)
+	} else {
+		if err := n.challenges.serve(ctx, conn, transcript, peerNow); err != nil {
+			return nil, nil, err
+		}
+		if err := verify(); err != nil {
+			return nil, nil, err
+		}
+	}
+	// The peer listens where its hello says, not on the port it dialed
+	// from; take the connection's host when it listens on every interface.
+	if node.Host == "" || net.ParseIP(node.Host).IsUnspecified() {
+		host, _, _ := net.SplitHostPort(address)
+		withHost := *node
+		withHost.Host = host
+		node = &withHost
+	}
+	secured, err := newSecureConn(conn, transcript, sealKey, openKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secured, node, nil
 }
@@ -0,0 +1,277 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"trustmesh/common"
+	"trustmesh/network"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// newNetwork starts a node on the loopback interface, over TCP unless
+// cfg.ListenAddr says otherwise.
+func newNetwork(t *testing.T, cfg network.Config) network.P2PNetwork {
+	t.Helper()
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = "127.0.0.1:0"
+	}
+	n, err := network.NewNetwork(cfg)
+	require.NoError(t, err, "Starting a node should not fail.")
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestNetworkConnectsToBootNodes(t *testing.T) {
+	boot := newNetwork(t, network.Config{})
+	node := newNetwork(t, network.Config{BootNodes: []*types.Node{boot.Self()}})
+
+	require.Equal(t, []*types.Node{boot.Self()}, node.BootNodes())
+	require.Empty(t, node.Nodes(), "No peers should be connected before Start.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, node.Start(ctx))
+	require.Contains(t, node.Nodes(), boot.Self().ID.String())
+	require.Eventually(t, func() bool {
+		_, ok := boot.Nodes()[node.Self().ID.String()]
+		return ok
+	}, 2*time.Second, 10*time.Millisecond, "The boot node should see the new peer.")
+
+	require.NoError(t, node.Close())
+	require.Eventually(t, func() bool {
+		return len(boot.Nodes()) == 0
+	}, 2*time.Second, 10*time.Millisecond, "A closed peer should leave the peerstore.")
+	require.ErrorIs(t, node.Start(ctx), network.ErrNetworkClosed)
+}
+
+func TestNetworkStartFailsWithoutBootNodes(t *testing.T) {
+	gone := newNetwork(t, network.Config{})
+	addr := gone.Self()
+	require.NoError(t, gone.Close())
+
+	node := newNetwork(t, network.Config{
+		BootNodes:    []*types.Node{addr},
+		BootAttempts: 3,
+		BootBackoff:  common.Backoff{Base: 10 * time.Millisecond, Factor: 2},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Error(t, node.Start(ctx), "Start should fail when no boot node answers.")
+	require.Equal(t, []*types.Node{addr}, node.FailedBootNodes())
+	select {
+	case <-node.Ready():
+		t.Fatal("A node that reached no boot node should not be ready.")
+	default:
+	}
+}
+
+func TestNetworkStartSkipsFailedBootNodes(t *testing.T) {
+	gone := newNetwork(t, network.Config{})
+	addr := gone.Self()
+	require.NoError(t, gone.Close())
+	boot := newNetwork(t, network.Config{})
+
+	node := newNetwork(t, network.Config{
+		BootNodes:    []*types.Node{addr, boot.Self()},
+		BootAttempts: 3,
+		BootBackoff:  common.Backoff{Base: 10 * time.Millisecond, Factor: 2},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, node.Start(ctx), "Start should succeed while a boot node answers.")
+	require.Equal(t, []*types.Node{addr}, node.FailedBootNodes())
+	require.Contains(t, node.Nodes(), boot.Self().ID.String())
+	select {
+	case <-node.Ready():
+	default:
+		t.Fatal("The node should be ready once a boot node answers.")
+	}
+}
+
+func TestNetworkTimeFollowsPeers(t *testing.T) {
+	// Further off than the challenge skew, but within MaxClockOffset.
+	skew := 2 * time.Minute
+	ahead := newNetwork(t, network.Config{Now: func() time.Time { return time.Now().Add(skew) }})
+	node := newNetwork(t, network.Config{})
+
+	start := node.UpTime()
+	_, err := node.Connect(context.Background(), ahead.Self().Address())
+	require.NoError(t, err)
+	require.InDelta(t, float64(time.Now().Add(skew).UnixNano()), float64(node.UTCTime().UnixNano()), float64(time.Second),
+		"Network time should follow the connected peers.")
+	require.Equal(t, time.UTC, node.UTCTime().Location())
+	require.Greater(t, node.UpTime(), start)
+}
+
+func TestUnauthenticatedPeersDoNotMoveTime(t *testing.T) {
+	victim := newNetwork(t, network.Config{})
+	other := newNetwork(t, network.Config{})
+
+	// The impostor replays another node's identity with a skewed clock but
+	// cannot answer the challenge.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hello map[string]any
+		if network.ReadMessage(conn, &hello) != nil {
+			return
+		}
+		network.WriteMessage(conn, map[string]any{
+			"node": other.Self(),
+			"time": time.Now().Add(5 * time.Minute).UnixNano(),
+		})
+		io.Copy(io.Discard, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = victim.Connect(ctx, l.Addr().String())
+	require.Error(t, err)
+	require.WithinDuration(t, time.Now(), victim.UTCTime(), time.Second,
+		"A peer that failed authentication should not be sampled.")
+}
+
+func TestClockIgnoresOutliers(t *testing.T) {
+	base := time.Unix(1000, 0)
+	clock := network.NewClock(func() time.Time { return base })
+	observe := func(peer byte, offset time.Duration) bool {
+		return clock.Observe(types.NodeID{peer}, base, base.Add(offset+50*time.Millisecond), base.Add(100*time.Millisecond))
+	}
+	for i, offset := range []time.Duration{time.Second, 2 * time.Second, time.Second, 5 * time.Minute, -5 * time.Minute} {
+		require.True(t, observe(byte(i), offset))
+	}
+	require.Equal(t, time.Second, clock.Offset(), "The median offset should win over outliers.")
+	require.Equal(t, base.Add(time.Second).UTC(), clock.Now())
+
+	require.False(t, observe(10, time.Hour), "Offsets beyond MaxClockOffset should be rejected.")
+	require.False(t, observe(11, -time.Hour))
+	require.Equal(t, time.Second, clock.Offset())
+
+	// One peer repeating its sample still counts once.
+	for i := 0; i < 10; i++ {
+		require.True(t, observe(3, 5*time.Minute))
+	}
+	require.Equal(t, time.Second, clock.Offset(), "A peer should only hold one sample.")
+	require.True(t, observe(0, 5*time.Minute))
+	require.True(t, observe(2, 5*time.Minute))
+	require.Equal(t, 5*time.Minute, clock.Offset(), "Replaced samples should count at their latest value.")
+}
+
+func TestProtocolViolationsBanPeers(t *testing.T) {
+	scores := trust.NewEngine(trust.Config{})
+	node := newNetwork(t, network.Config{Scorer: scores})
+	peer := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := peer.Ping(ctx, node.Self())
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		s, err := peer.NewStream(ctx, node.Self(), network.PingProtocol.Name)
+		require.NoError(t, err)
+		s.Write([]byte{0, 0, 0, 1, '?'})
+		io.ReadAll(s)
+		s.Close()
+	}
+	require.Eventually(t, func() bool { return scores.Banned(peer.Self().ID) }, 2*time.Second, 10*time.Millisecond,
+		"Malformed frames should get the peer banned.")
+	require.Eventually(t, func() bool { return len(node.Nodes()) == 0 }, 2*time.Second, 10*time.Millisecond,
+		"A banned peer should be disconnected.")
+
+	_, err = node.Connect(ctx, peer.Self().URL())
+	require.ErrorIs(t, err, network.ErrPeerBanned)
+	_, err = peer.Ping(ctx, node.Self())
+	require.Error(t, err, "A banned peer should not get back in.")
+}
+
+// tapTransport dials over TCP, records what the dialer writes and, once
+// tamper is set, flips a bit in every write.
+type tapTransport struct {
+	network.TCPTransport
+	mu      *sync.Mutex
+	written *bytes.Buffer
+	tamper  *atomic.Bool
+}
+
+func newTapTransport() tapTransport {
+	return tapTransport{mu: new(sync.Mutex), written: new(bytes.Buffer), tamper: new(atomic.Bool)}
+}
+
+func (t tapTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := t.TCPTransport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tapConn{Conn: conn, tap: t}, nil
+}
+
+func (t tapTransport) Written() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return bytes.Clone(t.written.Bytes())
+}
+
+type tapConn struct {
+	net.Conn
+	tap tapTransport
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	c.tap.mu.Lock()
+	c.tap.written.Write(p)
+	c.tap.mu.Unlock()
+	if c.tap.tamper.Load() && len(p) > 0 {
+		p = bytes.Clone(p)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+func TestSessionsAreEncrypted(t *testing.T) {
+	const echo = "/test/echo/1.0.0"
+	const secret = "attack at dawn"
+	node := newNetwork(t, network.Config{})
+	node.Handle(echo, func(ctx context.Context, rw io.ReadWriteCloser) error {
+		var msg string
+		if err := network.ReadMessage(rw, &msg); err != nil {
+			return err
+		}
+		return network.WriteMessage(rw, msg)
+	})
+	tap := newTapTransport()
+	peer := newNetwork(t, network.Config{Transports: []network.Transport{tap}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := peer.NewStream(ctx, node.Self(), echo)
+	require.NoError(t, err)
+	require.NoError(t, network.WriteMessage(s, secret))
+	var reply string
+	require.NoError(t, network.ReadMessage(s, &reply))
+	require.Equal(t, secret, reply)
+	s.Close()
+	require.NotContains(t, string(tap.Written()), secret, "Messages should not cross the wire in the clear.")
+	require.NotContains(t, string(tap.Written()), echo, "Protocol negotiation should not cross the wire in the clear.")
+
+	tap.tamper.Store(true)
+	if s, err := peer.NewStream(ctx, node.Self(), echo); err == nil {
+		network.WriteMessage(s, secret)
+		s.Close()
+	}
+	require.Eventually(t, func() bool { return len(node.Nodes()) == 0 }, 2*time.Second, 10*time.Millisecond,
+		"Tampered frames should end the session.")
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+	"trustmesh/network/smux"
+	"trustmesh/types"
+)
+
+// peer is a connected node.
+type peer struct {
+	node        *types.Node
+	conn        net.Conn
+	session     *smux.Session
+	transcript  []byte
+	outbound    bool
+	connectedAt time.Time
+}
+
+// peerstore tracks the nodes the local node is connected to.
+type peerstore struct {
+	mu    sync.RWMutex
+	peers map[types.NodeID]*peer
+}
+
+func newPeerstore() *peerstore {
+	return &peerstore{peers: make(map[types.NodeID]*peer)}
+}
+
+// add records p as the connection to its node and returns the connection
+// that lost out, if any, for the caller to close. When two nodes dial each
+// other at once, both keep the connection dialed by the lower node ID, so
+// they settle on the same one.
+func (ps *peerstore) add(p *peer, self types.NodeID) *peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	old, ok := ps.peers[p.node.ID]
+	if !ok {
+		ps.peers[p.node.ID] = p
+		return nil
+	}
+	keepOutbound := bytes.Compare(self[:], p.node.ID[:]) < 0
+	if old.outbound == p.outbound || old.outbound == keepOutbound {
+		return p
+	}
+	ps.peers[p.node.ID] = p
+	return old
+}
+
+// remove drops p if it is still the connection on record for its node.
+func (ps *peerstore) remove(p *peer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.peers[p.node.ID] == p {
+		delete(ps.peers, p.node.ID)
+	}
+}
+
+func (ps *peerstore) get(id types.NodeID) *peer {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.peers[id]
+}
+
+// nodes returns the connected nodes keyed by their hex ID.
+func (ps *peerstore) nodes() map[string]*types.Node {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	out := make(map[string]*types.Node, len(ps.peers))
+	for id, p := range ps.peers {
+		out[id.String()] = p.node
+	}
+	return out
+}
+
+// all returns every connected peer.
+func (ps *peerstore) all() []*peer {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	out := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		out = append(out, p)
+	}
+	return out
+}
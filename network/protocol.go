@@ -0,0 +1,48 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"trustmesh/types"
+)
+
+var ErrProtocolRegistered = errors.New("protocol is already registered")
+
+// Maps a protocol name to its descriptor
+var (
+	protocols      = make(map[string]types.Protocol)
+	protocolsMutex sync.RWMutex
+)
+
+// RegisterProtocol adds a protocol descriptor to the registry.
+func RegisterProtocol(p types.Protocol) error {
+	protocolsMutex.Lock()
+	defer protocolsMutex.Unlock()
+
+	if _, exists := protocols[p.Name]; exists {
+		return ErrProtocolRegistered
+	}
+	protocols[p.Name] = p
+	return nil
+}
+
+// LookupProtocol returns the registered descriptor for name.
+func LookupProtocol(name string) (types.Protocol, bool) {
+	protocolsMutex.RLock()
+	defer protocolsMutex.RUnlock()
+
+	p, ok := protocols[name]
+	return p, ok
+}
+
+// Protocols returns every registered protocol descriptor.
+func Protocols() []types.Protocol {
+	protocolsMutex.RLock()
+	defer protocolsMutex.RUnlock()
+
+	list := make([]types.Protocol, 0, len(protocols))
+	for _, p := range protocols {
+		list = append(list, p)
+	}
+	return list
+}
@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"time"
+	"trustmesh/types"
+)
+
+// messageCache holds the messages of the last few heartbeats, to answer
+// IWANT requests and to advertise in IHAVE gossip.
+type messageCache struct {
+	msgs map[MessageID]*Message
+	// sent counts how often each message was sent to each peer that asked
+	// for it.
+	sent map[MessageID]map[types.NodeID]int
+	// windows holds the IDs first seen in each heartbeat, newest first.
+	windows [][]MessageID
+	gossip  int
+}
+
+func newMessageCache(history, gossip int) *messageCache {
+	return &messageCache{
+		msgs:    make(map[MessageID]*Message),
+		sent:    make(map[MessageID]map[types.NodeID]int),
+		windows: make([][]MessageID, history),
+		gossip:  gossip,
+	}
+}
+
+func (c *messageCache) put(id MessageID, m *Message) {
+	if _, ok := c.msgs[id]; ok {
+		return
+	}
+	c.msgs[id] = m
+	c.windows[0] = append(c.windows[0], id)
+}
+
+// getFor returns the message with id for peer, and how many times it has
+// now been asked for it.
+func (c *messageCache) getFor(id MessageID, peer types.NodeID) (*Message, int, bool) {
+	m, ok := c.msgs[id]
+	if !ok {
+		return nil, 0, false
+	}
+	peers := c.sent[id]
+	if peers == nil {
+		peers = make(map[types.NodeID]int)
+		c.sent[id] = peers
+	}
+	peers[peer]++
+	return m, peers[peer], true
+}
+
+// gossipIDs returns the IDs of the messages on topic seen in the last few
+// heartbeats.
+func (c *messageCache) gossipIDs(topic string) []MessageID {
+	var ids []MessageID
+	for _, w := range c.windows[:c.gossip] {
+		for _, id := range w {
+			if c.msgs[id].Topic == topic {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// shift starts a new heartbeat window, forgetting the oldest one.
+func (c *messageCache) shift() {
+	last := len(c.windows) - 1
+	for _, id := range c.windows[last] {
+		delete(c.msgs, id)
+		delete(c.sent, id)
+	}
+	copy(c.windows[1:], c.windows[:last])
+	c.windows[0] = nil
+}
+
+// seenCache remembers the IDs of recent messages so that each is handled
+// only once, however many peers forward it.
+type seenCache struct {
+	ttl  time.Duration
+	seen map[MessageID]time.Time
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{ttl: ttl, seen: make(map[MessageID]time.Time)}
+}
+
+// add records id and reports whether it was new.
+func (c *seenCache) add(id MessageID, now time.Time) bool {
+	if _, ok := c.seen[id]; ok {
+		return false
+	}
+	c.seen[id] = now
+	return true
+}
+
+func (c *seenCache) has(id MessageID) bool {
+	_, ok := c.seen[id]
+	return ok
+}
+
+// sweep forgets IDs seen more than the TTL ago.
+func (c *seenCache) sweep(now time.Time) {
+	for id, at := range c.seen {
+		if now.Sub(at) > c.ttl {
+			delete(c.seen, id)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package pubsub
+
+import (
+	"sort"
+	"time"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// handleControlLocked applies a peer's control messages and returns the
+// reply they call for, if any. IWANTs beyond the node's limits go
+// unanswered and count against the peer.
+func (ps *PubSub) handleControlLocked(from types.NodeID, c *control) *rpc {
+	if c.empty() {
+		return nil
+	}
+	now := ps.now()
+	reply := &rpc{Control: &control{}}
+
+	// Ask for the advertised messages on subscribed topics not seen yet.
+	var want []MessageID
+	asked := make(map[MessageID]bool)
+	for _, ih := range c.IHave {
+		if _, ok := ps.mesh[ih.Topic]; !ok {
+			continue
+		}
+		for _, id := range ih.IDs {
+			if len(want) == ps.maxIWant {
+				break
+			}
+			if !ps.seen.has(id) && !asked[id] {
+				asked[id] = true
+				want = append(want, id)
+			}
+		}
+	}
+	if len(want) > 0 {
+		reply.Control.IWant = []iwant{{IDs: want}}
+	}
+	answered, over := 0, false
+	for _, iw := range c.IWant {
+		for _, id := range iw.IDs {
+			if answered == ps.maxIWant {
+				over = true
+				break
+			}
+			answered++
+			m, sent, ok := ps.mcache.getFor(id, from)
+			if !ok {
+				continue
+			}
+			if sent > ps.retransmit {
+				over = true
+				continue
+			}
+			reply.Publish = append(reply.Publish, m)
+		}
+	}
+	if over {
+		ps.record(from, trust.LimitExceeded)
+	}
+
+	// A graft is refused with a prune when the node is not in the topic, the
+	// peer grafts again before its backoff is over or it is badly scored.
+	for _, g := range c.Graft {
+		mesh, ok := ps.mesh[g.Topic]
+		if !ok || ps.backoff[g.Topic][from].After(now) || ps.score(from) < 0 {
+			reply.Control.Prune = append(reply.Control.Prune, prune{Topic: g.Topic})
+			continue
+		}
+		mesh[from] = true
+	}
+	for _, pr := range c.Prune {
+		delete(ps.mesh[pr.Topic], from)
+		ps.backoffLocked(pr.Topic, from, now)
+	}
+
+	if reply.Control.empty() {
+		reply.Control = nil
+	}
+	if reply.Control == nil && len(reply.Publish) == 0 {
+		return nil
+	}
+	return reply
+}
+
+// backoffLocked keeps id out of topic's mesh for the prune backoff.
+func (ps *PubSub) backoffLocked(topic string, id types.NodeID, now time.Time) {
+	ids := ps.backoff[topic]
+	if ids == nil {
+		ids = make(map[types.NodeID]time.Time)
+		ps.backoff[topic] = ids
+	}
+	ids[id] = now.Add(ps.pruneBackoff)
+}
+
+func (ps *PubSub) heartbeatLoop() {
+	defer ps.wg.Done()
+	t := time.NewTicker(ps.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-t.C:
+			ps.refreshPeers()
+			ps.heartbeatOnce()
+		}
+	}
+}
+
+// heartbeatOnce keeps every mesh between Dlo and Dhi peers, refreshes the
+// fanouts, sends IHAVE gossip and ages the caches.
+func (ps *PubSub) heartbeatOnce() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.ctx.Err() != nil {
+		return
+	}
+	now := ps.now()
+	ctrl := make(map[types.NodeID]*control)
+	to := func(id types.NodeID) *control {
+		c := ctrl[id]
+		if c == nil {
+			c = &control{}
+			ctrl[id] = c
+		}
+		return c
+	}
+
+	for _, topic := range sortedKeys(ps.mesh) {
+		mesh := ps.mesh[topic]
+		for id := range mesh {
+			if p := ps.peers[id]; p == nil || !p.topics[topic] {
+				delete(mesh, id)
+			} else if ps.score(id) < 0 {
+				delete(mesh, id)
+				ps.backoffLocked(topic, id, now)
+				to(id).Prune = append(to(id).Prune, prune{Topic: topic})
+			}
+		}
+		if len(mesh) < ps.dlo {
+			for _, id := range ps.candidatesLocked(topic, ps.d-len(mesh), mesh, true) {
+				mesh[id] = true
+				to(id).Graft = append(to(id).Graft, graft{Topic: topic})
+			}
+		}
+		if len(mesh) > ps.dhi {
+			// Keep the best scored peers, choosing at random among equals.
+			ids := sortedIDs(mesh)
+			ps.rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+			sort.SliceStable(ids, func(i, j int) bool { return ps.score(ids[i]) > ps.score(ids[j]) })
+			for _, id := range ids[ps.d:] {
+				delete(mesh, id)
+				ps.backoffLocked(topic, id, now)
+				to(id).Prune = append(to(id).Prune, prune{Topic: topic})
+			}
+		}
+		ps.gossipLocked(topic, mesh, to)
+	}
+
+	for _, topic := range sortedKeys(ps.fanout) {
+		fanout := ps.fanout[topic]
+		if now.Sub(ps.lastPub[topic]) > ps.fanoutTTL {
+			delete(ps.fanout, topic)
+			delete(ps.lastPub, topic)
+			continue
+		}
+		for id := range fanout {
+			if p := ps.peers[id]; p == nil || !p.topics[topic] {
+				delete(fanout, id)
+			}
+		}
+		if len(fanout) < ps.d {
+			for _, id := range ps.candidatesLocked(topic, ps.d-len(fanout), fanout, false) {
+				fanout[id] = true
+			}
+		}
+		ps.gossipLocked(topic, fanout, to)
+	}
+
+	for id, c := range ctrl {
+		ps.peers[id].send(&rpc{Control: c})
+	}
+	ps.protectMeshLocked()
+	ps.mcache.shift()
+	ps.seen.sweep(now)
+	for topic, ids := range ps.backoff {
+		for id, until := range ids {
+			if !until.After(now) {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(ps.backoff, topic)
+		}
+	}
+}
+
+// protectMeshLocked protects the connections to the peers in any mesh and
+// releases those of the peers that left them all.
+func (ps *PubSub) protectMeshLocked() {
+	if ps.protector == nil {
+		return
+	}
+	inMesh := make(map[types.NodeID]bool)
+	for _, mesh := range ps.mesh {
+		for id := range mesh {
+			inMesh[id] = true
+		}
+	}
+	for id := range inMesh {
+		if !ps.protected[id] {
+			ps.protector.Protect(id, MeshProtectTag)
+			ps.protected[id] = true
+		}
+	}
+	for id := range ps.protected {
+		if !inMesh[id] {
+			ps.protector.Unprotect(id, MeshProtectTag)
+			delete(ps.protected, id)
+		}
+	}
+}
+
+// gossipLocked advertises the recent messages on topic to Dlazy subscribed
+// peers outside exclude, the peers that already receive them in full.
+func (ps *PubSub) gossipLocked(topic string, exclude map[types.NodeID]bool, to func(types.NodeID) *control) {
+	if ps.dlazy == 0 {
+		return
+	}
+	ids := ps.mcache.gossipIDs(topic)
+	if len(ids) == 0 {
+		return
+	}
+	for _, id := range ps.candidatesLocked(topic, ps.dlazy, exclude, false) {
+		to(id).IHave = append(to(id).IHave, ihave{Topic: topic, IDs: ids})
+	}
+}
+
+// sortedKeys returns the topics of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
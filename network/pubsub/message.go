@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+const messageDomain = "trustmesh/pubsub/v1"
+
+// MessageID identifies a message by the BLAKE3 hash of its signed content
+// and signature, so only the publisher can mint a message with a given ID.
+type MessageID [32]byte
+
+// String returns the hex encoding of the ID.
+func (id MessageID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText encodes the ID as hex.
+func (id MessageID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a hex encoded ID.
+func (id *MessageID) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(id) {
+		return fmt.Errorf("invalid message id %q", text)
+	}
+	copy(id[:], b)
+	return nil
+}
+
+// Message is a signed publication on a topic.
+type Message struct {
+	// From is the publisher, whose node ID Key must hash to.
+	From types.NodeID `json:"from"`
+	// Key is the publisher's signing public key.
+	Key []byte `json:"key"`
+	// Seqno orders the publisher's messages and keeps equal payloads apart.
+	Seqno     uint64 `json:"seqno"`
+	Topic     string `json:"topic"`
+	Data      []byte `json:"data"`
+	Signature []byte `json:"signature"`
+
+	// ReceivedFrom is the peer that delivered the message, or the local node
+	// for messages it published.
+	ReceivedFrom types.NodeID `json:"-"`
+}
+
+// ID returns the message's identifier.
+func (m *Message) ID() MessageID {
+	h := blake3.New()
+	h.Write(m.signingBytes())
+	h.Write(m.Signature)
+	var id MessageID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// sign sets the publisher fields of m and signs it with key.
+func (m *Message) sign(key *crypto.SigningKey) error {
+	m.Key = key.PublicKeyBytes()
+	m.From = types.NewNodeID(m.Key)
+	sig, err := key.Sign(m.signingBytes())
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// verify checks that m is signed by the publisher it names.
+func (m *Message) verify() error {
+	if types.NewNodeID(m.Key) != m.From {
+		return ErrInvalidPublisher
+	}
+	if err := crypto.VerifySignature(m.Key, m.signingBytes(), m.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// signingBytes is the domain separated encoding covered by the signature.
+func (m *Message) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(messageDomain)
+	buf.Write(m.From[:])
+	binary.Write(&buf, binary.BigEndian, m.Seqno)
+	writeBytes(&buf, []byte(m.Topic))
+	writeBytes(&buf, m.Data)
+	return buf.Bytes()
+}
+
+// writeBytes writes a length-prefixed byte slice.
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+// rpc is one frame on a gossip stream. A frame may carry any mix of
+// subscription changes, messages and control.
+type rpc struct {
+	Subscriptions []subOpt   `json:"subscriptions,omitempty"`
+	Publish       []*Message `json:"publish,omitempty"`
+	Control       *control   `json:"control,omitempty"`
+}
+
+// subOpt announces that the sender joined or left a topic.
+type subOpt struct {
+	Subscribe bool   `json:"subscribe"`
+	Topic     string `json:"topic"`
+}
+
+// control manages the mesh and carries lazy gossip.
+type control struct {
+	IHave []ihave `json:"ihave,omitempty"`
+	IWant []iwant `json:"iwant,omitempty"`
+	Graft []graft `json:"graft,omitempty"`
+	Prune []prune `json:"prune,omitempty"`
+}
+
+// ihave advertises messages the sender recently saw on a topic.
+type ihave struct {
+	Topic string      `json:"topic"`
+	IDs   []MessageID `json:"ids"`
+}
+
+// iwant asks for advertised messages the sender has not seen.
+type iwant struct {
+	IDs []MessageID `json:"ids"`
+}
+
+// graft asks the receiver to add the sender to its mesh for a topic.
+type graft struct {
+	Topic string `json:"topic"`
+}
+
+// prune tells the receiver it left the sender's mesh for a topic.
+type prune struct {
+	Topic string `json:"topic"`
+}
+
+func (c *control) empty() bool {
+	return c == nil || len(c.IHave)+len(c.IWant)+len(c.Graft)+len(c.Prune) == 0
+}
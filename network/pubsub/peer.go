@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+	"trustmesh/network"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// pubsubPeer is a connected node the local node gossips with. Frames to it
+// go over one long-lived outbound stream; frames from it arrive on the
+// stream it opened in turn.
+type pubsubPeer struct {
+	node *types.Node
+	// topics are the topics the peer announced it subscribes to.
+	topics map[string]bool
+	out    chan *rpc
+	cancel context.CancelFunc
+}
+
+// send queues r for the peer, dropping it if the peer is too far behind.
+func (p *pubsubPeer) send(r *rpc) {
+	select {
+	case p.out <- r:
+	default:
+	}
+}
+
+// addPeerLocked starts gossiping with node. The first frame it is sent
+// announces the local subscriptions.
+func (ps *PubSub) addPeerLocked(node *types.Node) {
+	ctx, cancel := context.WithCancel(ps.ctx)
+	p := &pubsubPeer{
+		node:   node,
+		topics: make(map[string]bool),
+		out:    make(chan *rpc, ps.peerQueue),
+		cancel: cancel,
+	}
+	ps.peers[node.ID] = p
+	if len(ps.subs) > 0 {
+		hello := &rpc{}
+		for _, topic := range sortedKeys(ps.subs) {
+			hello.Subscriptions = append(hello.Subscriptions, subOpt{Subscribe: true, Topic: topic})
+		}
+		p.send(hello)
+	}
+	ps.wg.Add(1)
+	go ps.runPeer(ctx, p)
+}
+
+// removePeerLocked stops gossiping with p and drops it from every mesh.
+func (ps *PubSub) removePeerLocked(p *pubsubPeer) {
+	p.cancel()
+	id := p.node.ID
+	if ps.peers[id] != p {
+		return
+	}
+	delete(ps.peers, id)
+	for _, mesh := range ps.mesh {
+		delete(mesh, id)
+	}
+	for _, fanout := range ps.fanout {
+		delete(fanout, id)
+	}
+}
+
+func (ps *PubSub) removePeer(p *pubsubPeer) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.removePeerLocked(p)
+}
+
+// runPeer opens the outbound stream to p and writes its queued frames until
+// the stream fails or the peer is dropped.
+func (ps *PubSub) runPeer(ctx context.Context, p *pubsubPeer) {
+	defer ps.wg.Done()
+	defer ps.removePeer(p)
+
+	s, err := ps.host.NewStream(ctx, p.node, network.GossipProtocol.Name)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-p.out:
+			if err := network.WriteMessage(s, r); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// refreshPeers starts gossiping with newly connected nodes and drops the
+// peers the host is no longer connected to.
+func (ps *PubSub) refreshPeers() {
+	nodes := ps.host.Nodes()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.ctx.Err() != nil {
+		return
+	}
+	connected := make(map[types.NodeID]bool, len(nodes))
+	for _, n := range nodes {
+		connected[n.ID] = true
+		if n.ID != ps.self && ps.peers[n.ID] == nil {
+			ps.addPeerLocked(n)
+		}
+	}
+	for id, p := range ps.peers {
+		if !connected[id] {
+			ps.removePeerLocked(p)
+		}
+	}
+}
+
+// serve reads the frames a peer sends over its gossip stream.
+func (ps *PubSub) serve(ctx context.Context, rw io.ReadWriteCloser) error {
+	node := network.PeerFromContext(ctx)
+	if node == nil {
+		return ErrUnknownPeer
+	}
+	ps.mu.Lock()
+	if ps.ctx.Err() != nil {
+		ps.mu.Unlock()
+		return ErrClosed
+	}
+	if ps.peers[node.ID] == nil {
+		ps.addPeerLocked(node)
+	}
+	ps.mu.Unlock()
+
+	for {
+		var r rpc
+		if err := network.ReadMessage(rw, &r); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		ps.handleRPC(ctx, node.ID, &r)
+	}
+}
+
+// handleRPC applies one frame from a peer.
+func (ps *PubSub) handleRPC(ctx context.Context, from types.NodeID, r *rpc) {
+	ps.mu.Lock()
+	p := ps.peers[from]
+	if p == nil || ps.ctx.Err() != nil || ps.graylisted(from) {
+		ps.mu.Unlock()
+		return
+	}
+	over := false
+	for _, sub := range r.Subscriptions {
+		if sub.Subscribe {
+			if !p.topics[sub.Topic] && len(p.topics) >= ps.maxSubs {
+				over = true
+				continue
+			}
+			p.topics[sub.Topic] = true
+			continue
+		}
+		delete(p.topics, sub.Topic)
+		delete(ps.mesh[sub.Topic], from)
+		delete(ps.fanout[sub.Topic], from)
+	}
+	reply := ps.handleControlLocked(from, r.Control)
+	ps.mu.Unlock()
+	if over {
+		ps.record(from, trust.LimitExceeded)
+	}
+
+	for _, m := range r.Publish {
+		ps.pushMessage(ctx, from, m)
+	}
+	if reply != nil {
+		p.send(reply)
+	}
+}
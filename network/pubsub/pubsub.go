@@ -0,0 +1,613 @@
+// Package pubsub implements topic-based publish/subscribe over
+// network.GossipProtocol in the manner of GossipSub. Each node keeps a mesh
+// of a few peers per topic it subscribes to and forwards messages only to
+// them, while advertising recent messages to other peers in IHAVE gossip
+// that they fetch with IWANT when they missed them.
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/network"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultD is the number of peers a topic mesh aims for.
+	DefaultD = 6
+	// DefaultDlo is the mesh size below which peers are grafted.
+	DefaultDlo = 4
+	// DefaultDhi is the mesh size above which peers are pruned.
+	DefaultDhi = 12
+	// DefaultDlazy is the number of peers outside the mesh sent IHAVE gossip.
+	DefaultDlazy = 6
+	// DefaultHeartbeatInterval is how often meshes are maintained and gossip
+	// emitted.
+	DefaultHeartbeatInterval = time.Second
+	// DefaultHistoryLength is how many heartbeats messages stay cached for
+	// IWANT requests.
+	DefaultHistoryLength = 5
+	// DefaultHistoryGossip is how many heartbeats of messages IHAVE gossip
+	// advertises.
+	DefaultHistoryGossip = 3
+	// DefaultSeenTTL is how long message IDs are remembered for duplicate
+	// suppression.
+	DefaultSeenTTL = 2 * time.Minute
+	// DefaultFanoutTTL is how long the peers a node publishes to on a topic
+	// it does not subscribe to are kept after its last publish.
+	DefaultFanoutTTL = time.Minute
+	// DefaultPruneBackoff is how long a pruned peer is not grafted again.
+	DefaultPruneBackoff = time.Minute
+	// DefaultMaxMessageSize bounds the payload of a message.
+	DefaultMaxMessageSize = 1 << 20
+	// DefaultSubscriptionBuffer is how many messages a subscription channel
+	// holds before further messages are dropped for it.
+	DefaultSubscriptionBuffer = 32
+	// DefaultPeerQueue is how many frames wait to be sent to a peer before
+	// further frames are dropped.
+	DefaultPeerQueue = 256
+	// DefaultMaxSubscriptions is how many topics a peer may subscribe to.
+	DefaultMaxSubscriptions = 100
+	// DefaultMaxIWantLength is how many message IDs are asked for or
+	// answered in one frame.
+	DefaultMaxIWantLength = 5000
+	// DefaultGossipRetransmission is how many times a peer's IWANT for one
+	// message is answered.
+	DefaultGossipRetransmission = 3
+	// MeshProtectTag is the tag mesh peers are protected under.
+	MeshProtectTag = "pubsub-mesh"
+)
+
+var (
+	ErrClosed           = errors.New("pubsub is closed")
+	ErrNoSigningKey     = errors.New("no signing key configured")
+	ErrInvalidTopic     = errors.New("invalid topic")
+	ErrMessageTooLarge  = errors.New("message exceeds maximum size")
+	ErrInvalidPublisher = errors.New("message publisher does not match its key")
+	ErrInvalidSignature = errors.New("invalid message signature")
+	ErrRejected         = errors.New("message rejected by topic validator")
+	ErrUnknownPeer      = errors.New("gossip stream has no authenticated peer")
+)
+
+// Validator decides whether a message on a topic is delivered and
+// forwarded. It runs after the publisher's signature has been checked;
+// returning an error drops the message.
+type Validator func(ctx context.Context, msg *Message) error
+
+// Scorer rates peers by their behaviour. Frames from graylisted peers are
+// ignored and peers with a negative score are kept out of meshes.
+// trust.Engine implements it.
+type Scorer interface {
+	Score(id types.NodeID) float64
+	Graylisted(id types.NodeID) bool
+	Record(id types.NodeID, ev trust.Event)
+}
+
+var _ Scorer = (*trust.Engine)(nil)
+
+// Host is the network a PubSub runs over. network.P2PNetwork implements it.
+type Host interface {
+	Self() *types.Node
+	Nodes() map[string]*types.Node
+	Handle(path string, h func(ctx context.Context, rw io.ReadWriteCloser) error)
+	NewStream(ctx context.Context, node *types.Node, protocols ...string) (*network.Stream, error)
+}
+
+var _ Host = network.P2PNetwork(nil)
+
+// Protector keeps the connections to peers from being trimmed.
+// network.ConnManager implements it.
+type Protector interface {
+	Protect(id types.NodeID, tag string)
+	Unprotect(id types.NodeID, tag string) bool
+}
+
+var _ Protector = (*network.ConnManager)(nil)
+
+// Config configures a PubSub.
+type Config struct {
+	// Key signs the messages the node publishes. It should be the key the
+	// host network authenticates the node with.
+	Key *crypto.SigningKey
+	// D, Dlo and Dhi set the size a topic mesh aims for and the bounds it
+	// is kept within.
+	D, Dlo, Dhi int
+	// Dlazy is the number of peers outside the mesh each heartbeat sends
+	// IHAVE gossip to. A negative value disables gossip.
+	Dlazy int
+	// HeartbeatInterval is how often meshes are maintained and gossip
+	// emitted.
+	HeartbeatInterval time.Duration
+	// HistoryLength is how many heartbeats messages stay cached for IWANT
+	// requests, and HistoryGossip how many of those IHAVE advertises.
+	HistoryLength, HistoryGossip int
+	// SeenTTL is how long message IDs are remembered for duplicate
+	// suppression.
+	SeenTTL time.Duration
+	// FanoutTTL is how long the peers a node publishes to on a topic it does
+	// not subscribe to are kept after its last publish.
+	FanoutTTL time.Duration
+	// PruneBackoff is how long a peer that left a mesh is not grafted again.
+	PruneBackoff time.Duration
+	// MaxMessageSize bounds the payload of a message.
+	MaxMessageSize int
+	// SubscriptionBuffer is how many messages a subscription channel holds.
+	// Messages for a subscriber that falls further behind are dropped.
+	SubscriptionBuffer int
+	// PeerQueue is how many frames wait to be sent to a peer.
+	PeerQueue int
+	// MaxSubscriptions is how many topics a peer may subscribe to.
+	MaxSubscriptions int
+	// MaxIWantLength is how many message IDs are asked for or answered in
+	// one frame, and GossipRetransmission how many times a peer's IWANT for
+	// one message is answered. Peers going over these limits are ignored
+	// beyond them and reported to the Scorer.
+	MaxIWantLength, GossipRetransmission int
+	// Validators maps topics to their validators.
+	Validators map[string]Validator
+	// Scorer, when set, is told which peers deliver valid and invalid
+	// messages and consulted on which of them to keep in meshes.
+	Scorer Scorer
+	// Protector protects the connections to mesh peers. It defaults to the
+	// host's connection manager, if it has one.
+	Protector Protector
+	// Seed seeds the choice of mesh and gossip peers. Zero uses the time.
+	Seed int64
+	// Now overrides the clock, mainly for tests.
+	Now func() time.Time
+}
+
+// PubSub is a node's endpoint for publishing to and subscribing to topics.
+type PubSub struct {
+	host         Host
+	key          *crypto.SigningKey
+	self         types.NodeID
+	d, dlo, dhi  int
+	dlazy        int
+	heartbeat    time.Duration
+	fanoutTTL    time.Duration
+	pruneBackoff time.Duration
+	maxSize      int
+	subBuffer    int
+	peerQueue    int
+	maxSubs      int
+	maxIWant     int
+	retransmit   int
+	scorer       Scorer
+	protector    Protector
+	now          func() time.Time
+	seqno        atomic.Uint64
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	peers   map[types.NodeID]*pubsubPeer
+	subs    map[string][]chan *Message
+	mesh    map[string]map[types.NodeID]bool
+	fanout  map[string]map[types.NodeID]bool
+	lastPub map[string]time.Time
+	backoff map[string]map[types.NodeID]time.Time
+	// protected are the peers protected as mesh members.
+	protected map[types.NodeID]bool
+	mcache    *messageCache
+	seen      *seenCache
+
+	validatorsMu sync.RWMutex
+	validators   map[string]Validator
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts a PubSub on host and registers it for inbound
+// network.GossipProtocol streams.
+func New(host Host, cfg Config) (*PubSub, error) {
+	if cfg.Key == nil {
+		return nil, fmt.Errorf("pubsub config: %w", ErrNoSigningKey)
+	}
+	if cfg.D <= 0 {
+		cfg.D = DefaultD
+	}
+	if cfg.Dlo <= 0 {
+		cfg.Dlo = min(DefaultDlo, cfg.D)
+	}
+	if cfg.Dhi <= 0 {
+		cfg.Dhi = max(DefaultDhi, cfg.D)
+	}
+	if cfg.Dlo > cfg.D || cfg.Dhi < cfg.D {
+		return nil, fmt.Errorf("pubsub config: mesh bounds %d-%d do not contain D=%d", cfg.Dlo, cfg.Dhi, cfg.D)
+	}
+	if cfg.Dlazy == 0 {
+		cfg.Dlazy = DefaultDlazy
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.HistoryLength <= 0 {
+		cfg.HistoryLength = DefaultHistoryLength
+	}
+	if cfg.HistoryGossip <= 0 {
+		cfg.HistoryGossip = DefaultHistoryGossip
+	}
+	cfg.HistoryGossip = min(cfg.HistoryGossip, cfg.HistoryLength)
+	if cfg.SeenTTL <= 0 {
+		cfg.SeenTTL = DefaultSeenTTL
+	}
+	if cfg.FanoutTTL <= 0 {
+		cfg.FanoutTTL = DefaultFanoutTTL
+	}
+	if cfg.PruneBackoff <= 0 {
+		cfg.PruneBackoff = DefaultPruneBackoff
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if cfg.SubscriptionBuffer <= 0 {
+		cfg.SubscriptionBuffer = DefaultSubscriptionBuffer
+	}
+	if cfg.PeerQueue <= 0 {
+		cfg.PeerQueue = DefaultPeerQueue
+	}
+	if cfg.MaxSubscriptions <= 0 {
+		cfg.MaxSubscriptions = DefaultMaxSubscriptions
+	}
+	if cfg.MaxIWantLength <= 0 {
+		cfg.MaxIWantLength = DefaultMaxIWantLength
+	}
+	if cfg.GossipRetransmission <= 0 {
+		cfg.GossipRetransmission = DefaultGossipRetransmission
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if h, ok := host.(interface{ ConnManager() *network.ConnManager }); ok && cfg.Protector == nil {
+		cfg.Protector = h.ConnManager()
+	}
+
+	ps := &PubSub{
+		host:         host,
+		key:          cfg.Key,
+		self:         types.NewNodeID(cfg.Key.PublicKeyBytes()),
+		d:            cfg.D,
+		dlo:          cfg.Dlo,
+		dhi:          cfg.Dhi,
+		dlazy:        max(cfg.Dlazy, 0),
+		heartbeat:    cfg.HeartbeatInterval,
+		fanoutTTL:    cfg.FanoutTTL,
+		pruneBackoff: cfg.PruneBackoff,
+		maxSize:      cfg.MaxMessageSize,
+		subBuffer:    cfg.SubscriptionBuffer,
+		peerQueue:    cfg.PeerQueue,
+		maxSubs:      cfg.MaxSubscriptions,
+		maxIWant:     cfg.MaxIWantLength,
+		retransmit:   cfg.GossipRetransmission,
+		scorer:       cfg.Scorer,
+		protector:    cfg.Protector,
+		now:          cfg.Now,
+		rng:          rand.New(rand.NewSource(cfg.Seed)),
+		peers:        make(map[types.NodeID]*pubsubPeer),
+		subs:         make(map[string][]chan *Message),
+		mesh:         make(map[string]map[types.NodeID]bool),
+		fanout:       make(map[string]map[types.NodeID]bool),
+		lastPub:      make(map[string]time.Time),
+		backoff:      make(map[string]map[types.NodeID]time.Time),
+		protected:    make(map[types.NodeID]bool),
+		mcache:       newMessageCache(cfg.HistoryLength, cfg.HistoryGossip),
+		seen:         newSeenCache(cfg.SeenTTL),
+		validators:   make(map[string]Validator),
+	}
+	for topic, v := range cfg.Validators {
+		ps.validators[topic] = v
+	}
+	// Messages carry a sequence number that starts at the clock, so a
+	// restarted publisher does not reuse the numbers of its previous run.
+	ps.seqno.Store(uint64(ps.now().UnixNano()))
+	ps.ctx, ps.cancel = context.WithCancel(context.Background())
+
+	host.Handle(network.GossipProtocol.Name, ps.serve)
+	ps.refreshPeers()
+	ps.wg.Add(1)
+	go ps.heartbeatLoop()
+	return ps, nil
+}
+
+// RegisterValidator installs v for the messages on topic.
+func (ps *PubSub) RegisterValidator(topic string, v Validator) {
+	ps.validatorsMu.Lock()
+	defer ps.validatorsMu.Unlock()
+
+	ps.validators[topic] = v
+}
+
+// Subscribe joins topic and returns a channel receiving its messages,
+// including the ones the node publishes itself. The channel is closed by
+// Unsubscribe or Close.
+func (ps *PubSub) Subscribe(topic string) (<-chan *Message, error) {
+	if topic == "" {
+		return nil, ErrInvalidTopic
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	ch := make(chan *Message, ps.subBuffer)
+	first := len(ps.subs[topic]) == 0
+	ps.subs[topic] = append(ps.subs[topic], ch)
+	if first {
+		ps.announceLocked(topic, true)
+		ps.joinLocked(topic)
+	}
+	return ch, nil
+}
+
+// Unsubscribe leaves topic, closing every channel Subscribe returned for it.
+func (ps *PubSub) Unsubscribe(topic string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	chans, ok := ps.subs[topic]
+	if !ok {
+		return
+	}
+	for _, ch := range chans {
+		close(ch)
+	}
+	delete(ps.subs, topic)
+	ps.announceLocked(topic, false)
+	ps.leaveLocked(topic)
+}
+
+// Publish signs data and sends it on topic. Publishing does not require a
+// subscription; messages on other topics go to a fanout of the peers
+// subscribed to them.
+func (ps *PubSub) Publish(ctx context.Context, topic string, data []byte) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+	if len(data) > ps.maxSize {
+		return ErrMessageTooLarge
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m := &Message{Seqno: ps.seqno.Add(1), Topic: topic, Data: data}
+	if err := m.sign(ps.key); err != nil {
+		return err
+	}
+	if err := ps.validate(ctx, m); err != nil {
+		return err
+	}
+	m.ReceivedFrom = ps.self
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.ctx.Err() != nil {
+		return ErrClosed
+	}
+	id := m.ID()
+	ps.seen.add(id, ps.now())
+	ps.deliverLocked(id, m, true)
+	return nil
+}
+
+// MeshPeers returns the peers in the node's mesh for topic, sorted.
+func (ps *PubSub) MeshPeers(topic string) []types.NodeID {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return sortedIDs(ps.mesh[topic])
+}
+
+// Close leaves every topic, closes the subscription channels and drops the
+// gossip streams to peers.
+func (ps *PubSub) Close() error {
+	ps.mu.Lock()
+	if ps.ctx.Err() != nil {
+		ps.mu.Unlock()
+		return nil
+	}
+	ps.cancel()
+	for topic, chans := range ps.subs {
+		for _, ch := range chans {
+			close(ch)
+		}
+		delete(ps.subs, topic)
+	}
+	for _, p := range ps.peers {
+		p.cancel()
+	}
+	for id := range ps.protected {
+		ps.protector.Unprotect(id, MeshProtectTag)
+	}
+	ps.mu.Unlock()
+
+	ps.wg.Wait()
+	return nil
+}
+
+// validate checks m's signature and runs its topic's validator.
+func (ps *PubSub) validate(ctx context.Context, m *Message) error {
+	if m.Topic == "" {
+		return ErrInvalidTopic
+	}
+	if err := m.verify(); err != nil {
+		return err
+	}
+	ps.validatorsMu.RLock()
+	v := ps.validators[m.Topic]
+	ps.validatorsMu.RUnlock()
+	if v == nil {
+		return nil
+	}
+	if err := v(ctx, m); err != nil {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	return nil
+}
+
+// pushMessage handles a message a peer sent. A message is handled once,
+// however many peers send it, and only forwarded once it validates.
+func (ps *PubSub) pushMessage(ctx context.Context, from types.NodeID, m *Message) {
+	if m == nil || len(m.Data) > ps.maxSize {
+		ps.record(from, trust.InvalidGossip)
+		return
+	}
+	id := m.ID()
+	ps.mu.Lock()
+	fresh := ps.seen.add(id, ps.now())
+	ps.mu.Unlock()
+	if !fresh {
+		return
+	}
+	if err := ps.validate(ctx, m); err != nil {
+		ps.record(from, trust.InvalidGossip)
+		return
+	}
+	ps.record(from, trust.GossipDelivered)
+	m.ReceivedFrom = from
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.ctx.Err() == nil {
+		ps.deliverLocked(id, m, false)
+	}
+}
+
+// deliverLocked caches a valid message, hands it to the local subscribers
+// and forwards it to the topic's mesh. The node's own messages go to the
+// fanout on topics it does not subscribe to.
+func (ps *PubSub) deliverLocked(id MessageID, m *Message, local bool) {
+	ps.mcache.put(id, m)
+	for _, ch := range ps.subs[m.Topic] {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+
+	targets, subscribed := ps.mesh[m.Topic]
+	if !subscribed && local {
+		targets = ps.fanout[m.Topic]
+		if len(targets) == 0 {
+			targets = make(map[types.NodeID]bool)
+			for _, id := range ps.candidatesLocked(m.Topic, ps.d, nil, false) {
+				targets[id] = true
+			}
+			ps.fanout[m.Topic] = targets
+		}
+		ps.lastPub[m.Topic] = ps.now()
+	}
+	out := &rpc{Publish: []*Message{m}}
+	for _, id := range sortedIDs(targets) {
+		if id == m.ReceivedFrom || id == m.From {
+			continue
+		}
+		if p := ps.peers[id]; p != nil {
+			p.send(out)
+		}
+	}
+}
+
+// announceLocked tells every peer the node joined or left topic.
+func (ps *PubSub) announceLocked(topic string, subscribe bool) {
+	out := &rpc{Subscriptions: []subOpt{{Subscribe: subscribe, Topic: topic}}}
+	for _, p := range ps.peers {
+		p.send(out)
+	}
+}
+
+// joinLocked builds the mesh for a newly subscribed topic, starting from the
+// topic's fanout, and grafts its peers.
+func (ps *PubSub) joinLocked(topic string) {
+	mesh := ps.fanout[topic]
+	if mesh == nil {
+		mesh = make(map[types.NodeID]bool)
+	}
+	delete(ps.fanout, topic)
+	delete(ps.lastPub, topic)
+	if len(mesh) < ps.d {
+		for _, id := range ps.candidatesLocked(topic, ps.d-len(mesh), mesh, true) {
+			mesh[id] = true
+		}
+	}
+	ps.mesh[topic] = mesh
+	out := &rpc{Control: &control{Graft: []graft{{Topic: topic}}}}
+	for id := range mesh {
+		ps.peers[id].send(out)
+	}
+}
+
+// leaveLocked prunes the peers in topic's mesh and drops it.
+func (ps *PubSub) leaveLocked(topic string) {
+	out := &rpc{Control: &control{Prune: []prune{{Topic: topic}}}}
+	for id := range ps.mesh[topic] {
+		ps.peers[id].send(out)
+	}
+	delete(ps.mesh, topic)
+}
+
+// candidatesLocked picks up to n random peers subscribed to topic that are
+// neither in exclude nor graylisted. With mesh set, the peers must also be
+// fit for the topic's mesh: not backing off from it and not badly scored.
+func (ps *PubSub) candidatesLocked(topic string, n int, exclude map[types.NodeID]bool, mesh bool) []types.NodeID {
+	now := ps.now()
+	var ids []types.NodeID
+	for id, p := range ps.peers {
+		if !p.topics[topic] || exclude[id] || ps.graylisted(id) {
+			continue
+		}
+		if mesh && (ps.backoff[topic][id].After(now) || ps.score(id) < 0) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	// Sort before shuffling so that a seeded node picks the same peers.
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	ps.rng.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// record reports ev against a peer to the scorer.
+func (ps *PubSub) record(id types.NodeID, ev trust.Event) {
+	if ps.scorer != nil {
+		ps.scorer.Record(id, ev)
+	}
+}
+
+func (ps *PubSub) score(id types.NodeID) float64 {
+	if ps.scorer == nil {
+		return 0
+	}
+	return ps.scorer.Score(id)
+}
+
+func (ps *PubSub) graylisted(id types.NodeID) bool {
+	return ps.scorer != nil && ps.scorer.Graylisted(id)
+}
+
+// sortedIDs returns the keys of set in order.
+func sortedIDs(set map[types.NodeID]bool) []types.NodeID {
+	ids := make([]types.NodeID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	return ids
+}
@@ -0,0 +1,379 @@
+package pubsub_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/network"
+	"trustmesh/network/pubsub"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// fast maintains meshes and gossips every few milliseconds.
+var fast = pubsub.Config{HeartbeatInterval: 20 * time.Millisecond}
+
+// newHost starts a network node named name on hub.
+func newHost(t *testing.T, hub *network.MemNetwork, name string) (network.P2PNetwork, *crypto.SigningKey) {
+	t.Helper()
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	n, err := network.NewNetwork(network.Config{
+		ListenAddr: "mem://:0",
+		Transports: []network.Transport{hub.Host(name)},
+		Key:        key,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close() })
+	return n, key
+}
+
+// newPubSub starts a pubsub node named name on hub.
+func newPubSub(t *testing.T, hub *network.MemNetwork, name string, cfg pubsub.Config) (network.P2PNetwork, *pubsub.PubSub) {
+	t.Helper()
+	n, key := newHost(t, hub, name)
+	cfg.Key = key
+	ps, err := pubsub.New(n, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { ps.Close() })
+	return n, ps
+}
+
+func connect(t *testing.T, a, b network.P2PNetwork) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.Connect(ctx, b.Self().URL())
+	require.NoError(t, err)
+}
+
+// receive returns the next message on ch.
+func receive(t *testing.T, ch <-chan *pubsub.Message) *pubsub.Message {
+	t.Helper()
+	select {
+	case m, ok := <-ch:
+		require.True(t, ok, "The subscription should be open.")
+		return m
+	case <-time.After(3 * time.Second):
+		t.Fatal("No message arrived.")
+		return nil
+	}
+}
+
+// quiet checks that nothing more arrives on ch for a while.
+func quiet(t *testing.T, ch <-chan *pubsub.Message) {
+	t.Helper()
+	select {
+	case m := <-ch:
+		t.Fatalf("Unexpected message %q.", m.Data)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestPublishReachesEverySubscriberOnce(t *testing.T) {
+	const size = 6
+	hub := network.NewMemNetwork(network.Link{Latency: time.Millisecond}, 1)
+	cfg := fast
+	cfg.D, cfg.Dlo, cfg.Dhi = 3, 2, 4
+	nets := make([]network.P2PNetwork, size)
+	nodes := make([]*pubsub.PubSub, size)
+	subs := make([]<-chan *pubsub.Message, size)
+	for i := range nodes {
+		nets[i], nodes[i] = newPubSub(t, hub, fmt.Sprintf("n%d", i), cfg)
+		for j := 0; j < i; j++ {
+			connect(t, nets[i], nets[j])
+		}
+	}
+	for i, ps := range nodes {
+		var err error
+		subs[i], err = ps.Subscribe("blocks")
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		for _, ps := range nodes {
+			if mesh := ps.MeshPeers("blocks"); len(mesh) < cfg.Dlo || len(mesh) > cfg.Dhi {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond, "Every mesh should settle between Dlo and Dhi peers.")
+	require.Eventually(t, func() bool {
+		for _, id := range nodes[0].MeshPeers("blocks") {
+			if !nets[0].ConnManager().IsProtected(id, pubsub.MeshProtectTag) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 20*time.Millisecond, "Mesh peers should be protected from connection trimming.")
+
+	require.NoError(t, nodes[0].Publish(context.Background(), "blocks", []byte("block 1")))
+	for i, ch := range subs {
+		m := receive(t, ch)
+		require.Equal(t, "block 1", string(m.Data))
+		require.Equal(t, nets[0].Self().ID, m.From, "Messages should name their publisher.")
+		if i > 0 {
+			require.NotContains(t, []types.NodeID{{}, nets[i].Self().ID}, m.ReceivedFrom, "Messages should arrive from a peer.")
+		}
+	}
+	for _, ch := range subs {
+		quiet(t, ch)
+	}
+}
+
+func TestValidatorsStopMessages(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	na, a := newPubSub(t, hub, "a", fast)
+	cfg := fast
+	cfg.Validators = map[string]pubsub.Validator{
+		"votes": func(ctx context.Context, m *pubsub.Message) error {
+			if string(m.Data) == "bad" {
+				return errors.New("bad vote")
+			}
+			return nil
+		},
+	}
+	nb, b := newPubSub(t, hub, "b", cfg)
+	nc, c := newPubSub(t, hub, "c", fast)
+	connect(t, na, nb)
+	connect(t, nb, nc)
+
+	subA, err := a.Subscribe("votes")
+	require.NoError(t, err)
+	subB, err := b.Subscribe("votes")
+	require.NoError(t, err)
+	subC, err := c.Subscribe("votes")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(a.MeshPeers("votes")) == 1 && len(c.MeshPeers("votes")) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, a.Publish(context.Background(), "votes", []byte("bad")))
+	require.NoError(t, a.Publish(context.Background(), "votes", []byte("good")))
+	require.Equal(t, "bad", string(receive(t, subA).Data), "The publisher has no validator for the topic.")
+	require.Equal(t, "good", string(receive(t, subA).Data))
+	require.Equal(t, "good", string(receive(t, subB).Data), "The validator should drop the bad message.")
+	require.Equal(t, "good", string(receive(t, subC).Data), "A rejected message should not be forwarded.")
+	quiet(t, subB)
+	quiet(t, subC)
+
+	err = b.Publish(context.Background(), "votes", []byte("bad"))
+	require.ErrorIs(t, err, pubsub.ErrRejected, "Local messages should be validated too.")
+}
+
+// rawFrame is the part of a gossip frame the tests inspect.
+type rawFrame struct {
+	Publish []*pubsub.Message `json:"publish"`
+	Control *struct {
+		IHave []struct {
+			Topic string             `json:"topic"`
+			IDs   []pubsub.MessageID `json:"ids"`
+		} `json:"ihave"`
+	} `json:"control"`
+}
+
+// rawPeer connects a node speaking the gossip protocol by hand to target,
+// returning the stream it writes frames to and the frames it receives.
+func rawPeer(t *testing.T, hub *network.MemNetwork, target network.P2PNetwork) (io.Writer, <-chan rawFrame) {
+	t.Helper()
+	x, _ := newHost(t, hub, "x")
+	frames := make(chan rawFrame, 64)
+	x.Handle(network.GossipProtocol.Name, func(ctx context.Context, rw io.ReadWriteCloser) error {
+		for {
+			var f rawFrame
+			if err := network.ReadMessage(rw, &f); err != nil {
+				return err
+			}
+			frames <- f
+		}
+	})
+	connect(t, x, target)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := x.NewStream(ctx, target.Self(), network.GossipProtocol.Name)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, frames
+}
+
+func TestForgedAndDuplicateMessagesAreDropped(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	_, publisher := newPubSub(t, hub, "p", fast)
+	own, err := publisher.Subscribe("t")
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish(context.Background(), "t", []byte("one")))
+	require.NoError(t, publisher.Publish(context.Background(), "t", []byte("two")))
+	one, two := receive(t, own), receive(t, own)
+
+	nb, b := newPubSub(t, hub, "b", fast)
+	sub, err := b.Subscribe("t")
+	require.NoError(t, err)
+	x, _ := rawPeer(t, hub, nb)
+
+	tampered := *one
+	tampered.Data = []byte("three")
+	impostor := *one
+	impostor.From = types.NewNodeID([]byte("someone else"))
+	send := func(msgs ...*pubsub.Message) {
+		require.NoError(t, network.WriteMessage(x, map[string]interface{}{"publish": msgs}))
+	}
+	send(&tampered, &impostor, one, one)
+	send(one, two)
+
+	got := receive(t, sub)
+	require.Equal(t, "one", string(got.Data), "Forged messages should be dropped.")
+	require.Equal(t, one.ID(), got.ID())
+	require.Equal(t, "two", string(receive(t, sub).Data), "Duplicates should be dropped.")
+	quiet(t, sub)
+}
+
+func TestGossipRecoversMessagesOutsideTheMesh(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	na, a := newPubSub(t, hub, "a", fast)
+	own, err := a.Subscribe("t")
+	require.NoError(t, err)
+
+	// The raw peer joins the topic but leaves a's mesh, so it only hears of
+	// messages through IHAVE gossip.
+	x, frames := rawPeer(t, hub, na)
+	require.NoError(t, network.WriteMessage(x, map[string]interface{}{
+		"subscriptions": []map[string]interface{}{{"subscribe": true, "topic": "t"}},
+		"control":       map[string]interface{}{"prune": []map[string]string{{"topic": "t"}}},
+	}))
+	require.NoError(t, a.Publish(context.Background(), "t", []byte("hello")))
+	id := receive(t, own).ID()
+
+	deadline := time.After(3 * time.Second)
+	for advertised := false; !advertised; {
+		select {
+		case f := <-frames:
+			require.Empty(t, f.Publish, "A pruned peer should not be sent messages in full.")
+			if f.Control == nil {
+				continue
+			}
+			for _, ih := range f.Control.IHave {
+				advertised = advertised || (ih.Topic == "t" && len(ih.IDs) == 1 && ih.IDs[0] == id)
+			}
+		case <-deadline:
+			t.Fatal("The message was never advertised.")
+		}
+	}
+
+	require.NoError(t, network.WriteMessage(x, map[string]interface{}{
+		"control": map[string]interface{}{"iwant": []map[string]interface{}{{"ids": []pubsub.MessageID{id}}}},
+	}))
+	for {
+		select {
+		case f := <-frames:
+			if len(f.Publish) == 0 {
+				continue
+			}
+			require.Equal(t, "hello", string(f.Publish[0].Data), "IWANT should fetch the advertised message.")
+			require.Equal(t, id, f.Publish[0].ID())
+			return
+		case <-deadline:
+			t.Fatal("The wanted message never arrived.")
+		}
+	}
+}
+
+func TestInvalidGossipGraylistsPeers(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	_, publisher := newPubSub(t, hub, "p", fast)
+	own, err := publisher.Subscribe("t")
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish(context.Background(), "t", []byte("real")))
+	genuine := receive(t, own)
+
+	scores := trust.NewEngine(trust.Config{})
+	cfg := fast
+	cfg.Scorer = scores
+	nb, b := newPubSub(t, hub, "b", cfg)
+	sub, err := b.Subscribe("t")
+	require.NoError(t, err)
+	x, _ := rawPeer(t, hub, nb)
+	var xid types.NodeID
+	for _, n := range nb.Nodes() {
+		xid = n.ID
+	}
+
+	for i := 0; i < 3; i++ {
+		forged := *genuine
+		forged.Data = []byte(fmt.Sprint("forged ", i))
+		require.NoError(t, network.WriteMessage(x, map[string]interface{}{"publish": []*pubsub.Message{&forged}}))
+	}
+	require.Eventually(t, func() bool { return scores.Graylisted(xid) }, 2*time.Second, 10*time.Millisecond,
+		"Forwarding forgeries should graylist the peer.")
+
+	require.NoError(t, network.WriteMessage(x, map[string]interface{}{"publish": []*pubsub.Message{genuine}}))
+	quiet(t, sub)
+}
+
+func TestPeerLimits(t *testing.T) {
+	hub := network.NewMemNetwork(network.Link{}, 1)
+	scores := trust.NewEngine(trust.Config{})
+	cfg := fast
+	cfg.HistoryLength = 500
+	cfg.Scorer = scores
+	cfg.MaxSubscriptions, cfg.MaxIWantLength, cfg.GossipRetransmission = 2, 2, 1
+	na, a := newPubSub(t, hub, "a", cfg)
+	own, err := a.Subscribe("t")
+	require.NoError(t, err)
+	var ids []pubsub.MessageID
+	for i := 0; i < 3; i++ {
+		require.NoError(t, a.Publish(context.Background(), "t", []byte(fmt.Sprint("m", i))))
+		ids = append(ids, receive(t, own).ID())
+	}
+
+	x, frames := rawPeer(t, hub, na)
+	var xid types.NodeID
+	for _, n := range na.Nodes() {
+		xid = n.ID
+	}
+	published := func() []*pubsub.Message {
+		timeout := time.After(300 * time.Millisecond)
+		for {
+			select {
+			case f := <-frames:
+				if len(f.Publish) > 0 {
+					return f.Publish
+				}
+			case <-timeout:
+				return nil
+			}
+		}
+	}
+	iwant := func(ids ...pubsub.MessageID) {
+		require.NoError(t, network.WriteMessage(x, map[string]interface{}{
+			"control": map[string]interface{}{"iwant": []map[string]interface{}{{"ids": ids}}},
+		}))
+	}
+
+	iwant(ids...)
+	got := published()
+	require.Len(t, got, 2, "An IWANT should be answered up to MaxIWantLength messages.")
+	require.Equal(t, ids[:2], []pubsub.MessageID{got[0].ID(), got[1].ID()})
+	require.Eventually(t, func() bool { return scores.Score(xid) < 0 }, 2*time.Second, 10*time.Millisecond,
+		"Asking for too many messages should count against the peer.")
+
+	iwant(ids[2])
+	got = published()
+	require.Len(t, got, 1)
+	require.Equal(t, ids[2], got[0].ID())
+	iwant(ids[2])
+	require.Empty(t, published(), "A message should be resent only GossipRetransmission times.")
+
+	before := scores.Score(xid)
+	topics := []map[string]interface{}{}
+	for _, topic := range []string{"t", "u", "v", "w"} {
+		topics = append(topics, map[string]interface{}{"subscribe": true, "topic": topic})
+	}
+	require.NoError(t, network.WriteMessage(x, map[string]interface{}{"subscriptions": topics}))
+	require.Eventually(t, func() bool { return scores.Score(xid) < before }, 2*time.Second, 10*time.Millisecond,
+		"Subscribing beyond MaxSubscriptions should count against the peer.")
+}
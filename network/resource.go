@@ -0,0 +1,465 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"trustmesh/network/smux"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultSystemStreams and DefaultSystemMemory bound the inbound
+	// streams of every peer together.
+	DefaultSystemStreams = 2048
+	DefaultSystemMemory  = 1 << 30
+	// DefaultPeerStreams and DefaultPeerMemory bound the inbound streams of
+	// one peer.
+	DefaultPeerStreams = 128
+	DefaultPeerMemory  = 64 << 20
+	// DefaultProtocolStreams and DefaultProtocolMemory bound the inbound
+	// streams of one protocol across peers.
+	DefaultProtocolStreams = 1024
+	DefaultProtocolMemory  = 512 << 20
+	// DefaultPeerRate is how many streams a second a peer may open, with
+	// bursts of up to DefaultPeerBurst.
+	DefaultPeerRate  = 100
+	DefaultPeerBurst = 200
+	// DefaultProtocolRate is how many streams a second a peer may open for
+	// one protocol, with bursts of up to DefaultProtocolBurst.
+	DefaultProtocolRate  = 50
+	DefaultProtocolBurst = 100
+	// resourceSweepInterval is how often the state of idle peers is
+	// dropped.
+	resourceSweepInterval = time.Minute
+)
+
+var (
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	ErrPeerLimit     = errors.New("peer exceeded its resource budget")
+	ErrResourceLimit = errors.New("resource limit exceeded")
+)
+
+// Limits bounds the inbound streams open at once in a scope and the memory
+// they hold. Zero fields take the scope's default and negative ones are
+// unlimited.
+type Limits struct {
+	Streams int
+	Memory  int64
+}
+
+func (l Limits) withDefaults(def Limits) Limits {
+	if l.Streams == 0 {
+		l.Streams = def.Streams
+	}
+	if l.Memory == 0 {
+		l.Memory = def.Memory
+	}
+	return l
+}
+
+// fits reports whether used leaves room for streams and memory more.
+func (l Limits) fits(used Usage, streams int, memory int64) bool {
+	return (l.Streams < 0 || used.Streams+streams <= l.Streams) &&
+		(l.Memory < 0 || used.Memory+memory <= l.Memory)
+}
+
+// Rate is a token bucket holding up to Burst tokens and refilled with
+// PerSecond a second. Every inbound stream takes a token, which pays for the
+// first message read from it, and every further message takes another. A
+// zero Rate takes the default and a negative PerSecond is unlimited.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (r Rate) withDefaults(def Rate) Rate {
+	if r.PerSecond == 0 {
+		r = def
+	}
+	if r.Burst <= 0 {
+		r.Burst = max(int(r.PerSecond), 1)
+	}
+	return r
+}
+
+// ResourceConfig sets the rate limits and budgets of inbound streams.
+type ResourceConfig struct {
+	// System bounds the streams of every peer together, Peer those of each
+	// peer and Protocol those of each protocol across peers, unless
+	// Protocols sets limits for it.
+	System, Peer, Protocol Limits
+	Protocols              map[string]Limits
+	// PeerRate limits how fast each peer opens streams and sends messages
+	// over them, and ProtocolRate how fast it does so for each protocol,
+	// unless ProtocolRates sets a rate for it.
+	PeerRate, ProtocolRate Rate
+	ProtocolRates          map[string]Rate
+}
+
+// Usage is what a scope currently holds.
+type Usage struct {
+	Streams int   `json:"streams"`
+	Memory  int64 `json:"memory"`
+}
+
+func (u *Usage) add(streams int, memory int64) {
+	u.Streams += streams
+	u.Memory += memory
+}
+
+func (u Usage) zero() bool {
+	return u.Streams == 0 && u.Memory == 0
+}
+
+// ResourceUsage is the usage of every scope.
+type ResourceUsage struct {
+	System    Usage                  `json:"system"`
+	Peers     map[types.NodeID]Usage `json:"peers"`
+	Protocols map[string]Usage       `json:"protocols"`
+}
+
+// ResourceManager rate limits the inbound streams peers open and accounts
+// for the streams and memory they hold, per peer, per protocol and
+// system-wide. Each stream holds the receive window its peer may fill and
+// the frames being decoded from it.
+type ResourceManager struct {
+	system, peer, protocol Limits
+	protocols              map[string]Limits
+	peerRate, protocolRate Rate
+	protocolRates          map[string]Rate
+	// window is the memory each stream holds for its receive buffer.
+	window int64
+	now    func() time.Time
+
+	mu        sync.Mutex
+	used      Usage
+	peers     map[types.NodeID]*peerResources
+	protoUsed map[string]*Usage
+	lastSweep time.Time
+}
+
+// peerResources is what one peer holds and its rate limits.
+type peerResources struct {
+	used      Usage
+	rate      bucket
+	protocols map[string]*bucket
+}
+
+func newResourceManager(cfg ResourceConfig, window uint32, now func() time.Time) *ResourceManager {
+	if window == 0 {
+		window = smux.DefaultStreamWindow
+	}
+	rm := &ResourceManager{
+		system:        cfg.System.withDefaults(Limits{Streams: DefaultSystemStreams, Memory: DefaultSystemMemory}),
+		peer:          cfg.Peer.withDefaults(Limits{Streams: DefaultPeerStreams, Memory: DefaultPeerMemory}),
+		protocol:      cfg.Protocol.withDefaults(Limits{Streams: DefaultProtocolStreams, Memory: DefaultProtocolMemory}),
+		protocols:     make(map[string]Limits),
+		peerRate:      cfg.PeerRate.withDefaults(Rate{PerSecond: DefaultPeerRate, Burst: DefaultPeerBurst}),
+		protocolRate:  cfg.ProtocolRate.withDefaults(Rate{PerSecond: DefaultProtocolRate, Burst: DefaultProtocolBurst}),
+		protocolRates: make(map[string]Rate),
+		window:        int64(window),
+		now:           now,
+		peers:         make(map[types.NodeID]*peerResources),
+		protoUsed:     make(map[string]*Usage),
+		lastSweep:     now(),
+	}
+	for path, l := range cfg.Protocols {
+		rm.protocols[path] = l.withDefaults(rm.protocol)
+	}
+	for path, r := range cfg.ProtocolRates {
+		rm.protocolRates[path] = r.withDefaults(rm.protocolRate)
+	}
+	return rm
+}
+
+// Usage returns what every scope currently holds.
+func (rm *ResourceManager) Usage() ResourceUsage {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	u := ResourceUsage{
+		System:    rm.used,
+		Peers:     make(map[types.NodeID]Usage),
+		Protocols: make(map[string]Usage),
+	}
+	for id, p := range rm.peers {
+		if !p.used.zero() {
+			u.Peers[id] = p.used
+		}
+	}
+	for path, used := range rm.protoUsed {
+		u.Protocols[path] = *used
+	}
+	return u
+}
+
+// openStream admits an inbound stream from peer, charging it a token and
+// its receive window.
+func (rm *ResourceManager) openStream(peer types.NodeID) (*streamScope, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	now := rm.now()
+	rm.sweepLocked(now)
+	p := rm.peers[peer]
+	if p == nil {
+		p = &peerResources{rate: newBucket(rm.peerRate, now), protocols: make(map[string]*bucket)}
+		rm.peers[peer] = p
+	}
+	if !p.rate.take(rm.peerRate, now) {
+		return nil, fmt.Errorf("%w: streams from peer", ErrRateLimited)
+	}
+	if !rm.peer.fits(p.used, 1, rm.window) {
+		return nil, fmt.Errorf("%w: streams from peer", ErrPeerLimit)
+	}
+	if !rm.system.fits(rm.used, 1, rm.window) {
+		return nil, fmt.Errorf("%w: system streams", ErrResourceLimit)
+	}
+	p.used.add(1, rm.window)
+	rm.used.add(1, rm.window)
+	return &streamScope{rm: rm, peer: peer, memory: rm.window}, nil
+}
+
+// sweepLocked forgets, about once a minute, the peers holding nothing whose
+// rate limits have recovered in full.
+func (rm *ResourceManager) sweepLocked(now time.Time) {
+	if now.Sub(rm.lastSweep) < resourceSweepInterval {
+		return
+	}
+	rm.lastSweep = now
+	for id, p := range rm.peers {
+		if !p.used.zero() || !p.rate.full(rm.peerRate, now) {
+			continue
+		}
+		idle := true
+		for path, b := range p.protocols {
+			if !b.full(rm.rateFor(path), now) {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(rm.peers, id)
+		}
+	}
+	for path, used := range rm.protoUsed {
+		if used.zero() {
+			delete(rm.protoUsed, path)
+		}
+	}
+}
+
+func (rm *ResourceManager) rateFor(path string) Rate {
+	if r, ok := rm.protocolRates[path]; ok {
+		return r
+	}
+	return rm.protocolRate
+}
+
+func (rm *ResourceManager) limitsFor(path string) Limits {
+	if l, ok := rm.protocols[path]; ok {
+		return l
+	}
+	return rm.protocol
+}
+
+// streamScope is what one inbound stream holds.
+type streamScope struct {
+	rm       *ResourceManager
+	peer     types.NodeID
+	protocol string
+	memory   int64
+	messages int
+	closed   bool
+}
+
+// setProtocol charges the stream to the protocol negotiated for it.
+func (s *streamScope) setProtocol(path string) error {
+	rm := s.rm
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	now := rm.now()
+	p := rm.peers[s.peer]
+	b := p.protocols[path]
+	if b == nil {
+		fresh := newBucket(rm.rateFor(path), now)
+		b = &fresh
+		p.protocols[path] = b
+	}
+	if !b.take(rm.rateFor(path), now) {
+		return fmt.Errorf("%w: %s streams from peer", ErrRateLimited, path)
+	}
+	used := rm.protoUsed[path]
+	if used == nil {
+		used = &Usage{}
+		rm.protoUsed[path] = used
+	}
+	if !rm.limitsFor(path).fits(*used, 1, s.memory) {
+		return fmt.Errorf("%w: %s streams", ErrResourceLimit, path)
+	}
+	used.add(1, s.memory)
+	s.protocol = path
+	return nil
+}
+
+// chargeMessage takes a token from the peer's and the protocol's buckets for
+// a message read from the stream. The tokens the stream took when it opened
+// pay for the protocol negotiation and the first message.
+func (s *streamScope) chargeMessage() error {
+	rm := s.rm
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if s.closed {
+		return ErrResourceLimit
+	}
+	if s.protocol == "" {
+		return nil
+	}
+	if s.messages++; s.messages == 1 {
+		return nil
+	}
+	now := rm.now()
+	p := rm.peers[s.peer]
+	if !p.rate.take(rm.peerRate, now) {
+		return fmt.Errorf("%w: messages from peer", ErrRateLimited)
+	}
+	if !p.protocols[s.protocol].take(rm.rateFor(s.protocol), now) {
+		return fmt.Errorf("%w: %s messages from peer", ErrRateLimited, s.protocol)
+	}
+	return nil
+}
+
+// reserveMemory charges n bytes to the stream until the returned function
+// is called.
+func (s *streamScope) reserveMemory(n int64) (func(), error) {
+	rm := s.rm
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrResourceLimit
+	}
+	p := rm.peers[s.peer]
+	if !rm.peer.fits(p.used, 0, n) {
+		return nil, fmt.Errorf("%w: memory of peer", ErrPeerLimit)
+	}
+	var proto *Usage
+	if s.protocol != "" {
+		proto = rm.protoUsed[s.protocol]
+		if !rm.limitsFor(s.protocol).fits(*proto, 0, n) {
+			return nil, fmt.Errorf("%w: %s memory", ErrResourceLimit, s.protocol)
+		}
+	}
+	if !rm.system.fits(rm.used, 0, n) {
+		return nil, fmt.Errorf("%w: system memory", ErrResourceLimit)
+	}
+	p.used.add(0, n)
+	rm.used.add(0, n)
+	if proto != nil {
+		proto.add(0, n)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rm.mu.Lock()
+			defer rm.mu.Unlock()
+			p.used.add(0, -n)
+			rm.used.add(0, -n)
+			if proto != nil {
+				proto.add(0, -n)
+			}
+		})
+	}, nil
+}
+
+// done releases what the stream holds.
+func (s *streamScope) done() {
+	rm := s.rm
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	rm.peers[s.peer].used.add(-1, -s.memory)
+	rm.used.add(-1, -s.memory)
+	if s.protocol != "" {
+		rm.protoUsed[s.protocol].add(-1, -s.memory)
+	}
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(r Rate, now time.Time) bucket {
+	return bucket{tokens: float64(r.Burst), last: now}
+}
+
+// take takes a token if one is left.
+func (b *bucket) take(r Rate, now time.Time) bool {
+	if r.PerSecond < 0 {
+		return true
+	}
+	b.refill(r, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) full(r Rate, now time.Time) bool {
+	if r.PerSecond < 0 {
+		return true
+	}
+	b.refill(r, now)
+	return b.tokens >= float64(r.Burst)
+}
+
+func (b *bucket) refill(r Rate, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(float64(r.Burst), b.tokens+elapsed.Seconds()*r.PerSecond)
+		b.last = now
+	}
+}
+
+// managedStream is an inbound stream charged to its scope. ReadMessage
+// charges every message it reads from it and reserves the frames it
+// decodes.
+type managedStream struct {
+	*smux.Stream
+	scope *streamScope
+}
+
+func (s *managedStream) reserveMemory(n int64) (func(), error) {
+	return s.scope.reserveMemory(n)
+}
+
+func (s *managedStream) chargeMessage() error {
+	return s.scope.chargeMessage()
+}
+
+// memoryReserver is a stream whose memory use is accounted for.
+type memoryReserver interface {
+	reserveMemory(n int64) (func(), error)
+}
+
+// messageCharger is a stream whose messages are rate limited.
+type messageCharger interface {
+	chargeMessage() error
+}
+
+// overLimit reports whether a stream was refused because its peer exceeded
+// its rate limit or budget.
+func overLimit(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrPeerLimit)
+}
@@ -0,0 +1,112 @@
+package network_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"trustmesh/network"
+	"trustmesh/network/smux"
+	"trustmesh/trust"
+)
+
+func TestRateLimitsPerPeerAndProtocol(t *testing.T) {
+	const other = "/test/other/1.0.0"
+	scores := trust.NewEngine(trust.Config{})
+	node := newNetwork(t, network.Config{Scorer: scores, Resources: network.ResourceConfig{
+		PeerRate:      network.Rate{PerSecond: 0.1, Burst: 4},
+		ProtocolRates: map[string]network.Rate{network.PingProtocol.Name: {PerSecond: 0.1, Burst: 2}},
+	}})
+	node.Handle(other, func(ctx context.Context, rw io.ReadWriteCloser) error {
+		_, err := io.Copy(io.Discard, rw)
+		return err
+	})
+	peer := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		_, err := peer.Ping(ctx, node.Self())
+		require.NoError(t, err)
+	}
+	_, err := peer.Ping(ctx, node.Self())
+	require.ErrorIs(t, err, network.ErrRateLimited, "Streams beyond the protocol's burst should be refused.")
+
+	_, err = peer.NewStream(ctx, node.Self(), other)
+	require.NoError(t, err, "Other protocols should have their own bucket.")
+	_, err = peer.NewStream(ctx, node.Self(), other)
+	require.Error(t, err, "Streams beyond the peer's burst should be refused.")
+
+	require.Eventually(t, func() bool { return scores.Score(peer.Self().ID) < trust.DefaultWeights[trust.LimitExceeded] },
+		2*time.Second, 10*time.Millisecond, "Exceeding limits should count against the peer.")
+}
+
+func TestRateLimitsChargeEveryMessage(t *testing.T) {
+	scores := trust.NewEngine(trust.Config{})
+	node := newNetwork(t, network.Config{Scorer: scores, Resources: network.ResourceConfig{
+		ProtocolRates: map[string]network.Rate{network.PingProtocol.Name: {PerSecond: 0.1, Burst: 3}},
+	}})
+	peer := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := peer.NewStream(ctx, node.Self(), network.PingProtocol.Name)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err := network.Ping(ctx, s)
+		require.NoError(t, err, "The stream's token and the protocol's burst should pay for the first pings.")
+	}
+	_, err = network.Ping(ctx, s)
+	require.Error(t, err, "Pings beyond the protocol's burst should end the stream.")
+	require.Eventually(t, func() bool { return scores.Score(peer.Self().ID) < 0 },
+		2*time.Second, 10*time.Millisecond, "Exceeding limits should count against the peer.")
+}
+
+func TestResourceBudgets(t *testing.T) {
+	const echo = "/test/echo/1.0.0"
+	window := int64(smux.DefaultStreamWindow)
+	node := newNetwork(t, network.Config{Resources: network.ResourceConfig{
+		Peer: network.Limits{Streams: 1, Memory: window + 1024},
+	}})
+	release := make(chan struct{})
+	node.Handle(echo, func(ctx context.Context, rw io.ReadWriteCloser) error {
+		var msg string
+		if err := network.ReadMessage(rw, &msg); err != nil {
+			return err
+		}
+		<-release
+		return network.WriteMessage(rw, msg)
+	})
+	peer := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := peer.NewStream(ctx, node.Self(), echo)
+	require.NoError(t, err)
+	require.NoError(t, network.WriteMessage(s, "hello"))
+	require.Eventually(t, func() bool {
+		u := node.ResourceManager().Usage()
+		return u.Peers[peer.Self().ID].Streams == 1 && u.Protocols[echo].Streams == 1 && u.System.Memory == window
+	}, 2*time.Second, 10*time.Millisecond, "Open streams should be accounted for in every scope.")
+
+	_, err = peer.NewStream(ctx, node.Self(), echo)
+	require.Error(t, err, "Streams beyond the peer's budget should be refused.")
+
+	close(release)
+	var reply string
+	require.NoError(t, network.ReadMessage(s, &reply))
+	require.Equal(t, "hello", reply)
+	s.Close()
+	require.Eventually(t, func() bool { return node.ResourceManager().Usage().System == network.Usage{} },
+		2*time.Second, 10*time.Millisecond, "Closed streams should release what they held.")
+
+	s, err = peer.NewStream(ctx, node.Self(), echo)
+	require.NoError(t, err)
+	require.NoError(t, network.WriteMessage(s, strings.Repeat("x", 4096)))
+	data, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Empty(t, data, "Frames beyond the peer's memory budget should be refused.")
+}
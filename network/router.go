@@ -0,0 +1,255 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"trustmesh/types"
+)
+
+var (
+	ErrProtocolNotSupported = errors.New("protocol not supported")
+	ErrInvalidProtocol      = errors.New("invalid protocol path")
+	ErrHandlerRegistered    = errors.New("a handler is already registered for the protocol")
+)
+
+// StreamHandler serves one inbound stream of a protocol.
+type StreamHandler func(ctx context.Context, rw io.ReadWriteCloser) error
+
+// Router dispatches inbound streams to the handlers services register by
+// protocol path, such as "/trustmesh/ping/1.0.0". The last element of a path
+// is a semantic version: a stream asking for 1.2.0 is served by the newest
+// registered 1.x.y that is at least 1.2.0.
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string][]route
+}
+
+// route is a handler for one version of a protocol.
+type route struct {
+	path    string
+	version version
+	handler StreamHandler
+}
+
+var _ types.ProtocolHandler = (*Router)(nil).Handle
+
+// NewRouter creates a router with no protocols.
+func NewRouter() *Router {
+	return &Router{routes: make(map[string][]route)}
+}
+
+// Register adds h as the handler for path.
+func (r *Router) Register(path string, h StreamHandler) error {
+	base, v, err := parseProtocol(path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := r.routes[base]
+	for _, rt := range routes {
+		if rt.version == v {
+			return fmt.Errorf("%w: %s", ErrHandlerRegistered, path)
+		}
+	}
+	routes = append(routes, route{path: path, version: v, handler: h})
+	sort.Slice(routes, func(i, j int) bool { return routes[j].version.less(routes[i].version) })
+	r.routes[base] = routes
+	return nil
+}
+
+// Handle is Register for handlers known to be valid; it panics on a bad or
+// duplicate path, as http.Handle does.
+func (r *Router) Handle(path string, h func(ctx context.Context, rw io.ReadWriteCloser) error) {
+	if err := r.Register(path, h); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the handler for path.
+func (r *Router) Unregister(path string) {
+	base, v, err := parseProtocol(path)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := r.routes[base]
+	for i, rt := range routes {
+		if rt.version == v {
+			routes = append(routes[:i:i], routes[i+1:]...)
+			break
+		}
+	}
+	if len(routes) == 0 {
+		delete(r.routes, base)
+	} else {
+		r.routes[base] = routes
+	}
+}
+
+// Protocols returns the registered protocol paths, sorted.
+func (r *Router) Protocols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var paths []string
+	for _, routes := range r.routes {
+		for _, rt := range routes {
+			paths = append(paths, rt.path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// match returns the route serving the first of paths the router supports.
+func (r *Router) match(paths []string) (route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range paths {
+		base, want, err := parseProtocol(path)
+		if err != nil {
+			continue
+		}
+		for _, rt := range r.routes[base] {
+			if rt.version.major == want.major && !rt.version.less(want) {
+				return rt, true
+			}
+		}
+	}
+	return route{}, false
+}
+
+// protocolSelect proposes protocols for a stream in order of preference.
+type protocolSelect struct {
+	Protocols []string `json:"protocols"`
+}
+
+// protocolSelected answers a protocolSelect with the path that will serve
+// the stream, or why none will.
+type protocolSelected struct {
+	Protocol string `json:"protocol,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Serve negotiates the protocol of the inbound stream rw and runs its
+// handler. rw is closed when Serve returns.
+func (r *Router) Serve(ctx context.Context, rw io.ReadWriteCloser) error {
+	return r.serve(ctx, rw, nil)
+}
+
+// serve is Serve with admit, when set, deciding whether the negotiated
+// protocol may serve the stream.
+func (r *Router) serve(ctx context.Context, rw io.ReadWriteCloser, admit func(path string) error) error {
+	defer rw.Close()
+
+	clearDeadline := applyDeadline(ctx, rw)
+	var req protocolSelect
+	if err := ReadMessage(rw, &req); err != nil {
+		return err
+	}
+	rt, ok := r.match(req.Protocols)
+	if !ok {
+		WriteMessage(rw, &protocolSelected{Error: ErrProtocolNotSupported.Error()})
+		return fmt.Errorf("%w: %s", ErrProtocolNotSupported, strings.Join(req.Protocols, ", "))
+	}
+	if admit != nil {
+		if err := admit(rt.path); err != nil {
+			WriteMessage(rw, &protocolSelected{Error: err.Error()})
+			return err
+		}
+	}
+	if err := WriteMessage(rw, &protocolSelected{Protocol: rt.path}); err != nil {
+		return err
+	}
+	clearDeadline()
+	return rt.handler(ctx, rw)
+}
+
+// Select proposes paths over the outbound stream rw in order of preference
+// and returns the path the remote router chose to serve it.
+func Select(ctx context.Context, rw io.ReadWriter, paths ...string) (string, error) {
+	defer applyDeadline(ctx, rw)()
+
+	if err := WriteMessage(rw, &protocolSelect{Protocols: paths}); err != nil {
+		return "", err
+	}
+	var resp protocolSelected
+	if err := ReadMessage(rw, &resp); err != nil {
+		return "", err
+	}
+	if resp.Error != "" {
+		if resp.Error == ErrProtocolNotSupported.Error() {
+			return "", fmt.Errorf("%w: %s", ErrProtocolNotSupported, strings.Join(paths, ", "))
+		}
+		for _, known := range []error{ErrRateLimited, ErrPeerLimit, ErrResourceLimit} {
+			if detail, ok := strings.CutPrefix(resp.Error, known.Error()); ok {
+				return "", fmt.Errorf("%w%s", known, detail)
+			}
+		}
+		return "", errors.New(resp.Error)
+	}
+	for _, path := range paths {
+		if sameProtocol(path, resp.Protocol) {
+			return resp.Protocol, nil
+		}
+	}
+	return "", fmt.Errorf("%w: remote chose %q", ErrInvalidProtocol, resp.Protocol)
+}
+
+// sameProtocol reports whether the remote's choice chosen serves path.
+func sameProtocol(path, chosen string) bool {
+	base, want, err := parseProtocol(path)
+	if err != nil {
+		return false
+	}
+	chosenBase, got, err := parseProtocol(chosen)
+	return err == nil && base == chosenBase && got.major == want.major && !got.less(want)
+}
+
+// version is the semantic version ending a protocol path.
+type version struct {
+	major, minor, patch int
+}
+
+func (v version) less(o version) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+// parseProtocol splits a path such as "/trustmesh/ping/1.0.0" into its name
+// and version.
+func parseProtocol(path string) (string, version, error) {
+	i := strings.LastIndexByte(path, '/')
+	if !strings.HasPrefix(path, "/") || i <= 0 {
+		return "", version{}, fmt.Errorf("%w: %q", ErrInvalidProtocol, path)
+	}
+	parts := strings.Split(path[i+1:], ".")
+	if len(parts) != 3 {
+		return "", version{}, fmt.Errorf("%w: %q", ErrInvalidProtocol, path)
+	}
+	var nums [3]int
+	for j, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return "", version{}, fmt.Errorf("%w: %q", ErrInvalidProtocol, path)
+		}
+		nums[j] = n
+	}
+	return path[:i], version{major: nums[0], minor: nums[1], patch: nums[2]}, nil
+}
@@ -0,0 +1,126 @@
+package network_test
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/network"
+	"trustmesh/qdht"
+)
+
+// selectOver runs Select against router over an in-memory connection.
+func selectOver(t *testing.T, router *network.Router, paths ...string) (string, error) {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go router.Serve(ctx, b)
+	return network.Select(ctx, a, paths...)
+}
+
+func TestRouterMatchesCompatibleVersions(t *testing.T) {
+	router := network.NewRouter()
+	noop := func(context.Context, io.ReadWriteCloser) error { return nil }
+	require.NoError(t, router.Register("/app/echo/1.0.0", noop))
+	require.NoError(t, router.Register("/app/echo/1.2.0", noop))
+	require.NoError(t, router.Register("/app/echo/2.0.1", noop))
+
+	require.ErrorIs(t, router.Register("/app/echo/1.2.0", noop), network.ErrHandlerRegistered)
+	require.ErrorIs(t, router.Register("/app/echo/latest", noop), network.ErrInvalidProtocol)
+	require.Panics(t, func() { router.Handle("echo", noop) }, "Handle should panic on a bad path.")
+	require.Equal(t, []string{"/app/echo/1.0.0", "/app/echo/1.2.0", "/app/echo/2.0.1"}, router.Protocols())
+
+	path, err := selectOver(t, router, "/app/echo/1.1.0")
+	require.NoError(t, err)
+	require.Equal(t, "/app/echo/1.2.0", path, "The newest compatible version should serve the stream.")
+
+	path, err = selectOver(t, router, "/app/echo/3.0.0", "/app/echo/2.0.0")
+	require.NoError(t, err)
+	require.Equal(t, "/app/echo/2.0.1", path, "Later proposals should be tried in order.")
+
+	_, err = selectOver(t, router, "/app/echo/1.3.0")
+	require.ErrorIs(t, err, network.ErrProtocolNotSupported, "No registered 1.x is new enough.")
+
+	router.Unregister("/app/echo/1.2.0")
+	path, err = selectOver(t, router, "/app/echo/1.0.0")
+	require.NoError(t, err)
+	require.Equal(t, "/app/echo/1.0.0", path)
+}
+
+func TestNetworkStreams(t *testing.T) {
+	a := newNetwork(t, network.Config{})
+	b := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rtt, err := a.Ping(ctx, b.Self())
+	require.NoError(t, err, "Ping should be registered on every node.")
+	require.Positive(t, rtt)
+	require.Contains(t, a.Nodes(), b.Self().ID.String(), "Streams should run over the peer connection.")
+
+	peers := make(chan string, 1)
+	b.Handle("/app/echo/1.0.0", func(ctx context.Context, rw io.ReadWriteCloser) error {
+		peers <- network.PeerFromContext(ctx).ID.String()
+		_, err := io.Copy(rw, rw)
+		return err
+	})
+	s, err := a.NewStream(ctx, b.Self(), "/app/echo/1.0.0")
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, "/app/echo/1.0.0", s.Protocol)
+	require.Equal(t, b.Self().ID, s.Peer.ID)
+	require.Equal(t, a.Self().ID.String(), <-peers, "Handlers should learn the authenticated peer.")
+
+	_, err = s.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(s, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	_, err = a.NewStream(ctx, b.Self(), "/app/missing/1.0.0")
+	require.ErrorIs(t, err, network.ErrProtocolNotSupported)
+}
+
+func TestDHTOverNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var nodes []*qdht.DHT
+	for i := 0; i < 4; i++ {
+		key, err := crypto.NewSigningKey()
+		require.NoError(t, err)
+		n := newNetwork(t, network.Config{Key: key})
+		d, err := qdht.New(qdht.Config{Self: n.Self(), Key: key, Messenger: network.DHTMessenger{Network: n}})
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Close() })
+		n.Handle(network.DHTProtocol.Name, network.ServeDHT(d))
+		n.Handle(network.BlockProtocol.Name, network.ServeBlocks(d))
+		if i > 0 {
+			require.NoError(t, d.Join(qdht.NodeOf(nodes[0].Self())), "Joining over the network should not fail.")
+		}
+		nodes = append(nodes, d)
+	}
+
+	value := make([]byte, 32)
+	rand.Read(value)
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/app/doc", value)))
+	got, err := nodes[3].GetRecord(ctx, "/app/doc")
+	require.NoError(t, err, "Records should travel over DHT streams.")
+	require.Equal(t, value, got.Value())
+
+	content := make([]byte, 64<<10)
+	rand.Read(content)
+	c, err := nodes[2].ProvideContent(ctx, content)
+	require.NoError(t, err)
+	fetched, err := nodes[0].FetchContent(ctx, c)
+	require.NoError(t, err, "Blocks should travel over block streams.")
+	require.Equal(t, content, fetched)
+}
@@ -0,0 +1,591 @@
+// Package rudp is a reliable, connection-oriented byte stream over UDP, in
+// the spirit of QUIC. Lost datagrams are retransmitted, a NewReno-style
+// congestion window paces the sender, and connections are identified by a
+// random ID rather than by address, so they survive the client's address
+// changing, as it does when a mobile node hands over between networks.
+//
+// A connection only moves to a new address once the peer has echoed a
+// challenge sent there, so packets spoofed from elsewhere cannot redirect
+// it, and it is only reset by a packet carrying the reset token the peer
+// gave in the handshake. A listener keeps no state for a connection until
+// the dialer has echoed a retry token bound to its address, so SYNs from
+// spoofed addresses cost it nothing. Packets are not otherwise
+// authenticated: anyone who sees a connection's traffic can inject into it.
+package rudp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"trustmesh/network/internal/cond"
+)
+
+const (
+	// MSS is the largest payload of a data packet, small enough to avoid
+	// IP fragmentation on common paths.
+	MSS = 1200
+	// DefaultWindow is how many packets a connection buffers each way.
+	DefaultWindow = 256
+	// DefaultInitialRTO is the retransmission timeout before any RTT sample.
+	DefaultInitialRTO = 250 * time.Millisecond
+	// DefaultMinRTO and DefaultMaxRTO bound the retransmission timeout.
+	DefaultMinRTO = 50 * time.Millisecond
+	DefaultMaxRTO = 5 * time.Second
+	// DefaultMaxRetransmits is how many times in a row a packet may time out
+	// before the connection is given up.
+	DefaultMaxRetransmits = 10
+	// initialCwnd is the congestion window of a new connection, in packets.
+	initialCwnd = 10
+	// dupAckThreshold duplicate acks trigger a fast retransmit.
+	dupAckThreshold = 3
+)
+
+var (
+	ErrTimeout   = cond.ErrTimeout
+	ErrConnReset = errors.New("connection reset by peer")
+	ErrGaveUp    = errors.New("peer stopped acknowledging packets")
+
+	errNotDialed = errors.New("only dialed connections can rebind")
+)
+
+// Config tunes connections. Zero fields take their defaults.
+type Config struct {
+	// Window is how many packets a connection buffers each way.
+	Window int
+	// InitialRTO, MinRTO and MaxRTO govern the retransmission timeout.
+	InitialRTO, MinRTO, MaxRTO time.Duration
+	// MaxRetransmits is how many consecutive timeouts end a connection.
+	MaxRetransmits int
+	// ListenPacket opens the UDP sockets of listeners and dialed
+	// connections, by default with net.ListenPacket. Tests wrap the sockets
+	// to lose packets.
+	ListenPacket func(addr string) (net.PacketConn, error)
+}
+
+func (c Config) withDefaults() Config {
+	if c.Window <= 0 {
+		c.Window = DefaultWindow
+	}
+	if c.Window > 1<<16-1 {
+		c.Window = 1<<16 - 1
+	}
+	if c.InitialRTO <= 0 {
+		c.InitialRTO = DefaultInitialRTO
+	}
+	if c.MinRTO <= 0 {
+		c.MinRTO = DefaultMinRTO
+	}
+	if c.MaxRTO <= 0 {
+		c.MaxRTO = DefaultMaxRTO
+	}
+	if c.MaxRetransmits <= 0 {
+		c.MaxRetransmits = DefaultMaxRetransmits
+	}
+	if c.ListenPacket == nil {
+		c.ListenPacket = func(addr string) (net.PacketConn, error) {
+			return net.ListenPacket("udp", addr)
+		}
+	}
+	return c
+}
+
+// segment is a sequenced packet awaiting acknowledgement.
+type segment struct {
+	seq    uint32
+	data   []byte
+	fin    bool
+	sentAt time.Time
+	sends  int
+}
+
+// pathProbe is a challenge sent to an address packets arrived from.
+type pathProbe struct {
+	addr   net.Addr
+	token  []byte
+	sentAt time.Time
+}
+
+// Conn is one end of a connection. It implements net.Conn.
+type Conn struct {
+	id  uint64
+	cfg Config
+
+	mu     sync.Mutex
+	pc     net.PacketConn
+	remote net.Addr
+	// release frees the connection's slot in its listener, or its socket
+	// when it was dialed.
+	release func()
+	// established is closed when a dialed connection's handshake completes;
+	// it is nil for accepted connections.
+	established chan struct{}
+	once        sync.Once
+	// peerReset is the token the peer's resets must carry. It is nil until
+	// the peer's handshake packet arrives.
+	peerReset []byte
+	// syn is the payload of a dialed connection's SYNs: its reset token,
+	// followed by the listener's retry token once one arrives.
+	syn []byte
+	// probe is the challenge outstanding to the address the peer may have
+	// moved to.
+	probe *pathProbe
+
+	// Sending state.
+	nextSeq    uint32
+	unsent     []*segment
+	unacked    []*segment
+	cwnd       float64
+	ssthresh   float64
+	dupAcks    int
+	peerWindow int
+	srtt       time.Duration
+	rttvar     time.Duration
+	rto        time.Duration
+	retries    int
+	timer      *time.Timer
+	finAcked   bool
+	// recovering is set from a loss until everything sent before it,
+	// up to recover, has been acknowledged.
+	recovering bool
+	recover    uint32
+
+	// Receiving state.
+	rcvNext      uint32
+	outOfOrder   map[uint32]*packet
+	readBuf      bytes.Buffer
+	advertised   int
+	remoteClosed bool
+
+	closed   bool
+	released bool
+	err      error
+
+	readDeadline, writeDeadline time.Time
+	readable, writable          chan struct{}
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+func newConn(id uint64, cfg Config, pc net.PacketConn, remote net.Addr, release func()) *Conn {
+	c := &Conn{
+		id:         id,
+		cfg:        cfg,
+		pc:         pc,
+		remote:     remote,
+		release:    release,
+		cwnd:       initialCwnd,
+		ssthresh:   float64(cfg.Window),
+		peerWindow: cfg.Window,
+		rto:        cfg.InitialRTO,
+		outOfOrder: make(map[uint32]*packet),
+		advertised: cfg.Window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+	c.timer = time.AfterFunc(time.Hour, c.onTimeout)
+	c.timer.Stop()
+	return c
+}
+
+// Read reads from the peer's byte stream. It returns io.EOF once the peer
+// has closed and every byte has been read.
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.readBuf.Len() > 0 {
+			n, _ := c.readBuf.Read(p)
+			// Tell a peer we had throttled that there is room again.
+			if c.advertised < c.cfg.Window/2 && c.recvWindow() >= c.cfg.Window/2 && !c.remoteClosed {
+				c.sendAck(c.rcvNext - 1)
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.remoteClosed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := cond.Wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues p for reliable delivery, blocking while the send buffer is
+// full.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if len(c.unsent)+len(c.unacked) >= c.cfg.Window {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := cond.Wait(c.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		for written < len(p) && len(c.unsent)+len(c.unacked) < c.cfg.Window {
+			n := min(len(p)-written, MSS)
+			data := append([]byte(nil), p[written:written+n]...)
+			c.unsent = append(c.unsent, &segment{seq: c.nextSeq, data: data})
+			c.nextSeq++
+			written += n
+		}
+		c.pump()
+		c.mu.Unlock()
+	}
+	return written, nil
+}
+
+// Close half-closes the connection: queued data is still delivered and
+// the peer's data can still be read. The connection is released once the
+// peer has acknowledged everything and closed its side too.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	cond.Notify(c.readable)
+	cond.Notify(c.writable)
+	if c.err != nil {
+		c.releaseLocked()
+		return nil
+	}
+	c.unsent = append(c.unsent, &segment{seq: c.nextSeq, fin: true})
+	c.nextSeq++
+	c.pump()
+	// Give up on a peer that never closes its side.
+	time.AfterFunc(c.cfg.MaxRTO*time.Duration(c.cfg.MaxRetransmits), func() {
+		c.mu.Lock()
+		c.releaseLocked()
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	cond.Notify(c.readable)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	cond.Notify(c.writable)
+	return nil
+}
+
+// handle processes a packet the connection's socket received from addr.
+func (c *Conn) handle(p *packet, from net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.released {
+		return
+	}
+	// The connection ID, not the address, names the connection: a peer
+	// whose address changed carries on from its new one once it has shown
+	// it receives there.
+	switch {
+	case p.typ == pktChallenge:
+		c.pc.WriteTo((&packet{connID: c.id, typ: pktResponse, payload: p.payload}).encode(), from)
+		return
+	case from.String() == c.remote.String():
+	case p.typ == pktResponse:
+		if c.probe != nil && c.probe.addr.String() == from.String() && subtle.ConstantTimeCompare(c.probe.token, p.payload) == 1 {
+			c.remote, c.probe = from, nil
+			c.pump()
+		}
+		return
+	default:
+		c.challenge(from)
+	}
+
+	switch p.typ {
+	case pktRST:
+		if c.peerReset != nil && subtle.ConstantTimeCompare(c.peerReset, p.payload) == 1 {
+			c.fail(ErrConnReset)
+		}
+	case pktData, pktFIN:
+		c.onAck(p, false)
+		c.onData(p)
+	case pktACK:
+		c.onAck(p, true)
+	}
+}
+
+// challenge asks addr to echo a fresh token, unless a challenge to it went
+// out within the last RTO.
+func (c *Conn) challenge(addr net.Addr) {
+	if c.probe != nil && c.probe.addr.String() == addr.String() && time.Since(c.probe.sentAt) < c.rto {
+		return
+	}
+	token := make([]byte, challengeSize)
+	rand.Read(token)
+	c.probe = &pathProbe{addr: addr, token: token, sentAt: time.Now()}
+	c.pc.WriteTo((&packet{connID: c.id, typ: pktChallenge, payload: token}).encode(), addr)
+}
+
+// onAck processes the cumulative ack and window every packet carries.
+func (c *Conn) onAck(p *packet, pure bool) {
+	c.peerWindow = int(p.window)
+	if pure {
+		// Time the packet the ack answers. Karn's rule: only packets sent
+		// once give an unambiguous sample.
+		for _, seg := range c.unacked {
+			if seg.seq == p.seq && seg.sends == 1 {
+				c.sampleRTT(time.Since(seg.sentAt))
+				break
+			}
+		}
+	}
+	acked := 0
+	for len(c.unacked) > 0 && seqLess(c.unacked[0].seq, p.ack) {
+		seg := c.unacked[0]
+		if seg.fin {
+			c.finAcked = true
+		}
+		c.unacked = c.unacked[1:]
+		acked++
+	}
+
+	switch {
+	case acked > 0 && c.recovering && seqLess(p.ack, c.recover):
+		// A partial ack during recovery: the next hole was lost too.
+		c.retries, c.dupAcks = 0, 0
+		c.transmit(c.unacked[0])
+		c.resetTimer()
+		cond.Notify(c.writable)
+	case acked > 0:
+		c.retries, c.dupAcks = 0, 0
+		c.recovering = false
+		for i := 0; i < acked; i++ {
+			if c.cwnd < c.ssthresh {
+				c.cwnd++
+			} else {
+				c.cwnd += 1 / c.cwnd
+			}
+		}
+		c.resetTimer()
+		cond.Notify(c.writable)
+	case pure && len(c.unacked) > 0 && p.ack == c.unacked[0].seq:
+		c.dupAcks++
+		if c.dupAcks == dupAckThreshold && !c.recovering {
+			c.ssthresh = max(c.cwnd/2, 2)
+			c.cwnd = c.ssthresh
+			c.enterRecovery()
+			c.transmit(c.unacked[0])
+		}
+	case p.window == 0:
+		// The peer is alive, just full; keep probing without giving up.
+		c.retries = 0
+	}
+	c.pump()
+	c.maybeRelease()
+}
+
+// onData buffers a data or FIN packet and acknowledges it.
+func (c *Conn) onData(p *packet) {
+	offset := int(p.seq - c.rcvNext)
+	switch {
+	case seqLess(p.seq, c.rcvNext):
+		// A retransmission of something already received; the ack below
+		// tells the peer so.
+	case offset >= c.recvWindow():
+		// No room; the peer will retransmit.
+	case offset == 0:
+		c.deliver(p)
+		for next, ok := c.outOfOrder[c.rcvNext]; ok; next, ok = c.outOfOrder[c.rcvNext] {
+			delete(c.outOfOrder, c.rcvNext)
+			c.deliver(next)
+		}
+	default:
+		c.outOfOrder[p.seq] = p
+	}
+	c.sendAck(p.seq)
+	c.maybeRelease()
+}
+
+func (c *Conn) deliver(p *packet) {
+	c.rcvNext++
+	if p.typ == pktFIN {
+		c.remoteClosed = true
+	} else {
+		c.readBuf.Write(p.payload)
+	}
+	cond.Notify(c.readable)
+}
+
+// recvWindow is how many more packets the connection can buffer.
+func (c *Conn) recvWindow() int {
+	buffered := (c.readBuf.Len()+MSS-1)/MSS + len(c.outOfOrder)
+	return max(c.cfg.Window-buffered, 0)
+}
+
+// sampleRTT updates the retransmission timeout as RFC 6298 does.
+func (c *Conn) sampleRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, c.cfg.MinRTO), c.cfg.MaxRTO)
+}
+
+// pump sends queued segments while the congestion and peer windows allow.
+// A closed peer window still admits one packet, which probes for it to
+// reopen.
+func (c *Conn) pump() {
+	window := min(int(c.cwnd), max(c.peerWindow, 1))
+	for len(c.unsent) > 0 && len(c.unacked) < window {
+		seg := c.unsent[0]
+		c.unsent = c.unsent[1:]
+		c.unacked = append(c.unacked, seg)
+		c.transmit(seg)
+		if len(c.unacked) == 1 {
+			c.resetTimer()
+		}
+	}
+}
+
+func (c *Conn) transmit(seg *segment) {
+	seg.sentAt = time.Now()
+	seg.sends++
+	typ := pktData
+	if seg.fin {
+		typ = pktFIN
+	}
+	c.advertised = c.recvWindow()
+	c.send(&packet{connID: c.id, typ: typ, seq: seg.seq, ack: c.rcvNext, window: uint16(c.advertised), payload: seg.data})
+}
+
+// sendAck acknowledges everything before rcvNext, echoing seq as the
+// packet that prompted it.
+func (c *Conn) sendAck(seq uint32) {
+	c.advertised = c.recvWindow()
+	c.send(&packet{connID: c.id, typ: pktACK, seq: seq, ack: c.rcvNext, window: uint16(c.advertised)})
+}
+
+// send writes p to the peer.
+func (c *Conn) send(p *packet) {
+	c.pc.WriteTo(p.encode(), c.remote)
+}
+
+func (c *Conn) resetTimer() {
+	if len(c.unacked) == 0 {
+		c.timer.Stop()
+		return
+	}
+	c.timer.Reset(c.rto)
+}
+
+// onTimeout retransmits the oldest unacknowledged packet and backs off.
+func (c *Conn) onTimeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.released || len(c.unacked) == 0 {
+		return
+	}
+	seg := c.unacked[0]
+	if wait := c.rto - time.Since(seg.sentAt); wait > 0 {
+		c.timer.Reset(wait)
+		return
+	}
+	c.retries++
+	if c.retries > c.cfg.MaxRetransmits {
+		c.fail(ErrGaveUp)
+		return
+	}
+	c.ssthresh = max(c.cwnd/2, 2)
+	c.cwnd = 1
+	c.enterRecovery()
+	c.rto = min(c.rto*2, c.cfg.MaxRTO)
+	c.transmit(seg)
+	c.timer.Reset(c.rto)
+}
+
+func (c *Conn) enterRecovery() {
+	c.recovering = true
+	c.recover = c.unacked[len(c.unacked)-1].seq + 1
+}
+
+// fail ends the connection with err.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	cond.Notify(c.readable)
+	cond.Notify(c.writable)
+	c.releaseLocked()
+}
+
+// maybeRelease frees the connection once both byte streams have ended.
+func (c *Conn) maybeRelease() {
+	if c.finAcked && c.remoteClosed {
+		c.releaseLocked()
+	}
+}
+
+func (c *Conn) releaseLocked() {
+	if c.released {
+		return
+	}
+	c.released = true
+	c.timer.Stop()
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	if c.release != nil {
+		go c.release()
+	}
+}
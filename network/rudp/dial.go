@@ -0,0 +1,149 @@
+package rudp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Dial opens a connection to the listener at the UDP address addr,
+// retransmitting the handshake until it is answered or ctx ends.
+func Dial(ctx context.Context, addr string, cfg Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg = cfg.withDefaults()
+	pc, err := cfg.ListenPacket(":0")
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	rand.Read(id[:])
+	// The dialer never sends resets, but gives the listener a token all the
+	// same, so the accepted connection only honours resets carrying it.
+	token := make([]byte, resetTokenSize)
+	rand.Read(token)
+
+	established := make(chan struct{})
+	c := newConn(binary.BigEndian.Uint64(id[:]), cfg, pc, raddr, nil)
+	c.syn = token
+	c.release = func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pc.Close()
+	}
+	c.established = established
+	go c.readLoop(pc)
+
+	rto := cfg.InitialRTO
+	for {
+		c.mu.Lock()
+		c.sendSYN()
+		c.mu.Unlock()
+
+		select {
+		case <-established:
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.err != nil {
+				return nil, c.err
+			}
+			return c, nil
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.fail(ctx.Err())
+			c.mu.Unlock()
+			return nil, ctx.Err()
+		case <-time.After(rto):
+			rto = min(rto*2, cfg.MaxRTO)
+		}
+	}
+}
+
+// Rebind moves a dialed connection to a fresh local socket, as when the
+// host's address changes. The listener follows the connection to its new
+// address on the next packet, which Rebind sends straight away.
+func (c *Conn) Rebind() error {
+	if c.established == nil {
+		return errNotDialed
+	}
+	pc, err := c.cfg.ListenPacket(":0")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.released {
+		c.mu.Unlock()
+		pc.Close()
+		return net.ErrClosed
+	}
+	old := c.pc
+	c.pc = pc
+	c.sendAck(c.rcvNext - 1)
+	c.mu.Unlock()
+
+	old.Close()
+	go c.readLoop(pc)
+	return nil
+}
+
+// readLoop feeds a dialed connection the packets its socket receives.
+func (c *Conn) readLoop(pc net.PacketConn) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p, err := decodePacket(buf[:n])
+		if err != nil || p.connID != c.id {
+			continue
+		}
+		if p.typ == pktRetry {
+			c.retry(p, from)
+			continue
+		}
+		c.establish()
+		if p.typ != pktSYNACK {
+			c.handle(p, from)
+			continue
+		}
+		c.mu.Lock()
+		if c.peerReset == nil && len(p.payload) == resetTokenSize && from.String() == c.remote.String() {
+			c.peerReset = p.payload
+		}
+		c.mu.Unlock()
+	}
+}
+
+// sendSYN asks the listener to open the connection.
+func (c *Conn) sendSYN() {
+	c.send(&packet{connID: c.id, typ: pktSYN, window: uint16(c.recvWindow()), payload: c.syn})
+}
+
+// retry repeats the SYN with the retry token the listener answered it
+// with. Retries are ignored once the connection is established.
+func (c *Conn) retry(p *packet, from net.Addr) {
+	select {
+	case <-c.established:
+		return
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(p.payload) != retryTokenSize || from.String() != c.remote.String() || c.released {
+		return
+	}
+	c.syn = append(c.syn[:resetTokenSize:resetTokenSize], p.payload...)
+	c.sendSYN()
+}
+
+// establish marks the handshake done. Any packet from the listener
+// implies it, should the SYNACK itself be lost; the connection then ignores
+// resets until a SYNACK brings the listener's reset token.
+func (c *Conn) establish() {
+	c.once.Do(func() { close(c.established) })
+}
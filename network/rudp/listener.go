@@ -0,0 +1,199 @@
+package rudp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBacklog is how many connections may wait to be accepted.
+	DefaultBacklog = 128
+	// retryTokenLifetime is how long a retry token opens connections for.
+	retryTokenLifetime = 30 * time.Second
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// Listener accepts connections on one UDP socket, telling them apart by
+// connection ID.
+type Listener struct {
+	pc  net.PacketConn
+	cfg Config
+	// secret derives the reset token of each connection, so the listener
+	// can reset connections it holds no state for, and the retry tokens
+	// dialers must echo before it holds any.
+	secret []byte
+
+	mu     sync.Mutex
+	conns  map[uint64]*Conn
+	closed bool
+
+	accept chan *Conn
+	done   chan struct{}
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+// Listen listens for connections on the UDP address addr.
+func Listen(addr string, cfg Config) (*Listener, error) {
+	cfg = cfg.withDefaults()
+	pc, err := cfg.ListenPacket(addr)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	l := &Listener{
+		pc:     pc,
+		cfg:    cfg,
+		secret: secret,
+		conns:  make(map[uint64]*Conn),
+		accept: make(chan *Conn, DefaultBacklog),
+		done:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops accepting connections. Accepted connections carry on, and
+// the socket is closed once the last of them is released.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	for len(l.accept) > 0 {
+		c := <-l.accept
+		delete(l.conns, c.id)
+		c.mu.Lock()
+		c.fail(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	if len(l.conns) == 0 {
+		return l.pc.Close()
+	}
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		p, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		l.dispatch(p, from)
+	}
+}
+
+// dispatch hands a packet to its connection, opening one for a SYN that
+// carries a valid retry token and answering other SYNs with a token.
+func (l *Listener) dispatch(p *packet, from net.Addr) {
+	retried := p.typ == pktSYN && len(p.payload) == resetTokenSize+retryTokenSize &&
+		l.validRetryToken(p.connID, from, p.payload[resetTokenSize:])
+	l.mu.Lock()
+	c, ok := l.conns[p.connID]
+	if !ok && p.typ == pktSYN && !l.closed {
+		if !retried {
+			l.mu.Unlock()
+			l.pc.WriteTo((&packet{connID: p.connID, typ: pktRetry, payload: l.retryToken(p.connID, from, time.Now())}).encode(), from)
+			return
+		}
+		c = newConn(p.connID, l.cfg, l.pc, from, func() { l.remove(p.connID) })
+		c.peerReset = p.payload[:resetTokenSize]
+		select {
+		case l.accept <- c:
+			l.conns[p.connID] = c
+			ok = true
+		default:
+			// The backlog is full; the dialer will retry.
+			l.mu.Unlock()
+			return
+		}
+	}
+	l.mu.Unlock()
+
+	switch {
+	case !ok && p.typ != pktRST:
+		l.pc.WriteTo((&packet{connID: p.connID, typ: pktRST, payload: l.resetToken(p.connID)}).encode(), from)
+	case !ok:
+	case p.typ == pktSYN:
+		c.mu.Lock()
+		c.send(&packet{connID: c.id, typ: pktSYNACK, window: uint16(c.recvWindow()), payload: l.resetToken(c.id)})
+		c.mu.Unlock()
+	default:
+		c.handle(p, from)
+	}
+}
+
+// resetToken is the token the listener's resets of connection id carry. The
+// dialer learns it from the SYNACK.
+func (l *Listener) resetToken(id uint64) []byte {
+	mac := hmac.New(sha256.New, l.secret)
+	binary.Write(mac, binary.BigEndian, id)
+	return mac.Sum(nil)[:resetTokenSize]
+}
+
+// retryToken is the token a SYN for connection id from addr must carry for
+// the listener to open the connection, issued at the given time.
+func (l *Listener) retryToken(id uint64, addr net.Addr, issued time.Time) []byte {
+	token := make([]byte, 4, retryTokenSize)
+	binary.BigEndian.PutUint32(token, uint32(issued.Unix()))
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte("retry"))
+	binary.Write(mac, binary.BigEndian, id)
+	mac.Write(token)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(token)[:retryTokenSize]
+}
+
+// validRetryToken reports whether token was issued for connection id from
+// addr within the last retryTokenLifetime.
+func (l *Listener) validRetryToken(id uint64, addr net.Addr, token []byte) bool {
+	issued := time.Unix(int64(binary.BigEndian.Uint32(token)), 0)
+	if age := time.Since(issued); age < 0 || age > retryTokenLifetime {
+		return false
+	}
+	return hmac.Equal(token, l.retryToken(id, addr, issued))
+}
+
+// remove forgets a released connection, closing the socket if the listener
+// was closed and this was the last one.
+func (l *Listener) remove(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, id)
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
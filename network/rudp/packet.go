@@ -0,0 +1,98 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// packetType says what a packet carries.
+type packetType uint8
+
+const (
+	// pktSYN opens a connection. It carries the dialer's reset token.
+	pktSYN packetType = iota + 1
+	// pktSYNACK accepts a connection. It carries the listener's reset token.
+	pktSYNACK
+	// pktData carries one segment of the byte stream.
+	pktData
+	// pktFIN ends the sender's byte stream; it is sequenced like data.
+	pktFIN
+	// pktACK acknowledges data without carrying any.
+	pktACK
+	// pktRST tells the peer the connection is unknown or abandoned. It
+	// carries the sender's reset token, without which it is ignored.
+	pktRST
+	// pktChallenge asks the sender of a packet from a new address to prove
+	// it receives there by echoing the payload.
+	pktChallenge
+	// pktResponse echoes a challenge's payload from the challenged address.
+	pktResponse
+	// pktRetry answers a SYN without a valid retry token with one, which
+	// the dialer's next SYN must carry.
+	pktRetry
+)
+
+// resetTokenSize is the length of a reset token, challengeSize of a path
+// challenge and retryTokenSize of a retry token: when it was issued and a
+// MAC binding it to the connection and the dialer's address.
+const (
+	resetTokenSize = 16
+	challengeSize  = 8
+	retryTokenSize = 4 + 16
+)
+
+// headerSize is the length of a packet header: connection ID, type,
+// sequence number, cumulative ack and receive window.
+const headerSize = 8 + 1 + 4 + 4 + 2
+
+var errShortPacket = errors.New("packet is shorter than its header")
+
+// packet is one datagram. Every packet carries the sender's cumulative ack
+// and receive window, so data flowing both ways acknowledges itself.
+type packet struct {
+	connID uint64
+	typ    packetType
+	// seq numbers data and FIN packets. An ACK echoes the seq of the
+	// packet that prompted it, which times that packet even when it is
+	// held behind a gap.
+	seq uint32
+	// ack is the next sequence number the sender expects.
+	ack uint32
+	// window is how many more packets the sender can buffer.
+	window  uint16
+	payload []byte
+}
+
+func (p *packet) encode() []byte {
+	b := make([]byte, headerSize+len(p.payload))
+	binary.BigEndian.PutUint64(b[0:8], p.connID)
+	b[8] = byte(p.typ)
+	binary.BigEndian.PutUint32(b[9:13], p.seq)
+	binary.BigEndian.PutUint32(b[13:17], p.ack)
+	binary.BigEndian.PutUint16(b[17:19], p.window)
+	copy(b[headerSize:], p.payload)
+	return b
+}
+
+func decodePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, errShortPacket
+	}
+	p := &packet{
+		connID: binary.BigEndian.Uint64(b[0:8]),
+		typ:    packetType(b[8]),
+		seq:    binary.BigEndian.Uint32(b[9:13]),
+		ack:    binary.BigEndian.Uint32(b[13:17]),
+		window: binary.BigEndian.Uint16(b[17:19]),
+	}
+	if len(b) > headerSize {
+		p.payload = append([]byte(nil), b[headerSize:]...)
+	}
+	return p, nil
+}
+
+// seqLess reports whether sequence number a comes before b, allowing for
+// wraparound.
+func seqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
@@ -0,0 +1,246 @@
+package rudp_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"trustmesh/network/internal/lossy"
+	"trustmesh/network/rudp"
+)
+
+// lossyConfig drops a tenth of the packets each way and recovers quickly.
+func lossyConfig() rudp.Config {
+	return rudp.Config{ListenPacket: lossy.Listen(0.1, 1), InitialRTO: 50 * time.Millisecond, MinRTO: 10 * time.Millisecond}
+}
+
+// listenEcho starts a listener that echoes every connection back.
+func listenEcho(t *testing.T, cfg rudp.Config) *rudp.Listener {
+	t.Helper()
+	l, err := rudp.Listen("127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTransferUnderLoss(t *testing.T) {
+	l := listenEcho(t, lossyConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := rudp.Dial(ctx, l.Addr().String(), lossyConfig())
+	require.NoError(t, err, "The handshake should survive loss.")
+
+	msg := make([]byte, 1<<20)
+	rand.Read(msg)
+	go func() {
+		c.Write(msg)
+		c.Close()
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(c)
+	require.NoError(t, err, "Reading the echo should end at EOF.")
+	require.True(t, bytes.Equal(msg, got), "Every byte should arrive in order despite loss.")
+}
+
+func TestConnectionSurvivesRebind(t *testing.T) {
+	l, err := rudp.Listen("127.0.0.1:0", rudp.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	c, err := rudp.Dial(context.Background(), l.Addr().String(), rudp.Config{})
+	require.NoError(t, err)
+	defer c.Close()
+	peer, err := l.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+
+	roundTrip := func(msg string) {
+		_, err := c.Write([]byte(msg))
+		require.NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(peer, buf)
+		require.NoError(t, err)
+		_, err = peer.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(buf))
+	}
+	roundTrip("before")
+	before := peer.RemoteAddr().String()
+
+	require.NoError(t, c.Rebind())
+	roundTrip("after")
+	require.NotEqual(t, before, peer.RemoteAddr().String(), "The listener should follow the new address.")
+	require.Equal(t, c.LocalAddr().(*net.UDPAddr).Port, peer.RemoteAddr().(*net.UDPAddr).Port)
+}
+
+func TestDialWithoutListenerTimesOut(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = rudp.Dial(ctx, addr, rudp.Config{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// Packet types as they appear on the wire.
+const (
+	rawSYN       = 1
+	rawSYNACK    = 2
+	rawData      = 3
+	rawACK       = 5
+	rawRST       = 6
+	rawChallenge = 7
+	rawRetry     = 9
+)
+
+// rawPacket encodes a packet as a peer speaking the protocol by hand would.
+func rawPacket(connID uint64, typ byte, seq, ack uint32, payload []byte) []byte {
+	b := make([]byte, 19+len(payload))
+	binary.BigEndian.PutUint64(b[0:8], connID)
+	b[8] = typ
+	binary.BigEndian.PutUint32(b[9:13], seq)
+	binary.BigEndian.PutUint32(b[13:17], ack)
+	binary.BigEndian.PutUint16(b[17:19], 64)
+	copy(b[19:], payload)
+	return b
+}
+
+// readRaw reads packets from pc until one of type typ arrives, and returns
+// it with its sender.
+func readRaw(t *testing.T, pc net.PacketConn, typ byte) ([]byte, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		require.NoError(t, err, "A packet of type %d should arrive.", typ)
+		if n >= 19 && buf[8] == typ {
+			return append([]byte(nil), buf[:n]...), from
+		}
+	}
+}
+
+func rawSocket(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestSpoofedPacketsDoNotMigrate(t *testing.T) {
+	l, err := rudp.Listen("127.0.0.1:0", rudp.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// A hand-rolled dialer, so the test knows the connection ID.
+	const connID = 0x1234
+	client, spoofer := rawSocket(t), rawSocket(t)
+	_, err = client.WriteTo(rawPacket(connID, rawSYN, 0, 0, make([]byte, 16)), l.Addr())
+	require.NoError(t, err)
+	retry, _ := readRaw(t, client, rawRetry)
+	_, err = client.WriteTo(rawPacket(connID, rawSYN, 0, 0, append(make([]byte, 16), retry[19:]...)), l.Addr())
+	require.NoError(t, err)
+	peer, err := l.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+	readRaw(t, client, rawSYNACK)
+	addr := peer.RemoteAddr().String()
+
+	_, err = spoofer.WriteTo(rawPacket(connID, rawACK, 0, 0, nil), l.Addr())
+	require.NoError(t, err)
+	readRaw(t, spoofer, rawChallenge)
+	require.Equal(t, addr, peer.RemoteAddr().String(), "A packet from a new address should not move the connection.")
+
+	_, err = peer.Write([]byte("still here"))
+	require.NoError(t, err)
+	data, _ := readRaw(t, client, rawData)
+	require.Equal(t, "still here", string(data[19:]), "Data should keep going to the validated address.")
+}
+
+func TestResetNeedsToken(t *testing.T) {
+	// A hand-rolled listener, so the test knows the connection ID.
+	server, spoofer := rawSocket(t), rawSocket(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token := []byte("0123456789abcdef")
+	dialed := make(chan *rudp.Conn, 1)
+	go func() {
+		c, err := rudp.Dial(ctx, server.LocalAddr().String(), rudp.Config{})
+		if err == nil {
+			dialed <- c
+		}
+	}()
+	syn, from := readRaw(t, server, rawSYN)
+	connID := binary.BigEndian.Uint64(syn[0:8])
+	_, err := server.WriteTo(rawPacket(connID, rawSYNACK, 0, 0, token), from)
+	require.NoError(t, err)
+	c := <-dialed
+	defer c.Close()
+
+	read := func() error {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		return err
+	}
+	for _, forged := range [][]byte{nil, []byte("fedcba9876543210")} {
+		_, err = spoofer.WriteTo(rawPacket(connID, rawRST, 0, 0, forged), from)
+		require.NoError(t, err)
+		require.ErrorIs(t, read(), rudp.ErrTimeout, "A reset without the token should be ignored.")
+	}
+	_, err = spoofer.WriteTo(rawPacket(connID, rawRST, 0, 0, token), from)
+	require.NoError(t, err)
+	require.ErrorIs(t, read(), rudp.ErrConnReset, "A reset carrying the token should end the connection.")
+}
+
+func TestListenerKeepsNoStateBeforeRetry(t *testing.T) {
+	l, err := rudp.Listen("127.0.0.1:0", rudp.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	client, spoofer := rawSocket(t), rawSocket(t)
+
+	// A SYN without a retry token only earns one.
+	_, err = client.WriteTo(rawPacket(1, rawSYN, 0, 0, make([]byte, 16)), l.Addr())
+	require.NoError(t, err)
+	retry, _ := readRaw(t, client, rawRetry)
+	token := retry[19:]
+
+	// The token only opens the connection it was issued for, from the
+	// address it was issued to.
+	for _, syn := range []struct {
+		pc     net.PacketConn
+		connID uint64
+	}{{spoofer, 1}, {client, 2}} {
+		_, err = syn.pc.WriteTo(rawPacket(syn.connID, rawSYN, 0, 0, append(make([]byte, 16), token...)), l.Addr())
+		require.NoError(t, err)
+		readRaw(t, syn.pc, rawRetry)
+	}
+
+	_, err = client.WriteTo(rawPacket(1, rawSYN, 0, 0, append(make([]byte, 16), token...)), l.Addr())
+	require.NoError(t, err)
+	readRaw(t, client, rawSYNACK)
+	peer, err := l.Accept()
+	require.NoError(t, err, "A SYN echoing its retry token should open the connection.")
+	peer.Close()
+}
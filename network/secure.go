@@ -0,0 +1,149 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"github.com/zeebo/blake3"
+	"io"
+	"net"
+	"sync"
+)
+
+const sessionKeyDomain = "trustmesh/session/v1"
+
+// maxSecurePayload bounds the plaintext sealed into one frame on a secured
+// connection. Longer writes are split across frames.
+const maxSecurePayload = 16 << 10
+
+var ErrSecureFrame = errors.New("secured connection frame failed authentication")
+
+// sessionKeys derives the keys each direction of a connection is sealed
+// with from the handshake transcript and the secrets both sides
+// encapsulated to each other. Either secret alone keeps the keys from an
+// attacker that learns the other.
+func sessionKeys(transcript, dialerSecret, listenerSecret []byte) (dialerKey, listenerKey []byte) {
+	material := make([]byte, 0, len(transcript)+len(dialerSecret)+len(listenerSecret))
+	material = append(append(append(material, transcript...), dialerSecret...), listenerSecret...)
+	keys := make([]byte, 64)
+	blake3.DeriveKey(sessionKeyDomain, material, keys)
+	return keys[:32], keys[32:]
+}
+
+// secureConn seals everything written to a connection with AES-256-GCM and
+// opens everything read from it. Each frame carries a 4 byte length and is
+// sealed under a per-direction counter nonce, so frames that are altered,
+// injected, replayed, reordered or dropped fail to open and end the
+// connection.
+type secureConn struct {
+	net.Conn
+	// transcript is the handshake the keys were derived from.
+	transcript []byte
+
+	writeMu  sync.Mutex
+	seal     cipher.AEAD
+	sealSeq  uint64
+	readMu   sync.Mutex
+	open     cipher.AEAD
+	openSeq  uint64
+	buf      []byte
+	readErr  error
+	writeErr error
+}
+
+// newSecureConn wraps conn, handshaken with the given transcript, to seal
+// writes under sealKey and open reads under openKey.
+func newSecureConn(conn net.Conn, transcript, sealKey, openKey []byte) (*secureConn, error) {
+	seal, err := newGCM(sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newGCM(openKey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, transcript: transcript, seal: seal, open: open}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxSecurePayload)]
+		frame := make([]byte, 4, 4+len(chunk)+c.seal.Overhead())
+		binary.BigEndian.PutUint32(frame, uint32(len(chunk)+c.seal.Overhead()))
+		frame = c.seal.Seal(frame, c.nonce(c.sealSeq), chunk, frame[:4])
+		c.sealSeq++
+		if _, err := c.Conn.Write(frame); err != nil {
+			// A partly written frame leaves the peer unable to
+			// open anything after it.
+			c.writeErr = err
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.buf) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.readFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// readFrame reads and opens the next frame into c.buf.
+func (c *secureConn) readFrame() error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size < uint32(c.open.Overhead()) || size > uint32(maxSecurePayload+c.open.Overhead()) {
+		return ErrSecureFrame
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plain, err := c.open.Open(sealed[:0], c.nonce(c.openSeq), sealed, hdr[:])
+	if err != nil {
+		return ErrSecureFrame
+	}
+	c.openSeq++
+	c.buf = plain
+	return nil
+}
+
+func (c *secureConn) nonce(seq uint64) []byte {
+	nonce := make([]byte, c.seal.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
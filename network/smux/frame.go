@@ -0,0 +1,71 @@
+package smux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// protoVersion is the only frame format version.
+const protoVersion = 0
+
+// headerSize is the length of a frame header.
+const headerSize = 12
+
+// frameType says what a frame carries.
+type frameType uint8
+
+const (
+	// typeData carries stream data; its length is the payload size.
+	typeData frameType = iota
+	// typeWindowUpdate grants the peer more send window; its length is the
+	// increment.
+	typeWindowUpdate
+	// typePing checks the session is live; its length is an opaque value
+	// echoed in the ACK.
+	typePing
+	// typeGoAway announces no more streams will be accepted; its length is
+	// the reason code.
+	typeGoAway
+)
+
+// Flags qualify data and window update frames.
+const (
+	// flagSYN opens a stream.
+	flagSYN uint16 = 1 << iota
+	// flagACK answers a ping.
+	flagACK
+	// flagFIN half-closes a stream.
+	flagFIN
+	// flagRST resets a stream.
+	flagRST
+)
+
+// GoAway reason codes.
+const (
+	goAwayNormal uint32 = iota
+	goAwayProtoErr
+	goAwayInternalErr
+)
+
+// header is the fixed part of every frame: version, type, flags, stream ID
+// and length, in network byte order.
+type header [headerSize]byte
+
+func (h header) version() uint8       { return h[0] }
+func (h header) typ() frameType       { return frameType(h[1]) }
+func (h header) flags() uint16        { return binary.BigEndian.Uint16(h[2:4]) }
+func (h header) streamID() uint32     { return binary.BigEndian.Uint32(h[4:8]) }
+func (h header) length() uint32       { return binary.BigEndian.Uint32(h[8:12]) }
+func (h header) has(flag uint16) bool { return h.flags()&flag != 0 }
+
+func (h *header) encode(t frameType, flags uint16, id, length uint32) {
+	h[0] = protoVersion
+	h[1] = byte(t)
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func (h header) String() string {
+	return fmt.Sprintf("type %d flags %#x stream %d length %d", h.typ(), h.flags(), h.streamID(), h.length())
+}
@@ -0,0 +1,498 @@
+// Package smux multiplexes many streams over one connection, in the manner
+// of yamux. Each stream has its own flow control window, so a stream whose
+// reader falls behind stalls only itself, never the connection or the
+// other streams on it.
+package smux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"trustmesh/network/internal/cond"
+)
+
+const (
+	// DefaultStreamWindow is how much unread data a stream buffers.
+	DefaultStreamWindow = 256 << 10
+	// MaxStreamWindow caps a stream's window. Window updates that would
+	// grow the send window beyond it are protocol violations.
+	MaxStreamWindow = 16 << 20
+	// DefaultAcceptBacklog is how many opened streams may wait for Accept.
+	DefaultAcceptBacklog = 256
+	// DefaultKeepAliveInterval is how often an idle session is pinged.
+	DefaultKeepAliveInterval = 30 * time.Second
+	// DefaultKeepAliveTimeout is how long a ping may go unanswered.
+	DefaultKeepAliveTimeout = 10 * time.Second
+	// DefaultWriteTimeout bounds each write to the underlying connection.
+	DefaultWriteTimeout = 10 * time.Second
+	// maxDataFrame bounds a data frame, so streams take turns on the wire.
+	maxDataFrame = 16 << 10
+	// controlQueue is how many control frames, ping answers and refusals
+	// of streams, may wait for the writer. The receive loop stops reading
+	// while it is full, so a peer flooding pings or SYNs is slowed to the
+	// pace its answers are written at.
+	controlQueue = 64
+)
+
+var (
+	ErrSessionClosed    = errors.New("session is closed")
+	ErrStreamClosed     = errors.New("stream is closed")
+	ErrStreamReset      = errors.New("stream was reset")
+	ErrRemoteGoAway     = errors.New("remote is not accepting streams")
+	ErrKeepAliveTimeout = errors.New("keepalive ping went unanswered")
+	ErrProtocol         = errors.New("smux protocol violation")
+	ErrStreamsExhausted = errors.New("stream IDs exhausted")
+	ErrTimeout          = cond.ErrTimeout
+)
+
+// Config tunes a session. Zero fields take their defaults; a negative
+// KeepAliveInterval disables keepalives. StreamWindow is capped at
+// MaxStreamWindow.
+type Config struct {
+	StreamWindow      uint32
+	AcceptBacklog     int
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	WriteTimeout      time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.StreamWindow == 0 {
+		c.StreamWindow = DefaultStreamWindow
+	}
+	c.StreamWindow = min(c.StreamWindow, MaxStreamWindow)
+	if c.AcceptBacklog <= 0 {
+		c.AcceptBacklog = DefaultAcceptBacklog
+	}
+	if c.KeepAliveInterval == 0 {
+		c.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+	if c.KeepAliveTimeout <= 0 {
+		c.KeepAliveTimeout = DefaultKeepAliveTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = DefaultWriteTimeout
+	}
+	return c
+}
+
+// Session is one end of a multiplexed connection.
+type Session struct {
+	conn io.ReadWriteCloser
+	cfg  Config
+
+	writeMu sync.Mutex
+
+	mu           sync.Mutex
+	streams      map[uint32]*Stream
+	nextID       uint32
+	localGoAway  bool
+	remoteGoAway bool
+	pings        map[uint32]chan struct{}
+	nextPing     uint32
+	err          error
+
+	accept chan *Stream
+	// control queues the frames the receive loop answers with.
+	control  chan header
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+// Client starts the dialing side of a session over conn. Client streams
+// have odd IDs.
+func Client(conn io.ReadWriteCloser, cfg Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server starts the accepting side of a session over conn. Server streams
+// have even IDs.
+func Server(conn io.ReadWriteCloser, cfg Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, cfg Config, firstID uint32) *Session {
+	cfg = cfg.withDefaults()
+	s := &Session{
+		conn:     conn,
+		cfg:      cfg,
+		streams:  make(map[uint32]*Stream),
+		nextID:   firstID,
+		pings:    make(map[uint32]chan struct{}),
+		accept:   make(chan *Stream, cfg.AcceptBacklog),
+		control:  make(chan header, controlQueue),
+		shutdown: make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.controlLoop()
+	if cfg.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// Open opens a new stream to the remote side.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.remoteGoAway {
+		s.mu.Unlock()
+		return nil, ErrRemoteGoAway
+	}
+	id := s.nextID
+	if id >= 1<<32-2 {
+		s.mu.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the remote side to open a stream.
+func (s *Session) Accept() (*Stream, error) {
+	return s.AcceptContext(context.Background())
+}
+
+// AcceptContext is Accept bounded by ctx.
+func (s *Session) AcceptContext(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.shutdown:
+		return nil, s.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping sends a ping and returns how long the remote took to answer.
+func (s *Session) Ping() (time.Duration, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return 0, s.err
+	}
+	id := s.nextPing
+	s.nextPing++
+	done := make(chan struct{})
+	s.pings[id] = done
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(typePing, flagSYN, 0, id, nil); err != nil {
+		return 0, err
+	}
+	timer := time.NewTimer(s.cfg.KeepAliveTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-timer.C:
+		return 0, ErrKeepAliveTimeout
+	case <-s.shutdown:
+		return 0, s.closeErr()
+	}
+}
+
+// GoAway tells the remote side no more streams will be accepted. Open
+// streams carry on until they are closed.
+func (s *Session) GoAway() error {
+	s.mu.Lock()
+	s.localGoAway = true
+	s.mu.Unlock()
+	return s.writeFrame(typeGoAway, 0, 0, goAwayNormal, nil)
+}
+
+// Close sends GoAway, resets every stream and closes the connection.
+func (s *Session) Close() error {
+	s.GoAway()
+	return s.close(ErrSessionClosed)
+}
+
+// Done is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.shutdown
+}
+
+// Err returns why the session closed, or nil while it is open.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// LocalAddr returns the local address of the connection, if it has one.
+func (s *Session) LocalAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote address of the connection, if it has one.
+func (s *Session) RemoteAddr() net.Addr {
+	if c, ok := s.conn.(net.Conn); ok {
+		return c.RemoteAddr()
+	}
+	return nil
+}
+
+// close shuts the session down with err, which later calls return.
+func (s *Session) close(err error) error {
+	var closeErr error
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		close(s.shutdown)
+		closeErr = s.conn.Close()
+		for _, st := range streams {
+			st.terminate(err)
+		}
+	})
+	return closeErr
+}
+
+func (s *Session) closeErr() error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return ErrSessionClosed
+}
+
+// keepalive pings the remote side at every interval and closes the session
+// when a ping goes unanswered.
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.cfg.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			if _, err := s.Ping(); errors.Is(err, ErrKeepAliveTimeout) {
+				s.close(err)
+				return
+			}
+		}
+	}
+}
+
+// writeFrame writes one frame. Frames from concurrent streams are written
+// whole, one at a time.
+func (s *Session) writeFrame(t frameType, flags uint16, id, length uint32, payload []byte) error {
+	var h header
+	h.encode(t, flags, id, length)
+	return s.write(h, payload)
+}
+
+// queueControl queues a payload-free frame for controlLoop to write,
+// blocking while the queue is full.
+func (s *Session) queueControl(t frameType, flags uint16, id, length uint32) {
+	var h header
+	h.encode(t, flags, id, length)
+	select {
+	case s.control <- h:
+	case <-s.shutdown:
+	}
+}
+
+// controlLoop writes the queued control frames, so answering the remote
+// never takes more than one goroutine.
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case h := <-s.control:
+			if s.write(h, nil) != nil {
+				return
+			}
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// write writes the frame with header h.
+func (s *Session) write(h header, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.shutdown:
+		return s.closeErr()
+	default:
+	}
+	if c, ok := s.conn.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		c.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+		defer c.SetWriteDeadline(time.Time{})
+	}
+	if _, err := s.conn.Write(h[:]); err != nil {
+		s.close(err)
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.close(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// recvLoop reads frames until the connection fails.
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			}
+			s.close(err)
+			return
+		}
+		if err := s.handle(h); err != nil {
+			if errors.Is(err, ErrProtocol) {
+				s.writeFrame(typeGoAway, 0, 0, goAwayProtoErr, nil)
+			}
+			s.close(err)
+			return
+		}
+	}
+}
+
+// handle processes one frame whose header has been read.
+func (s *Session) handle(h header) error {
+	if h.version() != protoVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrProtocol, h.version())
+	}
+	switch h.typ() {
+	case typeData, typeWindowUpdate:
+		return s.handleStream(h)
+	case typePing:
+		if h.has(flagSYN) {
+			s.queueControl(typePing, flagACK, 0, h.length())
+			return nil
+		}
+		s.mu.Lock()
+		if done, ok := s.pings[h.length()]; ok {
+			close(done)
+			delete(s.pings, h.length())
+		}
+		s.mu.Unlock()
+		return nil
+	case typeGoAway:
+		s.mu.Lock()
+		s.remoteGoAway = true
+		s.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown frame %s", ErrProtocol, h)
+	}
+}
+
+// handleStream processes a data or window update frame.
+func (s *Session) handleStream(h header) error {
+	id := h.streamID()
+	if h.has(flagSYN) {
+		if err := s.incoming(id); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	var payload []byte
+	if h.typ() == typeData && h.length() > 0 {
+		if h.length() > s.cfg.StreamWindow {
+			return fmt.Errorf("%w: frame of %d bytes exceeds the window", ErrProtocol, h.length())
+		}
+		payload = make([]byte, h.length())
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+	}
+	if st == nil {
+		// The stream was reset or closed locally; late frames are dropped.
+		return nil
+	}
+	if h.has(flagRST) {
+		st.terminate(ErrStreamReset)
+		s.removeStream(id)
+		return nil
+	}
+	if h.typ() == typeWindowUpdate {
+		if err := st.grant(h.length()); err != nil {
+			return err
+		}
+	} else if err := st.receive(payload); err != nil {
+		return err
+	}
+	if h.has(flagFIN) {
+		st.remoteClose()
+	}
+	return nil
+}
+
+// incoming registers a stream the remote side opened.
+func (s *Session) incoming(id uint32) error {
+	if id%2 == s.nextID%2 {
+		return fmt.Errorf("%w: remote opened stream %d with a local ID", ErrProtocol, id)
+	}
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice", ErrProtocol, id)
+	}
+	if s.localGoAway {
+		s.mu.Unlock()
+		s.queueControl(typeWindowUpdate, flagRST, id, 0)
+		return nil
+	}
+	st := newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		s.queueControl(typeWindowUpdate, flagRST, id, 0)
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
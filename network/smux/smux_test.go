@@ -0,0 +1,231 @@
+package smux_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"trustmesh/network/smux"
+)
+
+// newPair starts both sides of a session over an in-memory connection.
+func newPair(t *testing.T, cfg smux.Config) (client, server *smux.Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server = smux.Client(a, cfg), smux.Server(b, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo serves every stream the session accepts by echoing it back.
+func echo(s *smux.Session) {
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(st, st)
+			st.Close()
+		}()
+	}
+}
+
+func TestStreamsShareSession(t *testing.T) {
+	client, server := newPair(t, smux.Config{})
+	go echo(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open()
+			require.NoError(t, err)
+			msg := make([]byte, 100<<10)
+			rand.Read(msg)
+
+			go func() {
+				st.Write(msg)
+				st.Close()
+			}()
+			got, err := io.ReadAll(st)
+			require.NoError(t, err, "Reading the echo should end at EOF.")
+			require.True(t, bytes.Equal(msg, got), "Each stream should echo its own data.")
+		}()
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool { return client.NumStreams() == 0 }, time.Second, 10*time.Millisecond,
+		"Streams closed on both sides should leave the session.")
+}
+
+func TestFlowControlStallsOnlyTheStream(t *testing.T) {
+	window := uint32(64 << 10)
+	client, server := newPair(t, smux.Config{StreamWindow: window})
+	accepted := make(chan *smux.Stream, 2)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- st
+		}
+	}()
+
+	slow, err := client.Open()
+	require.NoError(t, err)
+	slow.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 2*window))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout(), "Writing past the window should block.")
+	require.Equal(t, int(window), n, "Exactly one window should be sent unread.")
+	slowPeer := <-accepted
+
+	fast, err := client.Open()
+	require.NoError(t, err)
+	_, err = fast.Write([]byte("ping"))
+	require.NoError(t, err, "Other streams should not be blocked by the stalled one.")
+	fastPeer := <-accepted
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(fastPeer, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+
+	slow.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(make([]byte, window))
+		done <- err
+	}()
+	_, err = io.ReadFull(slowPeer, make([]byte, 2*window))
+	require.NoError(t, err, "Reading should reopen the window.")
+	require.NoError(t, <-done)
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := newPair(t, smux.Config{})
+	st, err := client.Open()
+	require.NoError(t, err)
+	_, err = st.Write([]byte("x"))
+	require.NoError(t, err)
+	peer, err := server.Accept()
+	require.NoError(t, err)
+
+	require.NoError(t, st.Reset())
+	_, err = st.Write([]byte("y"))
+	require.ErrorIs(t, err, smux.ErrStreamReset)
+	require.Eventually(t, func() bool {
+		_, err := peer.Write([]byte("z"))
+		return errors.Is(err, smux.ErrStreamReset)
+	}, time.Second, 10*time.Millisecond, "The remote should see the reset.")
+}
+
+func TestGoAwayKeepsOpenStreams(t *testing.T) {
+	client, server := newPair(t, smux.Config{})
+	go echo(server)
+	st, err := client.Open()
+	require.NoError(t, err)
+	_, err = st.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(st, make([]byte, 2))
+	require.NoError(t, err, "The stream should be accepted before GoAway.")
+
+	require.NoError(t, server.GoAway())
+	require.Eventually(t, func() bool {
+		_, err := client.Open()
+		return errors.Is(err, smux.ErrRemoteGoAway)
+	}, time.Second, 10*time.Millisecond, "No streams should open after GoAway.")
+
+	_, err = st.Write([]byte("still here"))
+	require.NoError(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(st, buf)
+	require.NoError(t, err, "Streams open before GoAway should carry on.")
+	require.Equal(t, "still here", string(buf))
+}
+
+func TestKeepAliveClosesDeadSession(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// The remote reads frames but never answers them.
+	go io.Copy(io.Discard, b)
+
+	s := smux.Client(a, smux.Config{KeepAliveInterval: 20 * time.Millisecond, KeepAliveTimeout: 50 * time.Millisecond})
+	defer s.Close()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("An unanswered keepalive should close the session.")
+	}
+	require.ErrorIs(t, s.Err(), smux.ErrKeepAliveTimeout)
+
+	client, _ := newPair(t, smux.Config{})
+	rtt, err := client.Ping()
+	require.NoError(t, err)
+	require.Positive(t, rtt)
+}
+
+// rawFrame encodes a frame header as a misbehaving peer would send it.
+func rawFrame(typ byte, flags uint16, id, length uint32) []byte {
+	h := make([]byte, 12)
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:4], flags)
+	binary.BigEndian.PutUint32(h[4:8], id)
+	binary.BigEndian.PutUint32(h[8:12], length)
+	return h
+}
+
+func TestControlFloodIsBounded(t *testing.T) {
+	a, b := net.Pipe()
+	server := smux.Server(b, smux.Config{AcceptBacklog: 1, KeepAliveInterval: -1})
+	defer server.Close()
+	defer a.Close()
+
+	// The peer floods pings and SYNs but never reads the answers.
+	before := runtime.NumGoroutine()
+	go func() {
+		for i := uint32(0); i < 5000; i++ {
+			if _, err := a.Write(rawFrame(2, 1, 0, i)); err != nil {
+				return
+			}
+			if _, err := a.Write(rawFrame(1, 1, 2*i+1, 0)); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	require.Less(t, runtime.NumGoroutine()-before, 20, "Answers to a flood should not take a goroutine each.")
+}
+
+func TestWindowUpdateOverflowIsRejected(t *testing.T) {
+	a, b := net.Pipe()
+	server := smux.Server(b, smux.Config{KeepAliveInterval: -1})
+	defer server.Close()
+	defer a.Close()
+	go io.Copy(io.Discard, a)
+
+	_, err := a.Write(rawFrame(1, 1, 1, 0))
+	require.NoError(t, err)
+	_, err = server.Accept()
+	require.NoError(t, err)
+	_, err = a.Write(rawFrame(1, 0, 1, 1<<32-1))
+	require.NoError(t, err)
+
+	select {
+	case <-server.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("A window update overflowing the window should close the session.")
+	}
+	require.ErrorIs(t, server.Err(), smux.ErrProtocol)
+}
@@ -0,0 +1,245 @@
+package smux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"trustmesh/network/internal/cond"
+)
+
+// Stream is one bidirectional stream of a session. It implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu sync.Mutex
+	// recvBuf holds data received but not yet read.
+	recvBuf bytes.Buffer
+	// recvWindow is how much more the remote may send before it is granted
+	// more, and consumed how much has been read since the last grant.
+	recvWindow, consumed uint32
+	// sendWindow is how much more may be sent before the remote grants more.
+	sendWindow   uint32
+	localClosed  bool
+	remoteClosed bool
+	// err is set when the stream is reset or its session closes.
+	err error
+
+	readDeadline, writeDeadline time.Time
+
+	// readable and writable are signalled whenever a blocked Read or Write
+	// may be able to make progress.
+	readable, writable chan struct{}
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: s.cfg.StreamWindow,
+		sendWindow: s.cfg.StreamWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream's identifier within its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads data sent by the remote side. It returns io.EOF once the
+// remote has closed its side and every byte has been read.
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.consumed += uint32(n)
+			var grant uint32
+			// Grant the window back in halves rather than on every read.
+			if st.consumed >= st.session.cfg.StreamWindow/2 && !st.remoteClosed && st.err == nil {
+				grant, st.consumed = st.consumed, 0
+				st.recvWindow += grant
+			}
+			st.mu.Unlock()
+			if grant > 0 {
+				st.session.writeFrame(typeWindowUpdate, 0, st.id, grant, nil)
+			}
+			return n, nil
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		if st.remoteClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := cond.Wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends p to the remote side, blocking while the remote's window is
+// full.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.localClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := cond.Wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(uint32(len(p)-written), st.sendWindow, maxDataFrame)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(typeData, 0, st.id, n, p[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// Close half-closes the stream: the remote reads io.EOF once it has read
+// everything written, and may keep writing until it closes its side too.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+	cond.Notify(st.writable)
+
+	err := st.session.writeFrame(typeData, flagFIN, st.id, 0, nil)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Reset abandons the stream in both directions. Pending and later reads
+// and writes on either side fail with ErrStreamReset.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.mu.Unlock()
+	st.terminate(ErrStreamReset)
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(typeWindowUpdate, flagRST, st.id, 0, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	cond.Notify(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	cond.Notify(st.writable)
+	return nil
+}
+
+// receive buffers data the remote sent, which must fit its window.
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return ErrProtocol
+	}
+	st.recvWindow -= uint32(len(data))
+	if st.err == nil {
+		st.recvBuf.Write(data)
+	}
+	st.mu.Unlock()
+	cond.Notify(st.readable)
+	return nil
+}
+
+// grant adds to the send window, which may not grow beyond MaxStreamWindow.
+func (st *Stream) grant(n uint32) error {
+	if n == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	if n > MaxStreamWindow-st.sendWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: window update of %d bytes overflows the window", ErrProtocol, n)
+	}
+	st.sendWindow += n
+	st.mu.Unlock()
+	cond.Notify(st.writable)
+	return nil
+}
+
+// remoteClose records that the remote will send no more.
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+	cond.Notify(st.readable)
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+// terminate fails the stream's pending and later operations with err.
+func (st *Stream) terminate(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	cond.Notify(st.readable)
+	cond.Notify(st.writable)
+}
@@ -1 +1,24 @@
 package network
+
+import (
+	"context"
+	"net"
+)
+
+// TCPTransport carries peer connections over TCP.
+type TCPTransport struct{}
+
+var _ Transport = TCPTransport{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (TCPTransport) Protocols() []string {
+	return []string{"tcp"}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var ErrUnsupportedTransport = errors.New("no transport for address")
+
+// Transport carries peer connections. The network handshakes and
+// multiplexes streams over whatever connections a transport provides.
+type Transport interface {
+	// Listen accepts connections on addr, a host:port.
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to addr, a host:port.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// Protocols returns the URL schemes the transport serves, such as "tcp".
+	Protocols() []string
+}
+
+// splitAddr splits an address such as udp://host:port into its scheme and
+// host:port. Addresses without a scheme are TCP.
+func splitAddr(addr string) (scheme, hostport string) {
+	if scheme, hostport, ok := strings.Cut(addr, "://"); ok {
+		return scheme, hostport
+	}
+	return "tcp", addr
+}
+
+// transportFor returns the transport serving scheme.
+func transportFor(transports []Transport, scheme string) (Transport, error) {
+	for _, t := range transports {
+		for _, p := range t.Protocols() {
+			if p == scheme {
+				return t, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedTransport, scheme)
+}
@@ -0,0 +1,70 @@
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+	"time"
+	"trustmesh/network"
+	"trustmesh/network/internal/lossy"
+	"trustmesh/network/rudp"
+	"trustmesh/types"
+)
+
+func TestNetworkOverLossyUDP(t *testing.T) {
+	lossyUDP := []network.Transport{network.UDPTransport{Config: rudp.Config{ListenPacket: lossy.Listen(0.05, 1), MinRTO: 10 * time.Millisecond}}}
+	boot := newNetwork(t, network.Config{ListenAddr: "udp://127.0.0.1:0", Transports: lossyUDP})
+	node := newNetwork(t, network.Config{
+		ListenAddr: "udp://127.0.0.1:0",
+		Transports: lossyUDP,
+		BootNodes:  []*types.Node{boot.Self()},
+	})
+	require.Equal(t, "udp://"+boot.Self().Address(), boot.Self().URL())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, node.Start(ctx), "Boot nodes should be dialed over their transport.")
+	require.Contains(t, node.Nodes(), boot.Self().ID.String())
+
+	boot.Handle("/app/echo/1.0.0", func(ctx context.Context, rw io.ReadWriteCloser) error {
+		_, err := io.Copy(rw, rw)
+		return err
+	})
+	s, err := node.NewStream(ctx, boot.Self(), "/app/echo/1.0.0")
+	require.NoError(t, err)
+	msg := make([]byte, 256<<10)
+	rand.Read(msg)
+	go func() {
+		s.Write(msg)
+		s.Close()
+	}()
+	got, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(msg, got), "Streams should arrive intact over a lossy link.")
+}
+
+func TestNetworkDialsByScheme(t *testing.T) {
+	tcp := newNetwork(t, network.Config{})
+	udp := newNetwork(t, network.Config{ListenAddr: "udp://127.0.0.1:0"})
+	node := newNetwork(t, network.Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, remote := range []network.P2PNetwork{tcp, udp} {
+		got, err := node.Connect(ctx, remote.Self().URL())
+		require.NoError(t, err)
+		require.Equal(t, remote.Self().ID, got.ID)
+		_, err = node.Ping(ctx, remote.Self())
+		require.NoError(t, err)
+	}
+	_, err := node.Connect(ctx, tcp.Self().Address())
+	require.NoError(t, err, "Addresses without a scheme should be TCP.")
+
+	_, err = node.Connect(ctx, "quic://"+udp.Self().Address())
+	require.ErrorIs(t, err, network.ErrUnsupportedTransport)
+	_, err = network.NewNetwork(network.Config{ListenAddr: "udp://127.0.0.1:0", Transports: []network.Transport{network.TCPTransport{}}})
+	require.ErrorIs(t, err, network.ErrUnsupportedTransport)
+}
@@ -0,0 +1,31 @@
+package network
+
+import (
+	"context"
+	"net"
+	"trustmesh/network/rudp"
+)
+
+// UDPTransport carries peer connections as reliable streams over UDP,
+// which keep going when a node's address changes.
+type UDPTransport struct {
+	Config rudp.Config
+}
+
+var _ Transport = UDPTransport{}
+
+func (t UDPTransport) Listen(addr string) (net.Listener, error) {
+	return rudp.Listen(addr, t.Config)
+}
+
+func (t UDPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := rudp.Dial(ctx, addr, t.Config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (UDPTransport) Protocols() []string {
+	return []string{"udp"}
+}
@@ -0,0 +1,472 @@
+package qdht
+
+import (
+	"bytes"
+	"context"
+	"github.com/goccy/go-json"
+	"github.com/zeebo/blake3"
+	"sort"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultSyncInterval is how often a node reconciles its records with
+	// their other replicas.
+	DefaultSyncInterval = 10 * time.Minute
+	// syncLeafRecords is the size below which a differing subtree is
+	// exchanged outright instead of being split further. It also caps the
+	// records either side sends in one exchange.
+	syncLeafRecords = 32
+	// maxSyncRanges caps the ranges one sync request asks about.
+	maxSyncRanges = 256
+	// idBits is the length of identifiers, and so the depth of a full tree.
+	idBits = len(types.NodeID{}) * 8
+)
+
+// KeyRange is the XOR range of keys whose KeyID starts with the first Bits
+// bits of Prefix.
+type KeyRange struct {
+	Prefix types.NodeID `json:"prefix"`
+	Bits   int          `json:"bits"`
+}
+
+// NewKeyRange returns the range of identifiers sharing the first bits bits
+// of id.
+func NewKeyRange(id types.NodeID, bits int) KeyRange {
+	if bits > idBits {
+		bits = idBits
+	}
+	var prefix types.NodeID
+	copy(prefix[:], id[:bits/8])
+	if rem := bits % 8; rem > 0 {
+		prefix[bits/8] = id[bits/8] & (0xff << (8 - rem))
+	}
+	return KeyRange{Prefix: prefix, Bits: bits}
+}
+
+// Contains reports whether id falls in the range.
+func (r KeyRange) Contains(id types.NodeID) bool {
+	return CommonPrefixLen(r.Prefix, id) >= r.Bits
+}
+
+// split returns the two halves of the range.
+func (r KeyRange) split() (KeyRange, KeyRange) {
+	left := KeyRange{Prefix: r.Prefix, Bits: r.Bits + 1}
+	right := left
+	right.Prefix[r.Bits/8] |= 0x80 >> (r.Bits % 8)
+	return left, right
+}
+
+// MerkleSummary is a node's digest of the records it stores in a range.
+// Equal hashes mean both nodes hold exactly the same records.
+type MerkleSummary struct {
+	Range KeyRange `json:"range"`
+	Hash  []byte   `json:"hash,omitempty"`
+	Count int      `json:"count"`
+}
+
+// SyncMetrics reports the anti-entropy work a node has initiated.
+type SyncMetrics struct {
+	// Sessions counts reconciliations with a neighbour, Failures those that
+	// ended in an error.
+	Sessions, Failures uint64
+	// Rounds counts summary and record exchanges.
+	Rounds uint64
+	// BytesSent and BytesReceived count encoded sync messages.
+	BytesSent, BytesReceived uint64
+	// RecordsSent and RecordsReceived count records transferred.
+	RecordsSent, RecordsReceived uint64
+	// LastDuration and TotalDuration time the sessions.
+	LastDuration, TotalDuration time.Duration
+}
+
+// syncEntry is a stored record positioned in the identifier space.
+type syncEntry struct {
+	id     types.NodeID
+	digest [32]byte
+	rec    *Record
+}
+
+// replicas returns the contacts that, with the local node, are the k
+// closest the routing table knows to id, and whether the local node is one
+// of the k closest, and so replicates the key.
+func (d *DHT) replicas(id types.NodeID) ([]*types.Node, bool) {
+	closest := d.table.Closest(id, d.k)
+	if len(closest) < d.k {
+		return closest, true
+	}
+	if closer(d.self.ID, closest[d.k-1].ID, id) {
+		return closest[:d.k-1], true
+	}
+	return closest, false
+}
+
+// replicates reports whether the local node is one of the k closest to id.
+func (d *DHT) replicates(id types.NodeID) bool {
+	_, ok := d.replicas(id)
+	return ok
+}
+
+// syncEntries returns the live stored records the node replicates, sorted by
+// key identifier, which keeps every range a contiguous run. Only these take
+// part in anti-entropy.
+func (d *DHT) syncEntries() []syncEntry {
+	now := d.now()
+	var entries []syncEntry
+	for _, rec := range d.allRecords() {
+		if rec.Expired(now) || !d.replicates(KeyID(rec.key)) {
+			continue
+		}
+		entries = append(entries, syncEntry{id: KeyID(rec.key), digest: blake3.Sum256(rec.signature), rec: rec})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if c := bytes.Compare(entries[i].id[:], entries[j].id[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(entries[i].digest[:], entries[j].digest[:]) < 0
+	})
+	return entries
+}
+
+// inRange returns the run of entries that fall in r.
+func inRange(entries []syncEntry, r KeyRange) []syncEntry {
+	start := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].id[:], r.Prefix[:]) >= 0
+	})
+	end := start
+	for end < len(entries) && r.Contains(entries[end].id) {
+		end++
+	}
+	return entries[start:end]
+}
+
+// merkleHash returns the root of the binary trie over entries, which all lie
+// in r. The trie splits on identifier bits until each leaf holds a single
+// key, so its shape depends only on the entries and both sides of a sync
+// compute the same hash for the same records.
+func merkleHash(entries []syncEntry, r KeyRange) []byte {
+	if len(entries) == 0 {
+		return nil
+	}
+	h := blake3.New()
+	if entries[0].id == entries[len(entries)-1].id || r.Bits >= idBits {
+		h.Write([]byte{0})
+		for _, e := range entries {
+			h.Write(e.id[:])
+			h.Write(e.digest[:])
+		}
+		return h.Sum(nil)
+	}
+
+	left, right := r.split()
+	mid := sort.Search(len(entries), func(i int) bool {
+		return !left.Contains(entries[i].id)
+	})
+	var empty [32]byte
+	h.Write([]byte{1})
+	for _, half := range [][]byte{merkleHash(entries[:mid], left), merkleHash(entries[mid:], right)} {
+		if half == nil {
+			half = empty[:]
+		}
+		h.Write(half)
+	}
+	return h.Sum(nil)
+}
+
+// summarize digests the local records in each of ranges.
+func (d *DHT) summarize(ranges []KeyRange) []MerkleSummary {
+	entries := d.syncEntries()
+	out := make([]MerkleSummary, len(ranges))
+	for i, r := range ranges {
+		sub := inRange(entries, r)
+		out[i] = MerkleSummary{Range: r, Hash: merkleHash(sub, r), Count: len(sub)}
+	}
+	return out
+}
+
+// recordsIn returns the local records in any of ranges. More than
+// syncLeafRecords of them fail with ErrSyncTooLarge, so that the peer
+// subdivides the ranges, unless they share one key that cannot be
+// subdivided; then the first syncLeafRecords are returned.
+func (d *DHT) recordsIn(ranges []KeyRange) ([]*Record, error) {
+	entries := d.syncEntries()
+	var recs []*Record
+	for _, r := range ranges {
+		for _, e := range inRange(entries, r) {
+			recs = append(recs, e.rec)
+		}
+	}
+	if len(recs) <= syncLeafRecords {
+		return recs, nil
+	}
+	if len(ranges) == 1 && ranges[0].Bits >= idBits {
+		return recs[:syncLeafRecords], nil
+	}
+	return nil, ErrSyncTooLarge
+}
+
+// Sync reconciles the records this node and peer both replicate in ranges.
+// The nodes compare Merkle summaries level by level and exchange records
+// only in the subtrees that differ.
+func (d *DHT) Sync(ctx context.Context, peer *types.Node, ranges ...KeyRange) error {
+	start := time.Now()
+	var stats SyncMetrics
+	err := d.sync(ctx, peer, ranges, &stats)
+
+	stats.Sessions = 1
+	if err != nil {
+		stats.Failures = 1
+	}
+	stats.LastDuration = time.Since(start)
+	stats.TotalDuration = stats.LastDuration
+	d.addSyncMetrics(stats)
+	return err
+}
+
+func (d *DHT) sync(ctx context.Context, peer *types.Node, pending []KeyRange, stats *SyncMetrics) error {
+	for len(pending) > 0 {
+		batch := pending[:min(len(pending), maxSyncRanges)]
+		pending = pending[len(batch):]
+		resp, err := d.syncRound(ctx, peer, &Message{Type: MsgSyncSummary, Summaries: summaryRequests(batch)}, stats)
+		if err != nil {
+			return err
+		}
+		if len(resp.Summaries) != len(batch) {
+			return ErrInvalidSummary
+		}
+
+		// Differing ranges small enough are exchanged in groups holding at
+		// most syncLeafRecords records on either side; the others are split.
+		mine := d.summarize(batch)
+		var differing []KeyRange
+		size := 0
+		for i, theirs := range resp.Summaries {
+			if theirs.Range != batch[i] {
+				return ErrInvalidSummary
+			}
+			if bytes.Equal(theirs.Hash, mine[i].Hash) {
+				continue
+			}
+			n := theirs.Count + mine[i].Count
+			if n > syncLeafRecords && batch[i].Bits < idBits {
+				left, right := batch[i].split()
+				pending = append(pending, left, right)
+				continue
+			}
+			if len(differing) > 0 && size+n > syncLeafRecords {
+				if err := d.exchange(ctx, peer, differing, stats); err != nil {
+					return err
+				}
+				differing, size = nil, 0
+			}
+			differing = append(differing, batch[i])
+			size += n
+		}
+		if len(differing) > 0 {
+			if err := d.exchange(ctx, peer, differing, stats); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exchange sends peer the local records in ranges and stores the ones it
+// holds that this node lacks.
+func (d *DHT) exchange(ctx context.Context, peer *types.Node, ranges []KeyRange, stats *SyncMetrics) error {
+	recs, err := d.recordsIn(ranges)
+	if err != nil {
+		return err
+	}
+	resp, err := d.syncRound(ctx, peer, &Message{Type: MsgSyncRecords, Summaries: summaryRequests(ranges), Records: recs}, stats)
+	if err != nil {
+		return err
+	}
+	stats.RecordsSent += uint64(len(recs))
+	for _, rec := range resp.Records {
+		if id := KeyID(rec.key); !inAnyRange(ranges, id) || !d.replicates(id) {
+			continue
+		}
+		if d.storeLocal(rec) == nil {
+			stats.RecordsReceived++
+		}
+	}
+	return nil
+}
+
+// syncRound sends one sync request and accounts for its size.
+func (d *DHT) syncRound(ctx context.Context, peer *types.Node, msg *Message, stats *SyncMetrics) (*Message, error) {
+	stats.Rounds++
+	if b, err := json.Marshal(msg); err == nil {
+		stats.BytesSent += uint64(len(b))
+	}
+	resp, err := d.send(ctx, peer, msg)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := json.Marshal(resp); err == nil {
+		stats.BytesReceived += uint64(len(b))
+	}
+	return resp, nil
+}
+
+// handleSyncRecords stores the records a peer sent for ranges and returns
+// the local ones it did not send. Like the summaries, it only covers the
+// keys this node replicates, and at most syncLeafRecords records each way.
+func (d *DHT) handleSyncRecords(ranges []KeyRange, recs []*Record) ([]*Record, error) {
+	local, err := d.recordsIn(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if len(recs) > syncLeafRecords {
+		return nil, ErrSyncTooLarge
+	}
+	sent := make(map[[32]byte]bool, len(recs))
+	for _, rec := range recs {
+		if id := KeyID(rec.key); !inAnyRange(ranges, id) || !d.replicates(id) {
+			continue
+		}
+		sent[blake3.Sum256(rec.signature)] = true
+		d.storeLocal(rec)
+	}
+
+	var out []*Record
+	for _, rec := range local {
+		if !sent[blake3.Sum256(rec.signature)] {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// SyncNeighbours reconciles the records the node replicates with the other
+// replicas of each. Every contact is synced over the ranges holding exactly
+// the local records both replicate, as far as the routing table tells.
+func (d *DHT) SyncNeighbours(ctx context.Context) {
+	entries := d.syncEntries()
+	shared := make(map[types.NodeID]map[types.NodeID]bool)
+	peers := make(map[types.NodeID]*types.Node)
+	for _, e := range entries {
+		replicas, _ := d.replicas(e.id)
+		for _, n := range replicas {
+			if shared[n.ID] == nil {
+				shared[n.ID] = make(map[types.NodeID]bool)
+				peers[n.ID] = n
+			}
+			shared[n.ID][e.id] = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	for id, keys := range shared {
+		wg.Add(1)
+		go func(n *types.Node, ranges []KeyRange) {
+			defer wg.Done()
+			d.Sync(ctx, n, ranges...)
+		}(peers[id], coverRanges(entries, keys))
+	}
+	wg.Wait()
+}
+
+// coverRanges returns the fewest ranges that hold the entries whose
+// identifiers are in keys and no other entry.
+func coverRanges(entries []syncEntry, keys map[types.NodeID]bool) []KeyRange {
+	var out []KeyRange
+	var walk func(sub []syncEntry, r KeyRange)
+	walk = func(sub []syncEntry, r KeyRange) {
+		some, all := false, true
+		for _, e := range sub {
+			some = some || keys[e.id]
+			all = all && keys[e.id]
+		}
+		if !some {
+			return
+		}
+		// Entries sharing an identifier are either all in keys or none, so
+		// a full-length range is never split.
+		if all {
+			out = append(out, r)
+			return
+		}
+		left, right := r.split()
+		mid := sort.Search(len(sub), func(i int) bool { return !left.Contains(sub[i].id) })
+		walk(sub[:mid], left)
+		walk(sub[mid:], right)
+	}
+	walk(entries, KeyRange{})
+	return out
+}
+
+// SyncMetrics returns the anti-entropy counters accumulated so far.
+func (d *DHT) SyncMetrics() SyncMetrics {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+	return d.syncStats
+}
+
+func (d *DHT) addSyncMetrics(s SyncMetrics) {
+	d.syncMu.Lock()
+	defer d.syncMu.Unlock()
+
+	t := &d.syncStats
+	t.Sessions += s.Sessions
+	t.Failures += s.Failures
+	t.Rounds += s.Rounds
+	t.BytesSent += s.BytesSent
+	t.BytesReceived += s.BytesReceived
+	t.RecordsSent += s.RecordsSent
+	t.RecordsReceived += s.RecordsReceived
+	t.LastDuration = s.LastDuration
+	t.TotalDuration += s.TotalDuration
+}
+
+// syncLoop periodically reconciles with the other replicas.
+func (d *DHT) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			ctx, cancel := d.opContext()
+			d.SyncNeighbours(ctx)
+			cancel()
+		}
+	}
+}
+
+// requestedRanges returns the ranges a sync request asks about.
+func requestedRanges(msg *Message) ([]KeyRange, error) {
+	if len(msg.Summaries) > maxSyncRanges {
+		return nil, ErrSyncTooLarge
+	}
+	ranges := make([]KeyRange, len(msg.Summaries))
+	for i, s := range msg.Summaries {
+		if s.Range.Bits < 0 || s.Range.Bits > idBits || NewKeyRange(s.Range.Prefix, s.Range.Bits) != s.Range {
+			return nil, ErrInvalidSummary
+		}
+		ranges[i] = s.Range
+	}
+	return ranges, nil
+}
+
+func summaryRequests(ranges []KeyRange) []MerkleSummary {
+	out := make([]MerkleSummary, len(ranges))
+	for i, r := range ranges {
+		out[i] = MerkleSummary{Range: r}
+	}
+	return out
+}
+
+func inAnyRange(ranges []KeyRange, id types.NodeID) bool {
+	for _, r := range ranges {
+		if r.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
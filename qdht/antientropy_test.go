@@ -0,0 +1,198 @@
+package qdht_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// stored returns how many records d stores for key.
+func stored(t *testing.T, d *qdht.DHT, key string) int {
+	t.Helper()
+	resp, err := d.HandleMessage(context.Background(), &qdht.Message{Type: qdht.MsgFindValue, Key: key})
+	require.NoError(t, err)
+	return len(resp.Records)
+}
+
+// holds reports whether d stores a record for key.
+func holds(t *testing.T, d *qdht.DHT, key string) bool {
+	t.Helper()
+	return stored(t, d, key) > 0
+}
+
+// newSeededMesh is newTestMesh with node keys derived from fixed seeds, so
+// that node IDs, and which nodes replicate a key, are the same every run.
+func newSeededMesh(t *testing.T, size int, cfg qdht.Config) (*qdht.Mesh, []*qdht.DHT) {
+	t.Helper()
+	mesh := qdht.NewMesh()
+	nodes := make([]*qdht.DHT, size)
+	for i := range nodes {
+		key, err := crypto.NewSigningKeyFromSeed([]byte(fmt.Sprint("anti-entropy node ", i)))
+		require.NoError(t, err)
+		cfg.Key = key
+		nodes[i], err = mesh.NewNode(cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() { nodes[i].Close() })
+		if i > 0 {
+			require.NoError(t, nodes[i].Join(qdht.NodeOf(nodes[0].Self())))
+		}
+	}
+	return mesh, nodes
+}
+
+// replicasOf returns the k nodes closest to key.
+func replicasOf(nodes []*qdht.DHT, key string, k int) []*qdht.DHT {
+	sorted := append([]*qdht.DHT(nil), nodes...)
+	target := qdht.KeyID(key)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := qdht.Distance(sorted[i].Self().ID, target), qdht.Distance(sorted[j].Self().ID, target)
+		return bytes.Compare(a[:], b[:]) < 0
+	})
+	return sorted[:k]
+}
+
+// summary returns d's Merkle summary of r.
+func summary(t *testing.T, d *qdht.DHT, r qdht.KeyRange) qdht.MerkleSummary {
+	t.Helper()
+	resp, err := d.HandleMessage(context.Background(), &qdht.Message{
+		Type:      qdht.MsgSyncSummary,
+		Summaries: []qdht.MerkleSummary{{Range: r}},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Summaries, 1)
+	return resp.Summaries[0]
+}
+
+func TestAntiEntropyConvergesAfterPartition(t *testing.T) {
+	const k = 4
+	mesh, nodes := newSeededMesh(t, 8, qdht.Config{K: k, SyncInterval: -1})
+	ctx := context.Background()
+
+	var left, right []types.NodeID
+	for i, d := range nodes {
+		if i < 4 {
+			left = append(left, d.Self().ID)
+		} else {
+			right = append(right, d.Self().ID)
+		}
+	}
+	mesh.Partition(left, right)
+
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("/app/left", []byte("l"))))
+	require.NoError(t, nodes[5].Put(qdht.NewDataItem("/app/right", []byte("r"))))
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/app/shared", []byte("from left"))))
+	require.NoError(t, nodes[6].Put(qdht.NewDataItem("/app/shared", []byte("from right"))))
+	for _, d := range nodes[4:] {
+		require.Zero(t, stored(t, d, "/app/left"), "The left write should not cross the partition.")
+	}
+
+	mesh.Heal()
+	for i, d := range nodes {
+		other := nodes[(i+4)%len(nodes)]
+		require.NoError(t, d.Join(qdht.NodeOf(other.Self())), "Rejoining after the partition should not fail.")
+	}
+
+	for round := 0; round < 10; round++ {
+		before := uint64(0)
+		for _, d := range nodes {
+			before += d.SyncMetrics().RecordsReceived
+		}
+		for _, d := range nodes {
+			d.SyncNeighbours(ctx)
+		}
+		after := uint64(0)
+		for _, d := range nodes {
+			after += d.SyncMetrics().RecordsReceived
+		}
+		if after == before {
+			break
+		}
+	}
+
+	// Every replica of a key ends up with every version written on either
+	// side.
+	for key, versions := range map[string]int{"/app/left": 1, "/app/right": 1, "/app/shared": 2} {
+		for _, d := range replicasOf(nodes, key, k) {
+			require.Equal(t, versions, stored(t, d, key), "Anti-entropy should give every replica of %s its versions.", key)
+		}
+	}
+
+	recs, err := nodes[3].GetRecords(ctx, "/app/shared", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 2, "Writes on both sides of the partition conflict.")
+
+	var received uint64
+	for _, d := range nodes {
+		m := d.SyncMetrics()
+		require.NotZero(t, m.Sessions)
+		require.NotZero(t, m.BytesSent)
+		require.NotZero(t, m.TotalDuration)
+		received += m.RecordsReceived
+	}
+	require.NotZero(t, received)
+}
+
+func TestAntiEntropyLimitsRequests(t *testing.T) {
+	_, nodes := newSeededMesh(t, 2, qdht.Config{K: 1, SyncInterval: -1})
+	ctx := context.Background()
+	a, b := nodes[0], nodes[1]
+
+	// With k=1 each node replicates the keys closer to it than to the other.
+	var mine, theirs []string
+	for i := 0; len(mine) < 40 || len(theirs) == 0; i++ {
+		key := fmt.Sprint("/app/", i)
+		if replicasOf(nodes, key, 1)[0] == a {
+			mine = append(mine, key)
+		} else {
+			theirs = append(theirs, key)
+		}
+	}
+	for _, key := range mine[:40] {
+		require.NoError(t, a.Put(qdht.NewDataItem(key, []byte(key))))
+	}
+
+	resp, err := a.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgSyncRecords, Summaries: []qdht.MerkleSummary{{}}})
+	require.NoError(t, err)
+	require.Equal(t, qdht.ErrSyncTooLarge.Error(), resp.Error, "A range holding too many records should be refused.")
+
+	signer, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	foreign := qdht.NewRecord(theirs[0], []byte("x"), 1, time.Now().Add(time.Hour))
+	require.NoError(t, foreign.Sign(signer))
+	_, err = a.HandleMessage(ctx, &qdht.Message{
+		Type:      qdht.MsgSyncRecords,
+		Summaries: []qdht.MerkleSummary{{Range: qdht.NewKeyRange(qdht.KeyID(theirs[0]), 256)}},
+		Records:   []*qdht.Record{foreign},
+	})
+	require.NoError(t, err)
+	require.Zero(t, stored(t, a, theirs[0]), "Records the node does not replicate should not be stored.")
+
+	summaries := summary(t, a, qdht.KeyRange{})
+	require.Equal(t, 40, summaries.Count)
+	require.NoError(t, b.Sync(ctx, a.Self(), qdht.KeyRange{}))
+	require.Equal(t, 0, summary(t, b, qdht.KeyRange{}).Count, "Records only a replicates should not move to b.")
+}
+
+func TestAntiEntropySkipsIdenticalRanges(t *testing.T) {
+	_, nodes := newTestMesh(t, 2, qdht.Config{K: 4, SyncInterval: -1})
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, nodes[0].Put(qdht.NewDataItem(key, []byte(key))))
+	}
+	r := qdht.KeyRange{}
+	require.NoError(t, nodes[0].Sync(ctx, nodes[1].Self(), r))
+
+	before := nodes[0].SyncMetrics()
+	require.NoError(t, nodes[0].Sync(ctx, nodes[1].Self(), r))
+	after := nodes[0].SyncMetrics()
+	require.Equal(t, before.Rounds+1, after.Rounds, "Matching roots should end the sync after one round.")
+	require.Equal(t, before.RecordsSent, after.RecordsSent, "No records should move between identical replicas.")
+}
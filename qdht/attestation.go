@@ -0,0 +1,323 @@
+package qdht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"sort"
+	"strings"
+	"time"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+const (
+	// AttestationNamespace is the key namespace nodes publish the
+	// attestations they issue under.
+	AttestationNamespace = "attest"
+	// MaxAttestations is how many nodes one issuer may vouch for at once.
+	MaxAttestations = 1024
+	// DefaultTrustDepth is how many hops from the seeds GlobalTrust follows
+	// attestations.
+	DefaultTrustDepth = 4
+	// DefaultTrustNodes is how many issuers GlobalTrust fetches the
+	// attestations of.
+	DefaultTrustNodes = 256
+	// DefaultTrustInterval is how often the global trust estimates are
+	// refreshed.
+	DefaultTrustInterval = 10 * time.Minute
+)
+
+// Attestation is a node vouching for another: Issuer trusts Subject with a
+// weight between zero and one until Expires. An issuer's attestations are
+// published together in one record under AttestationKey, which only the
+// issuer can sign.
+type Attestation struct {
+	Issuer  types.NodeID `json:"-"`
+	Subject types.NodeID `json:"subject"`
+	Weight  float64      `json:"weight"`
+	Expires time.Time    `json:"expires"`
+}
+
+// attestationSet is the stored form of an issuer's attestations.
+type attestationSet struct {
+	Attestations []Attestation `json:"attestations"`
+}
+
+// AttestationKey returns the key issuer's attestations are published under.
+func AttestationKey(issuer types.NodeID) string {
+	return "/" + AttestationNamespace + "/" + issuer.String()
+}
+
+func parseAttestationKey(key string) (types.NodeID, error) {
+	name, ok := strings.CutPrefix(key, "/"+AttestationNamespace+"/")
+	if !ok {
+		return types.NodeID{}, fmt.Errorf("%w: bad key %q", ErrInvalidAttestation, key)
+	}
+	id, err := types.ParseNodeID(name)
+	if err != nil {
+		return types.NodeID{}, fmt.Errorf("%w: bad key %q", ErrInvalidAttestation, key)
+	}
+	return id, nil
+}
+
+func decodeAttestations(issuer types.NodeID, data []byte) ([]Attestation, error) {
+	var set attestationSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if len(set.Attestations) > MaxAttestations {
+		return nil, fmt.Errorf("%w: %d attestations", ErrInvalidAttestation, len(set.Attestations))
+	}
+	subjects := make(map[types.NodeID]bool, len(set.Attestations))
+	for i := range set.Attestations {
+		a := &set.Attestations[i]
+		if a.Subject == issuer || subjects[a.Subject] {
+			return nil, fmt.Errorf("%w: bad subject %s", ErrInvalidAttestation, a.Subject)
+		}
+		if !(a.Weight > 0 && a.Weight <= 1) {
+			return nil, fmt.Errorf("%w: weight %v", ErrInvalidAttestation, a.Weight)
+		}
+		subjects[a.Subject] = true
+		a.Issuer = issuer
+	}
+	return set.Attestations, nil
+}
+
+// AttestationValidator accepts attestation records signed by the issuer
+// their key names.
+type AttestationValidator struct{}
+
+func (AttestationValidator) Validate(rec *Record) error {
+	issuer, err := parseAttestationKey(rec.key)
+	if err != nil {
+		return err
+	}
+	if rec.PublisherID() != issuer {
+		return fmt.Errorf("%w: published by %s", ErrInvalidAttestation, rec.PublisherID())
+	}
+	if len(rec.value) == tombstoneValueLen {
+		return nil
+	}
+	_, err = decodeAttestations(issuer, rec.value)
+	return err
+}
+
+func (AttestationValidator) Select(key string, recs []*Record) (int, error) {
+	return DefaultValidator{}.Select(key, recs)
+}
+
+// Vouch publishes that the local node trusts subject with weight, between
+// zero and one, until expires. It replaces any earlier attestation of
+// subject by the local node.
+func (d *DHT) Vouch(ctx context.Context, subject types.NodeID, weight float64, expires time.Time) error {
+	if !(weight > 0 && weight <= 1) {
+		return fmt.Errorf("%w: weight %v", ErrInvalidAttestation, weight)
+	}
+	return d.updateAttestations(ctx, subject, &Attestation{Subject: subject, Weight: weight, Expires: expires})
+}
+
+// Revoke withdraws the local node's attestation of subject.
+func (d *DHT) Revoke(ctx context.Context, subject types.NodeID) error {
+	return d.updateAttestations(ctx, subject, nil)
+}
+
+// updateAttestations republishes the local node's unexpired attestations
+// with that of subject replaced by a, or dropped if a is nil.
+func (d *DHT) updateAttestations(ctx context.Context, subject types.NodeID, a *Attestation) error {
+	if d.key == nil {
+		return ErrNoSigningKey
+	}
+	d.attestMu.Lock()
+	defer d.attestMu.Unlock()
+
+	issuer := types.NewNodeID(d.key.PublicKeyBytes())
+	current, err := d.ownAttestations(ctx, issuer)
+	if err != nil {
+		return err
+	}
+	var kept []Attestation
+	for _, c := range current {
+		if c.Subject != subject {
+			kept = append(kept, c)
+		}
+	}
+	if a != nil {
+		kept = append(kept, *a)
+	}
+	if len(kept) > MaxAttestations {
+		return fmt.Errorf("%w: %d attestations", ErrInvalidAttestation, len(kept))
+	}
+	sort.Slice(kept, func(i, j int) bool { return bytes.Compare(kept[i].Subject[:], kept[j].Subject[:]) < 0 })
+
+	key := AttestationKey(issuer)
+	if len(kept) == 0 {
+		opts := d.putOptions(nil)
+		if p := d.untrack(key); p != nil {
+			opts = p.opts
+		}
+		_, err = d.publish(ctx, key, nil, opts)
+	} else {
+		var value []byte
+		if value, err = json.Marshal(attestationSet{Attestations: kept}); err != nil {
+			return err
+		}
+		_, err = d.publish(ctx, key, value, d.putOptions(nil))
+	}
+	if err == nil {
+		d.attested = true
+	}
+	return err
+}
+
+// ownAttestations returns the local node's unexpired attestations, from
+// the record it keeps of its own latest version when it has one. Without
+// one it reads them from the network, and finding none there is only taken
+// as an empty set when the node has not published any since it started.
+func (d *DHT) ownAttestations(ctx context.Context, issuer types.NodeID) ([]Attestation, error) {
+	for _, rec := range d.localRecords(AttestationKey(issuer)) {
+		if rec.PublisherID() != issuer {
+			continue
+		}
+		if len(rec.value) == tombstoneValueLen {
+			return nil, nil
+		}
+		all, err := decodeAttestations(issuer, rec.value)
+		if err != nil {
+			return nil, err
+		}
+		return d.liveAttestations(all), nil
+	}
+
+	current, err := d.Attestations(ctx, issuer)
+	if errors.Is(err, ErrNotFound) {
+		if d.attested {
+			return nil, fmt.Errorf("%w: %v", ErrAttestationsLost, err)
+		}
+		return nil, nil
+	}
+	return current, err
+}
+
+// Attestations returns the unexpired attestations issuer has published.
+func (d *DHT) Attestations(ctx context.Context, issuer types.NodeID, opts ...GetOptions) ([]Attestation, error) {
+	recs, err := d.GetRecords(ctx, AttestationKey(issuer), opts...)
+	if err != nil {
+		return nil, err
+	}
+	all, err := decodeAttestations(issuer, recs[0].value)
+	if err != nil {
+		return nil, err
+	}
+	return d.liveAttestations(all), nil
+}
+
+// liveAttestations returns the attestations in all that have not expired.
+func (d *DHT) liveAttestations(all []Attestation) []Attestation {
+	now := d.now()
+	var live []Attestation
+	for _, a := range all {
+		if now.Before(a.Expires) {
+			live = append(live, a)
+		}
+	}
+	return live
+}
+
+// TrustOptions bounds how GlobalTrust explores the web of trust.
+type TrustOptions struct {
+	// MaxDepth is how many hops from the seeds attestations are followed.
+	MaxDepth int
+	// MaxNodes is how many issuers' attestations are fetched.
+	MaxNodes int
+	// EigenTrust tunes the computation over the graph found.
+	EigenTrust trust.EigenTrustConfig
+}
+
+// GlobalTrust fetches the attestations reachable from the trusted seeds and
+// computes every node's global trust from them with EigenTrust. The
+// estimates sum to one; nodes the seeds do not transitively vouch for are
+// missing.
+func (d *DHT) GlobalTrust(ctx context.Context, seeds []types.NodeID, opts TrustOptions) (map[types.NodeID]float64, error) {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = DefaultTrustDepth
+	}
+	if opts.MaxNodes <= 0 {
+		opts.MaxNodes = DefaultTrustNodes
+	}
+
+	g := make(trust.Graph)
+	visited := make(map[types.NodeID]bool)
+	var frontier []types.NodeID
+	for _, id := range seeds {
+		if !visited[id] {
+			visited[id] = true
+			frontier = append(frontier, id)
+		}
+	}
+	for depth := 0; depth < opts.MaxDepth && len(frontier) > 0; depth++ {
+		// Attestations that cannot be fetched or are invalid count as none.
+		found := make([][]Attestation, len(frontier))
+		d.fanOut(len(frontier), func(i int) {
+			found[i], _ = d.Attestations(ctx, frontier[i])
+		})
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var next []types.NodeID
+		for _, as := range found {
+			for _, a := range as {
+				g.Vouch(a.Issuer, a.Subject, a.Weight)
+				if !visited[a.Subject] && len(visited) < opts.MaxNodes {
+					visited[a.Subject] = true
+					next = append(next, a.Subject)
+				}
+			}
+		}
+		frontier = next
+	}
+	return trust.EigenTrust(g, seeds, opts.EigenTrust), nil
+}
+
+// GlobalTrustSetter takes global trust estimates. A Scorer implementing it
+// is handed the estimates the DHT computes from its trust seeds;
+// trust.Engine does.
+type GlobalTrustSetter interface {
+	SetGlobalTrust(trust map[types.NodeID]float64)
+}
+
+var _ GlobalTrustSetter = (*trust.Engine)(nil)
+
+// RefreshTrust recomputes the global trust of the configured trust seeds'
+// web of trust and hands it to the scorer.
+func (d *DHT) RefreshTrust(ctx context.Context) error {
+	setter, ok := d.scorer.(GlobalTrustSetter)
+	if !ok || len(d.trustSeeds) == 0 {
+		return nil
+	}
+	estimates, err := d.GlobalTrust(ctx, d.trustSeeds, d.trustOpts)
+	if err != nil {
+		return err
+	}
+	setter.SetGlobalTrust(estimates)
+	return nil
+}
+
+func (d *DHT) trustLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			ctx, cancel := d.opContext()
+			d.RefreshTrust(ctx)
+			cancel()
+		}
+	}
+}
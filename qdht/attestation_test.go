@@ -0,0 +1,126 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+func TestAttestationsRoundTrip(t *testing.T) {
+	_, nodes := newTestMesh(t, 5, qdht.Config{K: 4})
+	ctx := context.Background()
+	issuer, subject := nodes[1], nodes[2].Self().ID
+	expires := time.Now().Add(time.Hour)
+
+	require.NoError(t, issuer.Vouch(ctx, subject, 0.8, expires))
+	require.NoError(t, issuer.Vouch(ctx, nodes[3].Self().ID, 0.4, time.Now().Add(-time.Minute)))
+	as, err := nodes[4].Attestations(ctx, issuer.Self().ID)
+	require.NoError(t, err)
+	require.Len(t, as, 1, "Expired attestations should be ignored.")
+	require.Equal(t, issuer.Self().ID, as[0].Issuer)
+	require.Equal(t, subject, as[0].Subject)
+	require.Equal(t, 0.8, as[0].Weight)
+	require.WithinDuration(t, expires, as[0].Expires, time.Second)
+
+	require.ErrorIs(t, issuer.Vouch(ctx, subject, 1.5, expires), qdht.ErrInvalidAttestation, "Weights above one should be refused.")
+
+	require.NoError(t, issuer.Revoke(ctx, subject))
+	_, err = nodes[4].Attestations(ctx, issuer.Self().ID)
+	require.ErrorIs(t, err, qdht.ErrNotFound, "Revoking the last attestation should remove the record.")
+}
+
+// forgetfulStore loses every record it is asked for.
+type forgetfulStore struct {
+	qdht.RecordStore
+}
+
+func (forgetfulStore) Get(string) ([]*qdht.Record, error) {
+	return nil, qdht.ErrNotFound
+}
+
+func TestAttestationsAreNotOverwrittenWhenLost(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 5, qdht.Config{K: 4})
+	issuer, err := mesh.NewNode(qdht.Config{K: 4, Store: forgetfulStore{qdht.NewMemoryRecordStore()}})
+	require.NoError(t, err)
+	t.Cleanup(func() { issuer.Close() })
+	require.NoError(t, issuer.Join(qdht.NodeOf(nodes[0].Self())))
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, issuer.Vouch(ctx, nodes[1].Self().ID, 0.8, expires))
+
+	mesh.Partition([]types.NodeID{issuer.Self().ID})
+	require.ErrorIs(t, issuer.Vouch(ctx, nodes[2].Self().ID, 0.5, expires), qdht.ErrAttestationsLost,
+		"An issuer that cannot read back its attestations should not overwrite them.")
+
+	mesh.Heal()
+	require.NoError(t, issuer.Join(qdht.NodeOf(nodes[0].Self())), "The issuer should rejoin once the partition heals.")
+	require.NoError(t, issuer.Vouch(ctx, nodes[2].Self().ID, 0.5, expires))
+	as, err := nodes[4].Attestations(ctx, issuer.Self().ID)
+	require.NoError(t, err)
+	require.Len(t, as, 2, "Earlier attestations should survive the update.")
+}
+
+func TestAttestationValidator(t *testing.T) {
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	issuer := types.NewNodeID(key.PublicKeyBytes())
+	other := types.NewNodeID([]byte("other"))
+	sign := func(k *crypto.SigningKey, key string, value string) *qdht.Record {
+		rec := qdht.NewRecord(key, []byte(value), 1, time.Now().Add(time.Hour))
+		require.NoError(t, rec.Sign(k))
+		return rec
+	}
+	valid := `{"attestations":[{"subject":"` + other.String() + `","weight":0.5,"expires":"2030-01-01T00:00:00Z"}]}`
+	v := qdht.AttestationValidator{}
+
+	require.NoError(t, v.Validate(sign(key, qdht.AttestationKey(issuer), valid)))
+
+	forger, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	require.ErrorIs(t, v.Validate(sign(forger, qdht.AttestationKey(issuer), valid)), qdht.ErrInvalidAttestation,
+		"Only the issuer should publish its attestations.")
+
+	self := `{"attestations":[{"subject":"` + issuer.String() + `","weight":1,"expires":"2030-01-01T00:00:00Z"}]}`
+	require.ErrorIs(t, v.Validate(sign(key, qdht.AttestationKey(issuer), self)), qdht.ErrInvalidAttestation,
+		"Issuers should not vouch for themselves.")
+	heavy := `{"attestations":[{"subject":"` + other.String() + `","weight":2,"expires":"2030-01-01T00:00:00Z"}]}`
+	require.ErrorIs(t, v.Validate(sign(key, qdht.AttestationKey(issuer), heavy)), qdht.ErrInvalidAttestation)
+}
+
+func TestTransitiveTrustAdmission(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 5, qdht.Config{K: 4})
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour)
+	seed := nodes[0].Self().ID
+
+	// The seed vouches for 1, who vouches for 2; 3 vouches for 4, but no
+	// one trusted vouches for 3.
+	require.NoError(t, nodes[0].Vouch(ctx, nodes[1].Self().ID, 1, expires))
+	require.NoError(t, nodes[1].Vouch(ctx, nodes[2].Self().ID, 1, expires))
+	require.NoError(t, nodes[3].Vouch(ctx, nodes[4].Self().ID, 1, expires))
+
+	scores := trust.NewEngine(trust.Config{MinGlobalTrust: 0.1})
+	d, err := mesh.NewNode(qdht.Config{K: 4, Scorer: scores, TrustSeeds: []types.NodeID{seed}, TrustInterval: -1})
+	require.NoError(t, err)
+	t.Cleanup(func() { d.Close() })
+	require.NoError(t, d.Join(qdht.NodeOf(nodes[0].Self())))
+
+	estimates, err := d.GlobalTrust(ctx, []types.NodeID{seed}, qdht.TrustOptions{})
+	require.NoError(t, err)
+	require.Greater(t, estimates[nodes[1].Self().ID], estimates[nodes[2].Self().ID], "Trust should weaken with distance.")
+	require.Greater(t, estimates[nodes[2].Self().ID], 0.0, "Trust should flow transitively.")
+	require.NotContains(t, estimates, nodes[4].Self().ID, "Vouches from untrusted nodes should not count.")
+
+	require.NoError(t, d.RefreshTrust(ctx))
+	for _, i := range []int{0, 1, 2} {
+		require.False(t, scores.Graylisted(nodes[i].Self().ID), "Node %d is vouched for transitively.", i)
+	}
+	for _, i := range []int{3, 4} {
+		require.True(t, scores.Graylisted(nodes[i].Self().ID), "Node %d is not vouched for by the seeds.", i)
+	}
+}
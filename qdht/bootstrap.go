@@ -0,0 +1,169 @@
+package qdht
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"trustmesh/common"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultBootstrapAttempts is how many times each boot node is dialed
+	// before it is recorded as failed.
+	DefaultBootstrapAttempts = 5
+	// DefaultRefreshInterval is how often a bootstrapped node refreshes its
+	// routing table.
+	DefaultRefreshInterval = time.Hour
+)
+
+// Bootstrap joins the network through the configured boot nodes. It dials
+// them concurrently, retrying each with exponential backoff, then looks up
+// the local ID to learn its neighbours and a random ID in every bucket
+// farther than the nearest neighbour to fill the distant buckets. Ready is
+// closed once it succeeds, and the routing table is refreshed the same way
+// every RefreshInterval from then on. Bootstrap fails only when no boot node
+// answers; the ones that did not are reported by FailedBootNodes.
+func (d *DHT) Bootstrap(ctx context.Context) error {
+	if err := d.ctx.Err(); err != nil {
+		return ErrClosed
+	}
+
+	failed, err := DialBootNodes(ctx, d.boot, d.bootAttempts, d.bootBackoff, func(ctx context.Context, b *types.Node) error {
+		_, err := d.send(ctx, b, &Message{Type: MsgPing})
+		return err
+	})
+	d.bootMu.Lock()
+	d.bootFailed = failed
+	d.bootMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := d.refreshTable(ctx); err != nil {
+		return err
+	}
+	d.readyOnce.Do(func() {
+		close(d.ready)
+		if d.refreshInterval > 0 {
+			d.goLoop(d.refreshLoop)
+		}
+	})
+	return nil
+}
+
+// DialBootNodes dials every boot node concurrently, retrying each up to
+// attempts times spaced out by backoff. It returns the boot nodes that never
+// answered, and fails with ErrBootstrapFailed only when none did.
+func DialBootNodes(ctx context.Context, boot []*types.Node, attempts int, backoff common.Backoff, dial func(context.Context, *types.Node) error) ([]*types.Node, error) {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []*types.Node
+		errs   []error
+	)
+	for _, b := range boot {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := backoff.Retry(ctx, attempts, func(ctx context.Context) error {
+				return dial(ctx, b)
+			})
+			if err != nil {
+				mu.Lock()
+				failed = append(failed, b)
+				errs = append(errs, fmt.Errorf("boot node %s: %w", b.Address(), err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(boot) > 0 && len(failed) == len(boot) {
+		return failed, fmt.Errorf("%w: %w", ErrBootstrapFailed, errors.Join(errs...))
+	}
+	return failed, nil
+}
+
+// Ready is closed once Bootstrap has joined the network.
+func (d *DHT) Ready() <-chan struct{} {
+	return d.ready
+}
+
+// FailedBootNodes returns the boot nodes that did not answer during the last
+// Bootstrap.
+func (d *DHT) FailedBootNodes() []*types.Node {
+	d.bootMu.Lock()
+	defer d.bootMu.Unlock()
+	return append([]*types.Node(nil), d.bootFailed...)
+}
+
+// refreshTable looks up the local ID to fill the buckets of the nearest
+// neighbours, then a random ID in each bucket that shares fewer bits with the
+// local ID than its nearest neighbour does.
+func (d *DHT) refreshTable(ctx context.Context) error {
+	if err := d.refreshLookup(ctx, d.self.ID); err != nil {
+		return err
+	}
+	nearest := d.table.Closest(d.self.ID, 1)
+	if len(nearest) == 0 {
+		return nil
+	}
+	for prefix := CommonPrefixLen(d.self.ID, nearest[0].ID) - 1; prefix >= 0; prefix-- {
+		target, err := randomIDAt(d.self.ID, prefix)
+		if err != nil {
+			return err
+		}
+		if err := d.refreshLookup(ctx, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshLookup looks up target for the contacts it adds to the routing
+// table. Paths that disagree on the closest nodes still add the contacts they
+// met, so ErrPathsDisagree does not fail the refresh.
+func (d *DHT) refreshLookup(ctx context.Context, target types.NodeID) error {
+	_, err := d.lookup(ctx, target, Message{Type: MsgFindNode, Target: target}, nil)
+	if errors.Is(err, ErrPathsDisagree) {
+		return nil
+	}
+	return err
+}
+
+// refreshLoop refreshes the routing table every refreshInterval, so buckets
+// no lookup passes through do not go stale.
+func (d *DHT) refreshLoop() {
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			ctx, cancel := d.opContext()
+			d.refreshTable(ctx)
+			cancel()
+		}
+	}
+}
+
+// randomIDAt returns a random ID sharing exactly prefix leading bits with
+// self, so it falls in bucket prefix of self's routing table.
+func randomIDAt(self types.NodeID, prefix int) (types.NodeID, error) {
+	var id types.NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("failed to read random ID: %v", err)
+	}
+	for i := 0; i <= prefix; i++ {
+		bit := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^bit | self[i/8]&bit
+	}
+	id[prefix/8] ^= byte(0x80) >> (prefix % 8)
+	return id, nil
+}
@@ -0,0 +1,119 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/common"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// fastBackoff retries quickly enough for tests.
+var fastBackoff = common.Backoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2, Jitter: 0.5}
+
+func TestBootstrapFillsRoutingTable(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 24, qdht.Config{K: 4})
+	gone := &types.Node{ID: qdht.KeyID("gone"), Host: "mesh", Port: "gone"}
+
+	d, err := mesh.NewNode(qdht.Config{
+		K:                 4,
+		BootNodes:         []*types.Node{gone, nodes[0].Self(), nodes[1].Self()},
+		BootstrapAttempts: 3,
+		BootstrapBackoff:  fastBackoff,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	select {
+	case <-d.Ready():
+		t.Fatal("The node should not be ready before bootstrapping.")
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Bootstrap(ctx), "Bootstrap should succeed while a boot node answers.")
+
+	select {
+	case <-d.Ready():
+	default:
+		t.Fatal("The node should be ready after bootstrapping.")
+	}
+	failed := d.FailedBootNodes()
+	require.Len(t, failed, 1, "Only the unreachable boot node should fail.")
+	require.Equal(t, gone.ID, failed[0].ID)
+	require.Greater(t, d.Table().Size(), 2, "Lookups should add contacts beyond the boot nodes.")
+
+	closest, err := nodes[2].FindNode(ctx, d.Self().ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, closest)
+	require.Equal(t, d.Self().ID, closest[0].ID, "The network should learn of the new node.")
+}
+
+func TestBootstrapRetriesBootNodes(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 4, qdht.Config{K: 4})
+	d, err := mesh.NewNode(qdht.Config{
+		K:                 4,
+		BootNodes:         []*types.Node{nodes[0].Self()},
+		BootstrapAttempts: 10,
+		BootstrapBackoff:  fastBackoff,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	mesh.Partition([]types.NodeID{d.Self().ID})
+	time.AfterFunc(50*time.Millisecond, mesh.Heal)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Bootstrap(ctx), "Bootstrap should retry until the boot node is reachable.")
+	require.Empty(t, d.FailedBootNodes())
+	require.Equal(t, 4, d.Table().Size())
+}
+
+func TestBootstrapFailsWithoutBootNodes(t *testing.T) {
+	mesh := qdht.NewMesh()
+	d, err := mesh.NewNode(qdht.Config{
+		BootNodes: []*types.Node{
+			{ID: qdht.KeyID("a"), Host: "mesh", Port: "a"},
+			{ID: qdht.KeyID("b"), Host: "mesh", Port: "b"},
+		},
+		BootstrapAttempts: 2,
+		BootstrapBackoff:  fastBackoff,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.ErrorIs(t, d.Bootstrap(ctx), qdht.ErrBootstrapFailed)
+	require.Len(t, d.FailedBootNodes(), 2)
+	select {
+	case <-d.Ready():
+		t.Fatal("A node that reached no boot node should not be ready.")
+	default:
+	}
+}
+
+func TestBootstrapRefreshesRoutingTable(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 8, qdht.Config{K: 4})
+	d, err := mesh.NewNode(qdht.Config{
+		K:               4,
+		BootNodes:       []*types.Node{nodes[0].Self()},
+		RefreshInterval: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, d.Bootstrap(ctx))
+
+	contacted := &senderSpy{senders: make(map[types.NodeID]bool)}
+	for _, n := range nodes {
+		mesh.AddHandler(n.Self().ID, spiedSender{n, contacted})
+	}
+	require.Eventually(t, func() bool { return contacted.saw(d.Self().ID) }, 2*time.Second, 10*time.Millisecond,
+		"A bootstrapped node should keep refreshing its routing table.")
+}
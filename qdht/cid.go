@@ -0,0 +1,124 @@
+package qdht
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/zeebo/blake3"
+)
+
+// Content codecs, numbered after their multicodec counterparts.
+const (
+	CodecRaw byte = 0x55
+	CodecDAG byte = 0x71
+)
+
+// ContentNamespace is the key namespace content blocks are stored under.
+const ContentNamespace = "content"
+
+// CID identifies a content block by its codec and the BLAKE3 hash of its bytes.
+type CID struct {
+	Codec byte
+	Hash  [32]byte
+}
+
+// NewCID hashes block into an identifier with the given codec.
+func NewCID(codec byte, block []byte) CID {
+	return CID{Codec: codec, Hash: blake3.Sum256(block)}
+}
+
+// ParseCID decodes the string form of a CID.
+func ParseCID(s string) (CID, error) {
+	var c CID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCID, err)
+	}
+	if len(b) != 1+len(c.Hash) {
+		return c, ErrInvalidCID
+	}
+	if b[0] != CodecRaw && b[0] != CodecDAG {
+		return c, ErrInvalidCID
+	}
+	c.Codec = b[0]
+	copy(c.Hash[:], b[1:])
+	return c, nil
+}
+
+// String returns the hex encoding of the codec followed by the hash.
+func (c CID) String() string {
+	return hex.EncodeToString(append([]byte{c.Codec}, c.Hash[:]...))
+}
+
+// Key returns the DHT key the block is stored under.
+func (c CID) Key() string {
+	return "/" + ContentNamespace + "/" + c.String()
+}
+
+// MarshalText encodes the CID in its string form.
+func (c CID) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText decodes the string form of a CID.
+func (c *CID) UnmarshalText(text []byte) error {
+	parsed, err := ParseCID(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// Verify reports whether block hashes to the CID.
+func (c CID) Verify(block []byte) error {
+	if blake3.Sum256(block) != c.Hash {
+		return ErrContentMismatch
+	}
+	return nil
+}
+
+// dagLink points from a DAG node to a child block.
+type dagLink struct {
+	CID  CID
+	Size uint64
+}
+
+const dagLinkSize = 1 + 32 + 8
+
+// encodeDAGNode serialises links in a fixed binary layout so equal trees
+// always hash to the same CID.
+func encodeDAGNode(links []dagLink) []byte {
+	buf := make([]byte, 4, 4+len(links)*dagLinkSize)
+	binary.BigEndian.PutUint32(buf, uint32(len(links)))
+	for _, l := range links {
+		buf = append(buf, l.CID.Codec)
+		buf = append(buf, l.CID.Hash[:]...)
+		buf = binary.BigEndian.AppendUint64(buf, l.Size)
+	}
+	return buf
+}
+
+// decodeDAGNode parses a block produced by encodeDAGNode.
+func decodeDAGNode(block []byte) ([]dagLink, error) {
+	if len(block) < 4 {
+		return nil, ErrInvalidDAGNode
+	}
+	count := binary.BigEndian.Uint32(block)
+	body := block[4:]
+	if uint64(len(body)) != uint64(count)*dagLinkSize {
+		return nil, ErrInvalidDAGNode
+	}
+
+	links := make([]dagLink, count)
+	for i := range links {
+		l := body[i*dagLinkSize:]
+		links[i].CID.Codec = l[0]
+		if l[0] != CodecRaw && l[0] != CodecDAG {
+			return nil, ErrInvalidDAGNode
+		}
+		copy(links[i].CID.Hash[:], l[1:33])
+		links[i].Size = binary.BigEndian.Uint64(l[33:41])
+	}
+	return links, nil
+}
@@ -0,0 +1,141 @@
+package qdht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"trustmesh/types"
+)
+
+// Ordering is the causal relation between two vector clocks.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+// VectorClock counts, per publisher NodeID, the versions of a key a record
+// causally follows.
+type VectorClock map[string]uint64
+
+// Merge returns the element-wise maximum of vc and other.
+func (vc VectorClock) Merge(other VectorClock) VectorClock {
+	out := make(VectorClock, len(vc)+len(other))
+	for id, n := range vc {
+		out[id] = n
+	}
+	for id, n := range other {
+		if n > out[id] {
+			out[id] = n
+		}
+	}
+	return out
+}
+
+// Increment returns a copy of vc with id's counter advanced.
+func (vc VectorClock) Increment(id types.NodeID) VectorClock {
+	out := vc.Merge(nil)
+	out[id.String()]++
+	return out
+}
+
+// Compare reports how vc relates to other.
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	less, greater := false, false
+	for id, n := range vc {
+		switch m := other[id]; {
+		case n > m:
+			greater = true
+		case n < m:
+			less = true
+		}
+	}
+	for id, m := range other {
+		if _, ok := vc[id]; !ok && m > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && greater:
+		return Concurrent
+	case less:
+		return Before
+	case greater:
+		return After
+	}
+	return Equal
+}
+
+// encode writes the clock in a canonical order for signing.
+func (vc VectorClock) encode(buf *bytes.Buffer) {
+	ids := make([]string, 0, len(vc))
+	for id := range vc {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	binary.Write(buf, binary.BigEndian, uint32(len(ids)))
+	for _, id := range ids {
+		writeBytes(buf, []byte(id))
+		binary.Write(buf, binary.BigEndian, vc[id])
+	}
+}
+
+// versionOf returns rec's clock, or for records published without one the
+// clock holding just its publisher's sequence.
+func versionOf(rec *Record) VectorClock {
+	if len(rec.clock) > 0 {
+		return rec.clock
+	}
+	return VectorClock{rec.PublisherID().String(): rec.seq}
+}
+
+// supersedes reports whether a makes b obsolete: a's version causally
+// follows b's. A record only supersedes another publisher's record under a
+// shared key, as publishers choose their own clocks; otherwise any node could
+// remove another's record by inflating its clock entry for that publisher.
+func supersedes(a, b *Record, shared bool) bool {
+	if !shared && a.PublisherID() != b.PublisherID() {
+		return false
+	}
+	return versionOf(a).Compare(versionOf(b)) == After
+}
+
+// resolveVersions returns the records no other record supersedes, one per
+// publisher and ordered deterministically. More than one result means the
+// versions conflict. Only under shared keys do publishers supersede each
+// other.
+func resolveVersions(recs []*Record, shared bool) []*Record {
+	byPub := make(map[types.NodeID]*Record)
+	for _, rec := range recs {
+		pub := rec.PublisherID()
+		if cur, ok := byPub[pub]; !ok || rec.seq > cur.seq || (rec.seq == cur.seq && rec.expires.After(cur.expires)) {
+			byPub[pub] = rec
+		}
+	}
+	recs = make([]*Record, 0, len(byPub))
+	for _, rec := range byPub {
+		recs = append(recs, rec)
+	}
+
+	var frontier []*Record
+	for i, rec := range recs {
+		dominated := false
+		for j, other := range recs {
+			if i != j && supersedes(other, rec, shared) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			frontier = append(frontier, rec)
+		}
+	}
+	sort.Slice(frontier, func(i, j int) bool {
+		return bytes.Compare(frontier[i].publisher, frontier[j].publisher) < 0
+	})
+	return frontier
+}
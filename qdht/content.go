@@ -0,0 +1,181 @@
+package qdht
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultChunkSize is the size of the leaves large content is split into.
+	DefaultChunkSize = 256 << 10
+	// DefaultMaxLinks is the fan-out of interior DAG nodes.
+	DefaultMaxLinks = 1024
+	// contentFetchWorkers bounds how many child blocks are fetched at once.
+	contentFetchWorkers = 8
+)
+
+// ContentValidator accepts a block only when it hashes to the CID in its
+// key, which makes content self-certifying whichever node serves it.
+type ContentValidator struct{}
+
+func (ContentValidator) Validate(rec *Record) error {
+	c, err := ParseCID(strings.TrimPrefix(rec.key, "/"+ContentNamespace+"/"))
+	if err != nil {
+		return err
+	}
+	if err := c.Verify(rec.value); err != nil {
+		return err
+	}
+	if c.Codec == CodecDAG {
+		_, err = decodeDAGNode(rec.value)
+	}
+	return err
+}
+
+// Select picks any record; every valid record for a CID holds the same bytes.
+func (ContentValidator) Select(key string, recs []*Record) (int, error) {
+	return DefaultValidator{}.Select(key, recs)
+}
+
+// PutContent stores data in the DHT and returns its CID. Data no larger than
+// a chunk is stored as a single raw block keyed by its BLAKE3 hash; larger
+// data is split into chunks linked by a Merkle DAG.
+func (d *DHT) PutContent(data []byte, opts ...PutOptions) (CID, error) {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	o := d.putOptions(opts)
+	var root CID
+	err := d.buildDAG(data, func(c CID, block []byte) error {
+		root = c
+		return d.putBlock(ctx, c, block, o)
+	})
+	return root, err
+}
+
+// GetContent retrieves and reassembles the content behind c, verifying every
+// block against its hash.
+func (d *DHT) GetContent(c CID) ([]byte, error) {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	return d.assemble(ctx, c, d.fetchBlock)
+}
+
+// buildDAG chunks data into a Merkle DAG and hands every block to emit,
+// leaves first and the root last.
+func (d *DHT) buildDAG(data []byte, emit func(CID, []byte) error) error {
+	if len(data) <= d.chunkSize {
+		return emit(NewCID(CodecRaw, data), data)
+	}
+
+	var level []dagLink
+	for off := 0; off < len(data); off += d.chunkSize {
+		end := off + d.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[off:end]
+		c := NewCID(CodecRaw, chunk)
+		if err := emit(c, chunk); err != nil {
+			return err
+		}
+		level = append(level, dagLink{CID: c, Size: uint64(len(chunk))})
+	}
+
+	for {
+		var next []dagLink
+		for off := 0; off < len(level); off += d.maxLinks {
+			end := off + d.maxLinks
+			if end > len(level) {
+				end = len(level)
+			}
+			group := level[off:end]
+			block := encodeDAGNode(group)
+			c := NewCID(CodecDAG, block)
+			if err := emit(c, block); err != nil {
+				return err
+			}
+			var size uint64
+			for _, l := range group {
+				size += l.Size
+			}
+			next = append(next, dagLink{CID: c, Size: size})
+		}
+		if len(next) == 1 {
+			return nil
+		}
+		level = next
+	}
+}
+
+// putBlock publishes an immutable block under its CID.
+func (d *DHT) putBlock(ctx context.Context, c CID, block []byte, opts PutOptions) error {
+	if d.key == nil {
+		return ErrNoSigningKey
+	}
+	rec, err := d.signRecord(d.key, c.Key(), block, 1, nil, opts.TTL)
+	if err != nil {
+		return err
+	}
+	d.track(rec, opts)
+	return d.PutRecord(ctx, rec, opts)
+}
+
+// fetchBlock retrieves a single block from the DHT.
+func (d *DHT) fetchBlock(ctx context.Context, c CID) ([]byte, error) {
+	rec, err := d.GetRecord(ctx, c.Key())
+	if err != nil {
+		return nil, err
+	}
+	return rec.value, nil
+}
+
+// blockFetcher retrieves the bytes of a single block.
+type blockFetcher func(ctx context.Context, c CID) ([]byte, error)
+
+// assemble walks the DAG rooted at c and concatenates its leaves.
+func (d *DHT) assemble(ctx context.Context, c CID, fetch blockFetcher) ([]byte, error) {
+	block, err := fetch(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(block); err != nil {
+		return nil, err
+	}
+	if c.Codec == CodecRaw {
+		return block, nil
+	}
+
+	links, err := decodeDAGNode(block)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([][]byte, len(links))
+	errs := make([]error, len(links))
+	sem := make(chan struct{}, contentFetchWorkers)
+	var wg sync.WaitGroup
+	for i, l := range links {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, l dagLink) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			parts[i], errs[i] = d.assemble(ctx, l.CID, fetch)
+			if errs[i] == nil && uint64(len(parts[i])) != l.Size {
+				errs[i] = ErrContentMismatch
+			}
+		}(i, l)
+	}
+	wg.Wait()
+
+	var out []byte
+	for i := range parts {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		out = append(out, parts[i]...)
+	}
+	return out, nil
+}
@@ -0,0 +1,52 @@
+package qdht_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/zeebo/blake3"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+)
+
+func TestContentRoundTrip(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4, ChunkSize: 64, MaxLinks: 4})
+
+	small := []byte("a short message")
+	c, err := nodes[0].PutContent(small)
+	require.NoError(t, err)
+	require.Equal(t, qdht.CodecRaw, c.Codec)
+	require.Equal(t, blake3.Sum256(small), c.Hash, "Small content is keyed by its own hash.")
+
+	got, err := nodes[5].GetContent(c)
+	require.NoError(t, err)
+	require.Equal(t, small, got)
+
+	// 1000 bytes in 64 byte chunks with a fan-out of 4 needs a three level DAG.
+	large := bytes.Repeat([]byte("0123456789abcdef"), 62)
+	large = append(large, []byte("tail")...)
+	c, err = nodes[1].PutContent(large)
+	require.NoError(t, err)
+	require.Equal(t, qdht.CodecDAG, c.Codec)
+
+	got, err = nodes[6].GetContent(c)
+	require.NoError(t, err)
+	require.Equal(t, large, got)
+}
+
+func TestContentRejectsTamperedBlocks(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{K: 4})
+
+	c := qdht.NewCID(qdht.CodecRaw, []byte("genuine"))
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+
+	forged := qdht.NewRecord(c.Key(), []byte("forged"), 1, time.Now().Add(time.Hour))
+	require.NoError(t, forged.Sign(key))
+	require.ErrorIs(t, nodes[0].PutRecord(context.Background(), forged), qdht.ErrContentMismatch)
+
+	_, err = nodes[2].GetContent(c)
+	require.ErrorIs(t, err, qdht.ErrNotFound)
+}
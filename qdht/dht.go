@@ -0,0 +1,915 @@
+package qdht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+	"trustmesh/common"
+	"trustmesh/crypto"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+const (
+	DefaultK          = 20
+	DefaultAlpha      = 3
+	DefaultRecordTTL  = 24 * time.Hour
+	DefaultOpTimeout  = 30 * time.Second
+	tombstoneValueLen = 0
+)
+
+// Config configures a DHT node.
+type Config struct {
+	// Self describes the local node. Its ID is derived from Key when unset.
+	Self *types.Node
+	// Key signs the records this node publishes.
+	Key *crypto.SigningKey
+	// KEMKey lets other nodes encrypt to this one, as onion circuits do.
+	// A fresh key is generated when unset.
+	KEMKey *crypto.KEMKey
+	// Messenger delivers RPCs to other nodes.
+	Messenger Messenger
+	// Blocks fetches content blocks straight from their providers. It
+	// defaults to the Messenger when that implements BlockTransport.
+	Blocks BlockTransport
+	// Store holds the records the node is responsible for. It defaults to
+	// a MemoryRecordStore and is closed with the DHT.
+	Store RecordStore
+	// K is the bucket size and replication factor.
+	K int
+	// Alpha is the lookup parallelism.
+	Alpha int
+	// RecordTTL is how long published records stay valid.
+	RecordTTL time.Duration
+	// OpTimeout bounds Put, Get and Remove, which take no context.
+	OpTimeout time.Duration
+	// MaxRecordTTL caps how far in the future stored records may expire.
+	MaxRecordTTL time.Duration
+	// RepublishInterval is how often the originator re-signs its records,
+	// never less often than every half TTL. A negative interval disables it.
+	RepublishInterval time.Duration
+	// ReplicateInterval is how often stored records are pushed to the
+	// closest nodes. A negative interval disables it.
+	ReplicateInterval time.Duration
+	// SweepInterval is how often expired state is dropped. A negative
+	// interval disables it.
+	SweepInterval time.Duration
+	// ChunkSize is the leaf size content is split into by PutContent.
+	ChunkSize int
+	// MaxLinks is the fan-out of interior content DAG nodes.
+	MaxLinks int
+	// ProviderTTL is how long provider announcements stay valid.
+	ProviderTTL time.Duration
+	// MaxProviders caps the announcements held for one CID. Beyond it, a
+	// new provider replaces the announcement closest to expiry.
+	MaxProviders int
+	// ProviderRepublish is how often provided content is re-announced. A
+	// negative interval disables republishing.
+	ProviderRepublish time.Duration
+	// WriteQuorum is how many replicas must accept a put when its options
+	// set no quorum. Zero accepts any outcome.
+	WriteQuorum int
+	// ReadQuorum is how many replicas must answer a get when its options set
+	// no quorum. Zero accepts any outcome.
+	ReadQuorum int
+	// SyncInterval is how often records are reconciled with their other
+	// replicas by Merkle anti-entropy. A negative interval disables it.
+	SyncInterval time.Duration
+	// GeoLeafSize is how many records a leaf of the geo index holds before
+	// it splits.
+	GeoLeafSize int
+	// CircuitLength is how many relays anonymous requests are onion-routed
+	// through.
+	CircuitLength int
+	// BootNodes are the nodes Bootstrap joins the network through.
+	BootNodes []*types.Node
+	// BootstrapAttempts is how many times Bootstrap dials each boot node.
+	BootstrapAttempts int
+	// BootstrapBackoff spaces out the dials to a boot node. The zero value
+	// uses common.DefaultBackoff.
+	BootstrapBackoff common.Backoff
+	// RefreshInterval is how often the routing table is refreshed once
+	// Bootstrap has succeeded. A negative interval disables it.
+	RefreshInterval time.Duration
+	// Lookup sets how lookups are routed, by default over a single path.
+	Lookup LookupOptions
+	// StaticPuzzleBits and DynamicPuzzleBits set the difficulty of the
+	// puzzles contacts must solve to be admitted to the routing table and
+	// lookups. The local node's signing key, Key or the one Self carries,
+	// must solve the static puzzle; the dynamic one is solved when the node
+	// is created.
+	StaticPuzzleBits, DynamicPuzzleBits int
+	// Validators maps key namespaces to their validators.
+	Validators map[string]Validator
+	// Scorer, when set, is told how other nodes answer and consulted on
+	// which of them to admit and query.
+	Scorer Scorer
+	// TrustSeeds are the nodes trusted a priori. When set and the Scorer
+	// takes global trust estimates, the estimates are computed from the
+	// attestations the seeds transitively vouch for every TrustInterval; a
+	// negative interval disables the refresh.
+	TrustSeeds    []types.NodeID
+	TrustInterval time.Duration
+	// Trust bounds the web of trust explored from the seeds.
+	Trust TrustOptions
+	// Protector, when set, protects the connections to the closest
+	// contacts on every sweep.
+	Protector Protector
+	// Now overrides the clock, mainly for tests.
+	Now func() time.Time
+	// Simulated runs fan-outs one request at a time, so that a node on a
+	// deterministic Messenger behaves deterministically, and starts no
+	// maintenance loops: the simulation drives maintenance on its own
+	// clock, republishing every RepublishInterval.
+	Simulated bool
+}
+
+// DHT is a Kademlia node storing signed, versioned records.
+type DHT struct {
+	self        *types.Node
+	key         *crypto.SigningKey
+	kem         *crypto.KEMKey
+	messenger   Messenger
+	transfer    BlockTransport
+	table       *RoutingTable
+	records     RecordStore
+	providers   *providerBook
+	blocks      *blockStore
+	k, alpha    int
+	ttl         time.Duration
+	opTimeout   time.Duration
+	maxTTL      time.Duration
+	chunkSize   int
+	maxLinks    int
+	providerTTL time.Duration
+	writeQuorum int
+	readQuorum  int
+	geoLeafSize int
+	circuitLen  int
+	lookupOpts  LookupOptions
+	scorer      Scorer
+	trustSeeds  []types.NodeID
+	trustOpts   TrustOptions
+	now         func() time.Time
+
+	// attestMu serialises updates of the local node's attestations, and
+	// attested records that it published them since it started.
+	attestMu sync.Mutex
+	attested bool
+
+	protector Protector
+	protectMu sync.Mutex
+	neighbors map[types.NodeID]bool
+
+	republishInterval time.Duration
+	publishedMu       sync.Mutex
+	published         map[string]*publication
+	republishWake     chan struct{}
+
+	validatorsMu sync.RWMutex
+	validators   map[string]Validator
+
+	syncMu    sync.Mutex
+	syncStats SyncMetrics
+
+	circuitMu sync.Mutex
+	circuit   *Circuit
+
+	boot            []*types.Node
+	bootAttempts    int
+	bootBackoff     common.Backoff
+	bootMu          sync.Mutex
+	bootFailed      []*types.Node
+	ready           chan struct{}
+	readyOnce       sync.Once
+	refreshInterval time.Duration
+
+	staticPuzzle, dynamicPuzzle int
+
+	// sequential runs fan-outs one request at a time, as Config.Simulated
+	// asks.
+	sequential bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// loops tracks the maintenance loops Close waits for; loopMu keeps
+	// loops from starting once Close has cancelled ctx.
+	loopMu    sync.Mutex
+	loops     sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ QDHT = (*DHT)(nil)
+
+// New creates a DHT node. The node starts with an empty routing table; call
+// Join with a known node to enter the network.
+func New(cfg Config) (*DHT, error) {
+	if cfg.Self == nil {
+		return nil, fmt.Errorf("qdht config: %w", ErrInvalidNode)
+	}
+	if cfg.Messenger == nil {
+		return nil, fmt.Errorf("qdht config: no messenger")
+	}
+	if cfg.Blocks == nil {
+		cfg.Blocks, _ = cfg.Messenger.(BlockTransport)
+	}
+	if cfg.K <= 0 {
+		cfg.K = DefaultK
+	}
+	if cfg.Alpha <= 0 {
+		cfg.Alpha = DefaultAlpha
+	}
+	if cfg.RecordTTL <= 0 {
+		cfg.RecordTTL = DefaultRecordTTL
+	}
+	if cfg.OpTimeout <= 0 {
+		cfg.OpTimeout = DefaultOpTimeout
+	}
+	if cfg.MaxRecordTTL <= 0 {
+		cfg.MaxRecordTTL = DefaultMaxRecordTTL
+	}
+	if cfg.RepublishInterval == 0 {
+		cfg.RepublishInterval = DefaultRepublishInterval
+	}
+	if cfg.ReplicateInterval == 0 {
+		cfg.ReplicateInterval = DefaultReplicateInterval
+	}
+	if cfg.SweepInterval == 0 {
+		cfg.SweepInterval = DefaultSweepInterval
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = DefaultChunkSize
+	}
+	if cfg.MaxLinks < 2 {
+		cfg.MaxLinks = DefaultMaxLinks
+	}
+	if cfg.ProviderTTL <= 0 {
+		cfg.ProviderTTL = DefaultProviderTTL
+	}
+	if cfg.MaxProviders <= 0 {
+		cfg.MaxProviders = DefaultMaxProviders
+	}
+	if cfg.ProviderRepublish == 0 {
+		cfg.ProviderRepublish = DefaultProviderRepublish
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+	if cfg.GeoLeafSize <= 0 {
+		cfg.GeoLeafSize = DefaultGeoLeafSize
+	}
+	if cfg.TrustInterval == 0 {
+		cfg.TrustInterval = DefaultTrustInterval
+	}
+	if cfg.CircuitLength <= 0 {
+		cfg.CircuitLength = DefaultCircuitLength
+	}
+	if cfg.BootstrapAttempts <= 0 {
+		cfg.BootstrapAttempts = DefaultBootstrapAttempts
+	}
+	if cfg.BootstrapBackoff == (common.Backoff{}) {
+		cfg.BootstrapBackoff = common.DefaultBackoff()
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	if cfg.KEMKey == nil {
+		kem, err := crypto.NewKEMKey()
+		if err != nil {
+			return nil, fmt.Errorf("qdht config: %v", err)
+		}
+		cfg.KEMKey = kem
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRecordStore()
+	}
+
+	self := *cfg.Self
+	if cfg.Key != nil {
+		if self.ID == (types.NodeID{}) {
+			self.ID = types.NewNodeID(cfg.Key.PublicKeyBytes())
+		}
+		if self.PeerInfo.SigningKey() == nil {
+			self.PeerInfo = &types.Peer{Keys: [][]byte{cfg.Key.PublicKeyBytes()}}
+		}
+	}
+	if self.PeerInfo.KEMKey() == nil {
+		peer := &types.Peer{Keys: make([][]byte, types.KEMKeyIndex+1)}
+		if self.PeerInfo != nil {
+			copy(peer.Keys, self.PeerInfo.Keys)
+		}
+		peer.Keys[types.KEMKeyIndex] = cfg.KEMKey.PublicKeyBytes()
+		self.PeerInfo = peer
+	}
+	if cfg.StaticPuzzleBits > 0 || cfg.DynamicPuzzleBits > 0 {
+		if self.PeerInfo.SigningKey() == nil {
+			return nil, fmt.Errorf("qdht config: %w", ErrNoSigningKey)
+		}
+		self.Puzzle = SolvePuzzle(self.ID, cfg.DynamicPuzzleBits)
+		if err := VerifyPuzzle(&self, cfg.StaticPuzzleBits, cfg.DynamicPuzzleBits); err != nil {
+			return nil, fmt.Errorf("qdht config: %w", err)
+		}
+	}
+
+	d := &DHT{
+		self:        &self,
+		key:         cfg.Key,
+		kem:         cfg.KEMKey,
+		messenger:   cfg.Messenger,
+		transfer:    cfg.Blocks,
+		table:       NewRoutingTable(self.ID, cfg.K),
+		records:     cfg.Store,
+		providers:   newProviderBook(cfg.MaxProviders),
+		blocks:      newBlockStore(),
+		k:           cfg.K,
+		alpha:       cfg.Alpha,
+		ttl:         cfg.RecordTTL,
+		opTimeout:   cfg.OpTimeout,
+		maxTTL:      cfg.MaxRecordTTL,
+		chunkSize:   cfg.ChunkSize,
+		maxLinks:    cfg.MaxLinks,
+		providerTTL: cfg.ProviderTTL,
+		writeQuorum: cfg.WriteQuorum,
+		readQuorum:  cfg.ReadQuorum,
+		geoLeafSize: cfg.GeoLeafSize,
+		circuitLen:  cfg.CircuitLength,
+		lookupOpts:  cfg.Lookup,
+		scorer:      cfg.Scorer,
+		trustSeeds:  cfg.TrustSeeds,
+		trustOpts:   cfg.Trust,
+		protector:   cfg.Protector,
+		now:         cfg.Now,
+		validators: map[string]Validator{
+			ContentNamespace:     ContentValidator{},
+			GeoNamespace:         GeoValidator{},
+			GeoIndexNamespace:    GeoIndexValidator{},
+			SealedNamespace:      SealedValidator{},
+			AttestationNamespace: AttestationValidator{},
+		},
+
+		boot:            cfg.BootNodes,
+		bootAttempts:    cfg.BootstrapAttempts,
+		bootBackoff:     cfg.BootstrapBackoff,
+		refreshInterval: cfg.RefreshInterval,
+		ready:           make(chan struct{}),
+
+		staticPuzzle:      cfg.StaticPuzzleBits,
+		dynamicPuzzle:     cfg.DynamicPuzzleBits,
+		republishInterval: cfg.RepublishInterval,
+		published:         make(map[string]*publication),
+		republishWake:     make(chan struct{}, 1),
+		sequential:        cfg.Simulated,
+	}
+
+	for ns, v := range cfg.Validators {
+		d.validators[ns] = v
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if cfg.Simulated {
+		d.refreshInterval = -1
+		return d, nil
+	}
+	if cfg.ProviderRepublish > 0 {
+		d.goLoop(func() { d.republishProviders(cfg.ProviderRepublish) })
+	}
+	if cfg.RepublishInterval > 0 {
+		d.goLoop(func() { d.republishLoop() })
+	}
+	if cfg.ReplicateInterval > 0 {
+		d.goLoop(func() { d.replicateLoop(cfg.ReplicateInterval) })
+	}
+	if cfg.SweepInterval > 0 {
+		d.goLoop(func() { d.sweepLoop(cfg.SweepInterval) })
+	}
+	if cfg.SyncInterval > 0 {
+		d.goLoop(func() { d.syncLoop(cfg.SyncInterval) })
+	}
+	if _, ok := cfg.Scorer.(GlobalTrustSetter); ok && len(cfg.TrustSeeds) > 0 && cfg.TrustInterval > 0 {
+		d.goLoop(func() { d.trustLoop(cfg.TrustInterval) })
+	}
+	return d, nil
+}
+
+// Self returns the local node.
+func (d *DHT) Self() *types.Node {
+	return d.self
+}
+
+// Table returns the node's routing table.
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// Join adds node as a contact and looks up the local ID to populate the
+// routing table.
+func (d *DHT) Join(node Node) error {
+	contact, err := contactFromNode(node)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	if _, err := d.send(ctx, contact, &Message{Type: MsgPing}); err != nil {
+		return fmt.Errorf("failed to reach %s: %w", contact.Address(), err)
+	}
+	_, err = d.lookup(ctx, d.self.ID, Message{Type: MsgFindNode, Target: d.self.ID}, nil)
+	return err
+}
+
+// Leave removes node from the routing table. When node is the local node its
+// records are handed to the closest remaining nodes and the DHT is closed.
+func (d *DHT) Leave(node Node) error {
+	contact, err := contactFromNode(node)
+	if err != nil {
+		return err
+	}
+	if contact.ID != d.self.ID {
+		d.table.Remove(contact.ID)
+		return nil
+	}
+
+	ctx, cancel := d.opContext()
+	defer cancel()
+	for _, rec := range d.allRecords() {
+		if rec.Expired(d.now()) {
+			continue
+		}
+		d.storeAt(ctx, d.table.Closest(KeyID(rec.key), d.k), rec)
+	}
+	return d.Close()
+}
+
+// Put signs item as a new version of its key and stores it on the nodes
+// closest to the key. Already signed records are stored unchanged. The
+// local node republishes records it signed until they are removed.
+func (d *DHT) Put(item DataItem, opts ...PutOptions) error {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	if rec, ok := item.(*Record); ok && len(rec.signature) > 0 {
+		return d.PutRecord(ctx, rec, opts...)
+	}
+	_, err := d.publish(ctx, item.Key(), item.Value(), d.putOptions(opts))
+	return err
+}
+
+// Get returns the best valid record for key across the closest nodes.
+func (d *DHT) Get(key string, opts ...GetOptions) (DataItem, error) {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	recs, err := d.GetRecords(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return recs[0], nil
+}
+
+// Remove supersedes the local node's record for key with an empty one and
+// stops republishing it.
+func (d *DHT) Remove(key string) error {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	opts := d.putOptions(nil)
+	if p := d.untrack(key); p != nil {
+		opts = p.opts
+	}
+	_, err := d.publish(ctx, key, nil, opts)
+	d.untrack(key)
+	return err
+}
+
+// Nodes returns the contacts in the routing table.
+func (d *DHT) Nodes() ([]Node, error) {
+	all := d.table.All()
+	nodes := make([]Node, len(all))
+	for i, n := range all {
+		nodes[i] = contact{n}
+	}
+	return nodes, nil
+}
+
+// Close stops the DHT, waits for its maintenance loops to return and closes
+// its record store.
+func (d *DHT) Close() error {
+	d.closeOnce.Do(func() {
+		d.loopMu.Lock()
+		d.cancel()
+		d.loopMu.Unlock()
+		d.loops.Wait()
+		d.closeErr = d.records.Close()
+	})
+	return d.closeErr
+}
+
+// goLoop runs loop in the background for Close to wait on. Once the DHT is
+// closed, loops are no longer started.
+func (d *DHT) goLoop(loop func()) {
+	d.loopMu.Lock()
+	defer d.loopMu.Unlock()
+	if d.ctx.Err() != nil {
+		return
+	}
+	d.loops.Add(1)
+	go func() {
+		defer d.loops.Done()
+		loop()
+	}()
+}
+
+// PutRecord validates a signed record and stores it on the closest nodes.
+func (d *DHT) PutRecord(ctx context.Context, rec *Record, opts ...PutOptions) error {
+	if err := d.validate(rec, d.now()); err != nil {
+		return err
+	}
+	if _, err := d.records.Put(rec); err != nil && !errors.Is(err, ErrStaleRecord) {
+		return err
+	}
+	o := d.putOptions(opts)
+	target := KeyID(rec.key)
+	closest, err := d.lookupWidth(ctx, target, Message{Type: MsgFindNode, Target: target}, o.Replication, nil)
+	if err != nil {
+		return err
+	}
+	return d.replicate(ctx, closest, rec, o)
+}
+
+// GetRecord returns the record the key's validator selects among the latest
+// versions found on the closest nodes.
+func (d *DHT) GetRecord(ctx context.Context, key string) (*Record, error) {
+	recs, err := d.GetRecords(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return recs[0], nil
+}
+
+// publish signs value as the next version of key and stores it. The new
+// version's clock follows every version of the key the lookup finds, so it
+// supersedes them; only writers that miss each other's versions conflict.
+func (d *DHT) publish(ctx context.Context, key string, value []byte, opts PutOptions) (*Record, error) {
+	if d.key == nil {
+		return nil, ErrNoSigningKey
+	}
+	signer := d.key
+	if opts.Anonymous {
+		var err error
+		if signer, err = d.pseudonym(key); err != nil {
+			return nil, err
+		}
+	}
+	selfPub := types.NewNodeID(signer.PublicKeyBytes())
+	now := d.now()
+	seen := make(VectorClock)
+	observe := func(rec *Record) {
+		if rec.key == key && d.validate(rec, now) == nil {
+			seen = seen.Merge(versionOf(rec))
+		}
+	}
+	for _, rec := range d.localRecords(key) {
+		observe(rec)
+	}
+
+	// The lookup doubles as a search for versions this node published before
+	// it last restarted, so the new sequence always supersedes them.
+	var closest []*types.Node
+	if opts.Anonymous {
+		resp, err := d.relay(ctx, &onionRequest{Type: MsgFindValue, Key: key, Conflicts: true})
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if resp != nil {
+			for _, rec := range resp.Records {
+				observe(rec)
+			}
+		}
+	} else {
+		target := KeyID(key)
+		var err error
+		closest, err = d.lookupWidth(ctx, target, Message{Type: MsgFindValue, Key: key, Target: target}, opts.Replication, func(_ *types.Node, resp *Message) bool {
+			for _, rec := range resp.Records {
+				observe(rec)
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clock := seen.Increment(selfPub)
+	rec, err := d.signRecord(signer, key, value, clock[selfPub.String()], clock, opts.TTL)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > tombstoneValueLen {
+		d.track(rec, opts)
+	}
+	if opts.Anonymous {
+		_, err = d.relay(ctx, &onionRequest{Type: MsgStore, Records: []*Record{rec}, Replication: opts.Replication, Quorum: opts.Quorum})
+		return rec, err
+	}
+	return rec, d.replicate(ctx, closest, rec, opts)
+}
+
+// signRecord creates a record signed with signer and validates it. Records
+// signed with the node's own key are kept locally; those signed under a
+// pseudonym are not, as lookups passing through the node would find them.
+func (d *DHT) signRecord(signer *crypto.SigningKey, key string, value []byte, seq uint64, clock VectorClock, ttl time.Duration) (*Record, error) {
+	rec := NewRecord(key, value, seq, d.now().Add(ttl))
+	rec.clock = clock
+
+	if err := rec.Sign(signer); err != nil {
+		return nil, err
+	}
+	if err := d.validate(rec, d.now()); err != nil {
+		return nil, err
+	}
+	if signer != d.key {
+		return rec, nil
+	}
+	if _, err := d.records.Put(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// replicate stores rec on the first opts.Replication of nodes and checks the
+// write quorum.
+func (d *DHT) replicate(ctx context.Context, nodes []*types.Node, rec *Record, opts PutOptions) error {
+	if len(nodes) > opts.Replication {
+		nodes = nodes[:opts.Replication]
+	}
+	stored := d.storeAt(ctx, nodes, rec)
+	if opts.Quorum > 0 && stored < opts.Quorum {
+		return fmt.Errorf("%w: %d of %d replicas stored the record", ErrQuorumNotMet, stored, opts.Quorum)
+	}
+	return nil
+}
+
+// storeAt sends rec to every node in nodes and returns how many accepted it.
+func (d *DHT) storeAt(ctx context.Context, nodes []*types.Node, rec *Record) int {
+	var (
+		mu     sync.Mutex
+		stored int
+	)
+	d.fanOut(len(nodes), func(i int) {
+		if _, err := d.send(ctx, nodes[i], &Message{Type: MsgStore, Key: rec.key, Records: []*Record{rec}}); err == nil {
+			mu.Lock()
+			stored++
+			mu.Unlock()
+		}
+	})
+	return stored
+}
+
+// fanOut calls fn with 0 to n-1 concurrently, or in order on a sequential
+// node, and waits for every call.
+func (d *DHT) fanOut(n int, fn func(i int)) {
+	if d.sequential {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// send delivers msg to a remote node, keeping the routing table in step with
+// which nodes answer.
+func (d *DHT) send(ctx context.Context, to *types.Node, msg *Message) (*Message, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, ErrClosed
+	}
+	msg.Sender = d.self
+	start := d.now()
+	resp, err := d.messenger.Send(ctx, to, msg)
+	if err != nil {
+		// A request the caller gave up on says nothing about the node.
+		if ctx.Err() == nil {
+			d.table.Remove(to.ID)
+			d.record(to.ID, trust.Timeout)
+		}
+		return nil, err
+	}
+	// An error reply earns no credit and no latency sample, as it may
+	// have been cheaper to give than a real answer. Errors the protocol
+	// defines are the node's to give; anything else counts against it.
+	var remoteErr error
+	if resp.Error != "" {
+		remoteErr = remoteError(resp.Error)
+		if !slices.Contains(remoteErrors, remoteErr) {
+			d.record(to.ID, trust.InvalidResponse)
+		}
+	} else {
+		if d.scorer != nil {
+			d.scorer.ObserveLatency(to.ID, d.now().Sub(start))
+		}
+		d.record(to.ID, trust.ValidResponse)
+	}
+	// Prefer the node's own description, which carries its keys and puzzle
+	// solution, over the contact it was reached through.
+	if resp.Sender != nil && resp.Sender.ID == to.ID {
+		n := *resp.Sender
+		n.Host, n.Port = to.Host, to.Port
+		to = &n
+	}
+	d.addContact(to)
+	return resp, remoteErr
+}
+
+// HandleMessage answers an RPC from another node.
+func (d *DHT) HandleMessage(ctx context.Context, msg *Message) (*Message, error) {
+	if err := d.ctx.Err(); err != nil {
+		return nil, ErrClosed
+	}
+	if msg.Sender != nil {
+		d.addContact(msg.Sender)
+	}
+
+	resp := &Message{Type: msg.Type, Sender: d.self, Key: msg.Key, Target: msg.Target}
+	switch msg.Type {
+	case MsgPing:
+	case MsgFindNode:
+		resp.Closer = d.closestExcept(msg.Target, msg.Sender)
+	case MsgFindValue:
+		now := d.now()
+		for _, rec := range d.localRecords(msg.Key) {
+			if !rec.Expired(now) {
+				resp.Records = append(resp.Records, rec)
+			}
+		}
+		resp.Closer = d.closestExcept(KeyID(msg.Key), msg.Sender)
+	case MsgStore:
+		for _, rec := range msg.Records {
+			if err := d.storeLocal(rec); err != nil {
+				resp.Error = err.Error()
+				break
+			}
+		}
+	case MsgAddProvider:
+		for _, pr := range msg.Providers {
+			if pr.Expired(d.now()) || pr.Verify() != nil {
+				resp.Error = ErrInvalidProvider.Error()
+				break
+			}
+			d.providers.add(pr)
+		}
+	case MsgGetProviders:
+		c, err := ParseCID(msg.Key)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Providers = d.providers.get(c, d.now())
+		resp.Closer = d.closestExcept(KeyID(c.Key()), msg.Sender)
+	case MsgSyncSummary:
+		ranges, err := requestedRanges(msg)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Summaries = d.summarize(ranges)
+	case MsgSyncRecords:
+		ranges, err := requestedRanges(msg)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		if resp.Records, err = d.handleSyncRecords(ranges, msg.Records); err != nil {
+			resp.Error = err.Error()
+		}
+	case MsgRelay:
+		onion, err := d.peel(ctx, msg.Onion)
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		resp.Onion = onion
+
+	default:
+		return nil, ErrUnknownMessage
+	}
+	return resp, nil
+}
+
+// storeLocal validates rec and keeps it if it supersedes the stored version.
+func (d *DHT) storeLocal(rec *Record) error {
+	if err := d.validate(rec, d.now()); err != nil {
+		return err
+	}
+	_, err := d.records.Put(rec)
+	return err
+}
+
+// localRecords returns the stored records for key. Records the store fails
+// to read are treated as missing; replicas recover them from other nodes.
+func (d *DHT) localRecords(key string) []*Record {
+	recs, err := d.records.Get(key)
+	if err != nil {
+		return nil
+	}
+	return recs
+}
+
+// allRecords returns every stored record.
+func (d *DHT) allRecords() []*Record {
+	var recs []*Record
+	d.records.Scan("", func(rec *Record) bool {
+		recs = append(recs, rec)
+		return true
+	})
+	return recs
+}
+
+// closestExcept returns the k closest contacts to target, leaving out the requester.
+func (d *DHT) closestExcept(target types.NodeID, except *types.Node) []*types.Node {
+	closest := d.table.Closest(target, d.k+1)
+	out := closest[:0]
+	for _, n := range closest {
+		if except == nil || n.ID != except.ID {
+			out = append(out, n)
+		}
+	}
+	if len(out) > d.k {
+		out = out[:d.k]
+	}
+	return out
+}
+
+// opContext bounds operations started without a context.
+func (d *DHT) opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(d.ctx, d.opTimeout)
+}
+
+// contact adapts a routing table entry to the Node interface.
+type contact struct {
+	n *types.Node
+}
+
+func (c contact) ID() string {
+	return c.n.ID.String()
+}
+
+func (c contact) Address() string {
+	return c.n.Address()
+}
+
+// contactFromNode converts a Node into a routing table entry.
+func contactFromNode(node Node) (*types.Node, error) {
+	if c, ok := node.(contact); ok {
+		return c.n, nil
+	}
+	id, err := types.ParseNodeID(node.ID())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNode, err)
+	}
+	host, port, err := net.SplitHostPort(node.Address())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNode, err)
+	}
+	return &types.Node{ID: id, Host: host, Port: port}, nil
+}
+
+// NodeOf adapts a routing table entry to the Node interface.
+func NodeOf(n *types.Node) Node {
+	return contact{n}
+}
+
+// remoteErrors are the errors a remote node may report by message.
+var remoteErrors = []error{
+	ErrNotFound, ErrRecordUnsigned, ErrRecordExpired, ErrRecordTooLarge,
+	ErrStaleRecord, ErrRecordConflict, ErrUnknownMessage, ErrClosed,
+	ErrInvalidCID, ErrInvalidDAGNode, ErrContentMismatch, ErrInvalidProvider,
+	ErrRecordTTLTooLong, ErrInvalidClock, ErrInvalidSummary, ErrPuzzleFailed,
+	ErrPathsDisagree, ErrInvalidGeoKey, ErrInvalidGeoIndex, ErrInvalidOnion,
+	ErrRelayFailed, ErrInvalidEnvelope, ErrSyncTooLarge,
+}
+
+// remoteError maps an error string from a remote node back to its sentinel.
+func remoteError(msg string) error {
+	for _, err := range remoteErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,97 @@
+package qdht_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/qdht"
+)
+
+// newTestMesh creates size nodes on one mesh, each joined through the first.
+func newTestMesh(t *testing.T, size int, cfg qdht.Config) (*qdht.Mesh, []*qdht.DHT) {
+	t.Helper()
+	mesh := qdht.NewMesh()
+	nodes := make([]*qdht.DHT, size)
+	for i := range nodes {
+		d, err := mesh.NewNode(cfg)
+		require.NoError(t, err, "Creating a mesh node should not fail.")
+		nodes[i] = d
+		if i > 0 {
+			require.NoError(t, d.Join(qdht.NodeOf(nodes[0].Self())), "Joining the mesh should not fail.")
+		}
+	}
+	t.Cleanup(func() {
+		for _, d := range nodes {
+			d.Close()
+		}
+	})
+	return mesh, nodes
+}
+
+func TestPutGetAcrossMesh(t *testing.T) {
+	_, nodes := newTestMesh(t, 16, qdht.Config{K: 4})
+
+	require.NoError(t, nodes[3].Put(qdht.NewDataItem("/app/greeting", []byte("hello"))))
+	item, err := nodes[11].Get("/app/greeting")
+	require.NoError(t, err, "Record should be found from another node.")
+	require.Equal(t, []byte("hello"), item.Value())
+
+	rec := item.(*qdht.Record)
+	require.Equal(t, uint64(1), rec.Seq())
+	require.Equal(t, nodes[3].Self().ID, rec.PublisherID())
+
+	require.NoError(t, nodes[3].Put(qdht.NewDataItem("/app/greeting", []byte("hello again"))))
+	item, err = nodes[7].Get("/app/greeting")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello again"), item.Value(), "Higher sequence should win.")
+	require.Equal(t, uint64(2), item.(*qdht.Record).Seq())
+
+	require.NoError(t, nodes[3].Remove("/app/greeting"))
+	_, err = nodes[5].Get("/app/greeting")
+	require.ErrorIs(t, err, qdht.ErrNotFound, "Removed record should not be returned.")
+}
+
+func TestStorageRejectsInvalidRecords(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{K: 4})
+	owner := nodes[0]
+
+	require.NoError(t, owner.Put(qdht.NewDataItem("key", []byte("v1"))))
+	item, err := owner.Get("key")
+	require.NoError(t, err)
+	older := item.(*qdht.Record)
+	require.NoError(t, owner.Put(qdht.NewDataItem("key", []byte("v2"))))
+
+	// An unsigned record is refused outright.
+	unsigned := qdht.NewRecord("key", []byte("forged"), older.Seq()+5, time.Now().Add(time.Hour))
+	require.ErrorIs(t, nodes[1].PutRecord(context.Background(), unsigned), qdht.ErrRecordUnsigned)
+
+	// Replaying an older signed version never displaces the newer one.
+	require.NoError(t, nodes[1].PutRecord(context.Background(), older))
+	item, err = nodes[2].Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), item.Value())
+}
+
+type evenLengthValidator struct {
+	qdht.DefaultValidator
+}
+
+func (evenLengthValidator) Validate(rec *qdht.Record) error {
+	if len(rec.Value())%2 != 0 {
+		return errors.New("value length must be even")
+	}
+	return nil
+}
+
+func TestNamespaceValidator(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{
+		K:          4,
+		Validators: map[string]qdht.Validator{"even": evenLengthValidator{}},
+	})
+
+	require.Error(t, nodes[0].Put(qdht.NewDataItem("/even/a", []byte("odd"))), "Validator should reject the record.")
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("/even/a", []byte("even"))))
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/other/a", []byte("odd"))), "Other namespaces are unaffected.")
+}
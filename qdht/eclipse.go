@@ -0,0 +1,180 @@
+package qdht
+
+import (
+	"context"
+	"fmt"
+	"github.com/zeebo/blake3"
+	"math/rand"
+	"trustmesh/types"
+)
+
+// EclipseConfig describes a simulated eclipse attack on node lookups.
+type EclipseConfig struct {
+	// Nodes is the size of the network.
+	Nodes int
+	// Adversarial is the fraction of nodes the attacker controls.
+	Adversarial float64
+	// K is the bucket size and lookup width.
+	K int
+	// Lookups is how many lookups are measured.
+	Lookups int
+	// Lookup is the routing under test.
+	Lookup LookupOptions
+	// Forge lets attackers mint node IDs right next to a lookup's target,
+	// as they can when IDs are not bound to keys and puzzles.
+	Forge bool
+	// PuzzleBits, when positive, binds every node's ID to a key and makes
+	// honest nodes admit only contacts solving a dynamic puzzle of that
+	// difficulty. Forged IDs then fail admission.
+	PuzzleBits int
+	// Seed makes the network and the lookups reproducible.
+	Seed int64
+}
+
+// EclipseResult reports how many lookups reached their target.
+type EclipseResult struct {
+	Lookups, Succeeded int
+	// SuccessRate is Succeeded over Lookups.
+	SuccessRate float64
+}
+
+// eclipseAttack is the shared state of the colluding nodes.
+type eclipseAttack struct {
+	mesh      *Mesh
+	colluders []*types.Node
+	k         int
+	forge     bool
+}
+
+// eclipseNode is an attacker: it answers every lookup with colluding nodes
+// closest to the target, hiding honest nodes, and never serves values.
+type eclipseNode struct {
+	self   *types.Node
+	attack *eclipseAttack
+}
+
+func (e *eclipseNode) HandleMessage(_ context.Context, msg *Message) (*Message, error) {
+	resp := &Message{Type: msg.Type, Sender: e.self, Key: msg.Key, Target: msg.Target}
+	target := msg.Target
+	switch msg.Type {
+	case MsgFindValue:
+		target = KeyID(msg.Key)
+	case MsgFindNode:
+	default:
+		return resp, nil
+	}
+	resp.Closer = e.attack.closest(target)
+	return resp, nil
+}
+
+// closest returns the colluders to report for target. When forging, they are
+// fresh identities sharing all but the last bytes of target.
+func (a *eclipseAttack) closest(target types.NodeID) []*types.Node {
+	if !a.forge {
+		return closestN(append([]*types.Node(nil), a.colluders...), target, a.k)
+	}
+	out := make([]*types.Node, a.k)
+	for i := range out {
+		id := target
+		h := blake3.Sum256(append(target[:], byte(i)))
+		copy(id[len(id)-4:], h[:4])
+		out[i] = &types.Node{ID: id, Host: "sybil", Port: fmt.Sprint(i)}
+		a.mesh.AddHandler(id, &eclipseNode{self: out[i], attack: a})
+	}
+	return out
+}
+
+// SimulateEclipse builds an in-process network in which a fraction of the
+// nodes collude to eclipse lookups, and measures how often a lookup from an
+// honest node finds the honest node closest to a random target. Routing
+// tables are filled from a random ordering of all nodes, so attackers hold
+// their fair share of every table.
+func SimulateEclipse(ctx context.Context, cfg EclipseConfig) (EclipseResult, error) {
+	if cfg.K <= 0 {
+		cfg.K = DefaultK
+	}
+	if cfg.Nodes < 2 || cfg.Lookups <= 0 {
+		return EclipseResult{}, fmt.Errorf("eclipse simulation needs at least two nodes and one lookup")
+	}
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	mesh := NewMesh()
+
+	all := make([]*types.Node, cfg.Nodes)
+	for i := range all {
+		n := &types.Node{Host: "sim", Port: fmt.Sprint(i)}
+		if cfg.PuzzleBits > 0 {
+			// Only the binding of IDs to public keys is checked, so random
+			// bytes stand in for the keys.
+			pub := make([]byte, 32)
+			rng.Read(pub)
+			n.ID = types.NewNodeID(pub)
+			n.PeerInfo = &types.Peer{Keys: [][]byte{pub}}
+			n.Puzzle = SolvePuzzle(n.ID, cfg.PuzzleBits)
+		} else {
+			rng.Read(n.ID[:])
+		}
+		all[i] = n
+	}
+	bad := int(cfg.Adversarial * float64(cfg.Nodes))
+	if bad >= cfg.Nodes {
+		bad = cfg.Nodes - 1
+	}
+	colluders, honestNodes := all[:bad], all[bad:]
+
+	attack := &eclipseAttack{mesh: mesh, colluders: colluders, k: cfg.K, forge: cfg.Forge}
+	for _, n := range colluders {
+		mesh.AddHandler(n.ID, &eclipseNode{self: n, attack: attack})
+	}
+	honest := make([]*DHT, len(honestNodes))
+	for i, n := range honestNodes {
+		d, err := New(Config{
+			Self:              n,
+			Messenger:         mesh,
+			K:                 cfg.K,
+			Lookup:            cfg.Lookup,
+			DynamicPuzzleBits: cfg.PuzzleBits,
+			RepublishInterval: -1,
+			ReplicateInterval: -1,
+			SweepInterval:     -1,
+			ProviderRepublish: -1,
+			SyncInterval:      -1,
+		})
+		if err != nil {
+			return EclipseResult{}, err
+		}
+		defer d.Close()
+		mesh.Add(d)
+		honest[i] = d
+	}
+	for _, d := range honest {
+		for _, i := range rng.Perm(len(all)) {
+			d.table.Add(all[i])
+		}
+	}
+
+	res := EclipseResult{Lookups: cfg.Lookups}
+	for i := 0; i < cfg.Lookups; i++ {
+		from := honest[rng.Intn(len(honest))]
+		var target types.NodeID
+		rng.Read(target[:])
+
+		var want types.NodeID
+		for j, n := range honestNodes {
+			if n.ID != from.self.ID && (want == (types.NodeID{}) || closer(n.ID, want, target)) {
+				want = honestNodes[j].ID
+			}
+		}
+		found, err := from.FindNode(ctx, target, cfg.Lookup)
+		if err != nil && ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		for _, n := range found {
+			if n.ID == want {
+				res.Succeeded++
+				break
+			}
+		}
+	}
+	res.SuccessRate = float64(res.Succeeded) / float64(res.Lookups)
+	return res, nil
+}
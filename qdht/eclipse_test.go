@@ -0,0 +1,64 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/qdht"
+)
+
+func TestDisjointPathLookups(t *testing.T) {
+	_, nodes := newTestMesh(t, 12, qdht.Config{K: 4, Lookup: qdht.LookupOptions{Paths: 3}})
+
+	require.NoError(t, nodes[2].Put(qdht.NewDataItem("/app/key", []byte("v"))))
+	item, err := nodes[9].Get("/app/key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), item.Value())
+
+	found, err := nodes[5].FindNode(context.Background(), nodes[7].Self().ID)
+	require.NoError(t, err)
+	require.NotEmpty(t, found)
+	require.Equal(t, nodes[7].Self().ID, found[0].ID, "Disjoint paths should still find the target.")
+}
+
+func TestEclipseSimulation(t *testing.T) {
+	ctx := context.Background()
+	simulate := func(adversarial float64, paths int, forge bool, puzzle int) float64 {
+		res, err := qdht.SimulateEclipse(ctx, qdht.EclipseConfig{
+			Nodes:       200,
+			Adversarial: adversarial,
+			K:           8,
+			Lookups:     200,
+			Lookup:      qdht.LookupOptions{Paths: paths},
+			Forge:       forge,
+			PuzzleBits:  puzzle,
+			Seed:        1,
+		})
+		require.NoError(t, err)
+		t.Logf("adversarial=%.1f paths=%d forge=%v puzzle=%d success=%.2f", adversarial, paths, forge, puzzle, res.SuccessRate)
+		return res.SuccessRate
+	}
+	run := func(adversarial float64, paths int, forge bool) float64 {
+		return simulate(adversarial, paths, forge, 0)
+	}
+
+	for _, paths := range []int{1, 4} {
+		require.Equal(t, 1.0, run(0, paths, false), "Lookups should always succeed without an attacker.")
+	}
+	var plain, disjoint []float64
+	for _, f := range []float64{0.2, 0.4, 0.6} {
+		plain = append(plain, run(f, 1, false))
+		disjoint = append(disjoint, run(f, 4, false))
+	}
+	require.Less(t, plain[2], plain[0], "Plain lookups should degrade as the attacker grows.")
+	require.Greater(t, disjoint[2], plain[2], "Disjoint paths should resist a large attacker better.")
+
+	// Without IDs bound to keys and puzzles, attackers mint IDs next to
+	// every target and capture plain lookups outright.
+	require.Less(t, run(0.2, 1, true), 0.5)
+
+	// With them, forged IDs are refused and lookups do as well as against
+	// an attacker limited to its own nodes.
+	require.GreaterOrEqual(t, simulate(0.2, 1, true, 8), plain[0]-0.05, "Puzzles should defeat forged IDs.")
+	require.GreaterOrEqual(t, simulate(0.2, 4, true, 8), disjoint[0]-0.05)
+}
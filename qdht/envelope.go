@@ -0,0 +1,275 @@
+package qdht
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/goccy/go-json"
+	"github.com/zeebo/blake3"
+	"strings"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+// SealedNamespace is the key namespace envelopes are stored under.
+const SealedNamespace = "sealed"
+
+const (
+	sealedKeyDomain = "trustmesh/qdht/sealed/v1"
+	// contentKeySize is the size of the random key an envelope's value is
+	// encrypted under.
+	contentKeySize = 32
+)
+
+// Envelope is a value encrypted under a random content key, together with
+// that key wrapped for each recipient's KEM key. Storage nodes holding an
+// envelope see only ciphertext.
+type Envelope struct {
+	Recipients []WrappedKey `json:"recipients"`
+	Ciphertext []byte       `json:"ciphertext"`
+}
+
+// WrappedKey is the content key of an envelope sealed for one recipient.
+type WrappedKey struct {
+	// PublicKey is the recipient's KEM public key.
+	PublicKey []byte `json:"publicKey"`
+	// Encapsulated is the KEM ciphertext of the wrapping secret.
+	Encapsulated []byte `json:"encapsulated"`
+	// Key is the content key sealed under the wrapping secret.
+	Key []byte `json:"key"`
+}
+
+// SealEnvelope encrypts value under a fresh content key and wraps the key
+// for the KEM key each recipient publishes in its Peer.Keys.
+func SealEnvelope(value []byte, recipients ...*types.Peer) (*Envelope, error) {
+	contentKey := make([]byte, contentKeySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, fmt.Errorf("failed to read content key: %v", err)
+	}
+	ciphertext, err := crypto.Seal(contentKey, value)
+	if err != nil {
+		return nil, err
+	}
+	e := &Envelope{Ciphertext: ciphertext}
+	if err := e.wrap(contentKey, recipients); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DecodeEnvelope parses an envelope from its stored form.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if len(e.Ciphertext) == 0 {
+		return nil, ErrInvalidEnvelope
+	}
+	return &e, nil
+}
+
+// Bytes returns the stored form of the envelope.
+func (e *Envelope) Bytes() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Open decrypts the envelope's value with the recipient's KEM key.
+func (e *Envelope) Open(kem *crypto.KEMKey) ([]byte, error) {
+	contentKey, err := e.contentKey(kem)
+	if err != nil {
+		return nil, err
+	}
+	value, err := crypto.Open(contentKey, e.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	return value, nil
+}
+
+// AddRecipients wraps the content key for more recipients. kem must open
+// the envelope.
+func (e *Envelope) AddRecipients(kem *crypto.KEMKey, recipients ...*types.Peer) error {
+	contentKey, err := e.contentKey(kem)
+	if err != nil {
+		return err
+	}
+	return e.wrap(contentKey, recipients)
+}
+
+// Revoke removes recipients from the envelope. Revoked recipients may
+// still know the old content key, so the value is encrypted afresh under a
+// new one and rewrapped for the remaining recipients. kem must open the
+// envelope.
+func (e *Envelope) Revoke(kem *crypto.KEMKey, recipients ...*types.Peer) error {
+	value, err := e.Open(kem)
+	if err != nil {
+		return err
+	}
+	var remaining []*types.Peer
+	for _, w := range e.Recipients {
+		revoked := false
+		for _, p := range recipients {
+			if bytes.Equal(w.PublicKey, p.KEMKey()) {
+				revoked = true
+				break
+			}
+		}
+		if !revoked {
+			remaining = append(remaining, &types.Peer{Keys: [][]byte{types.KEMKeyIndex: w.PublicKey}})
+		}
+	}
+	fresh, err := SealEnvelope(value, remaining...)
+	if err != nil {
+		return err
+	}
+	*e = *fresh
+	return nil
+}
+
+// wrap seals contentKey for each recipient not already on the envelope.
+func (e *Envelope) wrap(contentKey []byte, recipients []*types.Peer) error {
+	for _, p := range recipients {
+		pub := p.KEMKey()
+		if pub == nil {
+			return fmt.Errorf("%w: recipient has no KEM key", ErrInvalidEnvelope)
+		}
+		if e.wrappedFor(pub) != nil {
+			continue
+		}
+		secret, encapsulated, err := crypto.Encapsulate(pub)
+		if err != nil {
+			return err
+		}
+		key, err := crypto.Seal(secret, contentKey)
+		if err != nil {
+			return err
+		}
+		e.Recipients = append(e.Recipients, WrappedKey{PublicKey: pub, Encapsulated: encapsulated, Key: key})
+	}
+	return nil
+}
+
+// contentKey unwraps the content key with the recipient's KEM key.
+func (e *Envelope) contentKey(kem *crypto.KEMKey) ([]byte, error) {
+	w := e.wrappedFor(kem.PublicKeyBytes())
+	if w == nil {
+		return nil, ErrNotRecipient
+	}
+	secret, err := kem.Decapsulate(w.Encapsulated)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := crypto.Open(secret, w.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	return contentKey, nil
+}
+
+func (e *Envelope) wrappedFor(pub []byte) *WrappedKey {
+	for i := range e.Recipients {
+		if bytes.Equal(e.Recipients[i].PublicKey, pub) {
+			return &e.Recipients[i]
+		}
+	}
+	return nil
+}
+
+// SealedKey derives the key an envelope named name is stored under from a
+// secret its recipients share, so lookups and replicas never see the name.
+func SealedKey(secret []byte, name string) string {
+	var material bytes.Buffer
+	writeBytes(&material, secret)
+	material.WriteString(name)
+	var out [32]byte
+	blake3.DeriveKey(sealedKeyDomain, material.Bytes(), out[:])
+	return "/" + SealedNamespace + "/" + hex.EncodeToString(out[:])
+}
+
+// SealedValidator accepts well-formed envelopes under derived keys.
+type SealedValidator struct{}
+
+func (SealedValidator) Validate(rec *Record) error {
+	name := strings.TrimPrefix(rec.key, "/"+SealedNamespace+"/")
+	if b, err := hex.DecodeString(name); err != nil || len(b) != 32 {
+		return fmt.Errorf("%w: bad key %q", ErrInvalidEnvelope, rec.key)
+	}
+	if len(rec.value) == tombstoneValueLen {
+		return nil
+	}
+	_, err := DecodeEnvelope(rec.value)
+	return err
+}
+
+func (SealedValidator) Select(key string, recs []*Record) (int, error) {
+	return DefaultValidator{}.Select(key, recs)
+}
+
+// PutSealed stores value in an envelope for recipients under the key
+// derived from secret and name. The local node is always a recipient.
+func (d *DHT) PutSealed(ctx context.Context, secret []byte, name string, value []byte, recipients []*types.Peer, opts ...PutOptions) (*Record, error) {
+	e, err := SealEnvelope(value, append([]*types.Peer{d.self.PeerInfo}, recipients...)...)
+	if err != nil {
+		return nil, err
+	}
+	return d.putEnvelope(ctx, SealedKey(secret, name), e, opts)
+}
+
+// GetSealed fetches the envelope stored under secret and name and opens it
+// with the local node's KEM key.
+func (d *DHT) GetSealed(ctx context.Context, secret []byte, name string, opts ...GetOptions) ([]byte, error) {
+	e, err := d.getEnvelope(ctx, SealedKey(secret, name), opts)
+	if err != nil {
+		return nil, err
+	}
+	return e.Open(d.kem)
+}
+
+// AddRecipients rewraps the envelope stored under secret and name for more
+// recipients and stores the new version.
+func (d *DHT) AddRecipients(ctx context.Context, secret []byte, name string, recipients ...*types.Peer) error {
+	key := SealedKey(secret, name)
+	e, err := d.getEnvelope(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.AddRecipients(d.kem, recipients...); err != nil {
+		return err
+	}
+	_, err = d.putEnvelope(ctx, key, e, nil)
+	return err
+}
+
+// RevokeRecipients re-encrypts the envelope stored under secret and name
+// without recipients and stores the new version.
+func (d *DHT) RevokeRecipients(ctx context.Context, secret []byte, name string, recipients ...*types.Peer) error {
+	key := SealedKey(secret, name)
+	e, err := d.getEnvelope(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.Revoke(d.kem, recipients...); err != nil {
+		return err
+	}
+	_, err = d.putEnvelope(ctx, key, e, nil)
+	return err
+}
+
+func (d *DHT) putEnvelope(ctx context.Context, key string, e *Envelope, opts []PutOptions) (*Record, error) {
+	value, err := e.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return d.publish(ctx, key, value, d.putOptions(opts))
+}
+
+func (d *DHT) getEnvelope(ctx context.Context, key string, opts []GetOptions) (*Envelope, error) {
+	recs, err := d.GetRecords(ctx, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeEnvelope(recs[0].value)
+}
@@ -0,0 +1,75 @@
+package qdht_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// kemPeer returns a KEM key and the peer description publishing it.
+func kemPeer(t *testing.T) (*crypto.KEMKey, *types.Peer) {
+	t.Helper()
+	kem, err := crypto.NewKEMKey()
+	require.NoError(t, err)
+	return kem, &types.Peer{Keys: [][]byte{types.KEMKeyIndex: kem.PublicKeyBytes()}}
+}
+
+func TestEnvelopeRecipients(t *testing.T) {
+	alice, alicePeer := kemPeer(t)
+	bob, bobPeer := kemPeer(t)
+	carol, carolPeer := kemPeer(t)
+
+	e, err := qdht.SealEnvelope([]byte("payroll"), alicePeer, bobPeer)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(e.Ciphertext, []byte("payroll")))
+	for _, kem := range []*crypto.KEMKey{alice, bob} {
+		value, err := e.Open(kem)
+		require.NoError(t, err)
+		require.Equal(t, []byte("payroll"), value)
+	}
+	_, err = e.Open(carol)
+	require.ErrorIs(t, err, qdht.ErrNotRecipient)
+
+	require.NoError(t, e.AddRecipients(bob, carolPeer))
+	value, err := e.Open(carol)
+	require.NoError(t, err, "An added recipient should open the envelope.")
+	require.Equal(t, []byte("payroll"), value)
+
+	old := e.Ciphertext
+	require.NoError(t, e.Revoke(alice, bobPeer))
+	_, err = e.Open(bob)
+	require.ErrorIs(t, err, qdht.ErrNotRecipient, "A revoked recipient should no longer open the envelope.")
+	require.NotEqual(t, old, e.Ciphertext, "Revocation should re-encrypt under a new content key.")
+	_, err = e.Open(carol)
+	require.NoError(t, err)
+}
+
+func TestSealedValuesAcrossMesh(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4})
+	ctx := context.Background()
+	secret := []byte("shared team secret")
+	owner, reader, outsider := nodes[1], nodes[4], nodes[6]
+
+	rec, err := owner.PutSealed(ctx, secret, "salaries", []byte("payroll"), []*types.Peer{reader.Self().PeerInfo})
+	require.NoError(t, err)
+	require.NotContains(t, rec.Key(), "salaries", "The stored key should not reveal the name.")
+	require.False(t, bytes.Contains(rec.Value(), []byte("payroll")), "Replicas should only see ciphertext.")
+
+	value, err := reader.GetSealed(ctx, secret, "salaries")
+	require.NoError(t, err)
+	require.Equal(t, []byte("payroll"), value)
+	_, err = outsider.GetSealed(ctx, secret, "salaries")
+	require.ErrorIs(t, err, qdht.ErrNotRecipient)
+
+	require.NoError(t, owner.AddRecipients(ctx, secret, "salaries", outsider.Self().PeerInfo))
+	_, err = outsider.GetSealed(ctx, secret, "salaries")
+	require.NoError(t, err, "An added recipient should read the value.")
+
+	require.NoError(t, owner.RevokeRecipients(ctx, secret, "salaries", reader.Self().PeerInfo))
+	_, err = reader.GetSealed(ctx, secret, "salaries")
+	require.ErrorIs(t, err, qdht.ErrNotRecipient, "A revoked recipient should lose access.")
+}
@@ -0,0 +1,41 @@
+package qdht
+
+import "errors"
+
+var (
+	ErrNotFound           = errors.New("no record found for key")
+	ErrRecordUnsigned     = errors.New("record is not signed")
+	ErrRecordExpired      = errors.New("record has expired")
+	ErrRecordTooLarge     = errors.New("record value exceeds maximum size")
+	ErrStaleRecord        = errors.New("record sequence is older than the stored one")
+	ErrRecordConflict     = errors.New("record reuses a sequence number with different content")
+	ErrNoSigningKey       = errors.New("no signing key configured")
+	ErrUnreachable        = errors.New("node is unreachable")
+	ErrUnknownMessage     = errors.New("unknown message type")
+	ErrInvalidNode        = errors.New("invalid node")
+	ErrClosed             = errors.New("qdht is closed")
+	ErrNoValidRecords     = errors.New("no valid records to select from")
+	ErrInvalidCID         = errors.New("invalid content identifier")
+	ErrInvalidDAGNode     = errors.New("invalid content DAG node")
+	ErrContentMismatch    = errors.New("content does not match its identifier")
+	ErrInvalidProvider    = errors.New("invalid provider record")
+	ErrNoBlockTransport   = errors.New("no transport for content blocks")
+	ErrQuorumNotMet       = errors.New("quorum not met")
+	ErrRecordTTLTooLong   = errors.New("record expiry exceeds the maximum TTL")
+	ErrInvalidClock       = errors.New("record clock does not match its sequence")
+	ErrInvalidSummary     = errors.New("invalid sync summary")
+	ErrSyncTooLarge       = errors.New("sync request spans too many ranges or records")
+	ErrCorruptLog         = errors.New("record log is corrupt")
+	ErrPuzzleFailed       = errors.New("node ID does not solve the admission puzzle")
+	ErrPathsDisagree      = errors.New("lookup paths do not agree on any node")
+	ErrInvalidGeoKey      = errors.New("invalid geo key")
+	ErrInvalidGeoIndex    = errors.New("invalid geo index node")
+	ErrNoCircuit          = errors.New("not enough relays for an onion circuit")
+	ErrInvalidOnion       = errors.New("invalid onion")
+	ErrRelayFailed        = errors.New("onion relay could not reach the next hop")
+	ErrInvalidEnvelope    = errors.New("invalid envelope")
+	ErrNotRecipient       = errors.New("not a recipient of the envelope")
+	ErrBootstrapFailed    = errors.New("no boot node answered")
+	ErrInvalidAttestation = errors.New("invalid attestation")
+	ErrAttestationsLost   = errors.New("published attestations could not be read back")
+)
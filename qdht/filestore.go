@@ -0,0 +1,466 @@
+package qdht
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+// FsyncPolicy controls when the on-disk store flushes its log to stable
+// storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs after every write, so no acknowledged write is lost.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncPeriodic syncs every FsyncInterval; a crash loses at most the
+	// writes of the last interval.
+	FsyncPeriodic
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever
+)
+
+const (
+	// DefaultFsyncInterval is how often FsyncPeriodic flushes the log.
+	DefaultFsyncInterval = time.Second
+	// DefaultCompactRatio is the share of dead bytes that triggers compaction.
+	DefaultCompactRatio = 0.5
+	// DefaultCompactMinSize is the log size below which it is not compacted.
+	DefaultCompactMinSize = 1 << 20
+	// logHeaderSize is the length and CRC-32 prefixed to every log entry.
+	logHeaderSize = 8
+	// maxLogEntrySize bounds an entry: a record value encoded in JSON plus
+	// its envelope.
+	maxLogEntrySize = 2*MaxRecordValueSize + 64<<10
+)
+
+// FileStoreOptions tunes a FileRecordStore.
+type FileStoreOptions struct {
+	// Fsync is the flush policy, FsyncAlways by default.
+	Fsync FsyncPolicy
+	// FsyncInterval is the FsyncPeriodic flush interval.
+	FsyncInterval time.Duration
+	// CompactRatio is the share of the log taken by replaced and deleted
+	// entries above which it is rewritten. A negative ratio disables
+	// automatic compaction.
+	CompactRatio float64
+	// CompactMinSize is the log size below which it is never compacted
+	// automatically.
+	CompactMinSize int64
+}
+
+type logOp uint8
+
+const (
+	logPut logOp = iota + 1
+	logDelete
+)
+
+// logEntry is one record of the append-only log.
+type logEntry struct {
+	Op        logOp        `json:"op"`
+	Key       string       `json:"key"`
+	Publisher types.NodeID `json:"publisher"`
+	Record    *Record      `json:"record,omitempty"`
+}
+
+// logPointer locates an entry in the log.
+type logPointer struct {
+	offset int64
+	size   int64
+}
+
+// FileRecordStore is a RecordStore backed by an append-only log. Every change
+// is appended as a checksummed entry and an in-memory index locates the
+// current entry of each key and publisher. On open the log is replayed and a
+// torn or corrupt tail left by a crash is cut off. Once enough of the log is
+// dead the live entries are rewritten into a fresh log that atomically
+// replaces the old one.
+type FileRecordStore struct {
+	mu    sync.RWMutex
+	path  string
+	file  *os.File
+	size  int64
+	dead  int64
+	dirty bool
+	index *recordIndex[logPointer]
+	opts  FileStoreOptions
+
+	stop   chan struct{}
+	closed bool
+}
+
+var _ RecordStore = (*FileRecordStore)(nil)
+
+// NewFileRecordStore opens the log at path, creating it if needed, and
+// replays it to rebuild the index.
+func NewFileRecordStore(path string, opts ...FileStoreOptions) (*FileRecordStore, error) {
+	var o FileStoreOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.FsyncInterval <= 0 {
+		o.FsyncInterval = DefaultFsyncInterval
+	}
+	if o.CompactRatio == 0 {
+		o.CompactRatio = DefaultCompactRatio
+	}
+	if o.CompactMinSize <= 0 {
+		o.CompactMinSize = DefaultCompactMinSize
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record log: %v", err)
+	}
+	s := &FileRecordStore{
+		path:  path,
+		file:  file,
+		index: newRecordIndex[logPointer](),
+		opts:  o,
+		stop:  make(chan struct{}),
+	}
+	if err := s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if o.Fsync == FsyncPeriodic {
+		go s.syncLoop()
+	}
+	return s, nil
+}
+
+// replay rebuilds the index from the log, truncating it after the last
+// intact entry.
+func (s *FileRecordStore) replay() error {
+	r := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		entry, size, err := readLogEntry(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A crash mid-append leaves a partial entry; drop it.
+			if err := s.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate record log: %v", err)
+			}
+			if err := s.file.Sync(); err != nil {
+				return fmt.Errorf("failed to sync record log: %v", err)
+			}
+			break
+		}
+		s.apply(entry, logPointer{offset: offset, size: size})
+		offset += size
+	}
+	s.size = offset
+	return nil
+}
+
+// apply updates the index with an entry found at ptr.
+func (s *FileRecordStore) apply(entry *logEntry, ptr logPointer) {
+	if old, ok := s.index.entries[entry.Key][entry.Publisher]; ok {
+		s.dead += old.value.size
+	}
+	switch entry.Op {
+	case logPut:
+		s.index.set(entry.Key, entry.Publisher, ptr, entry.Record.expires)
+	case logDelete:
+		s.index.remove(entry.Key, entry.Publisher)
+		s.dead += ptr.size
+	}
+}
+
+func (s *FileRecordStore) Put(rec *Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+	current, err := s.readKey(rec.key)
+	if err != nil {
+		return false, err
+	}
+	ok, err := admit(current, rec)
+	if !ok {
+		return false, err
+	}
+	if err := s.append(&logEntry{Op: logPut, Key: rec.key, Publisher: rec.PublisherID(), Record: rec}); err != nil {
+		return false, err
+	}
+	s.maybeCompact()
+	return true, nil
+}
+
+func (s *FileRecordStore) Get(key string) ([]*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	return s.readKey(key)
+}
+
+func (s *FileRecordStore) Scan(prefix string, fn func(*Record) bool) error {
+	s.mu.RLock()
+	keys := s.index.scanKeys(prefix)
+	s.mu.RUnlock()
+
+	for _, key := range keys {
+		recs, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if !fn(rec) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileRecordStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+	expired := s.index.expire(now)
+	for _, e := range expired {
+		s.dead += e.value.size
+		if err := s.append(&logEntry{Op: logDelete, Key: e.key, Publisher: e.pub}); err != nil {
+			return 0, err
+		}
+	}
+	s.maybeCompact()
+	return len(expired), nil
+}
+
+// Compact rewrites the log with only its live entries.
+func (s *FileRecordStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	return s.compact()
+}
+
+// Close flushes the log and closes it.
+func (s *FileRecordStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return fmt.Errorf("failed to sync record log: %v", err)
+	}
+	return s.file.Close()
+}
+
+// readKey reads the current records of key from the log.
+func (s *FileRecordStore) readKey(key string) ([]*Record, error) {
+	ptrs := s.index.get(key)
+	recs := make([]*Record, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		buf := make([]byte, ptr.size)
+		if _, err := s.file.ReadAt(buf, ptr.offset); err != nil {
+			return nil, fmt.Errorf("failed to read record log: %v", err)
+		}
+		entry, err := decodeLogEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, entry.Record)
+	}
+	return recs, nil
+}
+
+// append writes entry at the end of the log and indexes it.
+func (s *FileRecordStore) append(entry *logEntry) error {
+	buf, err := encodeLogEntry(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		return fmt.Errorf("failed to write record log: %v", err)
+	}
+	if s.opts.Fsync == FsyncAlways {
+		if err := s.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync record log: %v", err)
+		}
+	} else {
+		s.dirty = true
+	}
+	ptr := logPointer{offset: s.size, size: int64(len(buf))}
+	s.size += ptr.size
+	s.apply(entry, ptr)
+	return nil
+}
+
+// maybeCompact compacts the log once dead entries dominate it. A failed
+// compaction leaves the old log in place and is retried on a later write.
+func (s *FileRecordStore) maybeCompact() {
+	if s.opts.CompactRatio < 0 || s.size < s.opts.CompactMinSize {
+		return
+	}
+	if float64(s.dead) > s.opts.CompactRatio*float64(s.size) {
+		s.compact()
+	}
+}
+
+// compact copies the live entries to a new log, syncs it and renames it over
+// the old one, so a crash leaves either the old or the new log intact.
+func (s *FileRecordStore) compact() error {
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to compact record log: %v", err)
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to compact record log: %v", err)
+	}
+
+	moved := make(map[string]map[types.NodeID]logPointer)
+	var offset int64
+	for _, key := range s.index.scanKeys("") {
+		moved[key] = make(map[types.NodeID]logPointer)
+		for pub, cur := range s.index.entries[key] {
+			buf := make([]byte, cur.value.size)
+			if _, err := s.file.ReadAt(buf, cur.value.offset); err != nil {
+				return fail(err)
+			}
+			if _, err := tmp.WriteAt(buf, offset); err != nil {
+				return fail(err)
+			}
+			moved[key][pub] = logPointer{offset: offset, size: cur.value.size}
+			offset += cur.value.size
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(s.path))
+
+	s.file.Close()
+	s.file = tmp
+	s.size = offset
+	s.dead = 0
+	s.dirty = false
+	for key, byPub := range moved {
+		for pub, ptr := range byPub {
+			s.index.relocate(key, pub, ptr)
+		}
+	}
+	return nil
+}
+
+// syncLoop flushes the log every FsyncInterval under FsyncPeriodic.
+func (s *FileRecordStore) syncLoop() {
+	ticker := time.NewTicker(s.opts.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty && !s.closed {
+				s.file.Sync()
+				s.dirty = false
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// encodeLogEntry frames entry as its length, CRC-32 and JSON payload.
+func encodeLogEntry(entry *logEntry) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log entry: %v", err)
+	}
+	buf := make([]byte, logHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[logHeaderSize:], payload)
+	return buf, nil
+}
+
+// decodeLogEntry checks and decodes a framed entry.
+func decodeLogEntry(buf []byte) (*logEntry, error) {
+	if len(buf) < logHeaderSize || int(binary.BigEndian.Uint32(buf[0:4])) != len(buf)-logHeaderSize {
+		return nil, ErrCorruptLog
+	}
+	payload := buf[logHeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, ErrCorruptLog
+	}
+	var entry logEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return nil, ErrCorruptLog
+	}
+	switch {
+	case entry.Op == logPut && entry.Record != nil && entry.Record.key == entry.Key:
+	case entry.Op == logDelete:
+	default:
+		return nil, ErrCorruptLog
+	}
+	return &entry, nil
+}
+
+// readLogEntry reads the next entry from r and returns its framed size. It
+// returns io.EOF only at a clean end of the log.
+func readLogEntry(r io.Reader) (*logEntry, int64, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n > maxLogEntrySize {
+		return nil, 0, ErrCorruptLog
+	}
+	buf := make([]byte, logHeaderSize+int(n))
+	copy(buf, header)
+	if _, err := io.ReadFull(r, buf[logHeaderSize:]); err != nil {
+		return nil, 0, ErrCorruptLog
+	}
+	entry, err := decodeLogEntry(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry, int64(len(buf)), nil
+}
+
+// syncDir flushes a directory so a rename within it is durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,412 @@
+package qdht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/goccy/go-json"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"trustmesh/common"
+	"trustmesh/types"
+)
+
+const (
+	// GeoNamespace is the key namespace of records published under geo cells.
+	GeoNamespace = "geo"
+	// GeoIndexNamespace is the key namespace of the prefix hash tree that
+	// indexes them.
+	GeoIndexNamespace = "geo-index"
+	// DefaultGeoLeafSize is how many records a geo index leaf holds before
+	// it splits.
+	DefaultGeoLeafSize = 16
+)
+
+// GeoKey returns the key a record named name is published under in cell.
+// Keys sort in cell order.
+func GeoKey(cell common.GeoCell, name string) string {
+	return fmt.Sprintf("/%s/%010x/%s", GeoNamespace, uint64(cell), name)
+}
+
+// ParseGeoKey returns the cell and name of a key made by GeoKey.
+func ParseGeoKey(key string) (common.GeoCell, string, error) {
+	rest, ok := strings.CutPrefix(key, "/"+GeoNamespace+"/")
+	hexCell, name, found := strings.Cut(rest, "/")
+	if !ok || !found || len(hexCell) != 10 || name == "" {
+		return 0, "", ErrInvalidGeoKey
+	}
+	c, err := strconv.ParseUint(hexCell, 16, 64)
+	if err != nil || c >= 1<<common.GeoCellBits {
+		return 0, "", ErrInvalidGeoKey
+	}
+	return common.GeoCell(c), name, nil
+}
+
+// GeoValidator accepts records whose keys name a valid geo cell.
+type GeoValidator struct{}
+
+func (GeoValidator) Validate(rec *Record) error {
+	_, _, err := ParseGeoKey(rec.key)
+	return err
+}
+
+func (GeoValidator) Select(key string, recs []*Record) (int, error) {
+	return DefaultValidator{}.Select(key, recs)
+}
+
+// GeoIndexValidator accepts geo index nodes holding only signed geo records
+// of cells under the node's label.
+type GeoIndexValidator struct{}
+
+func (GeoIndexValidator) Validate(rec *Record) error {
+	label, err := parseGeoIndexKey(rec.key)
+	if err != nil {
+		return err
+	}
+	if len(rec.value) == tombstoneValueLen {
+		return nil
+	}
+	node, err := decodeGeoNode(rec.value)
+	if err != nil {
+		return err
+	}
+	for _, r := range node.Records {
+		cell, _, err := ParseGeoKey(r.key)
+		if err != nil {
+			return err
+		}
+		if cellLabel(cell, len(label)) != label {
+			return fmt.Errorf("%w: record %s lies outside %q", ErrInvalidGeoIndex, r.key, label)
+		}
+		if err := r.Verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (GeoIndexValidator) Select(key string, recs []*Record) (int, error) {
+	return DefaultValidator{}.Select(key, recs)
+}
+
+// geoNode is a node of the prefix hash tree over geo cells. The node for a
+// label holds the records of the cells whose top bits spell the label, until
+// it overflows and splits them between the nodes of its two children.
+type geoNode struct {
+	Split   bool      `json:"split,omitempty"`
+	Records []*Record `json:"records,omitempty"`
+}
+
+func decodeGeoNode(data []byte) (*geoNode, error) {
+	var node geoNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidGeoIndex, err)
+	}
+	for _, r := range node.Records {
+		if r == nil {
+			return nil, ErrInvalidGeoIndex
+		}
+	}
+	return &node, nil
+}
+
+func geoIndexKey(label string) string {
+	return "/" + GeoIndexNamespace + "/" + label
+}
+
+func parseGeoIndexKey(key string) (string, error) {
+	label, ok := strings.CutPrefix(key, "/"+GeoIndexNamespace+"/")
+	if !ok || len(label) > common.GeoCellBits || strings.Trim(label, "01") != "" {
+		return "", fmt.Errorf("%w: bad key %q", ErrInvalidGeoIndex, key)
+	}
+	return label, nil
+}
+
+// cellLabel returns the top n bits of cell as a string of binary digits.
+func cellLabel(cell common.GeoCell, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteByte('0' + byte(cell>>(common.GeoCellBits-1-i)&1))
+	}
+	return b.String()
+}
+
+// labelRange returns the cells under label.
+func labelRange(label string) common.CellRange {
+	var from common.GeoCell
+	for i := 0; i < len(label); i++ {
+		from = from<<1 | common.GeoCell(label[i]-'0')
+	}
+	free := common.GeoCellBits - len(label)
+	return common.CellRange{From: from << free, To: from<<free | (1<<free - 1)}
+}
+
+// sharedLabel returns the longest label both a and b lie under.
+func sharedLabel(a, b common.GeoCell) string {
+	return cellLabel(a, bits.LeadingZeros64(uint64(a^b))-(64-common.GeoCellBits))
+}
+
+// overlaps reports whether r intersects any of the sorted, disjoint ranges.
+func overlaps(r common.CellRange, ranges []common.CellRange) bool {
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].To >= r.From })
+	return i < len(ranges) && ranges[i].From <= r.To
+}
+
+// mergeGeoRecords returns the newest record per key and publisher among
+// recs, in key order.
+func mergeGeoRecords(recs ...*Record) []*Record {
+	type slot struct {
+		key string
+		pub types.NodeID
+	}
+	newest := make(map[slot]*Record)
+	for _, rec := range recs {
+		s := slot{rec.key, rec.PublisherID()}
+		cur, ok := newest[s]
+		if !ok || rec.seq > cur.seq || (rec.seq == cur.seq && rec.expires.After(cur.expires)) {
+			newest[s] = rec
+		}
+	}
+	out := make([]*Record, 0, len(newest))
+	for _, rec := range newest {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].key != out[j].key {
+			return out[i].key < out[j].key
+		}
+		pi, pj := out[i].PublisherID(), out[j].PublisherID()
+		return string(pi[:]) < string(pj[:])
+	})
+	return out
+}
+
+// PutGeo publishes value as the record name in cell and adds it to the geo
+// index, a prefix hash tree whose nodes are themselves DHT records. The
+// index holds the signed record, so it must be put again to stay indexed
+// past its TTL.
+func (d *DHT) PutGeo(ctx context.Context, cell common.GeoCell, name string, value []byte, opts ...PutOptions) (*Record, error) {
+	if cell >= 1<<common.GeoCellBits {
+		return nil, ErrInvalidGeoKey
+	}
+	o := d.putOptions(opts)
+	rec, err := d.publish(ctx, GeoKey(cell, name), value, o)
+	if err != nil {
+		return nil, err
+	}
+	label, leaf, err := d.geoLeaf(ctx, cell)
+	if err != nil {
+		return nil, err
+	}
+	o.TTL = d.ttl
+	return rec, d.storeGeoLeaf(ctx, label, append(leaf.Records, rec), o)
+}
+
+// RangeQuery returns the live geo records of the cells from through to, in
+// cell order.
+func (d *DHT) RangeQuery(ctx context.Context, from, to common.GeoCell) ([]*Record, error) {
+	if from > to {
+		from, to = to, from
+	}
+	return d.geoQuery(ctx, []common.CellRange{{From: from, To: to}})
+}
+
+// Nearby returns the live geo records at most radius grid squares from cell,
+// nearest first.
+func (d *DHT) Nearby(ctx context.Context, cell common.GeoCell, radius int) ([]*Record, error) {
+	center, err := cell.Location()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := cell.Within(radius)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := d.geoQuery(ctx, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	dist := make(map[*Record]float64, len(recs))
+	var out []*Record
+	for _, rec := range recs {
+		c, _, _ := ParseGeoKey(rec.key)
+		loc, err := c.Location()
+		if err != nil {
+			continue
+		}
+		if dist[rec] = center.Distance(loc); dist[rec] <= float64(radius) {
+			out = append(out, rec)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return dist[out[i]] < dist[out[j]] })
+	return out, nil
+}
+
+// geoQuery returns the live geo records in ranges, which must be sorted and
+// disjoint. It starts from the index node for the longest label shared by
+// all of the ranges, or the leaf above it when that node does not exist,
+// and descends a level at a time into the children overlapping a range.
+func (d *DHT) geoQuery(ctx context.Context, ranges []common.CellRange) ([]*Record, error) {
+	if len(ranges) == 0 {
+		return nil, nil
+	}
+	lo, hi := ranges[0].From, ranges[len(ranges)-1].To
+	label := sharedLabel(lo, hi)
+	node, err := d.readGeoNode(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		if label, node, err = d.geoLeaf(ctx, lo); err != nil {
+			return nil, err
+		}
+	}
+
+	var found []*Record
+	level := map[string]*geoNode{label: node}
+	for len(level) > 0 {
+		var next []string
+		for label, node := range level {
+			// Records left on a split node by a concurrent insert still count.
+			found = append(found, node.Records...)
+			if !node.Split {
+				continue
+			}
+			for _, child := range []string{label + "0", label + "1"} {
+				if overlaps(labelRange(child), ranges) {
+					next = append(next, child)
+				}
+			}
+		}
+		if level, err = d.readGeoNodes(ctx, next); err != nil {
+			return nil, err
+		}
+	}
+
+	now := d.now()
+	var out []*Record
+	for _, rec := range mergeGeoRecords(found...) {
+		cell, _, err := ParseGeoKey(rec.key)
+		if err == nil && !rec.Expired(now) && overlaps(common.CellRange{From: cell, To: cell}, ranges) {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// geoLeaf finds the leaf of the geo index cell falls under by binary search
+// over the label length: a missing node lies below the leaf and a split one
+// above it. An empty index is a single empty leaf at the root.
+func (d *DHT) geoLeaf(ctx context.Context, cell common.GeoCell) (string, *geoNode, error) {
+	lo, hi := 0, common.GeoCellBits
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		label := cellLabel(cell, mid)
+		node, err := d.readGeoNode(ctx, label)
+		switch {
+		case err != nil:
+			return "", nil, err
+		case node == nil:
+			hi = mid - 1
+		case node.Split:
+			lo = mid + 1
+		default:
+			return label, node, nil
+		}
+	}
+	return cellLabel(cell, lo), &geoNode{}, nil
+}
+
+// storeGeoLeaf writes the live records among recs as the leaf for label,
+// splitting it while it holds more than the leaf size. Children are written
+// before their parent is marked split, so lookups never descend into a
+// missing leaf.
+func (d *DHT) storeGeoLeaf(ctx context.Context, label string, recs []*Record, opts PutOptions) error {
+	now := d.now()
+	var live []*Record
+	for _, rec := range mergeGeoRecords(recs...) {
+		if !rec.Expired(now) {
+			live = append(live, rec)
+		}
+	}
+	if len(live) <= d.geoLeafSize || len(label) == common.GeoCellBits {
+		return d.writeGeoNode(ctx, label, &geoNode{Records: live}, opts)
+	}
+
+	var halves [2][]*Record
+	for _, rec := range live {
+		cell, _, _ := ParseGeoKey(rec.key)
+		bit := cell >> (common.GeoCellBits - 1 - len(label)) & 1
+		halves[bit] = append(halves[bit], rec)
+	}
+	for i, half := range halves {
+		if err := d.storeGeoLeaf(ctx, label+strconv.Itoa(i), half, opts); err != nil {
+			return err
+		}
+	}
+	return d.writeGeoNode(ctx, label, &geoNode{Split: true}, opts)
+}
+
+func (d *DHT) writeGeoNode(ctx context.Context, label string, node *geoNode, opts PutOptions) error {
+	value, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	_, err = d.publish(ctx, geoIndexKey(label), value, opts)
+	return err
+}
+
+// readGeoNode returns the index node for label, or nil if there is none.
+// Concurrent versions of the node are merged.
+func (d *DHT) readGeoNode(ctx context.Context, label string) (*geoNode, error) {
+	recs, err := d.GetRecords(ctx, geoIndexKey(label), GetOptions{Conflicts: true})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	merged := &geoNode{}
+	var all []*Record
+	for _, rec := range recs {
+		node, err := decodeGeoNode(rec.value)
+		if err != nil {
+			continue
+		}
+		merged.Split = merged.Split || node.Split
+		all = append(all, node.Records...)
+	}
+	merged.Records = mergeGeoRecords(all...)
+	return merged, nil
+}
+
+// readGeoNodes reads the index nodes for labels in parallel, leaving out
+// those that do not exist.
+func (d *DHT) readGeoNodes(ctx context.Context, labels []string) (map[string]*geoNode, error) {
+	nodes := make([]*geoNode, len(labels))
+	errs := make([]error, len(labels))
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			nodes[i], errs[i] = d.readGeoNode(ctx, label)
+		}(i, label)
+	}
+	wg.Wait()
+
+	out := make(map[string]*geoNode, len(labels))
+	for i, label := range labels {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if nodes[i] != nil {
+			out[label] = nodes[i]
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,90 @@
+package qdht_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/common"
+	"trustmesh/qdht"
+)
+
+// geoCell returns the cell of a grid square.
+func geoCell(t *testing.T, lat, lon int) common.GeoCell {
+	t.Helper()
+	cell, err := common.SafeLatitudeLongitude{lat, lon}.Cell()
+	require.NoError(t, err)
+	return cell
+}
+
+// names returns the names of geo records.
+func names(t *testing.T, recs []*qdht.Record) []string {
+	t.Helper()
+	out := make([]string, len(recs))
+	for i, rec := range recs {
+		_, name, err := qdht.ParseGeoKey(rec.Key())
+		require.NoError(t, err)
+		out[i] = name
+	}
+	return out
+}
+
+func TestGeoRangeQuery(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4, GeoLeafSize: 2})
+	ctx := context.Background()
+
+	var cells []common.GeoCell
+	for i := 0; i < 8; i++ {
+		cell := geoCell(t, 100, 200+i)
+		cells = append(cells, cell)
+		_, err := nodes[i].PutGeo(ctx, cell, fmt.Sprint("cafe-", i), []byte("open"))
+		require.NoError(t, err)
+	}
+	_, err := nodes[0].PutGeo(ctx, geoCell(t, -3000, 9000), "far", []byte("away"))
+	require.NoError(t, err)
+
+	all, err := nodes[5].RangeQuery(ctx, 0, 1<<common.GeoCellBits-1)
+	require.NoError(t, err)
+	require.Len(t, all, 9, "Every record should be found once the index has split.")
+	for i := 1; i < len(all); i++ {
+		require.Less(t, all[i-1].Key(), all[i].Key(), "Results should be in cell order.")
+	}
+
+	lo, hi := cells[0], cells[0]
+	for _, c := range cells[2:5] {
+		lo, hi = min(lo, c), max(hi, c)
+	}
+	recs, err := nodes[3].RangeQuery(ctx, hi, lo)
+	require.NoError(t, err)
+	for _, rec := range recs {
+		cell, _, err := qdht.ParseGeoKey(rec.Key())
+		require.NoError(t, err)
+		require.True(t, lo <= cell && cell <= hi, "Only records in the range should be returned.")
+		require.NoError(t, rec.Verify(), "Records should keep their publisher's signature.")
+	}
+	require.Subset(t, names(t, recs), []string{"cafe-0", "cafe-2", "cafe-3", "cafe-4"})
+}
+
+func TestGeoNearby(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4, GeoLeafSize: 2})
+	ctx := context.Background()
+
+	for name, at := range map[string][2]int{
+		"here":   {0, 0},
+		"close":  {1, 1},
+		"around": {-3, 2},
+		"corner": {4, 4},
+		"far":    {50, -40},
+	} {
+		_, err := nodes[len(name)%len(nodes)].PutGeo(ctx, geoCell(t, at[0], at[1]), name, []byte(name))
+		require.NoError(t, err)
+	}
+
+	recs, err := nodes[2].Nearby(ctx, geoCell(t, 0, 0), 4)
+	require.NoError(t, err)
+	require.Equal(t, []string{"here", "close", "around"}, names(t, recs), "Records within the radius should be returned nearest first.")
+
+	recs, err = nodes[4].Nearby(ctx, geoCell(t, 50, -40), 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"far"}, names(t, recs))
+}
@@ -0,0 +1,49 @@
+package qdht
+
+import (
+	"bytes"
+	"github.com/zeebo/blake3"
+	"math/bits"
+	"sort"
+	"trustmesh/types"
+)
+
+// KeyID maps a record key into the node identifier space.
+func KeyID(key string) types.NodeID {
+	var id types.NodeID
+	h := blake3.Sum256([]byte(key))
+	copy(id[:], h[:])
+	return id
+}
+
+// Distance returns the XOR distance between two identifiers.
+func Distance(a, b types.NodeID) types.NodeID {
+	var d types.NodeID
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// CommonPrefixLen returns the number of leading bits shared by a and b.
+func CommonPrefixLen(a, b types.NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// closer reports whether a is strictly closer to target than b.
+func closer(a, b, target types.NodeID) bool {
+	da, db := Distance(a, target), Distance(b, target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// SortByDistance orders nodes by increasing distance to target.
+func SortByDistance(nodes []*types.Node, target types.NodeID) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return closer(nodes[i].ID, nodes[j].ID, target)
+	})
+}
@@ -0,0 +1,307 @@
+package qdht
+
+import (
+	"context"
+	"sync"
+	"trustmesh/types"
+)
+
+// replyFunc observes each lookup response; returning true ends the lookup.
+type replyFunc func(from *types.Node, resp *Message) bool
+
+// LookupOptions selects how lookups are routed.
+type LookupOptions struct {
+	// Paths is the number of disjoint paths a lookup runs, as in
+	// S/Kademlia. No node is queried by more than one path, so malicious
+	// nodes only capture the paths they sit on. Zero or one runs a plain
+	// lookup.
+	Paths int
+	// Agreement is how many paths must have learned of a node and got an
+	// answer from it for it to be part of the result. Zero requires two
+	// paths to agree.
+	Agreement int
+}
+
+// lookup runs an iterative Kademlia lookup towards target, sending req to
+// alpha unqueried nodes per round until the k closest known nodes have all
+// been queried. Each round waits for all of its replies and handles them in
+// distance order, so a lookup over a deterministic Messenger is itself
+// deterministic. It returns the k closest nodes that answered.
+func (d *DHT) lookup(ctx context.Context, target types.NodeID, req Message, onReply replyFunc) ([]*types.Node, error) {
+	return d.lookupWidth(ctx, target, req, d.k, onReply)
+}
+
+// lookupWidth is lookup converging on the width closest nodes instead of k.
+func (d *DHT) lookupWidth(ctx context.Context, target types.NodeID, req Message, width int, onReply replyFunc) ([]*types.Node, error) {
+	return d.route(ctx, target, req, width, d.lookupOpts, onReply)
+}
+
+// FindNode returns the k closest nodes to target that answered the lookup.
+func (d *DHT) FindNode(ctx context.Context, target types.NodeID, opts ...LookupOptions) ([]*types.Node, error) {
+	o := d.lookupOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return d.route(ctx, target, Message{Type: MsgFindNode, Target: target}, d.k, o, nil)
+}
+
+// lookupPath is the state of one path of a lookup.
+type lookupPath struct {
+	known     map[types.NodeID]bool
+	queried   map[types.NodeID]bool
+	answered  map[types.NodeID]bool
+	shortlist []*types.Node
+	responded []*types.Node
+}
+
+// lookupRun is the state shared by the paths of a lookup.
+type lookupRun struct {
+	d        *DHT
+	target   types.NodeID
+	req      Message
+	width    int
+	disjoint bool
+	onReply  replyFunc
+
+	mu      sync.Mutex
+	claimed map[types.NodeID]bool
+	done    bool
+}
+
+// route runs a lookup over opts.Paths paths. The closest contacts are dealt
+// out between the paths, which then proceed independently. With more than
+// one path the result only holds nodes at least opts.Agreement paths learned
+// of and got an answer from.
+func (d *DHT) route(ctx context.Context, target types.NodeID, req Message, width int, opts LookupOptions, onReply replyFunc) ([]*types.Node, error) {
+	seeds := d.table.Closest(target, width)
+	paths := opts.Paths
+	if paths > len(seeds) {
+		paths = len(seeds)
+	}
+	if paths < 1 {
+		paths = 1
+	}
+
+	run := &lookupRun{
+		d:        d,
+		target:   target,
+		req:      req,
+		width:    width,
+		disjoint: paths > 1,
+		onReply:  onReply,
+		claimed:  make(map[types.NodeID]bool),
+	}
+	all := make([]*lookupPath, paths)
+	for i := range all {
+		all[i] = &lookupPath{
+			known:    map[types.NodeID]bool{d.self.ID: true},
+			queried:  make(map[types.NodeID]bool),
+			answered: make(map[types.NodeID]bool),
+		}
+	}
+	for i, n := range seeds {
+		run.add(all[i%paths], []*types.Node{n})
+	}
+
+	errs := make([]error, paths)
+	d.fanOut(paths, func(i int) {
+		errs[i] = run.walk(ctx, all[i])
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !run.disjoint {
+		return closestN(all[0].responded, target, width), nil
+	}
+
+	agreement := opts.Agreement
+	if agreement <= 0 {
+		agreement = 2
+	}
+	if agreement > paths {
+		agreement = paths
+	}
+	var answered []*types.Node
+	seen := make(map[types.NodeID]bool)
+	for _, p := range all {
+		for _, n := range p.responded {
+			if !seen[n.ID] {
+				seen[n.ID] = true
+				answered = append(answered, n)
+			}
+		}
+	}
+	SortByDistance(answered, target)
+
+	// Hearing of a node is not enough: colluders on several paths can all
+	// name the same contacts. Each path pings the nodes it heard of but did
+	// not query, closest first, and a node gets a vote from every path it
+	// answered.
+	var agreed []*types.Node
+	for start := 0; start < len(answered) && len(agreed) < width; start += width {
+		batch := answered[start:min(start+width, len(answered))]
+		d.fanOut(paths, func(i int) {
+			run.confirm(ctx, all[i], batch)
+		})
+		for _, n := range batch {
+			votes := 0
+			for _, p := range all {
+				if p.answered[n.ID] {
+					votes++
+				}
+			}
+			if votes >= agreement {
+				agreed = append(agreed, n)
+			}
+		}
+	}
+	if len(agreed) == 0 && len(answered) > 0 {
+		return nil, ErrPathsDisagree
+	}
+	return closestN(agreed, target, width), nil
+}
+
+// confirm pings the nodes p heard of without getting an answer from them and
+// records those that answer.
+func (r *lookupRun) confirm(ctx context.Context, p *lookupPath, nodes []*types.Node) {
+	var ask []*types.Node
+	for _, n := range nodes {
+		if p.known[n.ID] && !p.answered[n.ID] {
+			ask = append(ask, n)
+		}
+	}
+	ok := make([]bool, len(ask))
+	r.d.fanOut(len(ask), func(i int) {
+		_, err := r.d.send(ctx, ask[i], &Message{Type: MsgPing})
+		ok[i] = err == nil
+	})
+	for i, n := range ask {
+		if ok[i] {
+			p.answered[n.ID] = true
+		}
+	}
+}
+
+// add puts the admissible nodes among nodes on p's shortlist.
+func (r *lookupRun) add(p *lookupPath, nodes []*types.Node) {
+	for _, n := range nodes {
+		if n == nil || p.known[n.ID] || !r.d.admissible(n) {
+			continue
+		}
+		p.known[n.ID] = true
+		p.shortlist = append(p.shortlist, n)
+	}
+	SortByDistance(p.shortlist, r.target)
+}
+
+// claim reserves n for p. On disjoint lookups a node another path has
+// queried is dropped from p's shortlist instead.
+func (r *lookupRun) claim(p *lookupPath, n *types.Node) bool {
+	p.queried[n.ID] = true
+	if !r.disjoint {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.claimed[n.ID] {
+		p.shortlist = removeNode(p.shortlist, n.ID)
+		return false
+	}
+	r.claimed[n.ID] = true
+	return true
+}
+
+// walk runs one path until its width closest known nodes have all been
+// queried or a reply ends the lookup.
+func (r *lookupRun) walk(ctx context.Context, p *lookupPath) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch := r.pick(p, true)
+		if len(batch) == 0 {
+			batch = r.pick(p, false)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		resps := make([]*Message, len(batch))
+		r.d.fanOut(len(batch), func(i int) {
+			msg := r.req
+			if resp, err := r.d.send(ctx, batch[i], &msg); err == nil {
+				resps[i] = resp
+			}
+		})
+
+		done := false
+		for i, n := range batch {
+			if resps[i] == nil {
+				p.shortlist = removeNode(p.shortlist, n.ID)
+				continue
+			}
+			p.responded = append(p.responded, n)
+			p.answered[n.ID] = true
+			r.add(p, resps[i].Closer)
+			if !done && r.reply(n, resps[i]) {
+				done = true
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// pick claims up to alpha unqueried nodes among p's width closest. With
+// preferredOnly set it passes over the nodes the scorer rates badly, which
+// are queried only when no others are left.
+func (r *lookupRun) pick(p *lookupPath, preferredOnly bool) []*types.Node {
+	var batch []*types.Node
+	for i := 0; i < len(p.shortlist) && i < r.width && len(batch) < r.d.alpha; i++ {
+		n := p.shortlist[i]
+		if p.queried[n.ID] || (preferredOnly && !r.d.preferred(n)) {
+			continue
+		}
+		if !r.claim(p, n) {
+			i--
+			continue
+		}
+		batch = append(batch, n)
+	}
+	return batch
+}
+
+// reply hands a response to the lookup's observer, one path at a time, and
+// reports whether the lookup is over.
+func (r *lookupRun) reply(from *types.Node, resp *Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.done && r.onReply != nil && r.onReply(from, resp) {
+		r.done = true
+	}
+	return r.done
+}
+
+// closestN returns the count nodes closest to target.
+func closestN(nodes []*types.Node, target types.NodeID, count int) []*types.Node {
+	SortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+func removeNode(nodes []*types.Node, id types.NodeID) []*types.Node {
+	for i, n := range nodes {
+		if n.ID == id {
+			return append(nodes[:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,236 @@
+package qdht
+
+import (
+	"sort"
+	"time"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultMaxRecordTTL caps how far in the future a record may expire.
+	DefaultMaxRecordTTL = 7 * 24 * time.Hour
+	// DefaultRepublishInterval is how often originators re-sign their records.
+	DefaultRepublishInterval = 12 * time.Hour
+	// DefaultReplicateInterval is how often replica holders push their
+	// records to the current closest nodes.
+	DefaultReplicateInterval = time.Hour
+	// DefaultSweepInterval is how often expired state is dropped.
+	DefaultSweepInterval = time.Minute
+	// idleRepublishWait is how long the republisher sleeps with nothing to do.
+	idleRepublishWait = time.Hour
+	// NeighborProtectTag is the tag the closest contacts are protected under.
+	NeighborProtectTag = "qdht-neighbor"
+)
+
+// Protector keeps the connections to nodes from being trimmed.
+// network.ConnManager implements it.
+type Protector interface {
+	Protect(id types.NodeID, tag string)
+	Unprotect(id types.NodeID, tag string) bool
+}
+
+// publication is a record this node originated and keeps alive.
+type publication struct {
+	key   string
+	value []byte
+	seq   uint64
+	clock VectorClock
+	opts  PutOptions
+	next  time.Time
+}
+
+// track schedules rec for republishing by its originator.
+func (d *DHT) track(rec *Record, opts PutOptions) {
+	if d.republishInterval <= 0 {
+		return
+	}
+	interval := d.republishInterval
+	if half := opts.TTL / 2; half < interval {
+		interval = half
+	}
+
+	d.publishedMu.Lock()
+	d.published[rec.key] = &publication{
+		key:   rec.key,
+		value: rec.value,
+		seq:   rec.seq,
+		clock: rec.clock,
+		opts:  opts,
+		next:  d.now().Add(interval),
+	}
+	d.publishedMu.Unlock()
+
+	select {
+	case d.republishWake <- struct{}{}:
+	default:
+	}
+}
+
+// untrack stops republishing key and returns its publication, if any.
+func (d *DHT) untrack(key string) *publication {
+	d.publishedMu.Lock()
+	defer d.publishedMu.Unlock()
+
+	p := d.published[key]
+	delete(d.published, key)
+	return p
+}
+
+// republishLoop re-signs each publication with a fresh expiry when it falls
+// due, so records outlive their TTL only while their originator is online.
+func (d *DHT) republishLoop() {
+	for {
+		wait := idleRepublishWait
+		d.publishedMu.Lock()
+		for _, p := range d.published {
+			if until := p.next.Sub(d.now()); until < wait {
+				wait = until
+			}
+		}
+		d.publishedMu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		case <-d.republishWake:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		d.republishDue()
+	}
+}
+
+// republishDue republishes the publications that have fallen due, in key
+// order.
+func (d *DHT) republishDue() {
+	now := d.now()
+	var due []*publication
+	d.publishedMu.Lock()
+	for _, p := range d.published {
+		if !p.next.After(now) {
+			due = append(due, p)
+		}
+	}
+	d.publishedMu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].key < due[j].key })
+	for _, p := range due {
+		d.republish(p)
+	}
+}
+
+// republish stores a fresh copy of a publication with the same sequence and
+// a later expiry, which replicas accept as a refresh.
+func (d *DHT) republish(p *publication) {
+	signer := d.key
+	if p.opts.Anonymous {
+		var err error
+		if signer, err = d.pseudonym(p.key); err != nil {
+			return
+		}
+	}
+	rec, err := d.signRecord(signer, p.key, p.value, p.seq, p.clock, p.opts.TTL)
+	if err != nil {
+		// A newer version superseded this one; stop keeping the old one alive.
+		d.publishedMu.Lock()
+		if d.published[p.key] == p {
+			delete(d.published, p.key)
+		}
+		d.publishedMu.Unlock()
+		return
+	}
+	d.track(rec, p.opts)
+
+	ctx, cancel := d.opContext()
+	defer cancel()
+	if p.opts.Anonymous {
+		d.relay(ctx, &onionRequest{Type: MsgStore, Records: []*Record{rec}, Replication: p.opts.Replication, Quorum: p.opts.Quorum})
+		return
+	}
+	d.PutRecord(ctx, rec, p.opts)
+}
+
+// replicateLoop periodically pushes every stored record to the closest nodes
+// the routing table knows of, as Kademlia replica holders do. Replicas never
+// extend a record's expiry, so records still age out once their originator
+// stops republishing.
+func (d *DHT) replicateLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.refreshReplicas()
+		}
+	}
+}
+
+// refreshReplicas pushes every live stored record to its k closest contacts.
+func (d *DHT) refreshReplicas() {
+	ctx, cancel := d.opContext()
+	defer cancel()
+
+	now := d.now()
+	for _, rec := range d.allRecords() {
+		if rec.Expired(now) {
+			continue
+		}
+		d.storeAt(ctx, d.table.Closest(KeyID(rec.key), d.k), rec)
+	}
+}
+
+// sweepLoop drops expired records and provider announcements and keeps the
+// closest contacts protected.
+func (d *DHT) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			d.sweep()
+			d.protectNeighbors()
+		}
+	}
+}
+
+// sweep drops expired records and provider announcements.
+func (d *DHT) sweep() {
+	now := d.now()
+	d.records.Expire(now)
+	d.providers.sweep(now)
+}
+
+// protectNeighbors protects the connections to the k contacts closest to the
+// local node, which the node replicates with and routes through first, and
+// releases those of former neighbours.
+func (d *DHT) protectNeighbors() {
+	if d.protector == nil {
+		return
+	}
+	d.protectMu.Lock()
+	defer d.protectMu.Unlock()
+
+	closest := make(map[types.NodeID]bool)
+	for _, n := range d.table.Closest(d.self.ID, d.k) {
+		closest[n.ID] = true
+		if !d.neighbors[n.ID] {
+			d.protector.Protect(n.ID, NeighborProtectTag)
+		}
+	}
+	for id := range d.neighbors {
+		if !closest[id] {
+			d.protector.Unprotect(id, NeighborProtectTag)
+		}
+	}
+	d.neighbors = closest
+}
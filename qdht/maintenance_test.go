@@ -0,0 +1,140 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+func TestRecordsExpireWithoutOriginator(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4, SweepInterval: 20 * time.Millisecond})
+
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("/mobile/announce", []byte("here")), qdht.PutOptions{TTL: 150 * time.Millisecond}))
+	_, err := nodes[3].Get("/mobile/announce")
+	require.NoError(t, err)
+
+	// The originator drops off the mesh, so nobody extends the record.
+	nodes[0].Close()
+	time.Sleep(250 * time.Millisecond)
+
+	_, err = nodes[3].Get("/mobile/announce")
+	require.ErrorIs(t, err, qdht.ErrNotFound, "Announcements should age out once their originator leaves.")
+}
+
+// protector records which nodes are protected.
+type protector struct {
+	mu  sync.Mutex
+	ids map[types.NodeID]bool
+}
+
+func (p *protector) Protect(id types.NodeID, tag string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids[id] = true
+}
+
+func (p *protector) Unprotect(id types.NodeID, tag string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.ids, id)
+	return false
+}
+
+func (p *protector) protected() map[types.NodeID]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[types.NodeID]bool, len(p.ids))
+	for id := range p.ids {
+		out[id] = true
+	}
+	return out
+}
+
+func TestClosestContactsAreProtected(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 6, qdht.Config{K: 2})
+	p := &protector{ids: make(map[types.NodeID]bool)}
+	d, err := mesh.NewNode(qdht.Config{K: 2, SweepInterval: 20 * time.Millisecond, Protector: p})
+	require.NoError(t, err)
+	t.Cleanup(func() { d.Close() })
+	require.NoError(t, d.Join(qdht.NodeOf(nodes[0].Self())))
+
+	want := make(map[types.NodeID]bool)
+	for _, id := range ids(d.Table().Closest(d.Self().ID, 2)) {
+		want[id] = true
+	}
+	require.Len(t, want, 2)
+	require.Eventually(t, func() bool {
+		got := p.protected()
+		if len(got) != len(want) {
+			return false
+		}
+		for id := range want {
+			if !got[id] {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond, "Exactly the closest contacts should be protected.")
+}
+
+func TestOriginatorRepublishes(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4, SweepInterval: 20 * time.Millisecond, RepublishInterval: time.Hour})
+
+	// The republish interval is capped at half the TTL.
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("/mobile/announce", []byte("still here")), qdht.PutOptions{TTL: 150 * time.Millisecond}))
+	time.Sleep(400 * time.Millisecond)
+
+	item, err := nodes[4].Get("/mobile/announce")
+	require.NoError(t, err, "Republished record should outlive its TTL.")
+	require.Equal(t, uint64(1), item.(*qdht.Record).Seq(), "Republishing keeps the sequence number.")
+}
+
+func TestPutQuorum(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4})
+
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("k", []byte("v")), qdht.PutOptions{Replication: 3, Quorum: 3}))
+	require.ErrorIs(t,
+		nodes[0].Put(qdht.NewDataItem("k", []byte("v2")), qdht.PutOptions{Replication: 2, Quorum: 3}),
+		qdht.ErrQuorumNotMet, "A quorum larger than the replica set cannot be met.")
+}
+
+func TestRecordTTLIsCapped(t *testing.T) {
+	_, nodes := newTestMesh(t, 2, qdht.Config{K: 4, MaxRecordTTL: time.Hour})
+
+	require.ErrorIs(t,
+		nodes[0].Put(qdht.NewDataItem("k", []byte("v")), qdht.PutOptions{TTL: 2 * time.Hour}),
+		qdht.ErrRecordTTLTooLong)
+}
+
+func TestCancelledRequestsKeepContacts(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{K: 4})
+	peer := nodes[1].Self()
+	require.NotNil(t, nodes[0].Table().Find(peer.ID))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, nodes[0].Sync(ctx, peer, qdht.KeyRange{}))
+	require.NotNil(t, nodes[0].Table().Find(peer.ID), "A request the caller cancelled should not drop the contact.")
+}
+
+func TestCloseWaitsForMaintenance(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{K: 4, SweepInterval: time.Millisecond, SyncInterval: time.Millisecond, ReplicateInterval: time.Millisecond})
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("/app/busy", []byte("v"))))
+	time.Sleep(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for _, d := range nodes {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				require.NoError(t, d.Close(), "Closing should not fail, however often it is called.")
+			}()
+		}
+	}
+	wg.Wait()
+}
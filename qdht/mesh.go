@@ -0,0 +1,154 @@
+package qdht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"trustmesh/types"
+)
+
+// Handler answers qDHT RPCs. DHT is the usual implementation; simulations
+// plug in others to model misbehaving nodes.
+type Handler interface {
+	HandleMessage(ctx context.Context, msg *Message) (*Message, error)
+}
+
+// Mesh is an in-process network of DHT nodes. It implements Messenger by
+// calling the destination node's HandleMessage directly, and gives the nodes
+// it creates a BlockTransport calling the provider's Block.
+type Mesh struct {
+	mu       sync.RWMutex
+	nodes    map[types.NodeID]*DHT
+	handlers map[types.NodeID]Handler
+	groups   map[types.NodeID]int
+	next     int
+}
+
+// NewMesh creates an empty in-process network.
+func NewMesh() *Mesh {
+	return &Mesh{
+		nodes:    make(map[types.NodeID]*DHT),
+		handlers: make(map[types.NodeID]Handler),
+		groups:   make(map[types.NodeID]int),
+	}
+}
+
+// NewNode creates a DHT attached to the mesh. A signing key is generated and
+// a mesh address assigned when cfg does not provide them.
+func (m *Mesh) NewNode(cfg Config) (*DHT, error) {
+	if cfg.Key == nil {
+		key, err := NewPuzzleKey(cfg.StaticPuzzleBits)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Key = key
+	}
+
+	if cfg.Self == nil {
+		m.mu.Lock()
+		m.next++
+		cfg.Self = &types.Node{Host: "mesh", Port: fmt.Sprint(m.next)}
+		m.mu.Unlock()
+	}
+	cfg.Messenger = m
+	from := cfg.Self.ID
+	if from == (types.NodeID{}) {
+		from = types.NewNodeID(cfg.Key.PublicKeyBytes())
+	}
+	cfg.Blocks = meshBlocks{mesh: m, from: from}
+
+	d, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.Add(d)
+	return d, nil
+}
+
+// Add attaches an existing node to the mesh.
+func (m *Mesh) Add(d *DHT) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nodes[d.self.ID] = d
+	m.handlers[d.self.ID] = d
+}
+
+// AddHandler attaches h as the node with the given identifier.
+func (m *Mesh) AddHandler(id types.NodeID, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = h
+}
+
+// Remove detaches a node, making it unreachable.
+func (m *Mesh) Remove(id types.NodeID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.nodes, id)
+	delete(m.handlers, id)
+}
+
+// Partition splits the mesh so that nodes only reach nodes in their own
+// group. Nodes left out of every group form one more group.
+func (m *Mesh) Partition(groups ...[]types.NodeID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.groups = make(map[types.NodeID]int)
+	for i, group := range groups {
+		for _, id := range group {
+			m.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (m *Mesh) Heal() {
+	m.Partition()
+}
+
+// reachable reports whether from can currently reach to.
+func (m *Mesh) reachable(from, to types.NodeID) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.groups[from] == m.groups[to]
+}
+
+// Node returns the node with the given identifier.
+func (m *Mesh) Node(id types.NodeID) *DHT {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.nodes[id]
+}
+
+func (m *Mesh) Send(ctx context.Context, to *types.Node, msg *Message) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	dst := m.handlers[to.ID]
+	m.mu.RUnlock()
+	if dst == nil || (msg.Sender != nil && !m.reachable(msg.Sender.ID, to.ID)) {
+		return nil, ErrUnreachable
+	}
+
+	req := *msg
+	return dst.HandleMessage(ctx, &req)
+}
+
+// meshBlocks fetches blocks for the node from over the mesh.
+type meshBlocks struct {
+	mesh *Mesh
+	from types.NodeID
+}
+
+func (b meshBlocks) FetchBlock(ctx context.Context, provider *types.Node, c CID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dst := b.mesh.Node(provider.ID)
+	if dst == nil || !b.mesh.reachable(b.from, provider.ID) {
+		return nil, ErrUnreachable
+	}
+	return dst.Block(c)
+}
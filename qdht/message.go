@@ -0,0 +1,45 @@
+package qdht
+
+import (
+	"context"
+	"trustmesh/types"
+)
+
+// MessageType identifies a qDHT RPC.
+type MessageType uint8
+
+const (
+	MsgPing MessageType = iota
+	MsgFindNode
+	MsgFindValue
+	MsgStore
+	MsgAddProvider
+	MsgGetProviders
+	// MsgSyncSummary asks for the Merkle summaries of the requested ranges.
+	MsgSyncSummary
+	// MsgSyncRecords carries the sender's records in the requested ranges
+	// and is answered with the receiver's records the sender lacks.
+	MsgSyncRecords
+	// MsgRelay carries an onion for the receiver to peel and pass on.
+	MsgRelay
+)
+
+// Message is both the request and the response of every qDHT RPC.
+type Message struct {
+	Type      MessageType       `json:"type"`
+	Sender    *types.Node       `json:"sender,omitempty"`
+	Target    types.NodeID      `json:"target"`
+	Key       string            `json:"key,omitempty"`
+	Records   []*Record         `json:"records,omitempty"`
+	Closer    []*types.Node     `json:"closer,omitempty"`
+	Providers []*ProviderRecord `json:"providers,omitempty"`
+	Summaries []MerkleSummary   `json:"summaries,omitempty"`
+	Onion     []byte            `json:"onion,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// Messenger delivers a request to a remote node and returns its response.
+// Implementations call the remote DHT's HandleMessage.
+type Messenger interface {
+	Send(ctx context.Context, to *types.Node, msg *Message) (*Message, error)
+}
@@ -0,0 +1,297 @@
+package qdht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/goccy/go-json"
+	"math/rand"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+// DefaultCircuitLength is how many relays a circuit runs through.
+const DefaultCircuitLength = 3
+
+// pseudonymDomain separates the keys anonymous puts are signed with.
+const pseudonymDomain = "trustmesh/qdht/pseudonym/v1"
+
+// Circuit is a path of relays that anonymous requests are onion-routed
+// through. The first relay learns who is asking but not what; the last, the
+// exit, learns what is asked but not by whom.
+type Circuit struct {
+	Relays []*types.Node
+}
+
+// onionLayer is the part of an onion one relay can decrypt. Each layer is
+// sealed under a secret encapsulated to the relay's KEM key, and the relay
+// seals its part of the response under the same secret.
+type onionLayer struct {
+	// Next is the relay to pass Onion on to. It is nil at the exit.
+	Next  *types.Node `json:"next,omitempty"`
+	Onion []byte      `json:"onion,omitempty"`
+	// Request is what the exit performs on the requester's behalf.
+	Request *onionRequest `json:"request,omitempty"`
+}
+
+// onionRequest is an operation an exit relay performs for an anonymous
+// requester: MsgPing checks the circuit, MsgFindValue reads a key from the
+// DHT and MsgStore stores signed records in it.
+type onionRequest struct {
+	Type        MessageType `json:"type"`
+	Key         string      `json:"key,omitempty"`
+	Records     []*Record   `json:"records,omitempty"`
+	Quorum      int         `json:"quorum,omitempty"`
+	Replication int         `json:"replication,omitempty"`
+	Conflicts   bool        `json:"conflicts,omitempty"`
+}
+
+// onionResponse is the exit's answer, read only by the requester.
+type onionResponse struct {
+	Records []*Record `json:"records,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// BuildCircuit picks relays at random among the routing table contacts that
+// publish a KEM key, checks the path with a ping through it and makes it the
+// circuit anonymous requests use.
+func (d *DHT) BuildCircuit(ctx context.Context) (*Circuit, error) {
+	return d.buildCircuit(ctx, nil)
+}
+
+// buildCircuit is BuildCircuit choosing no relay of avoid.
+func (d *DHT) buildCircuit(ctx context.Context, avoid *Circuit) (*Circuit, error) {
+	var candidates []*types.Node
+	for _, n := range d.table.All() {
+		if n.PeerInfo.KEMKey() != nil && !avoid.has(n.ID) {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) < d.circuitLen {
+		return nil, ErrNoCircuit
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	c := &Circuit{Relays: candidates[:d.circuitLen]}
+	if _, err := d.roundTrip(ctx, c, &onionRequest{Type: MsgPing}); err != nil {
+		return nil, err
+	}
+
+	d.circuitMu.Lock()
+	d.circuit = c
+	d.circuitMu.Unlock()
+	return c, nil
+}
+
+// has reports whether id is a relay of c.
+func (c *Circuit) has(id types.NodeID) bool {
+	if c == nil {
+		return false
+	}
+	for _, r := range c.Relays {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// relay sends req through the node's circuit, building a fresh circuit when
+// there is none or the current one fails. A failed circuit's relays are left
+// out of its replacement rather than contacted to find the broken one, which
+// would show the later relays who the requester is.
+func (d *DHT) relay(ctx context.Context, req *onionRequest) (*onionResponse, error) {
+	var failed *Circuit
+	for attempt := 0; ; attempt++ {
+		d.circuitMu.Lock()
+		c := d.circuit
+		d.circuitMu.Unlock()
+
+		var err error
+		if c == nil {
+			c, err = d.buildCircuit(ctx, failed)
+			if errors.Is(err, ErrNoCircuit) && failed != nil {
+				// Too few other relays; the failed ones may have recovered.
+				c, err = d.buildCircuit(ctx, nil)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		resp, err := d.roundTrip(ctx, c, req)
+		if err == nil {
+			if resp.Error != "" {
+				return resp, remoteError(resp.Error)
+			}
+			return resp, nil
+		}
+
+		d.circuitMu.Lock()
+		if d.circuit == c {
+			d.circuit = nil
+		}
+		d.circuitMu.Unlock()
+		if attempt > 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		failed = c
+	}
+}
+
+// pseudonym returns the key the local node signs anonymous puts of key with.
+// It is derived from the node's key, so successive anonymous versions of a
+// key share a publisher, but storing nodes cannot link it to the node.
+func (d *DHT) pseudonym(key string) (*crypto.SigningKey, error) {
+	return d.key.Derive([]byte(pseudonymDomain + key))
+}
+
+// roundTrip wraps req in one layer per relay of c, sends the onion to the
+// first relay and unwraps the response layer by layer.
+func (d *DHT) roundTrip(ctx context.Context, c *Circuit, req *onionRequest) (*onionResponse, error) {
+	secrets := make([][]byte, len(c.Relays))
+	var onion []byte
+	for i := len(c.Relays) - 1; i >= 0; i-- {
+		layer := onionLayer{Request: req}
+		if i < len(c.Relays)-1 {
+			next := c.Relays[i+1]
+			layer = onionLayer{Next: &types.Node{ID: next.ID, Host: next.Host, Port: next.Port}, Onion: onion}
+		}
+		plain, err := json.Marshal(layer)
+		if err != nil {
+			return nil, err
+		}
+		secret, ct, err := crypto.Encapsulate(c.Relays[i].PeerInfo.KEMKey())
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := crypto.Seal(secret, plain)
+		if err != nil {
+			return nil, err
+		}
+		secrets[i], onion = secret, packOnion(ct, sealed)
+	}
+
+	resp, err := d.send(ctx, c.Relays[0], &Message{Type: MsgRelay, Onion: onion})
+	if err != nil {
+		return nil, err
+	}
+	reply := resp.Onion
+	for _, secret := range secrets {
+		if reply, err = crypto.Open(secret, reply); err != nil {
+			return nil, ErrInvalidOnion
+		}
+	}
+	var out onionResponse
+	if err := json.Unmarshal(reply, &out); err != nil {
+		return nil, ErrInvalidOnion
+	}
+	return &out, nil
+}
+
+// peel decrypts the local node's layer of an onion and either passes the
+// rest on or, at the exit, performs the request. The response is sealed for
+// the previous hop.
+func (d *DHT) peel(ctx context.Context, onion []byte) ([]byte, error) {
+	ct, sealed, ok := unpackOnion(onion)
+	if !ok {
+		return nil, ErrInvalidOnion
+	}
+	secret, err := d.kem.Decapsulate(ct)
+	if err != nil {
+		return nil, ErrInvalidOnion
+	}
+	plain, err := crypto.Open(secret, sealed)
+	if err != nil {
+		return nil, ErrInvalidOnion
+	}
+	var layer onionLayer
+	if err := json.Unmarshal(plain, &layer); err != nil {
+		return nil, ErrInvalidOnion
+	}
+
+	var reply []byte
+	switch {
+	case layer.Next != nil:
+		resp, err := d.send(ctx, layer.Next, &Message{Type: MsgRelay, Onion: layer.Onion})
+		if errors.Is(err, ErrInvalidOnion) || errors.Is(err, ErrRelayFailed) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, ErrRelayFailed
+		}
+		reply = resp.Onion
+	case layer.Request != nil:
+		if reply, err = json.Marshal(d.exit(ctx, layer.Request)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidOnion
+	}
+	return crypto.Seal(secret, reply)
+}
+
+// exit performs req as the last relay of a circuit.
+func (d *DHT) exit(ctx context.Context, req *onionRequest) *onionResponse {
+	resp := &onionResponse{}
+	var err error
+	switch req.Type {
+	case MsgPing:
+	case MsgFindValue:
+		resp.Records, err = d.GetRecords(ctx, req.Key, GetOptions{Quorum: req.Quorum, Conflicts: req.Conflicts})
+	case MsgStore:
+		for _, rec := range req.Records {
+			if err = d.PutRecord(ctx, rec, PutOptions{Replication: req.Replication, Quorum: req.Quorum}); err != nil {
+				break
+			}
+		}
+	default:
+		err = ErrUnknownMessage
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// getAnonymously reads key through the node's circuit and selects among the
+// versions the exit returns and the local ones.
+func (d *DHT) getAnonymously(ctx context.Context, key string, o GetOptions) ([]*Record, error) {
+	resp, err := d.relay(ctx, &onionRequest{Type: MsgFindValue, Key: key, Quorum: o.Quorum, Conflicts: true})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	now := d.now()
+	var valid []*Record
+	for _, rec := range d.localRecords(key) {
+		if d.validate(rec, now) == nil {
+			valid = append(valid, rec)
+		}
+	}
+	if resp != nil {
+		for _, rec := range resp.Records {
+			if rec.key == key && d.validate(rec, now) == nil {
+				valid = append(valid, rec)
+			}
+		}
+	}
+	return d.selectVersions(key, resolveVersions(valid, d.sharedKey(key)), o)
+}
+
+// packOnion frames a KEM ciphertext and the sealed layer it unlocks.
+func packOnion(ct, sealed []byte) []byte {
+	out := make([]byte, 2, 2+len(ct)+len(sealed))
+	binary.BigEndian.PutUint16(out, uint16(len(ct)))
+	return append(append(out, ct...), sealed...)
+}
+
+func unpackOnion(onion []byte) (ct, sealed []byte, ok bool) {
+	if len(onion) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(onion))
+	if len(onion) < 2+n {
+		return nil, nil, false
+	}
+	return onion[2 : 2+n], onion[2+n:], true
+}
@@ -0,0 +1,162 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"slices"
+	"sync"
+	"testing"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// keySpy records which nodes sent messages naming a key.
+type keySpy struct {
+	mu      sync.Mutex
+	senders map[types.NodeID]bool
+	key     string
+}
+
+// watch routes the node's messages through the spy.
+func (s *keySpy) watch(mesh *qdht.Mesh, d *qdht.DHT) {
+	mesh.AddHandler(d.Self().ID, spiedNode{d, s})
+}
+
+func (s *keySpy) saw(id types.NodeID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.senders[id]
+}
+
+type spiedNode struct {
+	d   *qdht.DHT
+	spy *keySpy
+}
+
+func (n spiedNode) HandleMessage(ctx context.Context, msg *qdht.Message) (*qdht.Message, error) {
+	if msg.Key == n.spy.key && msg.Sender != nil {
+		n.spy.mu.Lock()
+		n.spy.senders[msg.Sender.ID] = true
+		n.spy.mu.Unlock()
+	}
+	return n.d.HandleMessage(ctx, msg)
+}
+
+func TestAnonymousPutGet(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 10, qdht.Config{K: 4})
+	spy := &keySpy{senders: make(map[types.NodeID]bool), key: "/app/secret"}
+	for _, d := range nodes {
+		spy.watch(mesh, d)
+	}
+	writer, reader := nodes[1], nodes[8]
+	ctx := context.Background()
+
+	// An exit names the key on its requester's behalf, so neither node may
+	// be a relay of the other's circuit.
+	circuitAvoiding := func(d *qdht.DHT, other *qdht.DHT) {
+		for {
+			c, err := d.BuildCircuit(ctx)
+			require.NoError(t, err)
+			if !slices.ContainsFunc(c.Relays, func(n *types.Node) bool { return n.ID == other.Self().ID }) {
+				return
+			}
+		}
+	}
+	circuitAvoiding(writer, reader)
+	circuitAvoiding(reader, writer)
+
+	require.NoError(t, writer.Put(qdht.NewDataItem("/app/secret", []byte("hidden")), qdht.PutOptions{Anonymous: true}))
+	item, err := reader.Get("/app/secret", qdht.GetOptions{Anonymous: true})
+	require.NoError(t, err, "The record should be found through the circuit.")
+	require.Equal(t, []byte("hidden"), item.Value())
+	require.False(t, spy.saw(writer.Self().ID), "No node should see the writer store the key.")
+	require.False(t, spy.saw(reader.Self().ID), "No node should see the reader ask for the key.")
+
+	// The record is signed under a pseudonym, which later anonymous puts
+	// of the key share.
+	pseudonym := item.(*qdht.Record).PublisherID()
+	require.NotEqual(t, writer.Self().ID, pseudonym, "The record should not name its writer.")
+	require.NoError(t, writer.Put(qdht.NewDataItem("/app/secret", []byte("hidden v2")), qdht.PutOptions{Anonymous: true}))
+	recs, err := reader.GetRecords(ctx, "/app/secret", qdht.GetOptions{Anonymous: true, Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	require.Equal(t, []byte("hidden v2"), recs[0].Value())
+	require.Equal(t, pseudonym, recs[0].PublisherID())
+	require.False(t, spy.saw(writer.Self().ID))
+
+	_, err = reader.Get("/app/secret")
+	require.NoError(t, err)
+	require.True(t, spy.saw(reader.Self().ID), "A direct get reveals the reader.")
+
+	_, err = reader.Get("/app/missing", qdht.GetOptions{Anonymous: true})
+	require.ErrorIs(t, err, qdht.ErrNotFound, "The exit's errors should reach the requester.")
+}
+
+func TestCircuitRebuildsAfterRelayFailure(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 10, qdht.Config{K: 4})
+	ctx := context.Background()
+	require.NoError(t, nodes[2].Put(qdht.NewDataItem("/app/doc", []byte("v1"))))
+
+	c, err := nodes[0].BuildCircuit(ctx)
+	require.NoError(t, err)
+	require.Len(t, c.Relays, qdht.DefaultCircuitLength)
+	seen := map[types.NodeID]bool{nodes[0].Self().ID: true}
+	for _, r := range c.Relays {
+		require.False(t, seen[r.ID], "Relays should be distinct and exclude the requester.")
+		seen[r.ID] = true
+	}
+
+	// The requester must not contact the relays past the first itself,
+	// which would show them who it is.
+	contacted := &senderSpy{senders: make(map[types.NodeID]bool)}
+	for _, r := range c.Relays[1:] {
+		mesh.AddHandler(r.ID, spiedSender{findNode(nodes, r.ID), contacted})
+	}
+	mesh.Remove(c.Relays[1].ID)
+	item, err := nodes[0].Get("/app/doc", qdht.GetOptions{Anonymous: true})
+	require.NoError(t, err, "A broken circuit should be replaced.")
+	require.Equal(t, []byte("v1"), item.Value())
+	require.False(t, contacted.saw(nodes[0].Self().ID), "The failed circuit's later relays should not hear from the requester.")
+}
+
+// senderSpy records which nodes sent any message.
+type senderSpy struct {
+	mu      sync.Mutex
+	senders map[types.NodeID]bool
+}
+
+func (s *senderSpy) saw(id types.NodeID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.senders[id]
+}
+
+type spiedSender struct {
+	d   *qdht.DHT
+	spy *senderSpy
+}
+
+func (n spiedSender) HandleMessage(ctx context.Context, msg *qdht.Message) (*qdht.Message, error) {
+	if msg.Sender != nil {
+		n.spy.mu.Lock()
+		n.spy.senders[msg.Sender.ID] = true
+		n.spy.mu.Unlock()
+	}
+	return n.d.HandleMessage(ctx, msg)
+}
+
+func findNode(nodes []*qdht.DHT, id types.NodeID) *qdht.DHT {
+	for _, d := range nodes {
+		if d.Self().ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+func TestCircuitNeedsEnoughRelays(t *testing.T) {
+	_, nodes := newTestMesh(t, 3, qdht.Config{K: 4})
+
+	_, err := nodes[0].BuildCircuit(context.Background())
+	require.ErrorIs(t, err, qdht.ErrNoCircuit)
+}
@@ -0,0 +1,65 @@
+package qdht
+
+import "time"
+
+// PutOptions controls how a record is stored.
+type PutOptions struct {
+	// TTL is how long the record stays valid. Zero uses the node's RecordTTL.
+	TTL time.Duration
+	// Replication is how many of the closest nodes receive the record. Zero
+	// uses the bucket size k.
+	Replication int
+	// Quorum is how many of those nodes must accept the record for the put to
+	// succeed. Zero uses the node's WriteQuorum.
+	Quorum int
+	// Anonymous routes the put through an onion circuit, so the nodes
+	// storing the record cannot tell which node sent it. The record is
+	// signed with a pseudonym the node derives for the key rather than its
+	// own key, so anonymous and direct puts of a key are versioned as
+	// different publishers.
+	Anonymous bool
+}
+
+// GetOptions controls how a record is read.
+type GetOptions struct {
+	// Quorum is how many of the closest nodes must answer for the get to
+	// succeed. Zero uses the node's ReadQuorum.
+	Quorum int
+	// Conflicts returns every concurrent version of the key instead of the
+	// one its validator selects.
+	Conflicts bool
+	// Anonymous routes the get through an onion circuit. The circuit's exit
+	// relay reads the key on the requester's behalf and is left to repair
+	// the replicas.
+	Anonymous bool
+}
+
+// putOptions fills in defaults for the first of opts.
+func (d *DHT) putOptions(opts []PutOptions) PutOptions {
+	var o PutOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.TTL <= 0 {
+		o.TTL = d.ttl
+	}
+	if o.Replication <= 0 {
+		o.Replication = d.k
+	}
+	if o.Quorum <= 0 {
+		o.Quorum = d.writeQuorum
+	}
+	return o
+}
+
+// getOptions fills in defaults for the first of opts.
+func (d *DHT) getOptions(opts []GetOptions) GetOptions {
+	var o GetOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Quorum <= 0 {
+		o.Quorum = d.readQuorum
+	}
+	return o
+}
@@ -0,0 +1,364 @@
+package qdht
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+const providerDomain = "trustmesh/qdht/provider/v1"
+
+const (
+	// DefaultProviderTTL is how long a provider announcement stays valid.
+	DefaultProviderTTL = 24 * time.Hour
+	// DefaultProviderRepublish is how often a node re-announces what it provides.
+	DefaultProviderRepublish = 12 * time.Hour
+	// DefaultMaxProviders caps the announcements a node holds for one CID.
+	DefaultMaxProviders = 64
+)
+
+// BlockTransport fetches content blocks straight from the providers serving
+// them, apart from the RPCs a Messenger carries. Implementations ask the
+// provider's DHT for the block through Block.
+type BlockTransport interface {
+	FetchBlock(ctx context.Context, provider *types.Node, c CID) ([]byte, error)
+}
+
+// ProviderRecord announces that a node can serve a content block.
+type ProviderRecord struct {
+	CID       CID         `json:"cid"`
+	Provider  *types.Node `json:"provider"`
+	Expires   int64       `json:"expires"`
+	Signature []byte      `json:"signature"`
+}
+
+// newProviderRecord creates an announcement for c signed by key.
+func newProviderRecord(c CID, provider *types.Node, expires time.Time, key *crypto.SigningKey) (*ProviderRecord, error) {
+	pr := &ProviderRecord{CID: c, Provider: provider, Expires: expires.UnixNano()}
+	sig, err := key.Sign(pr.signingBytes())
+	if err != nil {
+		return nil, err
+	}
+	pr.Signature = sig
+	return pr, nil
+}
+
+// Verify checks that the announcement was signed by the provider it names.
+func (pr *ProviderRecord) Verify() error {
+	if pr.Provider == nil {
+		return ErrInvalidNode
+	}
+	pub := pr.Provider.PeerInfo.SigningKey()
+	if pub == nil || types.NewNodeID(pub) != pr.Provider.ID {
+		return ErrInvalidNode
+	}
+	return crypto.VerifySignature(pub, pr.signingBytes(), pr.Signature)
+}
+
+// Expired reports whether the announcement has expired at now.
+func (pr *ProviderRecord) Expired(now time.Time) bool {
+	return now.UnixNano() >= pr.Expires
+}
+
+func (pr *ProviderRecord) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(providerDomain)
+	buf.WriteByte(pr.CID.Codec)
+	buf.Write(pr.CID.Hash[:])
+	buf.Write(pr.Provider.ID[:])
+	writeBytes(&buf, []byte(pr.Provider.Host))
+	writeBytes(&buf, []byte(pr.Provider.Port))
+	binary.Write(&buf, binary.BigEndian, pr.Expires)
+	return buf.Bytes()
+}
+
+// providerBook holds the provider announcements a node is responsible for,
+// at most limit for each CID.
+type providerBook struct {
+	mu        sync.RWMutex
+	providers map[CID]map[types.NodeID]*ProviderRecord
+	limit     int
+}
+
+func newProviderBook(limit int) *providerBook {
+	return &providerBook{providers: make(map[CID]map[types.NodeID]*ProviderRecord), limit: limit}
+}
+
+// add records pr, replacing an older announcement from the same provider.
+// Once a CID has as many providers as the book holds, a new one replaces the
+// announcement closest to expiry, unless its own expires sooner.
+func (b *providerBook) add(pr *ProviderRecord) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	byNode, ok := b.providers[pr.CID]
+	if !ok {
+		byNode = make(map[types.NodeID]*ProviderRecord)
+		b.providers[pr.CID] = byNode
+	}
+	if cur, exists := byNode[pr.Provider.ID]; exists {
+		if pr.Expires > cur.Expires {
+			byNode[pr.Provider.ID] = pr
+		}
+		return
+	}
+	if len(byNode) >= b.limit {
+		var stalest *ProviderRecord
+		for _, cur := range byNode {
+			if stalest == nil || cur.Expires < stalest.Expires {
+				stalest = cur
+			}
+		}
+		if pr.Expires <= stalest.Expires {
+			return
+		}
+		delete(byNode, stalest.Provider.ID)
+	}
+	byNode[pr.Provider.ID] = pr
+}
+
+func (b *providerBook) get(c CID, now time.Time) []*ProviderRecord {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var out []*ProviderRecord
+	for _, pr := range b.providers[c] {
+		if !pr.Expired(now) {
+			out = append(out, pr)
+		}
+	}
+	return out
+}
+
+// sweep drops expired announcements.
+func (b *providerBook) sweep(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c, byNode := range b.providers {
+		for id, pr := range byNode {
+			if pr.Expired(now) {
+				delete(byNode, id)
+			}
+		}
+		if len(byNode) == 0 {
+			delete(b.providers, c)
+		}
+	}
+}
+
+// blockStore holds the blocks this node serves directly to requesters.
+type blockStore struct {
+	mu       sync.RWMutex
+	blocks   map[CID][]byte
+	provided map[CID]bool
+}
+
+func newBlockStore() *blockStore {
+	return &blockStore{blocks: make(map[CID][]byte), provided: make(map[CID]bool)}
+}
+
+func (s *blockStore) put(c CID, block []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks[c] = block
+}
+
+func (s *blockStore) get(c CID) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	block, ok := s.blocks[c]
+	return block, ok
+}
+
+// markProvided records a root this node announces.
+func (s *blockStore) markProvided(c CID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.provided[c] = true
+}
+
+func (s *blockStore) roots() []CID {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roots := make([]CID, 0, len(s.provided))
+	for c := range s.provided {
+		roots = append(roots, c)
+	}
+	return roots
+}
+
+// ProvideContent keeps data in the local block store and announces this node
+// as a provider of its root, instead of storing the blocks on other nodes.
+func (d *DHT) ProvideContent(ctx context.Context, data []byte) (CID, error) {
+	var root CID
+	err := d.buildDAG(data, func(c CID, block []byte) error {
+		d.blocks.put(c, block)
+		root = c
+		return nil
+	})
+	if err != nil {
+		return CID{}, err
+	}
+	return root, d.Provide(ctx, root)
+}
+
+// Provide announces this node as a provider of c on the nodes closest to it.
+// The announcement is republished until the DHT is closed.
+func (d *DHT) Provide(ctx context.Context, c CID) error {
+	if _, ok := d.blocks.get(c); !ok {
+		return ErrNotFound
+	}
+	d.blocks.markProvided(c)
+	return d.announce(ctx, c)
+}
+
+// announce signs a fresh provider record for c and sends it to the closest nodes.
+func (d *DHT) announce(ctx context.Context, c CID) error {
+	if d.key == nil {
+		return ErrNoSigningKey
+	}
+	pr, err := newProviderRecord(c, d.self, d.now().Add(d.providerTTL), d.key)
+	if err != nil {
+		return err
+	}
+	target := KeyID(c.Key())
+	closest, err := d.lookup(ctx, target, Message{Type: MsgFindNode, Target: target}, nil)
+	if err != nil {
+		return err
+	}
+	for _, n := range closest {
+		d.send(ctx, n, &Message{Type: MsgAddProvider, Providers: []*ProviderRecord{pr}})
+	}
+	return nil
+}
+
+// FindProviders streams up to n providers of c as the lookup discovers them.
+// The channel is closed when the lookup finishes or ctx is cancelled.
+func (d *DHT) FindProviders(ctx context.Context, c CID, n int) <-chan *types.Node {
+	if n <= 0 {
+		n = math.MaxInt
+	}
+	out := make(chan *types.Node)
+	go func() {
+		defer close(out)
+
+		found := make(map[types.NodeID]bool)
+		emit := func(from *types.Node, recs []*ProviderRecord) bool {
+			for _, pr := range recs {
+				if pr.CID != c || pr.Verify() != nil {
+					if from != nil {
+						d.record(from.ID, trust.InvalidResponse)
+					}
+					continue
+				}
+				if found[pr.Provider.ID] || pr.Expired(d.now()) {
+					continue
+				}
+				found[pr.Provider.ID] = true
+				select {
+				case out <- pr.Provider:
+				case <-ctx.Done():
+					return true
+				}
+				if len(found) >= n {
+					return true
+				}
+			}
+			return false
+		}
+
+		if emit(nil, d.providers.get(c, d.now())) {
+			return
+		}
+		target := KeyID(c.Key())
+		d.lookup(ctx, target, Message{Type: MsgGetProviders, Key: c.String(), Target: target}, func(from *types.Node, resp *Message) bool {
+			return emit(from, resp.Providers)
+		})
+	}()
+	return out
+}
+
+// FetchContent retrieves the content behind c directly from its providers,
+// moving on to the next provider whenever one fails to serve a valid block.
+func (d *DHT) FetchContent(ctx context.Context, c CID) ([]byte, error) {
+	if data, err := d.assemble(ctx, c, d.localBlock); err == nil {
+		return data, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lastErr := ErrNotFound
+	for provider := range d.FindProviders(ctx, c, d.k) {
+		if provider.ID == d.self.ID {
+			continue
+		}
+		data, err := d.assemble(ctx, c, func(ctx context.Context, c CID) ([]byte, error) {
+			return d.requestBlock(ctx, provider, c)
+		})
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Block returns a block this node serves from its local block store, as
+// block transports answer requests for it.
+func (d *DHT) Block(c CID) ([]byte, error) {
+	block, ok := d.blocks.get(c)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return block, nil
+}
+
+// localBlock serves a block from the local block store.
+func (d *DHT) localBlock(_ context.Context, c CID) ([]byte, error) {
+	return d.Block(c)
+}
+
+// requestBlock asks a provider for a single block over the block transport.
+func (d *DHT) requestBlock(ctx context.Context, provider *types.Node, c CID) ([]byte, error) {
+	if d.transfer == nil {
+		return nil, ErrNoBlockTransport
+	}
+	block, err := d.transfer.FetchBlock(ctx, provider, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Verify(block); err != nil {
+		d.record(provider.ID, trust.InvalidResponse)
+		return nil, err
+	}
+	return block, nil
+}
+
+// republishProviders re-announces every provided root every interval until
+// the DHT is closed.
+func (d *DHT) republishProviders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, c := range d.blocks.roots() {
+				ctx, cancel := d.opContext()
+				d.announce(ctx, c)
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package qdht_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+func collectProviders(ch <-chan *types.Node) []*types.Node {
+	var out []*types.Node
+	for n := range ch {
+		out = append(out, n)
+	}
+	return out
+}
+
+func TestProvideAndFetchContent(t *testing.T) {
+	_, nodes := newTestMesh(t, 12, qdht.Config{K: 4, ChunkSize: 128, MaxLinks: 4})
+	ctx := context.Background()
+
+	media := bytes.Repeat([]byte("frame-"), 500)
+	c, err := nodes[2].ProvideContent(ctx, media)
+	require.NoError(t, err)
+
+	providers := collectProviders(nodes[9].FindProviders(ctx, c, 5))
+	require.Len(t, providers, 1)
+	require.Equal(t, nodes[2].Self().ID, providers[0].ID)
+
+	got, err := nodes[9].FetchContent(ctx, c)
+	require.NoError(t, err, "Content should be fetched directly from the provider.")
+	require.Equal(t, media, got)
+
+	// A second provider shows up once it announces the same content.
+	_, err = nodes[4].ProvideContent(ctx, media)
+	require.NoError(t, err)
+	providers = collectProviders(nodes[7].FindProviders(ctx, c, 5))
+	require.Len(t, providers, 2)
+}
+
+func TestProviderRecordsExpire(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4, ProviderTTL: 100 * time.Millisecond, ProviderRepublish: -1})
+	ctx := context.Background()
+
+	c, err := nodes[1].ProvideContent(ctx, []byte("ephemeral"))
+	require.NoError(t, err)
+	require.Len(t, collectProviders(nodes[3].FindProviders(ctx, c, 1)), 1)
+
+	time.Sleep(150 * time.Millisecond)
+	require.Empty(t, collectProviders(nodes[3].FindProviders(ctx, c, 1)), "Unrefreshed announcements should age out.")
+}
+
+func TestProviderRecordsRepublish(t *testing.T) {
+	_, nodes := newTestMesh(t, 6, qdht.Config{K: 4, ProviderTTL: 150 * time.Millisecond, ProviderRepublish: 40 * time.Millisecond})
+	ctx := context.Background()
+
+	c, err := nodes[1].ProvideContent(ctx, []byte("long lived"))
+	require.NoError(t, err)
+
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, collectProviders(nodes[3].FindProviders(ctx, c, 1)), 1, "Republished announcements should stay live.")
+}
+
+func TestProvidersPerCIDAreCapped(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 6, qdht.Config{K: 4, ProviderRepublish: -1})
+	ctx := context.Background()
+
+	media := []byte("popular content")
+	var c qdht.CID
+	for _, n := range nodes[1:5] {
+		var err error
+		c, err = n.ProvideContent(ctx, media)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	getProviders := func(n *qdht.DHT) []*qdht.ProviderRecord {
+		resp, err := n.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgGetProviders, Key: c.String(), Sender: nodes[0].Self()})
+		require.NoError(t, err)
+		return resp.Providers
+	}
+	byProvider := make(map[types.NodeID]*qdht.ProviderRecord)
+	for _, n := range nodes {
+		for _, pr := range getProviders(n) {
+			byProvider[pr.Provider.ID] = pr
+		}
+	}
+	var recs []*qdht.ProviderRecord
+	for _, pr := range byProvider {
+		recs = append(recs, pr)
+	}
+	require.Len(t, recs, 4)
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Expires < recs[j].Expires })
+
+	book, err := mesh.NewNode(qdht.Config{K: 4, MaxProviders: 2, ProviderRepublish: -1})
+	require.NoError(t, err)
+	t.Cleanup(func() { book.Close() })
+	for _, pr := range []*qdht.ProviderRecord{recs[3], recs[0], recs[1], recs[2], recs[0]} {
+		_, err := book.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgAddProvider, Providers: []*qdht.ProviderRecord{pr}, Sender: nodes[0].Self()})
+		require.NoError(t, err)
+	}
+	var held []types.NodeID
+	for _, pr := range getProviders(book) {
+		held = append(held, pr.Provider.ID)
+	}
+	require.ElementsMatch(t, []types.NodeID{recs[2].Provider.ID, recs[3].Provider.ID}, held,
+		"Once a CID is full, new providers should evict the announcements closest to expiry.")
+}
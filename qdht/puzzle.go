@@ -0,0 +1,95 @@
+package qdht
+
+import (
+	"encoding/binary"
+	"github.com/zeebo/blake3"
+	"math/bits"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+// S/Kademlia ties node IDs to work so that flooding the network with
+// identities is expensive. The static puzzle requires BLAKE3 of the ID to
+// start with a number of zero bits; as the ID is the hash of the signing key,
+// solving it means generating keys until one fits. The dynamic puzzle
+// requires BLAKE3 of the ID and a counter to start with zero bits, and is
+// solved once per ID.
+
+// NewPuzzleKey generates signing keys until one yields a node ID that solves
+// the static puzzle of the given difficulty. Each extra bit doubles the
+// expected number of keys generated.
+func NewPuzzleKey(difficulty int) (*crypto.SigningKey, error) {
+	for {
+		key, err := crypto.NewSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		if staticWork(types.NewNodeID(key.PublicKeyBytes())) >= difficulty {
+			return key, nil
+		}
+	}
+}
+
+// SolvePuzzle returns the smallest counter solving the dynamic puzzle of the
+// given difficulty for id.
+func SolvePuzzle(id types.NodeID, difficulty int) uint64 {
+	var x uint64
+	for dynamicWork(id, x) < difficulty {
+		x++
+	}
+	return x
+}
+
+// VerifyPuzzle checks that n's ID is derived from its signing key and solves
+// both puzzles at the given difficulties.
+func VerifyPuzzle(n *types.Node, static, dynamic int) error {
+	pub := n.PeerInfo.SigningKey()
+	if pub == nil || types.NewNodeID(pub) != n.ID {
+		return ErrInvalidNode
+	}
+	if staticWork(n.ID) < static || dynamicWork(n.ID, n.Puzzle) < dynamic {
+		return ErrPuzzleFailed
+	}
+	return nil
+}
+
+// admissible reports whether n may enter the routing table and lookups: it
+// must not be graylisted and must solve the configured puzzles.
+func (d *DHT) admissible(n *types.Node) bool {
+	if d.graylisted(n) {
+		return false
+	}
+	if d.staticPuzzle <= 0 && d.dynamicPuzzle <= 0 {
+		return true
+	}
+	return VerifyPuzzle(n, d.staticPuzzle, d.dynamicPuzzle) == nil
+}
+
+// addContact records n as seen if it passes admission.
+func (d *DHT) addContact(n *types.Node) {
+	if d.admissible(n) {
+		d.table.Add(n)
+	}
+}
+
+func staticWork(id types.NodeID) int {
+	h := blake3.Sum256(id[:])
+	return leadingZeros(h[:])
+}
+
+func dynamicWork(id types.NodeID, x uint64) int {
+	var buf [len(types.NodeID{}) + 8]byte
+	copy(buf[:], id[:])
+	binary.BigEndian.PutUint64(buf[len(id):], x)
+	h := blake3.Sum256(buf[:])
+	return leadingZeros(h[:])
+}
+
+func leadingZeros(b []byte) int {
+	for i, c := range b {
+		if c != 0 {
+			return i*8 + bits.LeadingZeros8(c)
+		}
+	}
+	return len(b) * 8
+}
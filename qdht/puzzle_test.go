@@ -0,0 +1,49 @@
+package qdht_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+func TestPuzzleAdmission(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 4, qdht.Config{K: 4, DynamicPuzzleBits: 10})
+	for _, d := range nodes {
+		require.NoError(t, qdht.VerifyPuzzle(d.Self(), 0, 10), "Nodes should solve their own puzzle.")
+		require.Equal(t, 3, d.Table().Size(), "Puzzle solving nodes should admit each other.")
+	}
+
+	// A node that did no work is answered but never admitted.
+	lazy, err := mesh.NewNode(qdht.Config{K: 4})
+	require.NoError(t, err)
+	defer lazy.Close()
+	require.NoError(t, lazy.Join(qdht.NodeOf(nodes[0].Self())))
+	for _, d := range nodes {
+		require.Nil(t, d.Table().Find(lazy.Self().ID), "A node without a solution should not be admitted.")
+	}
+
+	// Neither is a node claiming an ID its key does not hash to.
+	forged := *nodes[1].Self()
+	forged.ID = types.NodeID{1}
+	require.ErrorIs(t, qdht.VerifyPuzzle(&forged, 0, 0), qdht.ErrInvalidNode)
+}
+
+func TestStaticPuzzle(t *testing.T) {
+	key, err := qdht.NewPuzzleKey(2)
+	require.NoError(t, err)
+	_, err = qdht.New(qdht.Config{Self: &types.Node{}, Key: key, Messenger: qdht.NewMesh(), StaticPuzzleBits: 2})
+	require.NoError(t, err, "A key from NewPuzzleKey should solve the static puzzle.")
+
+	for {
+		key, err = crypto.NewSigningKey()
+		require.NoError(t, err)
+		self := &types.Node{ID: types.NewNodeID(key.PublicKeyBytes()), PeerInfo: &types.Peer{Keys: [][]byte{key.PublicKeyBytes()}}}
+		if qdht.VerifyPuzzle(self, 2, 0) != nil {
+			break
+		}
+	}
+	_, err = qdht.New(qdht.Config{Self: &types.Node{}, Key: key, Messenger: qdht.NewMesh(), StaticPuzzleBits: 2})
+	require.ErrorIs(t, err, qdht.ErrPuzzleFailed)
+}
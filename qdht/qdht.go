@@ -21,10 +21,10 @@ type QDHT interface {
 	Leave(node Node) error
 
 	// Put stores a data item in the qDHT.
-	Put(item DataItem) error
+	Put(item DataItem, opts ...PutOptions) error
 
 	// Get retrieves a data item from the qDHT by its key.
-	Get(key string) (DataItem, error)
+	Get(key string, opts ...GetOptions) (DataItem, error)
 
 	// Remove deletes a data item from the qDHT by its key.
 	Remove(key string) error
@@ -42,6 +42,11 @@ type SimpleNode struct {
 	address string
 }
 
+// NewSimpleNode creates a Node from a hex node ID and a host:port address.
+func NewSimpleNode(id, address string) SimpleNode {
+	return SimpleNode{id: id, address: address}
+}
+
 func (n SimpleNode) ID() string {
 	return n.id
 }
@@ -55,6 +60,11 @@ type SimpleDataItem struct {
 	value []byte
 }
 
+// NewDataItem creates a DataItem holding value under key.
+func NewDataItem(key string, value []byte) SimpleDataItem {
+	return SimpleDataItem{key: key, value: value}
+}
+
 func (d SimpleDataItem) Key() string {
 	return d.key
 }
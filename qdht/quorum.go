@@ -0,0 +1,154 @@
+package qdht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// replicaView is what one replica returned for a key during a read.
+type replicaView struct {
+	node *types.Node
+	recs []*Record
+}
+
+// holds reports whether the replica returned rec or a version superseding it.
+func (v *replicaView) holds(rec *Record, shared bool) bool {
+	for _, have := range v.recs {
+		if have == rec || supersedes(have, rec, shared) {
+			return true
+		}
+		if have.PublisherID() == rec.PublisherID() && have.seq == rec.seq && !rec.expires.After(have.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRecords reads key from the closest nodes and returns its latest version.
+// Versions are ordered by their vector clocks, or by sequence number for
+// records published without one. Replicas found holding superseded versions
+// are repaired before GetRecords returns. With GetOptions.Conflicts set,
+// every concurrent version is returned instead of the one the key's
+// validator selects.
+func (d *DHT) GetRecords(ctx context.Context, key string, opts ...GetOptions) ([]*Record, error) {
+	o := d.getOptions(opts)
+	if o.Anonymous {
+		return d.getAnonymously(ctx, key, o)
+	}
+	now := d.now()
+
+	var views []*replicaView
+	var valid []*Record
+	collect := func(n *types.Node, recs []*Record) {
+		view := &replicaView{node: n}
+		for _, rec := range recs {
+			if rec.key != key {
+				d.record(n.ID, trust.InvalidResponse)
+				continue
+			}
+			if err := d.validate(rec, now); err != nil {
+				// Expiry may just be clock skew; anything else is a bad
+				// answer.
+				if !errors.Is(err, ErrRecordExpired) {
+					d.record(n.ID, trust.InvalidResponse)
+				}
+				continue
+			}
+			view.recs = append(view.recs, rec)
+			valid = append(valid, rec)
+		}
+		views = append(views, view)
+	}
+
+	answered := 0
+	if local := d.localRecords(key); len(local) > 0 {
+		collect(d.self, local)
+		answered++
+	}
+	target := KeyID(key)
+	closest, err := d.lookup(ctx, target, Message{Type: MsgFindValue, Key: key, Target: target}, func(n *types.Node, resp *Message) bool {
+		collect(n, resp.Records)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	answered += len(closest)
+	if o.Quorum > 0 && answered < o.Quorum {
+		return nil, fmt.Errorf("%w: %d of %d replicas answered", ErrQuorumNotMet, answered, o.Quorum)
+	}
+
+	shared := d.sharedKey(key)
+	latest := resolveVersions(valid, shared)
+	d.repair(ctx, latest, views, closest, shared)
+	return d.selectVersions(key, latest, o)
+}
+
+// selectVersions returns the live records among the latest versions of key:
+// all of them with o.Conflicts set, else the one the validator selects.
+func (d *DHT) selectVersions(key string, latest []*Record, o GetOptions) ([]*Record, error) {
+	var live []*Record
+
+	for _, rec := range latest {
+		if len(rec.value) > tombstoneValueLen {
+			live = append(live, rec)
+		}
+	}
+	if len(live) == 0 {
+		return nil, ErrNotFound
+	}
+	if o.Conflicts {
+		return live, nil
+	}
+	idx, err := d.validatorFor(key).Select(key, latest)
+	if err != nil {
+		return nil, err
+	}
+	if len(latest[idx].value) == tombstoneValueLen {
+		return nil, ErrNotFound
+	}
+	return latest[idx : idx+1], nil
+}
+
+// repair sends the latest versions to the replicas among closest, and the
+// local node, that answered the read without them.
+func (d *DHT) repair(ctx context.Context, latest []*Record, views []*replicaView, closest []*types.Node, shared bool) {
+	replicas := map[types.NodeID]bool{d.self.ID: true}
+	for _, n := range closest {
+		replicas[n.ID] = true
+	}
+
+	type push struct {
+		node *types.Node
+		recs []*Record
+	}
+	var pushes []push
+	for _, view := range views {
+		if !replicas[view.node.ID] {
+			continue
+		}
+		var missing []*Record
+		for _, rec := range latest {
+			if !view.holds(rec, shared) {
+				missing = append(missing, rec)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if view.node.ID == d.self.ID {
+			for _, rec := range missing {
+				d.records.Put(rec)
+			}
+			continue
+		}
+		pushes = append(pushes, push{view.node, missing})
+	}
+	d.fanOut(len(pushes), func(i int) {
+		p := pushes[i]
+		d.send(ctx, p.node, &Message{Type: MsgStore, Key: p.recs[0].key, Records: p.recs})
+	})
+}
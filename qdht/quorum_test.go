@@ -0,0 +1,169 @@
+package qdht_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+	"trustmesh/types"
+)
+
+// sharedValidator lets the publishers of a namespace supersede each other.
+type sharedValidator struct {
+	qdht.DefaultValidator
+}
+
+func (sharedValidator) Shared(string) bool { return true }
+
+// shareNamespace registers sharedValidator for ns on every node.
+func shareNamespace(nodes []*qdht.DHT, ns string) {
+	for _, d := range nodes {
+		d.RegisterValidator(ns, sharedValidator{})
+	}
+}
+
+func TestLaterWriterSupersedesAcrossPublishers(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4})
+	shareNamespace(nodes, "app")
+
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/app/doc", []byte("draft"))))
+	require.NoError(t, nodes[6].Put(qdht.NewDataItem("/app/doc", []byte("edited"))))
+
+	recs, err := nodes[3].GetRecords(context.Background(), "/app/doc", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 1, "A write that saw the previous version should not conflict with it.")
+	require.Equal(t, []byte("edited"), recs[0].Value())
+	require.Equal(t, qdht.After, recs[0].Clock().Compare(qdht.VectorClock{nodes[1].Self().ID.String(): 1}))
+}
+
+func TestConcurrentVersionsConflict(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4})
+	shareNamespace(nodes, "app")
+	ctx := context.Background()
+
+	// Two writers that never saw each other's version.
+	for _, value := range []string{"left", "right"} {
+		key, err := crypto.NewSigningKey()
+		require.NoError(t, err)
+		rec := qdht.NewRecord("/app/doc", []byte(value), 1, time.Now().Add(time.Hour))
+		require.NoError(t, rec.Sign(key))
+		require.NoError(t, nodes[0].PutRecord(ctx, rec))
+	}
+
+	recs, err := nodes[5].GetRecords(ctx, "/app/doc", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 2, "Concurrent versions should all be returned.")
+
+	first, err := nodes[5].GetRecord(ctx, "/app/doc")
+	require.NoError(t, err)
+	second, err := nodes[2].GetRecord(ctx, "/app/doc")
+	require.NoError(t, err)
+	require.Equal(t, first.Value(), second.Value(), "Every node should select the same version.")
+
+	// A write that read both versions resolves the conflict.
+	require.NoError(t, nodes[3].Put(qdht.NewDataItem("/app/doc", []byte("merged"))))
+	recs, err = nodes[7].GetRecords(ctx, "/app/doc", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	require.Equal(t, []byte("merged"), recs[0].Value())
+}
+
+func TestInflatedClockCannotSupersedeOtherPublisher(t *testing.T) {
+	_, nodes := newTestMesh(t, 8, qdht.Config{K: 4})
+	ctx := context.Background()
+	victim := nodes[1]
+	require.NoError(t, victim.Put(qdht.NewDataItem("/app/doc", []byte("mine"))))
+	holding := func() int {
+		n := 0
+		for _, d := range nodes {
+			resp, err := d.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgFindValue, Key: "/app/doc"})
+			require.NoError(t, err)
+			for _, rec := range resp.Records {
+				if string(rec.Value()) == "mine" {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	held := holding()
+	require.Greater(t, held, 0)
+
+	// The attacker claims to follow a far later version of the victim's.
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	attacker := types.NewNodeID(key.PublicKeyBytes())
+	wire, err := json.Marshal(map[string]any{
+		"key":     "/app/doc",
+		"value":   []byte("theirs"),
+		"seq":     1,
+		"expires": time.Now().Add(time.Hour).UnixNano(),
+		"clock":   qdht.VectorClock{victim.Self().ID.String(): 100, attacker.String(): 1},
+	})
+	require.NoError(t, err)
+	var forged qdht.Record
+	require.NoError(t, json.Unmarshal(wire, &forged))
+	require.NoError(t, forged.Sign(key))
+	require.NoError(t, nodes[5].PutRecord(ctx, &forged))
+
+	require.Equal(t, held, holding(), "Replicas should keep the victim's record.")
+	recs, err := nodes[6].GetRecords(ctx, "/app/doc", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	require.Len(t, recs, 2, "The victim's record should survive the attacker's inflated clock.")
+
+	// The victim can still publish over its own record.
+	require.NoError(t, victim.Put(qdht.NewDataItem("/app/doc", []byte("mine again"))))
+	recs, err = nodes[6].GetRecords(ctx, "/app/doc", qdht.GetOptions{Conflicts: true})
+	require.NoError(t, err)
+	var values []string
+	for _, rec := range recs {
+		values = append(values, string(rec.Value()))
+	}
+	require.ElementsMatch(t, []string{"mine again", "theirs"}, values)
+}
+
+func TestReadQuorum(t *testing.T) {
+	_, nodes := newTestMesh(t, 4, qdht.Config{K: 4, ReadQuorum: 3})
+
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("k", []byte("v"))))
+	_, err := nodes[1].Get("k")
+	require.NoError(t, err)
+
+	_, err = nodes[1].GetRecords(context.Background(), "k", qdht.GetOptions{Quorum: 6})
+	require.ErrorIs(t, err, qdht.ErrQuorumNotMet, "A quorum larger than the network cannot be met.")
+}
+
+func TestReadRepairsStaleReplicas(t *testing.T) {
+	_, nodes := newTestMesh(t, 5, qdht.Config{K: 4})
+	ctx := context.Background()
+
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("k", []byte("v1"))))
+	// The second version reaches a single replica.
+	require.NoError(t, nodes[0].Put(qdht.NewDataItem("k", []byte("v2")), qdht.PutOptions{Replication: 1}))
+
+	stale := 0
+	for _, d := range nodes {
+		resp, err := d.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgFindValue, Key: "k"})
+		require.NoError(t, err)
+		for _, rec := range resp.Records {
+			if rec.Seq() == 1 {
+				stale++
+			}
+		}
+	}
+	require.Greater(t, stale, 0, "Some replicas should still hold the first version.")
+
+	item, err := nodes[4].Get("k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), item.Value())
+
+	for i, d := range nodes {
+		resp, err := d.HandleMessage(ctx, &qdht.Message{Type: qdht.MsgFindValue, Key: "k"})
+		require.NoError(t, err)
+		require.Len(t, resp.Records, 1, "Node %d should hold a single version.", i)
+		require.Equal(t, []byte("v2"), resp.Records[0].Value(), "Node %d should have been repaired.", i)
+	}
+}
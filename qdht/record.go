@@ -0,0 +1,165 @@
+package qdht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/goccy/go-json"
+	"strings"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+const recordDomain = "trustmesh/qdht/record/v1"
+
+// MaxRecordValueSize bounds the value carried by a single record.
+const MaxRecordValueSize = 1 << 20
+
+// Record is the signed, versioned envelope every value is stored in. Records
+// are immutable once signed and may be shared between goroutines.
+type Record struct {
+	key       string
+	value     []byte
+	publisher []byte
+	seq       uint64
+	expires   time.Time
+	clock     VectorClock
+	signature []byte
+}
+
+// recordWire is the serialised form of a Record.
+type recordWire struct {
+	Key       string      `json:"key"`
+	Value     []byte      `json:"value"`
+	Publisher []byte      `json:"publisher"`
+	Seq       uint64      `json:"seq"`
+	Expires   int64       `json:"expires"`
+	Clock     VectorClock `json:"clock,omitempty"`
+	Signature []byte      `json:"signature"`
+}
+
+// NewRecord creates an unsigned record.
+func NewRecord(key string, value []byte, seq uint64, expires time.Time) *Record {
+	return &Record{key: key, value: value, seq: seq, expires: expires}
+}
+
+func (r *Record) Key() string {
+	return r.key
+}
+
+func (r *Record) Value() []byte {
+	return r.value
+}
+
+// Publisher returns the Falcon public key of the record's publisher.
+func (r *Record) Publisher() []byte {
+	return r.publisher
+}
+
+// PublisherID returns the NodeID of the record's publisher.
+func (r *Record) PublisherID() types.NodeID {
+	return types.NewNodeID(r.publisher)
+}
+
+// Seq returns the record's sequence number.
+func (r *Record) Seq() uint64 {
+	return r.seq
+}
+
+// Expires returns the time after which the record is no longer valid.
+func (r *Record) Expires() time.Time {
+	return r.expires
+}
+
+// Clock returns the versions of the key this record causally follows.
+func (r *Record) Clock() VectorClock {
+	return r.clock
+}
+
+// Signature returns the publisher's signature over the record.
+func (r *Record) Signature() []byte {
+	return r.signature
+}
+
+// Expired reports whether the record has expired at now.
+func (r *Record) Expired(now time.Time) bool {
+	return !now.Before(r.expires)
+}
+
+// Sign sets the publisher to key's public key and signs the record.
+func (r *Record) Sign(key *crypto.SigningKey) error {
+	r.publisher = key.PublicKeyBytes()
+	sig, err := key.Sign(r.signingBytes())
+	if err != nil {
+		return err
+	}
+	r.signature = sig
+	return nil
+}
+
+// Verify checks the publisher's signature.
+func (r *Record) Verify() error {
+	if len(r.signature) == 0 {
+		return ErrRecordUnsigned
+	}
+	return crypto.VerifySignature(r.publisher, r.signingBytes(), r.signature)
+}
+
+// signingBytes is the domain separated encoding covered by the signature.
+func (r *Record) signingBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(recordDomain)
+	writeBytes(&buf, []byte(r.key))
+	writeBytes(&buf, r.value)
+	binary.Write(&buf, binary.BigEndian, r.seq)
+	binary.Write(&buf, binary.BigEndian, r.expires.UnixNano())
+	r.clock.encode(&buf)
+	return buf.Bytes()
+}
+
+func (r *Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&recordWire{
+		Key:       r.key,
+		Value:     r.value,
+		Publisher: r.publisher,
+		Seq:       r.seq,
+		Expires:   r.expires.UnixNano(),
+		Clock:     r.clock,
+		Signature: r.signature,
+	})
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var w recordWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	*r = Record{
+		key:       w.Key,
+		value:     w.Value,
+		publisher: w.Publisher,
+		seq:       w.Seq,
+		expires:   time.Unix(0, w.Expires),
+		clock:     w.Clock,
+		signature: w.Signature,
+	}
+	return nil
+}
+
+// Namespace returns the namespace of a key: the first path segment of keys
+// of the form "/namespace/rest", or "" for keys without one.
+func Namespace(key string) string {
+	if !strings.HasPrefix(key, "/") {
+		return ""
+	}
+	ns, _, found := strings.Cut(key[1:], "/")
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
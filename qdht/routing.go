@@ -0,0 +1,150 @@
+package qdht
+
+import (
+	"sync"
+	"trustmesh/types"
+)
+
+// RoutingTable is a Kademlia routing table. Buckets are indexed by the
+// length of the prefix a contact shares with the local node, and each bucket
+// is ordered from least to most recently seen.
+type RoutingTable struct {
+	mu           sync.RWMutex
+	self         types.NodeID
+	k            int
+	buckets      types.NBucket
+	replacements types.NBucket
+}
+
+// NewRoutingTable creates an empty table for self with buckets of size k.
+func NewRoutingTable(self types.NodeID, k int) *RoutingTable {
+	return &RoutingTable{
+		self:         self,
+		k:            k,
+		buckets:      make(types.NBucket),
+		replacements: make(types.NBucket),
+	}
+}
+
+// Self returns the local node identifier.
+func (rt *RoutingTable) Self() types.NodeID {
+	return rt.self
+}
+
+// Add records a contact as recently seen. When its bucket is full the
+// contact is kept in the bucket's replacement cache and false is returned.
+func (rt *RoutingTable) Add(n *types.Node) bool {
+	if n == nil || n.ID == rt.self {
+		return false
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	idx := rt.bucketIndex(n.ID)
+	bucket := rt.buckets[idx]
+	if i := indexOf(bucket, n.ID); i >= 0 {
+		bucket = append(bucket[:i], bucket[i+1:]...)
+		rt.buckets[idx] = append(bucket, n)
+		return true
+	}
+	if len(bucket) < rt.k {
+		rt.buckets[idx] = append(bucket, n)
+		return true
+	}
+
+	repl := rt.replacements[idx]
+	if i := indexOf(repl, n.ID); i >= 0 {
+		repl = append(repl[:i], repl[i+1:]...)
+	}
+	repl = append(repl, n)
+	if len(repl) > rt.k {
+		repl = repl[1:]
+	}
+	rt.replacements[idx] = repl
+	return false
+}
+
+// Remove drops a contact, promoting the freshest replacement in its place.
+func (rt *RoutingTable) Remove(id types.NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	idx := rt.bucketIndex(id)
+	bucket := rt.buckets[idx]
+	i := indexOf(bucket, id)
+	if i < 0 {
+		return
+	}
+	bucket = append(bucket[:i], bucket[i+1:]...)
+
+	if repl := rt.replacements[idx]; len(repl) > 0 {
+		bucket = append(bucket, repl[len(repl)-1])
+		rt.replacements[idx] = repl[:len(repl)-1]
+	}
+	if len(bucket) == 0 {
+		delete(rt.buckets, idx)
+	} else {
+		rt.buckets[idx] = bucket
+	}
+}
+
+// Find returns the contact with the given identifier, if present.
+func (rt *RoutingTable) Find(id types.NodeID) *types.Node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	bucket := rt.buckets[rt.bucketIndex(id)]
+	if i := indexOf(bucket, id); i >= 0 {
+		return bucket[i]
+	}
+	return nil
+}
+
+// Closest returns up to count contacts ordered by distance to target.
+func (rt *RoutingTable) Closest(target types.NodeID, count int) []*types.Node {
+	all := rt.All()
+	SortByDistance(all, target)
+	if len(all) > count {
+		all = all[:count]
+	}
+	return all
+}
+
+// All returns every contact in the table.
+func (rt *RoutingTable) All() []*types.Node {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var all []*types.Node
+	for _, bucket := range rt.buckets {
+		all = append(all, bucket...)
+	}
+	return all
+}
+
+// Size returns the number of contacts in the table.
+func (rt *RoutingTable) Size() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	size := 0
+	for _, bucket := range rt.buckets {
+		size += len(bucket)
+	}
+	return size
+}
+
+// bucketIndex returns the bucket a contact belongs in.
+func (rt *RoutingTable) bucketIndex(id types.NodeID) int32 {
+	return int32(CommonPrefixLen(rt.self, id))
+}
+
+func indexOf(nodes []*types.Node, id types.NodeID) int {
+	for i, n := range nodes {
+		if n.ID == id {
+			return i
+		}
+	}
+	return -1
+}
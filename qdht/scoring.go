@@ -0,0 +1,42 @@
+package qdht
+
+import (
+	"time"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// Scorer rates other nodes by how they answer. Graylisted nodes are kept out
+// of the routing table and lookups, and nodes with a negative score are
+// queried only once the better ones are exhausted. trust.Engine implements
+// it.
+type Scorer interface {
+	Score(id types.NodeID) float64
+	Graylisted(id types.NodeID) bool
+	Record(id types.NodeID, ev trust.Event)
+	ObserveLatency(id types.NodeID, rtt time.Duration)
+}
+
+var _ Scorer = (*trust.Engine)(nil)
+
+// record reports ev against id, dropping id from the routing table if it is
+// now graylisted.
+func (d *DHT) record(id types.NodeID, ev trust.Event) {
+	if d.scorer == nil || id == d.self.ID {
+		return
+	}
+	d.scorer.Record(id, ev)
+	if d.scorer.Graylisted(id) {
+		d.table.Remove(id)
+	}
+}
+
+// graylisted reports whether n must be ignored.
+func (d *DHT) graylisted(n *types.Node) bool {
+	return d.scorer != nil && d.scorer.Graylisted(n.ID)
+}
+
+// preferred reports whether n should be queried ahead of nodes that are not.
+func (d *DHT) preferred(n *types.Node) bool {
+	return d.scorer == nil || d.scorer.Score(n.ID) >= 0
+}
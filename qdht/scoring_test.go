@@ -0,0 +1,96 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/qdht"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// liar answers value lookups with an unsigned forgery.
+type liar struct {
+	d *qdht.DHT
+}
+
+func (l liar) HandleMessage(ctx context.Context, msg *qdht.Message) (*qdht.Message, error) {
+	resp, err := l.d.HandleMessage(ctx, msg)
+	if err == nil && msg.Type == qdht.MsgFindValue {
+		resp.Records = []*qdht.Record{qdht.NewRecord(msg.Key, []byte("forged"), 99, time.Now().Add(time.Hour))}
+	}
+	return resp, err
+}
+
+func TestScorerGraylistsLyingReplicas(t *testing.T) {
+	scores := trust.NewEngine(trust.Config{})
+	mesh, nodes := newTestMesh(t, 8, qdht.Config{K: 4, Scorer: scores})
+	reader := nodes[0]
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/app/k", []byte("v"))))
+
+	// The replica closest to the key lies, so every read asks it.
+	closest, err := reader.FindNode(context.Background(), qdht.KeyID("/app/k"))
+	require.NoError(t, err)
+	bad := closest[0]
+	for _, d := range nodes {
+		if d.Self().ID == bad.ID {
+			mesh.AddHandler(bad.ID, liar{d})
+		}
+	}
+
+	for i := 0; i < 20 && !scores.Graylisted(bad.ID); i++ {
+		item, err := reader.Get("/app/k")
+		require.NoError(t, err)
+		require.Equal(t, []byte("v"), item.Value(), "Forgeries should never be returned.")
+	}
+	require.True(t, scores.Graylisted(bad.ID), "Repeated forgeries should graylist the replica.")
+
+	found, err := reader.FindNode(context.Background(), qdht.KeyID("/app/k"))
+	require.NoError(t, err)
+	require.NotContains(t, ids(found), bad.ID, "Lookups should skip graylisted nodes.")
+	require.NotContains(t, ids(reader.Table().Closest(bad.ID, 8)), bad.ID, "Graylisted nodes should leave the routing table.")
+}
+
+func ids(nodes []*types.Node) []types.NodeID {
+	out := make([]types.NodeID, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.ID
+	}
+	return out
+}
+
+// refuser answers every sync request with an error reply.
+type refuser struct {
+	d      *qdht.DHT
+	reason string
+}
+
+func (r refuser) HandleMessage(ctx context.Context, msg *qdht.Message) (*qdht.Message, error) {
+	if msg.Type != qdht.MsgSyncSummary {
+		return r.d.HandleMessage(ctx, msg)
+	}
+	return &qdht.Message{Type: msg.Type, Sender: r.d.Self(), Error: r.reason}, nil
+}
+
+func TestErrorRepliesEarnNoCredit(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 3, qdht.Config{K: 4})
+	// A stopped clock keeps scores from decaying between samples.
+	now := time.Now()
+	scores := trust.NewEngine(trust.Config{Now: func() time.Time { return now }})
+	reader, err := mesh.NewNode(qdht.Config{K: 4, Scorer: scores})
+	require.NoError(t, err)
+	t.Cleanup(func() { reader.Close() })
+	require.NoError(t, reader.Join(qdht.NodeOf(nodes[0].Self())))
+
+	mesh.AddHandler(nodes[1].Self().ID, refuser{nodes[1], qdht.ErrSyncTooLarge.Error()})
+	mesh.AddHandler(nodes[2].Self().ID, refuser{nodes[2], "whatever"})
+	refusing, babbling := scores.Score(nodes[1].Self().ID), scores.Score(nodes[2].Self().ID)
+
+	ctx := context.Background()
+	require.ErrorIs(t, reader.Sync(ctx, nodes[1].Self(), qdht.KeyRange{}), qdht.ErrSyncTooLarge)
+	require.Error(t, reader.Sync(ctx, nodes[2].Self(), qdht.KeyRange{}))
+	require.Equal(t, refusing, scores.Score(nodes[1].Self().ID),
+		"Errors the protocol defines should neither earn nor cost trust.")
+	require.Less(t, scores.Score(nodes[2].Self().ID), babbling, "Undefined errors should count against the node.")
+}
@@ -0,0 +1,747 @@
+package qdht
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultSimLookupInterval is how often a simulation runs a lookup.
+	DefaultSimLookupInterval = time.Minute
+	// DefaultSimCheckInterval is how often a simulation measures data
+	// availability.
+	DefaultSimCheckInterval = 10 * time.Minute
+)
+
+// simEpoch is where simulated time starts, so that runs do not depend on
+// the wall clock.
+var simEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Distribution draws durations, such as session lengths.
+type Distribution func(rng *rand.Rand) time.Duration
+
+// Exponential draws durations with the given mean, as the gaps between
+// Poisson arrivals are.
+func Exponential(mean time.Duration) Distribution {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+}
+
+// Pareto draws heavy-tailed durations of at least scale, which models
+// measured peer-to-peer session lengths better than Exponential.
+func Pareto(scale time.Duration, shape float64) Distribution {
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(float64(scale) / math.Pow(1-rng.Float64(), 1/shape))
+	}
+}
+
+// ChurnModel describes how nodes come and go.
+type ChurnModel struct {
+	// Session draws how long each node stays online before it leaves for
+	// good, losing what it stored. Nil keeps nodes online.
+	Session Distribution
+	// Arrivals draws the time between new nodes joining. Nil lets none join.
+	Arrivals Distribution
+}
+
+// Behavior is how an adversarial node misbehaves.
+type Behavior int
+
+const (
+	// Honest nodes run the DHT as it is.
+	Honest Behavior = iota
+	// Drop nodes answer nothing.
+	Drop
+	// Eclipse nodes answer lookups with their colluders, hiding honest
+	// nodes, and never serve values.
+	Eclipse
+	// Blackhole nodes route honestly but silently discard the records they
+	// are asked to store and never serve values.
+	Blackhole
+)
+
+// AdversaryModel describes the attacker's share of the network.
+type AdversaryModel struct {
+	// Fraction of the nodes, initial and arriving, that misbehave.
+	Fraction float64
+	// Behavior is how they misbehave.
+	Behavior Behavior
+}
+
+// GeoModel places nodes in regions with known round-trip times.
+type GeoModel struct {
+	// Regions names the regions.
+	Regions []string
+	// RTT[i][j] is the round trip between a node in region i and one in
+	// region j.
+	RTT [][]time.Duration
+	// Weights shares nodes out between the regions. Nil spreads them evenly.
+	Weights []float64
+}
+
+// SimConfig describes a simulation.
+type SimConfig struct {
+	// Nodes is the initial size of the network.
+	Nodes int
+	// K, Alpha and Lookup configure every node as in Config.
+	K, Alpha int
+	Lookup   LookupOptions
+	// Duration is how much simulated time the run covers once the initial
+	// network is built and its records published.
+	Duration time.Duration
+	// Churn, Adversary and Geo shape the network.
+	Churn     ChurnModel
+	Adversary AdversaryModel
+	Geo       GeoModel
+	// Keys is how many records honest nodes publish at the start.
+	Keys int
+	// LookupInterval is how often a random honest node looks up a random
+	// target. A negative interval disables lookups.
+	LookupInterval time.Duration
+	// CheckInterval is how often every published key is read back. A
+	// negative interval disables the checks.
+	CheckInterval time.Duration
+	// ReplicateInterval and RepublishInterval drive node maintenance as in
+	// Config. Maintenance also drops expired records.
+	ReplicateInterval, RepublishInterval time.Duration
+	// RecordTTL is how long published records stay valid.
+	RecordTTL time.Duration
+	// Seed makes the run reproducible. Every node's keys, and so its
+	// identity, are derived from it.
+	Seed int64
+}
+
+// SimSample is a snapshot of the network at one availability check.
+type SimSample struct {
+	// At is the simulated time since the start.
+	At time.Duration
+	// Online is how many nodes were online.
+	Online int
+	// Availability is the share of published keys that could be read.
+	Availability float64
+}
+
+// SimReport is the outcome of a simulation.
+type SimReport struct {
+	// Lookups counts lookups and Succeeded those that found the honest node
+	// closest to their target.
+	Lookups, Succeeded int
+	SuccessRate        float64
+	// Hops counts lookups by the hop count of the closest node they found:
+	// one for a node the origin knew, one more for each referral after.
+	Hops     map[int]int
+	MeanHops float64
+	// MeanLatency is the mean round-trip time along the referrals that led
+	// each lookup to its closest node.
+	MeanLatency time.Duration
+	// Gets counts availability reads and Found those that returned the
+	// published value.
+	Gets, Found  int
+	Availability float64
+	Samples      []SimSample
+	// Joins and Leaves count churn after the initial network was built.
+	Joins, Leaves int
+	// Messages counts every RPC sent.
+	Messages int
+}
+
+// Simulate runs the DHT code of every node on a simulated clock. Events
+// such as churn, lookups and maintenance are processed one at a time in
+// time order. The reply to every RPC is an event of its own, one round trip
+// after the request, and operations waiting for replies take turns with the
+// other events, so a run is reproducible from cfg.Seed. Nodes issue the
+// requests of one operation one after another.
+func Simulate(ctx context.Context, cfg SimConfig) (SimReport, error) {
+	if cfg.Nodes < 2 || cfg.Duration <= 0 {
+		return SimReport{}, fmt.Errorf("simulation needs at least two nodes and a duration")
+	}
+	if len(cfg.Geo.RTT) != len(cfg.Geo.Regions) || (cfg.Geo.Weights != nil && len(cfg.Geo.Weights) != len(cfg.Geo.Regions)) {
+		return SimReport{}, fmt.Errorf("simulation geo model needs an RTT row and weight per region")
+	}
+	if cfg.K <= 0 {
+		cfg.K = DefaultK
+	}
+	if cfg.Alpha <= 0 {
+		cfg.Alpha = DefaultAlpha
+	}
+	if cfg.LookupInterval == 0 {
+		cfg.LookupInterval = DefaultSimLookupInterval
+	}
+	if cfg.CheckInterval == 0 {
+		cfg.CheckInterval = DefaultSimCheckInterval
+	}
+	if cfg.ReplicateInterval == 0 {
+		cfg.ReplicateInterval = DefaultReplicateInterval
+	}
+	if cfg.RepublishInterval == 0 {
+		cfg.RepublishInterval = DefaultRepublishInterval
+	}
+	if cfg.RecordTTL <= 0 {
+		cfg.RecordTTL = DefaultRecordTTL
+	}
+
+	s := &simulation{
+		cfg:     cfg,
+		rng:     rand.New(rand.NewSource(cfg.Seed)),
+		mesh:    NewMesh(),
+		now:     simEpoch,
+		yield:   make(chan struct{}),
+		stop:    make(chan struct{}),
+		regions: make(map[types.NodeID]int),
+		report:  SimReport{Hops: make(map[int]int)},
+	}
+	s.attack = &eclipseAttack{mesh: s.mesh, k: cfg.K}
+	defer s.close()
+	return s.run(ctx)
+}
+
+// simNode is a node of a simulation.
+type simNode struct {
+	node     *types.Node
+	dht      *DHT
+	behavior Behavior
+}
+
+// simKey is a record published at the start of a simulation.
+type simKey struct {
+	key   string
+	value []byte
+}
+
+type simulation struct {
+	cfg    SimConfig
+	rng    *rand.Rand
+	mesh   *Mesh
+	attack *eclipseAttack
+
+	mu    sync.Mutex
+	now   time.Time
+	start time.Time
+
+	// yield hands control from the running operation back to the event
+	// loop, when the operation ends or waits for a reply. inflight counts
+	// the operations not yet ended, and stop ends those still waiting when
+	// the run is over.
+	yield    chan struct{}
+	inflight int
+	stop     chan struct{}
+	ops      sync.WaitGroup
+
+	queue   simQueue
+	seq     int
+	created int
+	online  []*simNode
+	regions map[types.NodeID]int
+	keys    []simKey
+
+	hops    int
+	latency time.Duration
+	report  SimReport
+}
+
+func (s *simulation) run(ctx context.Context) (SimReport, error) {
+	adversaries := int(s.cfg.Adversary.Fraction * float64(s.cfg.Nodes))
+	if adversaries >= s.cfg.Nodes {
+		adversaries = s.cfg.Nodes - 1
+	}
+	behaviors := make([]Behavior, s.cfg.Nodes)
+	for _, i := range s.rng.Perm(s.cfg.Nodes)[:adversaries] {
+		behaviors[i] = s.cfg.Adversary.Behavior
+	}
+	for _, b := range behaviors {
+		if err := s.join(b); err != nil {
+			return s.report, err
+		}
+		if err := s.settle(); err != nil {
+			return s.report, err
+		}
+	}
+	var err error
+	s.spawn(func() { err = s.publish() })
+	if err := s.settle(); err != nil {
+		return s.report, err
+	}
+	if err != nil {
+		return s.report, err
+	}
+	s.start = s.Now()
+
+	if s.cfg.Churn.Arrivals != nil {
+		s.schedule(s.cfg.Churn.Arrivals(s.rng), evArrival, nil)
+	}
+	if s.cfg.LookupInterval > 0 {
+		s.schedule(s.cfg.LookupInterval, evLookup, nil)
+	}
+	if s.cfg.CheckInterval > 0 {
+		s.schedule(s.cfg.CheckInterval, evCheck, nil)
+	}
+	if s.cfg.ReplicateInterval > 0 {
+		s.schedule(s.cfg.ReplicateInterval, evMaintain, nil)
+	}
+
+	end := s.start.Add(s.cfg.Duration)
+	for s.queue.Len() > 0 && !s.queue[0].at.After(end) {
+		if err := ctx.Err(); err != nil {
+			return s.report, err
+		}
+		if err := s.advance(heap.Pop(&s.queue).(*simEvent)); err != nil {
+			return s.report, err
+		}
+	}
+	// Operations under way run to completion, but no new ones start.
+	for s.inflight > 0 {
+		if ev := heap.Pop(&s.queue).(*simEvent); ev.kind == evReply {
+			s.advance(ev)
+		}
+	}
+	s.finish()
+	return s.report, nil
+}
+
+// advance moves the clock to ev and handles it.
+func (s *simulation) advance(ev *simEvent) error {
+	s.mu.Lock()
+	s.now = ev.at
+	s.mu.Unlock()
+	return s.handle(ev)
+}
+
+// settle handles events until every operation has ended, as building the
+// initial network does between joins.
+func (s *simulation) settle() error {
+	for s.inflight > 0 {
+		if err := s.advance(heap.Pop(&s.queue).(*simEvent)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spawn runs op as an operation of the simulation. Operations and the event
+// loop take turns: spawn returns once op ends or waits for a reply.
+func (s *simulation) spawn(op func()) {
+	s.inflight++
+	s.ops.Add(1)
+	go func() {
+		defer s.ops.Done()
+		op()
+		s.inflight--
+		s.yield <- struct{}{}
+	}()
+	<-s.yield
+}
+
+// wait suspends the running operation until the clock has moved on by
+// after. An operation still waiting when the run is abandoned is stopped
+// where it is, so that it changes nothing after the report is taken.
+func (s *simulation) wait(after time.Duration) {
+	s.seq++
+	ev := &simEvent{at: s.Now().Add(after), seq: s.seq, kind: evReply, wake: make(chan struct{})}
+	heap.Push(&s.queue, ev)
+	s.yield <- struct{}{}
+	select {
+	case <-ev.wake:
+	case <-s.stop:
+		runtime.Goexit()
+	}
+}
+
+func (s *simulation) handle(ev *simEvent) error {
+	switch ev.kind {
+	case evReply:
+		close(ev.wake)
+		<-s.yield
+	case evArrival:
+		b := Honest
+		if s.rng.Float64() < s.cfg.Adversary.Fraction {
+			b = s.cfg.Adversary.Behavior
+		}
+		s.report.Joins++
+		s.schedule(s.cfg.Churn.Arrivals(s.rng), evArrival, nil)
+		return s.join(b)
+	case evLeave:
+		s.report.Leaves++
+		s.leave(ev.node)
+	case evLookup:
+		s.spawn(s.lookup)
+		s.schedule(s.cfg.LookupInterval, evLookup, nil)
+	case evCheck:
+		s.spawn(s.check)
+		s.schedule(s.cfg.CheckInterval, evCheck, nil)
+	case evMaintain:
+		for _, n := range s.online {
+			if d := n.dht; d != nil {
+				s.spawn(func() {
+					d.sweep()
+					d.republishDue()
+					d.refreshReplicas()
+				})
+			}
+		}
+		s.schedule(s.cfg.ReplicateInterval, evMaintain, nil)
+	}
+	return nil
+}
+
+// join adds a node that behaves as b. Nodes running the DHT join through a
+// random honest node; the others announce themselves to k honest nodes.
+func (s *simulation) join(b Behavior) error {
+	seed := make([]byte, 32)
+	s.rng.Read(seed)
+	s.created++
+	n := &simNode{node: &types.Node{Host: "sim", Port: fmt.Sprint(s.created)}, behavior: b}
+	region := s.region()
+	boot := s.honest()
+
+	switch b {
+	case Honest, Blackhole:
+		key, err := crypto.NewSigningKeyFromSeed(seed)
+		if err != nil {
+			return err
+		}
+		d, err := New(Config{
+			Self:              n.node,
+			Key:               key,
+			KEMKey:            crypto.NewKEMKeyFromSeed(seed),
+			Messenger:         simMessenger{s},
+			K:                 s.cfg.K,
+			Alpha:             s.cfg.Alpha,
+			Lookup:            s.cfg.Lookup,
+			RecordTTL:         s.cfg.RecordTTL,
+			RepublishInterval: s.cfg.RepublishInterval,
+			Now:               s.Now,
+			Simulated:         true,
+		})
+		if err != nil {
+			return err
+		}
+		n.dht, n.node = d, d.self
+		s.regions[d.self.ID] = region
+		s.mesh.Add(d)
+		if b == Blackhole {
+			s.mesh.AddHandler(d.self.ID, blackholeNode{d})
+		}
+		if len(boot) > 0 {
+			via := NodeOf(boot[s.rng.Intn(len(boot))].node)
+			s.spawn(func() { d.Join(via) })
+		}
+	case Drop:
+		n.node.ID = types.NewNodeID(seed)
+		s.regions[n.node.ID] = region
+		s.mesh.AddHandler(n.node.ID, dropNode{})
+	case Eclipse:
+		n.node.ID = types.NewNodeID(seed)
+		s.regions[n.node.ID] = region
+		s.mesh.AddHandler(n.node.ID, &eclipseNode{self: n.node, attack: s.attack})
+	}
+	if n.dht == nil {
+		for _, i := range s.rng.Perm(len(boot))[:min(len(boot), s.cfg.K)] {
+			boot[i].dht.HandleMessage(context.Background(), &Message{Type: MsgPing, Sender: n.node})
+		}
+	}
+
+	s.online = append(s.online, n)
+	s.updateColluders()
+	if s.cfg.Churn.Session != nil {
+		s.schedule(s.cfg.Churn.Session(s.rng), evLeave, n)
+	}
+	return nil
+}
+
+// leave takes n offline for good.
+func (s *simulation) leave(n *simNode) {
+	s.mesh.Remove(n.node.ID)
+	if n.dht != nil {
+		n.dht.Close()
+	}
+	for i, o := range s.online {
+		if o == n {
+			s.online = append(s.online[:i], s.online[i+1:]...)
+			break
+		}
+	}
+	s.updateColluders()
+}
+
+func (s *simulation) updateColluders() {
+	s.attack.colluders = s.attack.colluders[:0]
+	for _, n := range s.online {
+		if n.behavior == Eclipse {
+			s.attack.colluders = append(s.attack.colluders, n.node)
+		}
+	}
+}
+
+// publish has random honest nodes publish cfg.Keys records.
+func (s *simulation) publish() error {
+	honest := s.honest()
+	for i := 0; i < s.cfg.Keys; i++ {
+		k := simKey{key: fmt.Sprintf("sim/%d", i), value: []byte(fmt.Sprintf("value %d", i))}
+		d := honest[s.rng.Intn(len(honest))].dht
+		ctx, cancel := d.opContext()
+		_, err := d.publish(ctx, k.key, k.value, d.putOptions(nil))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("simulation publish: %w", err)
+		}
+		s.keys = append(s.keys, k)
+	}
+	return nil
+}
+
+// lookup has a random honest node look up a random target, and checks
+// whether it found the closest honest node.
+func (s *simulation) lookup() {
+	honest := s.honest()
+	if len(honest) < 2 {
+		return
+	}
+	origin := honest[s.rng.Intn(len(honest))]
+	var target types.NodeID
+	s.rng.Read(target[:])
+	var want types.NodeID
+	for _, n := range honest {
+		if n != origin && (want == (types.NodeID{}) || closer(n.node.ID, want, target)) {
+			want = n.node.ID
+		}
+	}
+
+	tr := &simTrace{s: s, origin: s.regions[origin.node.ID], hops: make(map[types.NodeID]int), latency: make(map[types.NodeID]time.Duration)}
+	ctx, cancel := origin.dht.opContext()
+	defer cancel()
+	found, _ := origin.dht.FindNode(context.WithValue(ctx, simTraceKey{}, tr), target)
+
+	s.report.Lookups++
+	for _, n := range found {
+		if n.ID == want {
+			s.report.Succeeded++
+			break
+		}
+	}
+	if len(found) > 0 {
+		hops := tr.hops[found[0].ID]
+		s.report.Hops[hops]++
+		s.hops += hops
+		s.latency += tr.latency[found[0].ID]
+	}
+}
+
+// check reads every published key from a random honest node.
+func (s *simulation) check() {
+	honest := s.honest()
+	if len(honest) == 0 || len(s.keys) == 0 {
+		return
+	}
+	sample := SimSample{At: s.Now().Sub(s.start), Online: len(s.online)}
+	found := 0
+	for _, k := range s.keys {
+		d := honest[s.rng.Intn(len(honest))].dht
+		ctx, cancel := d.opContext()
+		recs, err := d.GetRecords(ctx, k.key)
+		cancel()
+		if err == nil && bytes.Equal(recs[0].value, k.value) {
+			found++
+		}
+	}
+	s.report.Gets += len(s.keys)
+	s.report.Found += found
+	sample.Availability = float64(found) / float64(len(s.keys))
+	s.report.Samples = append(s.report.Samples, sample)
+}
+
+func (s *simulation) finish() {
+	r := &s.report
+	if r.Lookups > 0 {
+		r.SuccessRate = float64(r.Succeeded) / float64(r.Lookups)
+	}
+	measured := 0
+	for _, c := range r.Hops {
+		measured += c
+	}
+	if measured > 0 {
+		r.MeanHops = float64(s.hops) / float64(measured)
+		r.MeanLatency = s.latency / time.Duration(measured)
+	}
+	if r.Gets > 0 {
+		r.Availability = float64(r.Found) / float64(r.Gets)
+	}
+}
+
+func (s *simulation) close() {
+	close(s.stop)
+	s.ops.Wait()
+	for _, n := range s.online {
+		if n.dht != nil {
+			n.dht.Close()
+		}
+	}
+}
+
+// Now returns the simulated time.
+func (s *simulation) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// honest returns the online honest nodes.
+func (s *simulation) honest() []*simNode {
+	var out []*simNode
+	for _, n := range s.online {
+		if n.behavior == Honest {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// region draws a region for a new node.
+func (s *simulation) region() int {
+	regions := len(s.cfg.Geo.Regions)
+	if regions == 0 {
+		return 0
+	}
+	if s.cfg.Geo.Weights == nil {
+		return s.rng.Intn(regions)
+	}
+	total := 0.0
+	for _, w := range s.cfg.Geo.Weights {
+		total += w
+	}
+	x := s.rng.Float64() * total
+	for i, w := range s.cfg.Geo.Weights {
+		if x -= w; x < 0 {
+			return i
+		}
+	}
+	return regions - 1
+}
+
+// rtt returns the round trip from a node in region to node id. Nodes the
+// simulation did not place, such as forged ones, cost nothing.
+func (s *simulation) rtt(region int, id types.NodeID) time.Duration {
+	r, ok := s.regions[id]
+	if !ok || len(s.cfg.Geo.RTT) == 0 {
+		return 0
+	}
+	return s.cfg.Geo.RTT[region][r]
+}
+
+func (s *simulation) schedule(after time.Duration, kind simEventKind, n *simNode) {
+	s.seq++
+	heap.Push(&s.queue, &simEvent{at: s.Now().Add(after), seq: s.seq, kind: kind, node: n})
+}
+
+// simMessenger delivers RPCs over the simulation's mesh and traces lookups.
+// The sender gets the reply one round trip after the request.
+type simMessenger struct {
+	s *simulation
+}
+
+func (m simMessenger) Send(ctx context.Context, to *types.Node, msg *Message) (*Message, error) {
+	m.s.report.Messages++
+	resp, err := m.s.mesh.Send(ctx, to, msg)
+	m.s.wait(m.s.rtt(m.s.regions[msg.Sender.ID], to.ID))
+	if tr, ok := ctx.Value(simTraceKey{}).(*simTrace); ok && err == nil {
+		tr.observe(to, resp)
+	}
+	return resp, err
+}
+
+type simTraceKey struct{}
+
+// simTrace follows the referrals of one lookup: how many hops, and how
+// much round-trip time, it took to learn of each node.
+type simTrace struct {
+	s       *simulation
+	origin  int
+	hops    map[types.NodeID]int
+	latency map[types.NodeID]time.Duration
+}
+
+func (t *simTrace) observe(from *types.Node, resp *Message) {
+	if _, ok := t.hops[from.ID]; !ok {
+		// The origin knew of the node itself.
+		t.hops[from.ID] = 1
+		t.latency[from.ID] = t.s.rtt(t.origin, from.ID)
+	}
+	for _, n := range resp.Closer {
+		if _, ok := t.hops[n.ID]; !ok {
+			t.hops[n.ID] = t.hops[from.ID] + 1
+			t.latency[n.ID] = t.latency[from.ID] + t.s.rtt(t.origin, n.ID)
+		}
+	}
+}
+
+// dropNode answers nothing.
+type dropNode struct{}
+
+func (dropNode) HandleMessage(context.Context, *Message) (*Message, error) {
+	return nil, ErrUnreachable
+}
+
+// blackholeNode routes like its DHT but claims to store records it drops,
+// and never serves values.
+type blackholeNode struct {
+	d *DHT
+}
+
+func (b blackholeNode) HandleMessage(ctx context.Context, msg *Message) (*Message, error) {
+	if msg.Type == MsgStore {
+		return &Message{Type: msg.Type, Sender: b.d.self, Key: msg.Key}, nil
+	}
+	resp, err := b.d.HandleMessage(ctx, msg)
+	if resp != nil {
+		resp.Records = nil
+	}
+	return resp, err
+}
+
+type simEventKind int
+
+const (
+	evArrival simEventKind = iota
+	evLeave
+	evLookup
+	evCheck
+	evMaintain
+	evReply
+)
+
+type simEvent struct {
+	at   time.Time
+	seq  int
+	kind simEventKind
+	node *simNode
+	// wake resumes the operation waiting for an evReply.
+	wake chan struct{}
+}
+
+// simQueue orders events by time, then by when they were scheduled.
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q simQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	ev := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return ev
+}
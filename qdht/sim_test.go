@@ -0,0 +1,82 @@
+package qdht_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/qdht"
+)
+
+// simConfig is a small network with churn spread over three regions.
+func simConfig(seed int64) qdht.SimConfig {
+	ms := time.Millisecond
+	return qdht.SimConfig{
+		Nodes:    60,
+		K:        8,
+		Duration: 6 * time.Hour,
+		Churn: qdht.ChurnModel{
+			Session:  qdht.Exponential(8 * time.Hour),
+			Arrivals: qdht.Exponential(8 * time.Minute),
+		},
+		Geo: qdht.GeoModel{
+			Regions: []string{"eu", "us", "ap"},
+			RTT: [][]time.Duration{
+				{10 * ms, 90 * ms, 250 * ms},
+				{90 * ms, 10 * ms, 160 * ms},
+				{250 * ms, 160 * ms, 10 * ms},
+			},
+		},
+		Keys:              10,
+		LookupInterval:    5 * time.Minute,
+		CheckInterval:     30 * time.Minute,
+		ReplicateInterval: time.Hour,
+		Seed:              seed,
+	}
+}
+
+func TestSimulationIsReproducible(t *testing.T) {
+	ctx := context.Background()
+	first, err := qdht.Simulate(ctx, simConfig(1))
+	require.NoError(t, err)
+	t.Logf("lookups=%d success=%.2f hops=%.2f latency=%v availability=%.2f joins=%d leaves=%d messages=%d",
+		first.Lookups, first.SuccessRate, first.MeanHops, first.MeanLatency, first.Availability, first.Joins, first.Leaves, first.Messages)
+
+	require.Equal(t, 72, first.Lookups)
+	require.Greater(t, first.SuccessRate, 0.9, "Lookups in an honest network should succeed.")
+	require.Positive(t, first.MeanHops)
+	require.GreaterOrEqual(t, first.MeanLatency, 10*time.Millisecond)
+	require.Positive(t, first.Joins, "Nodes should arrive.")
+	require.Positive(t, first.Leaves, "Nodes should leave.")
+	require.Len(t, first.Samples, 12)
+	require.Greater(t, first.Availability, 0.9, "Replication should keep records available through churn.")
+
+	again, err := qdht.Simulate(ctx, simConfig(1))
+	require.NoError(t, err)
+	require.Equal(t, first, again, "The same seed should give the same run.")
+
+	other, err := qdht.Simulate(ctx, simConfig(2))
+	require.NoError(t, err)
+	require.NotEqual(t, first, other, "Another seed should give another run.")
+}
+
+func TestSimulationAdversaries(t *testing.T) {
+	ctx := context.Background()
+	run := func(b qdht.Behavior, fraction float64) qdht.SimReport {
+		cfg := simConfig(3)
+		cfg.Churn = qdht.ChurnModel{}
+		cfg.Duration = 2 * time.Hour
+		cfg.Adversary = qdht.AdversaryModel{Fraction: fraction, Behavior: b}
+		report, err := qdht.Simulate(ctx, cfg)
+		require.NoError(t, err)
+		t.Logf("behavior=%d fraction=%.1f success=%.2f availability=%.2f", b, fraction, report.SuccessRate, report.Availability)
+		return report
+	}
+	honest := run(qdht.Honest, 0)
+	eclipse := run(qdht.Eclipse, 0.3)
+	require.Less(t, eclipse.SuccessRate, honest.SuccessRate, "Eclipsing nodes should defeat lookups.")
+	blackhole := run(qdht.Blackhole, 0.8)
+	require.Less(t, blackhole.Availability, honest.Availability, "Blackholes should lose records.")
+	drop := run(qdht.Drop, 0.3)
+	require.Greater(t, drop.SuccessRate, 0.8, "Unresponsive nodes should be routed around.")
+}
@@ -0,0 +1,237 @@
+package qdht
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+// RecordStore holds the records a node is responsible for, keeping only the
+// newest version per key and publisher.
+type RecordStore interface {
+	// Put stores rec if it supersedes the publisher's current record for
+	// the key and reports whether it did. A record with the same sequence
+	// only replaces the current one when it carries identical content with
+	// a later expiry. Other publishers' records are never replaced; reads
+	// drop the ones a shared key's later versions supersede.
+	Put(rec *Record) (bool, error)
+
+	// Get returns every publisher's record for key.
+	Get(key string) ([]*Record, error)
+
+	// Scan calls fn for every record whose key starts with prefix, in key
+	// order, until fn returns false.
+	Scan(prefix string, fn func(*Record) bool) error
+
+	// Expire drops the records that have expired at now and returns how
+	// many it dropped.
+	Expire(now time.Time) (int, error)
+
+	Close() error
+}
+
+// admit applies the versioning rules to rec against the current records for
+// its key and reports whether rec should be stored. Only the publisher's own
+// record is compared against.
+func admit(current []*Record, rec *Record) (bool, error) {
+	pub := rec.PublisherID()
+	for _, cur := range current {
+		if cur.PublisherID() != pub {
+			continue
+		}
+		switch {
+		case rec.seq < cur.seq:
+			return false, ErrStaleRecord
+		case rec.seq == cur.seq && !bytes.Equal(rec.value, cur.value):
+			return false, ErrRecordConflict
+		case rec.seq == cur.seq && !rec.expires.After(cur.expires):
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// indexed is an index entry together with the expiry of the record it locates.
+type indexed[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// recordIndex locates the current record per key and publisher, and keeps the
+// sorted key list prefix scans walk and the expiry heap sweeps pop.
+type recordIndex[V any] struct {
+	entries map[string]map[types.NodeID]indexed[V]
+	keys    []string
+	ttl     ttlHeap
+}
+
+func newRecordIndex[V any]() *recordIndex[V] {
+	return &recordIndex[V]{entries: make(map[string]map[types.NodeID]indexed[V])}
+}
+
+func (x *recordIndex[V]) set(key string, pub types.NodeID, v V, expires time.Time) {
+	byPub, ok := x.entries[key]
+	if !ok {
+		byPub = make(map[types.NodeID]indexed[V])
+		x.entries[key] = byPub
+		i := sort.SearchStrings(x.keys, key)
+		x.keys = append(x.keys, "")
+		copy(x.keys[i+1:], x.keys[i:])
+		x.keys[i] = key
+	}
+	byPub[pub] = indexed[V]{value: v, expires: expires}
+	heap.Push(&x.ttl, ttlEntry{expires: expires, key: key, pub: pub})
+}
+
+func (x *recordIndex[V]) remove(key string, pub types.NodeID) {
+	byPub, ok := x.entries[key]
+	if !ok {
+		return
+	}
+	delete(byPub, pub)
+	if len(byPub) > 0 {
+		return
+	}
+	delete(x.entries, key)
+	if i := sort.SearchStrings(x.keys, key); i < len(x.keys) && x.keys[i] == key {
+		x.keys = append(x.keys[:i], x.keys[i+1:]...)
+	}
+}
+
+// get returns the entries for key ordered by publisher.
+func (x *recordIndex[V]) get(key string) []V {
+	byPub := x.entries[key]
+	pubs := make([]types.NodeID, 0, len(byPub))
+	for pub := range byPub {
+		pubs = append(pubs, pub)
+	}
+	sort.Slice(pubs, func(i, j int) bool {
+		return bytes.Compare(pubs[i][:], pubs[j][:]) < 0
+	})
+	out := make([]V, len(pubs))
+	for i, pub := range pubs {
+		out[i] = byPub[pub].value
+	}
+	return out
+}
+
+// relocate points the current entry of key and publisher at v.
+func (x *recordIndex[V]) relocate(key string, pub types.NodeID, v V) {
+	if cur, ok := x.entries[key][pub]; ok {
+		cur.value = v
+		x.entries[key][pub] = cur
+	}
+}
+
+// scanKeys returns the keys starting with prefix in order.
+func (x *recordIndex[V]) scanKeys(prefix string) []string {
+	var out []string
+	for i := sort.SearchStrings(x.keys, prefix); i < len(x.keys) && strings.HasPrefix(x.keys[i], prefix); i++ {
+		out = append(out, x.keys[i])
+	}
+	return out
+}
+
+// expire removes the entries that have expired at now and returns them.
+func (x *recordIndex[V]) expire(now time.Time) []expiredEntry[V] {
+	var out []expiredEntry[V]
+	for x.ttl.Len() > 0 && !now.Before(x.ttl[0].expires) {
+		e := heap.Pop(&x.ttl).(ttlEntry)
+		// Entries of replaced records are left in the heap and skipped here.
+		if cur, ok := x.entries[e.key][e.pub]; ok && cur.expires.Equal(e.expires) {
+			out = append(out, expiredEntry[V]{ttlEntry: e, value: cur.value})
+			x.remove(e.key, e.pub)
+		}
+	}
+	return out
+}
+
+// ttlEntry schedules the expiry of a key's record from one publisher.
+type ttlEntry struct {
+	expires time.Time
+	key     string
+	pub     types.NodeID
+}
+
+// expiredEntry is an index entry removed on expiry.
+type expiredEntry[V any] struct {
+	ttlEntry
+	value V
+}
+
+// ttlHeap orders entries by expiry.
+type ttlHeap []ttlEntry
+
+func (h ttlHeap) Len() int           { return len(h) }
+func (h ttlHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h ttlHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *ttlHeap) Push(x any)        { *h = append(*h, x.(ttlEntry)) }
+
+func (h *ttlHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// MemoryRecordStore is a RecordStore that keeps records in memory only.
+type MemoryRecordStore struct {
+	mu    sync.RWMutex
+	index *recordIndex[*Record]
+}
+
+var _ RecordStore = (*MemoryRecordStore)(nil)
+
+// NewMemoryRecordStore creates an empty in-memory store.
+func NewMemoryRecordStore() *MemoryRecordStore {
+	return &MemoryRecordStore{index: newRecordIndex[*Record]()}
+}
+
+func (s *MemoryRecordStore) Put(rec *Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, err := admit(s.index.get(rec.key), rec)
+	if !ok {
+		return false, err
+	}
+	s.index.set(rec.key, rec.PublisherID(), rec, rec.expires)
+	return true, nil
+}
+
+func (s *MemoryRecordStore) Get(key string) ([]*Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.get(key), nil
+}
+
+func (s *MemoryRecordStore) Scan(prefix string, fn func(*Record) bool) error {
+	s.mu.RLock()
+	var recs []*Record
+	for _, key := range s.index.scanKeys(prefix) {
+		recs = append(recs, s.index.get(key)...)
+	}
+	s.mu.RUnlock()
+
+	for _, rec := range recs {
+		if !fn(rec) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRecordStore) Expire(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.index.expire(now)), nil
+}
+
+func (s *MemoryRecordStore) Close() error {
+	return nil
+}
@@ -0,0 +1,170 @@
+package qdht_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"trustmesh/crypto"
+	"trustmesh/qdht"
+)
+
+// signedRecord returns a record for key signed by key.
+func signedRecord(t *testing.T, key *crypto.SigningKey, name, value string, seq uint64, expires time.Time) *qdht.Record {
+	t.Helper()
+	rec := qdht.NewRecord(name, []byte(value), seq, expires)
+	require.NoError(t, rec.Sign(key))
+	return rec
+}
+
+// scanValues returns the values of the records under prefix.
+func scanValues(t *testing.T, s qdht.RecordStore, prefix string) []string {
+	t.Helper()
+	var out []string
+	require.NoError(t, s.Scan(prefix, func(rec *qdht.Record) bool {
+		out = append(out, string(rec.Value()))
+		return true
+	}))
+	return out
+}
+
+func TestRecordStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) qdht.RecordStore{
+		"memory": func(t *testing.T) qdht.RecordStore {
+			return qdht.NewMemoryRecordStore()
+		},
+		"file": func(t *testing.T) qdht.RecordStore {
+			s, err := qdht.NewFileRecordStore(filepath.Join(t.TempDir(), "records.log"))
+			require.NoError(t, err)
+			return s
+		},
+	}
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	now := time.Now()
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+
+			for _, k := range []string{"/a/2", "/b/1", "/a/1"} {
+				stored, err := s.Put(signedRecord(t, key, k, k, 1, now.Add(time.Hour)))
+				require.NoError(t, err)
+				require.True(t, stored)
+			}
+			require.Equal(t, []string{"/a/1", "/a/2"}, scanValues(t, s, "/a/"), "Prefix scans should return matching keys in order.")
+
+			_, err := s.Put(signedRecord(t, key, "/a/1", "old", 0, now.Add(time.Hour)))
+			require.ErrorIs(t, err, qdht.ErrStaleRecord)
+			stored, err := s.Put(signedRecord(t, key, "/a/1", "new", 2, now.Add(time.Minute)))
+			require.NoError(t, err)
+			require.True(t, stored)
+
+			recs, err := s.Get("/a/1")
+			require.NoError(t, err)
+			require.Len(t, recs, 1)
+			require.Equal(t, []byte("new"), recs[0].Value())
+
+			n, err := s.Expire(now.Add(2 * time.Minute))
+			require.NoError(t, err)
+			require.Equal(t, 1, n, "Only the short lived record should expire.")
+			require.Equal(t, []string{"/a/2", "/b/1"}, scanValues(t, s, ""))
+		})
+	}
+}
+
+func TestFileRecordStoreReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	expires := time.Now().Add(time.Hour)
+
+	s, err := qdht.NewFileRecordStore(path)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Put(signedRecord(t, key, fmt.Sprintf("/k/%d", i), "v", 1, expires))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// A crash mid-append leaves a partial entry at the end of the log.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = qdht.NewFileRecordStore(path)
+	require.NoError(t, err, "A torn tail should not prevent opening the log.")
+	defer s.Close()
+	require.Equal(t, []string{"v", "v", "v"}, scanValues(t, s, "/k/"))
+
+	recs, err := s.Get("/k/1")
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	require.NoError(t, recs[0].Verify(), "Reloaded records should keep their signatures.")
+
+	_, err = s.Put(signedRecord(t, key, "/k/3", "v", 1, expires))
+	require.NoError(t, err, "Writes should continue after the recovered tail.")
+}
+
+func TestFileRecordStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.log")
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+	expires := time.Now().Add(time.Hour)
+
+	s, err := qdht.NewFileRecordStore(path, qdht.FileStoreOptions{Fsync: qdht.FsyncNever, CompactRatio: -1})
+	require.NoError(t, err)
+	for seq := uint64(1); seq <= 20; seq++ {
+		_, err := s.Put(signedRecord(t, key, "/k", fmt.Sprint(seq), seq, expires))
+		require.NoError(t, err)
+	}
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Compact())
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, after.Size()*10, before.Size(), "Compaction should drop replaced versions.")
+	require.NoError(t, s.Close())
+
+	s, err = qdht.NewFileRecordStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []string{"20"}, scanValues(t, s, ""))
+}
+
+func TestNodeRestartKeepsReplicas(t *testing.T) {
+	mesh, nodes := newTestMesh(t, 4, qdht.Config{K: 4})
+	path := filepath.Join(t.TempDir(), "records.log")
+	key, err := crypto.NewSigningKey()
+	require.NoError(t, err)
+
+	store, err := qdht.NewFileRecordStore(path)
+	require.NoError(t, err)
+	replica, err := mesh.NewNode(qdht.Config{K: 4, Key: key, Store: store})
+	require.NoError(t, err)
+	require.NoError(t, replica.Join(qdht.NodeOf(nodes[0].Self())))
+	require.NoError(t, nodes[1].Put(qdht.NewDataItem("/app/durable", []byte("kept"))))
+	require.True(t, holds(t, replica, "/app/durable"))
+
+	require.NoError(t, replica.Close())
+	mesh.Remove(replica.Self().ID)
+
+	store, err = qdht.NewFileRecordStore(path)
+	require.NoError(t, err)
+	restarted, err := mesh.NewNode(qdht.Config{K: 4, Key: key, Store: store})
+	require.NoError(t, err)
+	defer restarted.Close()
+	require.Equal(t, replica.Self().ID, restarted.Self().ID)
+
+	resp, err := restarted.HandleMessage(context.Background(), &qdht.Message{Type: qdht.MsgFindValue, Key: "/app/durable"})
+	require.NoError(t, err)
+	require.Len(t, resp.Records, 1, "The restarted node should still hold its replica.")
+	require.Equal(t, []byte("kept"), resp.Records[0].Value())
+}
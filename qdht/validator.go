@@ -0,0 +1,110 @@
+package qdht
+
+import (
+	"bytes"
+	"time"
+)
+
+// Validator lets applications impose their own acceptance rules on the
+// records stored under a key namespace.
+type Validator interface {
+	// Validate returns an error if the record must not be stored.
+	Validate(rec *Record) error
+
+	// Select returns the index of the best of several valid records stored
+	// under the same key.
+	Select(key string, recs []*Record) (int, error)
+}
+
+// SharedValidator is implemented by validators of namespaces whose keys
+// several publishers write together. Under a shared key, a version whose
+// vector clock causally follows another publisher's version supersedes it.
+// Publishers set their own clocks, so only namespaces whose publishers trust
+// each other not to inflate them should be shared.
+type SharedValidator interface {
+	Validator
+
+	// Shared reports whether records under key supersede other
+	// publishers' records.
+	Shared(key string) bool
+}
+
+// DefaultValidator accepts any correctly signed record and prefers the
+// highest sequence number, breaking ties on the latest expiry and then on the
+// publisher key so every node picks the same record.
+type DefaultValidator struct{}
+
+func (DefaultValidator) Validate(rec *Record) error {
+	return nil
+}
+
+func (DefaultValidator) Select(key string, recs []*Record) (int, error) {
+	if len(recs) == 0 {
+		return -1, ErrNoValidRecords
+	}
+	best := 0
+	for i, rec := range recs[1:] {
+		b := recs[best]
+		switch {
+		case rec.seq != b.seq:
+			if rec.seq > b.seq {
+				best = i + 1
+			}
+		case !rec.expires.Equal(b.expires):
+			if rec.expires.After(b.expires) {
+				best = i + 1
+			}
+		case bytes.Compare(rec.publisher, b.publisher) > 0:
+			best = i + 1
+		}
+	}
+	return best, nil
+}
+
+// validatorFor returns the validator registered for key's namespace.
+func (d *DHT) validatorFor(key string) Validator {
+	d.validatorsMu.RLock()
+	defer d.validatorsMu.RUnlock()
+
+	if v, ok := d.validators[Namespace(key)]; ok {
+		return v
+	}
+	return DefaultValidator{}
+}
+
+// sharedKey reports whether key's validator lets publishers supersede each
+// other's records.
+func (d *DHT) sharedKey(key string) bool {
+	v, ok := d.validatorFor(key).(SharedValidator)
+	return ok && v.Shared(key)
+}
+
+// RegisterValidator installs v for every key in namespace ns.
+func (d *DHT) RegisterValidator(ns string, v Validator) {
+	d.validatorsMu.Lock()
+	defer d.validatorsMu.Unlock()
+
+	d.validators[ns] = v
+}
+
+// validate runs the checks every stored record must pass before the
+// namespace validator is consulted.
+func (d *DHT) validate(rec *Record, now time.Time) error {
+	if len(rec.value) > MaxRecordValueSize {
+		return ErrRecordTooLarge
+	}
+	if rec.Expired(now) {
+		return ErrRecordExpired
+	}
+	if rec.expires.After(now.Add(d.maxTTL)) {
+		return ErrRecordTTLTooLong
+	}
+	if len(rec.clock) > 0 && rec.clock[rec.PublisherID().String()] != rec.seq {
+		return ErrInvalidClock
+	}
+	if err := rec.Verify(); err != nil {
+		return err
+	}
+
+	return d.validatorFor(rec.key).Validate(rec)
+}
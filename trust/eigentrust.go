@@ -0,0 +1,169 @@
+package trust
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"trustmesh/types"
+)
+
+const (
+	// DefaultPreTrust is the share of trust EigenTrust hands back to the
+	// seeds each iteration.
+	DefaultPreTrust = 0.15
+	// DefaultEpsilon is the change between iterations below which
+	// EigenTrust has converged.
+	DefaultEpsilon = 1e-9
+	// DefaultMaxIterations bounds the EigenTrust iterations.
+	DefaultMaxIterations = 100
+)
+
+// Graph is a web of trust: Graph[i][j] is how strongly i vouches for j.
+type Graph map[types.NodeID]map[types.NodeID]float64
+
+// Vouch adds an edge from issuer to subject.
+func (g Graph) Vouch(issuer, subject types.NodeID, weight float64) {
+	edges := g[issuer]
+	if edges == nil {
+		edges = make(map[types.NodeID]float64)
+		g[issuer] = edges
+	}
+	edges[subject] = weight
+}
+
+// EigenTrustConfig tunes EigenTrust.
+type EigenTrustConfig struct {
+	// PreTrust is the share of trust handed back to the seeds each
+	// iteration, which bounds what a clique vouching only for itself can
+	// capture.
+	PreTrust float64
+	// Epsilon is the change between iterations below which the estimate
+	// has converged.
+	Epsilon float64
+	// MaxIterations bounds the iterations.
+	MaxIterations int
+}
+
+// EigenTrust computes the global trust of the nodes of g as seen from the
+// trusted seeds, following Kamvar et al. Each node passes its trust on to
+// the nodes it vouches for in proportion to the weights; nodes vouching for
+// no one pass theirs back to the seeds. The estimates sum to one, and nodes
+// the seeds cannot reach get none.
+func EigenTrust(g Graph, seeds []types.NodeID, cfg EigenTrustConfig) map[types.NodeID]float64 {
+	if cfg.PreTrust <= 0 || cfg.PreTrust > 1 {
+		cfg.PreTrust = DefaultPreTrust
+	}
+	if cfg.Epsilon <= 0 {
+		cfg.Epsilon = DefaultEpsilon
+	}
+	if cfg.MaxIterations <= 0 {
+		cfg.MaxIterations = DefaultMaxIterations
+	}
+	if len(seeds) == 0 {
+		return nil
+	}
+
+	// Number the nodes in ID order so the iteration is deterministic.
+	index := make(map[types.NodeID]int)
+	var ids []types.NodeID
+	add := func(id types.NodeID) {
+		if _, ok := index[id]; !ok {
+			index[id] = -1
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range seeds {
+		add(id)
+	}
+	for i, edges := range g {
+		add(i)
+		for j := range edges {
+			add(j)
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return bytes.Compare(ids[a][:], ids[b][:]) < 0 })
+	for i, id := range ids {
+		index[id] = i
+	}
+
+	pre := make([]float64, len(ids))
+	for _, id := range seeds {
+		pre[index[id]] = 1
+	}
+	normalize(pre)
+
+	// Each row holds the normalised trust its node places in the others.
+	type edge struct {
+		to     int
+		weight float64
+	}
+	rows := make([][]edge, len(ids))
+	for i, edges := range g {
+		var sum float64
+		for j, w := range edges {
+			if w > 0 && j != i {
+				sum += w
+			}
+		}
+		if sum == 0 {
+			continue
+		}
+		row := make([]edge, 0, len(edges))
+		for j, w := range edges {
+			if w > 0 && j != i {
+				row = append(row, edge{to: index[j], weight: w / sum})
+			}
+		}
+		sort.Slice(row, func(a, b int) bool { return row[a].to < row[b].to })
+		rows[index[i]] = row
+	}
+
+	t := append([]float64(nil), pre...)
+	next := make([]float64, len(ids))
+	for iter := 0; iter < cfg.MaxIterations; iter++ {
+		var dangling float64
+		for k := range next {
+			next[k] = 0
+		}
+		for i, row := range rows {
+			if len(row) == 0 {
+				dangling += t[i]
+				continue
+			}
+			for _, e := range row {
+				next[e.to] += t[i] * e.weight
+			}
+		}
+		var delta float64
+		for k := range next {
+			next[k] = (1-cfg.PreTrust)*(next[k]+dangling*pre[k]) + cfg.PreTrust*pre[k]
+			delta += math.Abs(next[k] - t[k])
+		}
+		t, next = next, t
+		if delta < cfg.Epsilon {
+			break
+		}
+	}
+
+	out := make(map[types.NodeID]float64, len(ids))
+	for i, id := range ids {
+		if t[i] > 0 {
+			out[id] = t[i]
+		}
+	}
+	return out
+}
+
+// normalize scales v to sum to one.
+func normalize(v []float64) {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	if sum == 0 {
+		return
+	}
+	for i := range v {
+		v[i] /= sum
+	}
+}
@@ -0,0 +1,60 @@
+package trust_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+func TestEigenTrustFollowsVouches(t *testing.T) {
+	id := func(name string) types.NodeID { return types.NewNodeID([]byte(name)) }
+	seed, alice, bob, carol := id("seed"), id("alice"), id("bob"), id("carol")
+	sybil1, sybil2 := id("sybil1"), id("sybil2")
+
+	g := make(trust.Graph)
+	g.Vouch(seed, alice, 1)
+	g.Vouch(seed, bob, 0.5)
+	g.Vouch(alice, carol, 1)
+	g.Vouch(bob, carol, 1)
+	g.Vouch(carol, sybil1, 0.1)
+	g.Vouch(carol, alice, 0.9)
+	// The sybils vouch for each other and for an outsider none of the
+	// trusted nodes knows.
+	g.Vouch(sybil1, sybil2, 1)
+	g.Vouch(sybil2, sybil1, 1)
+	g.Vouch(id("outsider"), sybil2, 1)
+
+	scores := trust.EigenTrust(g, []types.NodeID{seed}, trust.EigenTrustConfig{})
+	var sum float64
+	for _, s := range scores {
+		sum += s
+	}
+	require.InDelta(t, 1, sum, 1e-6, "Global trust should sum to one.")
+	require.NotContains(t, scores, id("outsider"), "Nodes the seeds cannot reach should have no trust.")
+	require.Greater(t, scores[alice], scores[bob], "Stronger vouches should pass on more trust.")
+	require.Greater(t, scores[carol], scores[bob], "Trust should flow on transitively.")
+	require.Less(t, scores[sybil1]+scores[sybil2], scores[carol],
+		"A clique should capture little more than the trust vouched into it.")
+
+	require.Nil(t, trust.EigenTrust(g, nil, trust.EigenTrustConfig{}), "Without seeds no one is trusted.")
+}
+
+func TestGlobalTrustAdmission(t *testing.T) {
+	vouched := types.NewNodeID([]byte("vouched"))
+	e, _ := newEngine(trust.Config{MinGlobalTrust: 0.1})
+	require.False(t, e.Graylisted(peer), "Admission should not depend on global trust before it is set.")
+
+	e.SetGlobalTrust(map[types.NodeID]float64{vouched: 0.5, peer: 0.01, types.NewNodeID([]byte("seed")): 0.49})
+	require.InDelta(t, 1.5, e.GlobalTrust(vouched), 1e-9, "Global trust should be relative to the average.")
+	require.InDelta(t, trust.DefaultGlobalWeight, e.Score(vouched), 1e-9,
+		"Above-average global trust should earn the full bonus.")
+	require.False(t, e.Graylisted(vouched))
+	require.True(t, e.Graylisted(peer), "Peers with too little global trust should not be admitted.")
+	require.True(t, e.Graylisted(types.NewNodeID([]byte("stranger"))), "Peers no one vouches for should not be admitted.")
+
+	for i := 0; i < 8; i++ {
+		e.Record(vouched, trust.InvalidResponse)
+	}
+	require.True(t, e.Graylisted(vouched), "Global trust should not shield a peer misbehaving first hand.")
+}
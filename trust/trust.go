@@ -0,0 +1,366 @@
+// Package trust scores peers by their observed behaviour. Every peer's
+// score is a weighted sum of the events recorded against it, each decaying
+// with a common half-life, less a penalty for slow round trips. Peers that
+// fall below the graylist threshold are ignored by the services consulting
+// the scores; below the ban threshold they are also disconnected and kept
+// out for a while, however their score recovers.
+//
+// First-hand scores can be combined with transitive trust: the global
+// estimates EigenTrust derives from a web of attestations add to the scores
+// of the peers the seeds vouch for, and can keep every other peer out.
+package trust
+
+import (
+	"math"
+	"sync"
+	"time"
+	"trustmesh/types"
+)
+
+// Event is a kind of peer behaviour the engine scores.
+type Event int
+
+const (
+	// ValidResponse is a well-formed answer to a request.
+	ValidResponse Event = iota
+	// InvalidResponse is an answer carrying data that fails validation.
+	InvalidResponse
+	// Timeout is a request the peer did not answer.
+	Timeout
+	// GossipDelivered is a valid message the peer was first to deliver.
+	GossipDelivered
+	// InvalidGossip is a message the peer forwarded that fails validation.
+	InvalidGossip
+	// ProtocolViolation is a malformed or unauthorised frame.
+	ProtocolViolation
+	// LimitExceeded is a request refused because the peer exceeded its rate
+	// limit or resource budget.
+	LimitExceeded
+
+	numEvents = iota
+)
+
+var eventNames = [numEvents]string{
+	"valid response", "invalid response", "timeout", "gossip delivered",
+	"invalid gossip", "protocol violation", "limit exceeded",
+}
+
+func (e Event) String() string {
+	if e < 0 || e >= numEvents {
+		return "unknown event"
+	}
+	return eventNames[e]
+}
+
+// DefaultWeights is how much each event adds to a score.
+var DefaultWeights = map[Event]float64{
+	ValidResponse:     1,
+	InvalidResponse:   -10,
+	Timeout:           -2,
+	GossipDelivered:   1,
+	InvalidGossip:     -20,
+	ProtocolViolation: -100,
+	LimitExceeded:     -5,
+}
+
+const (
+	// DefaultHalfLife is how long an event takes to count half as much.
+	DefaultHalfLife = 10 * time.Minute
+	// DefaultMaxPositive caps what good behaviour can add to a score, so a
+	// peer cannot bank credit to spend on misbehaving later.
+	DefaultMaxPositive = 100
+	// DefaultLatencyTarget is the round trip above which peers are
+	// penalised.
+	DefaultLatencyTarget = 250 * time.Millisecond
+	// DefaultLatencyWeight is the penalty for a round trip of twice the
+	// target or more.
+	DefaultLatencyWeight = 10
+	// DefaultGraylistThreshold is the score below which peers are ignored.
+	DefaultGraylistThreshold = -50
+	// DefaultBanThreshold is the score below which peers are banned.
+	DefaultBanThreshold = -200
+	// DefaultBanDuration is how long a ban lasts.
+	DefaultBanDuration = time.Hour
+	// DefaultGlobalWeight is what a global trust estimate of at least the
+	// average adds to a score.
+	DefaultGlobalWeight = 20
+)
+
+// Config configures an Engine.
+type Config struct {
+	// Weights overrides the DefaultWeights of some events.
+	Weights map[Event]float64
+	// HalfLife is how long an event takes to count half as much.
+	HalfLife time.Duration
+	// MaxPositive caps what good behaviour can add to a score.
+	MaxPositive float64
+	// LatencyTarget is the round trip above which peers are penalised, up
+	// to LatencyWeight at twice the target. A negative weight disables the
+	// penalty.
+	LatencyTarget time.Duration
+	LatencyWeight float64
+	// GraylistThreshold and BanThreshold are the scores below which peers
+	// are ignored and banned. Both are negative.
+	GraylistThreshold, BanThreshold float64
+	// BanDuration is how long a ban lasts.
+	BanDuration time.Duration
+	// GlobalWeight is what a global trust estimate adds to a score, in full
+	// from the average estimate up. A negative weight disables the bonus.
+	GlobalWeight float64
+	// MinGlobalTrust, when positive, graylists the peers whose global trust
+	// is below that fraction of the average once estimates have been set,
+	// so that only peers vouched for transitively by the seeds are
+	// admitted.
+	MinGlobalTrust float64
+	// Now overrides the clock, mainly for tests.
+	Now func() time.Time
+}
+
+// Engine tracks the behaviour of peers and scores them.
+type Engine struct {
+	weights       [numEvents]float64
+	halfLife      time.Duration
+	maxPositive   float64
+	latencyTarget time.Duration
+	latencyWeight float64
+	graylist, ban float64
+	banDuration   time.Duration
+	globalWeight  float64
+	minGlobal     float64
+	now           func() time.Time
+
+	mu        sync.Mutex
+	peers     map[types.NodeID]*peerState
+	lastSweep time.Time
+	// global holds the global trust estimates relative to their average,
+	// or nil until some are set.
+	global map[types.NodeID]float64
+}
+
+// peerState is what the engine knows of one peer.
+type peerState struct {
+	// counts holds the decayed number of each event, as of updated.
+	counts  [numEvents]float64
+	updated time.Time
+	// latency is a moving average of the peer's round trips.
+	latency     time.Duration
+	bannedUntil time.Time
+}
+
+// NewEngine creates an engine with no peers.
+func NewEngine(cfg Config) *Engine {
+	if cfg.HalfLife <= 0 {
+		cfg.HalfLife = DefaultHalfLife
+	}
+	if cfg.MaxPositive <= 0 {
+		cfg.MaxPositive = DefaultMaxPositive
+	}
+	if cfg.LatencyTarget <= 0 {
+		cfg.LatencyTarget = DefaultLatencyTarget
+	}
+	if cfg.LatencyWeight == 0 {
+		cfg.LatencyWeight = DefaultLatencyWeight
+	}
+	if cfg.GraylistThreshold >= 0 {
+		cfg.GraylistThreshold = DefaultGraylistThreshold
+	}
+	if cfg.BanThreshold >= 0 {
+		cfg.BanThreshold = DefaultBanThreshold
+	}
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+	if cfg.GlobalWeight == 0 {
+		cfg.GlobalWeight = DefaultGlobalWeight
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	e := &Engine{
+		halfLife:      cfg.HalfLife,
+		maxPositive:   cfg.MaxPositive,
+		latencyTarget: cfg.LatencyTarget,
+		latencyWeight: max(cfg.LatencyWeight, 0),
+		graylist:      cfg.GraylistThreshold,
+		ban:           cfg.BanThreshold,
+		banDuration:   cfg.BanDuration,
+		globalWeight:  max(cfg.GlobalWeight, 0),
+		minGlobal:     max(cfg.MinGlobalTrust, 0),
+		now:           cfg.Now,
+		peers:         make(map[types.NodeID]*peerState),
+		lastSweep:     cfg.Now(),
+	}
+	for ev, w := range DefaultWeights {
+		e.weights[ev] = w
+	}
+	for ev, w := range cfg.Weights {
+		if ev >= 0 && ev < numEvents {
+			e.weights[ev] = w
+		}
+	}
+	return e
+}
+
+// Record notes that id behaved as ev.
+func (e *Engine) Record(id types.NodeID, ev Event) {
+	if ev < 0 || ev >= numEvents {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	p := e.stateLocked(id, now)
+	p.counts[ev]++
+	e.checkBanLocked(p, now)
+	e.sweepLocked(now)
+}
+
+// ObserveLatency folds a round trip to id into its average.
+func (e *Engine) ObserveLatency(id types.NodeID, rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	p := e.stateLocked(id, now)
+	if p.latency == 0 {
+		p.latency = rtt
+	} else {
+		p.latency = (7*p.latency + rtt) / 8
+	}
+	e.checkBanLocked(p, now)
+}
+
+// SetGlobalTrust replaces the global trust estimates, such as those
+// EigenTrust computes, with trust. Peers missing from it have none.
+func (e *Engine) SetGlobalTrust(trust map[types.NodeID]float64) {
+	var sum float64
+	for _, t := range trust {
+		sum += max(t, 0)
+	}
+	global := make(map[types.NodeID]float64, len(trust))
+	for id, t := range trust {
+		if t > 0 {
+			global[id] = t * float64(len(trust)) / sum
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.global = global
+}
+
+// GlobalTrust returns id's global trust estimate relative to the average,
+// so that one is an average peer and zero one the seeds do not vouch for.
+func (e *Engine) GlobalTrust(id types.NodeID) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.global[id]
+}
+
+// Score returns id's current score. Peers the engine knows nothing of score
+// zero, plus what their global trust earns them.
+func (e *Engine) Score(id types.NodeID) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	bonus := e.globalWeight * min(e.global[id], 1)
+	p, ok := e.peers[id]
+	if !ok {
+		return bonus
+	}
+	p.decay(e.now(), e.halfLife)
+	return e.scoreLocked(p) + bonus
+}
+
+// Graylisted reports whether id should be ignored: its score is below the
+// graylist threshold, it is banned or its global trust is below the
+// minimum.
+func (e *Engine) Graylisted(id types.NodeID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.minGlobal > 0 && e.global != nil && e.global[id] < e.minGlobal {
+		return true
+	}
+	p, ok := e.peers[id]
+	if !ok {
+		return false
+	}
+	now := e.now()
+	p.decay(now, e.halfLife)
+	score := e.scoreLocked(p) + e.globalWeight*min(e.global[id], 1)
+	return score < e.graylist || now.Before(p.bannedUntil)
+}
+
+// Banned reports whether id is banned.
+func (e *Engine) Banned(id types.NodeID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, ok := e.peers[id]
+	return ok && e.now().Before(p.bannedUntil)
+}
+
+// stateLocked returns id's state, decayed to now.
+func (e *Engine) stateLocked(id types.NodeID, now time.Time) *peerState {
+	p, ok := e.peers[id]
+	if !ok {
+		p = &peerState{updated: now}
+		e.peers[id] = p
+	}
+	p.decay(now, e.halfLife)
+	return p
+}
+
+// checkBanLocked bans p if its score fell below the ban threshold.
+func (e *Engine) checkBanLocked(p *peerState, now time.Time) {
+	if e.scoreLocked(p) < e.ban && !now.Before(p.bannedUntil) {
+		p.bannedUntil = now.Add(e.banDuration)
+	}
+}
+
+func (e *Engine) scoreLocked(p *peerState) float64 {
+	var good, bad float64
+	for ev, n := range p.counts {
+		if w := e.weights[ev] * n; w > 0 {
+			good += w
+		} else {
+			bad += w
+		}
+	}
+	score := min(good, e.maxPositive) + bad
+	if p.latency > e.latencyTarget {
+		over := float64(p.latency-e.latencyTarget) / float64(e.latencyTarget)
+		score -= e.latencyWeight * min(over, 1)
+	}
+	return score
+}
+
+// sweepLocked forgets, about once a half-life, the peers whose events have
+// decayed to nothing and that are not banned.
+func (e *Engine) sweepLocked(now time.Time) {
+	if now.Sub(e.lastSweep) < e.halfLife {
+		return
+	}
+	e.lastSweep = now
+	for id, p := range e.peers {
+		p.decay(now, e.halfLife)
+		if math.Abs(e.scoreLocked(p)) < 0.01 && !now.Before(p.bannedUntil) {
+			delete(e.peers, id)
+		}
+	}
+}
+
+// decay ages p's event counts to now.
+func (p *peerState) decay(now time.Time, halfLife time.Duration) {
+	elapsed := now.Sub(p.updated)
+	if elapsed <= 0 {
+		return
+	}
+	f := math.Exp2(-float64(elapsed) / float64(halfLife))
+	for i := range p.counts {
+		p.counts[i] *= f
+	}
+	p.updated = now
+}
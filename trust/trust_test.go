@@ -0,0 +1,73 @@
+package trust_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"trustmesh/trust"
+	"trustmesh/types"
+)
+
+// clock is a manually advanced time source.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newEngine(cfg trust.Config) (*trust.Engine, *clock) {
+	c := &clock{t: time.Unix(1700000000, 0)}
+	cfg.Now = c.now
+	return trust.NewEngine(cfg), c
+}
+
+var peer = types.NewNodeID([]byte("peer"))
+
+func TestScoresDecay(t *testing.T) {
+	e, c := newEngine(trust.Config{HalfLife: time.Minute})
+	require.Zero(t, e.Score(peer), "Unknown peers should score zero.")
+
+	for i := 0; i < 3; i++ {
+		e.Record(peer, trust.InvalidResponse)
+	}
+	require.InDelta(t, -30, e.Score(peer), 1e-9)
+	c.advance(time.Minute)
+	require.InDelta(t, -15, e.Score(peer), 1e-9, "A half-life should halve the score.")
+	c.advance(2 * time.Minute)
+	require.InDelta(t, -3.75, e.Score(peer), 1e-9)
+}
+
+func TestGoodBehaviourIsCapped(t *testing.T) {
+	e, _ := newEngine(trust.Config{})
+	for i := 0; i < 500; i++ {
+		e.Record(peer, trust.ValidResponse)
+	}
+	require.InDelta(t, trust.DefaultMaxPositive, e.Score(peer), 1e-9, "Good behaviour should not bank unlimited credit.")
+
+	e.Record(peer, trust.InvalidGossip)
+	require.InDelta(t, trust.DefaultMaxPositive-20, e.Score(peer), 1e-9, "Misbehaviour should count against the cap.")
+
+	e.ObserveLatency(peer, 2*trust.DefaultLatencyTarget)
+	require.InDelta(t, trust.DefaultMaxPositive-20-trust.DefaultLatencyWeight, e.Score(peer), 1e-9,
+		"Round trips of twice the target should cost the full latency weight.")
+}
+
+func TestGraylistAndBan(t *testing.T) {
+	e, c := newEngine(trust.Config{HalfLife: 10 * time.Minute, BanDuration: time.Hour})
+
+	e.Record(peer, trust.ProtocolViolation)
+	require.True(t, e.Graylisted(peer), "A violation should graylist the peer.")
+	require.False(t, e.Banned(peer))
+
+	e.Record(peer, trust.ProtocolViolation)
+	e.Record(peer, trust.ProtocolViolation)
+	require.True(t, e.Banned(peer), "Falling below the ban threshold should ban the peer.")
+
+	c.advance(30 * time.Minute)
+	require.Greater(t, e.Score(peer), float64(trust.DefaultGraylistThreshold))
+	require.True(t, e.Banned(peer), "A ban should outlast the score's recovery.")
+	require.True(t, e.Graylisted(peer), "Banned peers should stay graylisted.")
+
+	c.advance(31 * time.Minute)
+	require.False(t, e.Banned(peer), "Bans should expire.")
+	require.False(t, e.Graylisted(peer))
+}
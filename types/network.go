@@ -2,6 +2,9 @@ package types
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/zeebo/blake3"
 	"io"
 	"net"
 	"time"
@@ -20,6 +23,27 @@ type Node struct {
 	ID         NodeID
 	PeerInfo   *Peer
 	Host, Port string
+	// Puzzle solves the proof-of-work puzzle on ID that admission to
+	// routing tables may require.
+	Puzzle uint64
+	// Transport is the scheme of the transport the node listens on, such as
+	// "udp". Empty means TCP.
+	Transport string `json:",omitempty"`
+}
+
+// Address returns the dialable host:port of the node.
+func (n *Node) Address() string {
+	return net.JoinHostPort(n.Host, n.Port)
+}
+
+// URL returns the node's address with its transport scheme, such as
+// udp://10.0.0.1:7000.
+func (n *Node) URL() string {
+	transport := n.Transport
+	if transport == "" {
+		transport = "tcp"
+	}
+	return transport + "://" + n.Address()
 }
 
 type NodeID [20]byte
@@ -28,6 +52,70 @@ type Peer struct {
 	Keys [][]byte
 }
 
+// NewNodeID derives a node identifier from the node's signing public key.
+func NewNodeID(publicKey []byte) NodeID {
+	var id NodeID
+	h := blake3.Sum256(publicKey)
+	copy(id[:], h[:])
+	return id
+}
+
+// String returns the hex encoding of the identifier.
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText encodes the identifier as hex.
+func (id NodeID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a hex encoded identifier.
+func (id *NodeID) UnmarshalText(text []byte) error {
+	parsed, err := ParseNodeID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// ParseNodeID decodes a hex encoded identifier.
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, fmt.Errorf("invalid node id: %v", err)
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("invalid node id length %d", len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Indexes into Peer.Keys.
+const (
+	SigningKeyIndex = iota
+	KEMKeyIndex
+)
+
+// SigningKey returns the peer's signature public key, if known.
+func (p *Peer) SigningKey() []byte {
+	if p == nil || len(p.Keys) <= SigningKeyIndex {
+		return nil
+	}
+	return p.Keys[SigningKeyIndex]
+}
+
+// KEMKey returns the peer's key encapsulation public key, if known.
+func (p *Peer) KEMKey() []byte {
+	if p == nil || len(p.Keys) <= KEMKeyIndex {
+		return nil
+	}
+	return p.Keys[KEMKeyIndex]
+}
+
 type Protocol struct {
 	Name   string `json:"protocol_name"`
 	ID     []byte `json:"protocol_id"`